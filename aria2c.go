@@ -1,16 +1,18 @@
 package main
 
 import (
-	"bufio"
 	"bytes"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
 	"flag"
 	"fmt"
 	"github.com/hanjm/log"
-	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
-	"os/exec"
+	"net/url"
+	"os"
 	"strings"
 	"time"
 )
@@ -19,53 +21,166 @@ import (
 // https://www.iana.org/assignments/service-names-port-numbers/service-names-port-numbers.xhtml
 var aria2cPort = flag.Int("aria2cPort", 6902, "the command-line-arguments 'rpc-listen-port' when start aria2c")
 
+// the secret is passed to aria2c by a conf file, so it is not exposed in the process list
+var aria2cSecret = flag.String("aria2cSecret", "", "the rpc secret of aria2c, env ARIA2C_SECRET is used if empty, a random secret is generated if both are empty")
+
+// connect to the external aria2c instead of spawning one, e.g. ws://127.0.0.1:6800/jsonrpc
+var aria2cRPC = flag.String("aria2cRPC", "", "the rpc url of external aria2c, http(s):// or ws(s)://, fdp does not spawn aria2c if it is set")
+
+var aria2cDirFlag = flag.String("aria2cDir", "", "the path of download dir seen by the external aria2c, if it mounts the volume of -dir at a different path")
+
+// the unfinished downloads of the spawned aria2c are saved to the session and restored on start
+var aria2cSession = flag.String("aria2cSession", "aria2.session", "the session file of the aria2c spawned by fdp, empty to disable")
+
+// the aria2c left by the previous fdp process is found by the pid file, the other process on -aria2cPort is never killed
+var aria2cPidFile = flag.String("aria2cPidFile", "aria2c.pid", "the pid file of the aria2c spawned by fdp, the aria2c left by the previous fdp process is killed by it")
+
+var aria2cCleanPartial = flag.Bool("aria2cCleanPartial", true, "remove the partial files and .aria2 control files of magnet task which is failed, timeout or canceled")
+
 // json rpc client
 type Aria2cRPCClient struct {
-	httpClient *http.Client
-	requestURL string
+	transport aria2cTransport
+	secret    string
 }
 
+// aria2cTransport sends the json-rpc request and returns the raw response
+type aria2cTransport interface {
+	roundTrip(req *aria2cRPCRequest) (respData []byte, err error)
+}
+
+type aria2cRPCRequest struct {
+	Method  string        `json:"method"`
+	JSONRPC string        `json:"jsonrpc"`
+	ID      string        `json:"id"`
+	Params  []interface{} `json:"params"`
+}
+
+// NewAria2cRPCClient returns the client of the aria2c spawned by fdp, or the external aria2c if -aria2cRPC is set
 func NewAria2cRPCClient() *Aria2cRPCClient {
-	reqURL := fmt.Sprintf("http://127.0.0.1:%d/jsonrpc", *aria2cPort)
-	return &Aria2cRPCClient{
-		httpClient: &http.Client{
-			Timeout: time.Minute,
-		},
-		requestURL: reqURL,
+	return newAria2cRPCClient(aria2cRPCURL(), *aria2cSecret)
+}
+
+func newAria2cRPCClient(rpcURL string, secret string) *Aria2cRPCClient {
+	c := &Aria2cRPCClient{secret: secret}
+	if strings.HasPrefix(rpcURL, "ws://") || strings.HasPrefix(rpcURL, "wss://") {
+		c.transport = getAria2cWSTransport(rpcURL)
+	} else {
+		c.transport = &aria2cHTTPTransport{
+			httpClient: &http.Client{
+				Timeout: time.Minute,
+			},
+			requestURL: rpcURL,
+		}
+	}
+	return c
+}
+
+func isExternalAria2c() bool {
+	return *aria2cRPC != ""
+}
+
+// isLocalAria2c reports whether aria2c runs on this host, only it can connect the proxy listening on the loopback address
+func isLocalAria2c() bool {
+	if !isExternalAria2c() {
+		return true
+	}
+	u, err := url.Parse(*aria2cRPC)
+	if err != nil {
+		return false
+	}
+	if u.Hostname() == "localhost" {
+		return true
 	}
+	ip := net.ParseIP(u.Hostname())
+	return ip != nil && ip.IsLoopback()
 }
 
-func (c *Aria2cRPCClient) AddURI(uri string) (taskGID string, err error) {
+func aria2cRPCURL() string {
+	if isExternalAria2c() {
+		return *aria2cRPC
+	}
+	// the websocket connection is kept, and it receives the notifications of aria2c
+	return fmt.Sprintf("ws://127.0.0.1:%d/jsonrpc", *aria2cPort)
+}
+
+// aria2cDir returns the path of download dir seen by aria2c
+func aria2cDir(downloadDir string) string {
+	if *aria2cDirFlag != "" {
+		return strings.TrimSuffix(*aria2cDirFlag, "/")
+	}
+	return downloadDir
+}
+
+// initAria2cSecret generates a random rpc secret if it is not configured
+func initAria2cSecret() error {
+	if *aria2cSecret != "" {
+		return nil
+	}
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Errorf("generate aria2c secret error:%s", err)
+	}
+	*aria2cSecret = hex.EncodeToString(b)
+	return nil
+}
+
+// redactSecret hides the rpc secret in the message which may be logged
+func redactSecret(message string) string {
+	if *aria2cSecret == "" {
+		return message
+	}
+	return strings.Replace(message, *aria2cSecret, "******", -1)
+}
+
+func (c *Aria2cRPCClient) AddURI(uri string, options *Aria2cOptions) (taskGID string, err error) {
 	var respResult string
-	return respResult, c.callAria2cAndUnmarshal("aria2.addUri", uri, []interface{}{[]string{uri}}, &respResult)
+	params := []interface{}{[]string{uri}}
+	if options != nil {
+		params = append(params, options)
+	}
+	return respResult, c.callAria2cAndUnmarshal("aria2.addUri", uri, params, &respResult)
 }
 
-func (c *Aria2cRPCClient) AddTorrent(base64Content string) (taskGID string, err error) {
+func (c *Aria2cRPCClient) AddTorrent(base64Content string, options *Aria2cOptions) (taskGID string, err error) {
 	var respResult string
-	return respResult, c.callAria2cAndUnmarshal("aria2.addTorrent", "addTorrent", []interface{}{base64Content}, &respResult)
+	params := []interface{}{base64Content}
+	if options != nil {
+		params = append(params, []string{}, options)
+	}
+	return respResult, c.callAria2cAndUnmarshal("aria2.addTorrent", "addTorrent", params, &respResult)
+}
+
+type Aria2cVersionResult struct {
+	Version         string   `json:"version"`
+	EnabledFeatures []string `json:"enabledFeatures"`
+}
+
+func (c *Aria2cRPCClient) GetVersion() (*Aria2cVersionResult, error) {
+	var respResult = Aria2cVersionResult{}
+	return &respResult, c.callAria2cAndUnmarshal("aria2.getVersion", "getVersion", []interface{}{}, &respResult)
 }
 
 type Aria2cTellStatusResult struct {
-	CompletedLength int64 `json:"completedLength,string"`
-	Connections     int   `json:"connections,string"`
-	DownloadSpeed   int64 `json:"downloadSpeed,string"`
-	Files           []struct {
-		CompletedLength int64               `json:"completedLength,string"`
-		Index           int                 `json:"index,string"`
-		Length          int64               `json:"length,string"`
-		Path            string              `json:"path"`
-		Selected        bool                `json:"selected,string"`
-		URIs            []map[string]string `json:"uris"`
-	} `json:"files"`
-	FollowedBy   []string `json:"followedBy"`
-	Following    string   `json:"following"`
-	GID          string   `json:"gid"`
-	NumSeeders   int      `json:"numSeeders,string"`
-	Seeder       bool     `json:"seeder,string"`
-	Status       string   `json:"status"`
-	TotalLength  int64    `json:"totalLength,string"`
-	UploadLength int64    `json:"uploadLength,string"`
-	UploadSpeed  int64    `json:"uploadSpeed,string"`
+	Bitfield        string            `json:"bitfield"`
+	Bittorrent      *Aria2cBittorrent `json:"bittorrent"`
+	CompletedLength int64             `json:"completedLength,string"`
+	Connections     int               `json:"connections,string"`
+	DownloadSpeed   int64             `json:"downloadSpeed,string"`
+	Files           []Aria2cFile      `json:"files"`
+	ErrorCode       string            `json:"errorCode"`
+	ErrorMessage    string            `json:"errorMessage"`
+	FollowedBy      []string          `json:"followedBy"`
+	Following       string            `json:"following"`
+	GID             string            `json:"gid"`
+	InfoHash        string            `json:"infoHash"`
+	NumPieces       int               `json:"numPieces,string"`
+	NumSeeders      int               `json:"numSeeders,string"`
+	PieceLength     int64             `json:"pieceLength,string"`
+	Seeder          bool              `json:"seeder,string"`
+	Status          string            `json:"status"`
+	TotalLength     int64             `json:"totalLength,string"`
+	UploadLength    int64             `json:"uploadLength,string"`
+	UploadSpeed     int64             `json:"uploadSpeed,string"`
 }
 
 func (r *Aria2cTellStatusResult) GetFilePath() string {
@@ -79,59 +194,85 @@ func (r *Aria2cTellStatusResult) Completed() bool {
 	return r.Status == "complete"
 }
 
+// Stopped reports whether aria2c has stopped the download, its result can be removed then
+func (r *Aria2cTellStatusResult) Stopped() bool {
+	return r.Status == "complete" || r.Status == "error" || r.Status == "removed"
+}
+
 func (c *Aria2cRPCClient) TellStatus(taskGID string) (*Aria2cTellStatusResult, error) {
 	var respResult = Aria2cTellStatusResult{}
 	return &respResult, c.callAria2cAndUnmarshal("aria2.tellStatus", taskGID, []interface{}{taskGID}, &respResult)
 }
 
-func (c *Aria2cRPCClient) RemoveDownloadResult(taskGID string) error {
-	var respResult string
-	err := c.callAria2cAndUnmarshal("aria2.removeDownloadResult", taskGID, []interface{}{taskGID}, &respResult)
+// TellActive returns the status of all the active downloads
+func (c *Aria2cRPCClient) TellActive() ([]*Aria2cTellStatusResult, error) {
+	var respResult []*Aria2cTellStatusResult
+	return respResult, c.callAria2cAndUnmarshal("aria2.tellActive", "tellActive", []interface{}{}, &respResult)
+}
+
+type Aria2cMethodCall struct {
+	MethodName string        `json:"methodName"`
+	Params     []interface{} `json:"params"`
+}
+
+// Multicall sends the calls in one request, the result of each call is an array with one item, or a fault struct
+func (c *Aria2cRPCClient) Multicall(calls []Aria2cMethodCall) ([]json.RawMessage, error) {
+	if c.secret != "" {
+		// the calls of caller are not changed, they may be sent again
+		withToken := make([]Aria2cMethodCall, len(calls))
+		for i, call := range calls {
+			call.Params = append([]interface{}{"token:" + c.secret}, call.Params...)
+			withToken[i] = call
+		}
+		calls = withToken
+	}
+	var respResult []json.RawMessage
+	return respResult, c.callAria2cAndUnmarshal("system.multicall", "multicall", []interface{}{calls}, &respResult)
+}
+
+// TellStatusMulti returns the status of downloads in one request
+func (c *Aria2cRPCClient) TellStatusMulti(taskGIDs []string) ([]*Aria2cTellStatusResult, []error, error) {
+	calls := make([]Aria2cMethodCall, 0, len(taskGIDs))
+	for _, gid := range taskGIDs {
+		calls = append(calls, Aria2cMethodCall{MethodName: "aria2.tellStatus", Params: []interface{}{gid}})
+	}
+	respResult, err := c.Multicall(calls)
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
-	if respResult != "OK" {
-		return fmt.Errorf("result expect 'ok', not %s", respResult)
+	results, errs := make([]*Aria2cTellStatusResult, len(taskGIDs)), make([]error, len(taskGIDs))
+	for i := range taskGIDs {
+		if i >= len(respResult) {
+			errs[i] = fmt.Errorf("[callAria2c]multicall returns %d results, expect %d", len(respResult), len(taskGIDs))
+			continue
+		}
+		var result Aria2cTellStatusResult
+		if errs[i] = unmarshalAria2cCallResult("aria2.tellStatus", respResult[i], &result); errs[i] == nil {
+			results[i] = &result
+		}
 	}
-	return nil
+	return results, errs, nil
+}
+
+// Shutdown stops aria2c after the active downloads are stopped
+func (c *Aria2cRPCClient) Shutdown() error {
+	var respResult string
+	return c.callAria2cAndUnmarshal("aria2.shutdown", "shutdown", []interface{}{}, &respResult)
 }
 
 func (c *Aria2cRPCClient) callAria2cAndUnmarshal(method string, requestID string, params []interface{}, respResult interface{}) (err error) {
-	var rpcReq = struct {
-		Method  string        `json:"method"`
-		JSONRPC string        `json:"jsonrpc"`
-		ID      string        `json:"id"`
-		Params  []interface{} `json:"params"`
-	}{
+	// the system methods do not accept the token, the calls of system.multicall carry their own tokens
+	if c.secret != "" && !strings.HasPrefix(method, "system.") {
+		params = append([]interface{}{"token:" + c.secret}, params...)
+	}
+	var rpcReq = aria2cRPCRequest{
 		Method:  method,
 		JSONRPC: "2.0",
 		ID:      requestID,
 		Params:  params,
 	}
-	reqData, err := json.Marshal(&rpcReq)
-	if err != nil {
-		err = fmt.Errorf("[callAria2c]marshal rpc req to json error:%s", err)
-		return err
-	}
-	var resp *http.Response
-	const maxRetry = 3
-	for retry := 1; retry <= maxRetry; retry++ {
-		resp, err = c.httpClient.Post(c.requestURL, "application/json-rpc", bytes.NewReader(reqData))
-		if err != nil {
-			err = fmt.Errorf("[callAria2c]do request error:%s, is aria2c process running? ", err)
-			log.Warnf("%s, retry... %d/%d", err, retry, maxRetry)
-			time.Sleep(time.Second)
-		} else {
-			break
-		}
-	}
-	if err != nil {
-		return err
-	}
-	defer resp.Body.Close()
-	respData, err := ioutil.ReadAll(resp.Body)
+	respData, err := c.transport.roundTrip(&rpcReq)
 	if err != nil {
-		err = fmt.Errorf("[callAria2c]read rpc resp error:%s", err)
 		return err
 	}
 	var rpcResp = struct {
@@ -145,81 +286,135 @@ func (c *Aria2cRPCClient) callAria2cAndUnmarshal(method string, requestID string
 	}{}
 	err = json.Unmarshal(respData, &rpcResp)
 	if err != nil {
-		err = fmt.Errorf("[callAria2c]json.Unmarshal respData error:%s, rawBody:%s", err, respData)
+		err = fmt.Errorf("[callAria2c]json.Unmarshal respData error:%s, rawBody:%s", err, redactSecret(string(respData)))
 		return err
 	}
 	if rpcResp.Error.Code != 0 {
-		return fmt.Errorf("[callAria2c]aria2 return error, code:%d, message:%s", rpcResp.Error.Code, rpcResp.Error.Message)
+		return &Aria2cError{Method: method, Code: rpcResp.Error.Code, Message: redactSecret(rpcResp.Error.Message)}
 	}
 	//log.Debugf("[Aria2cTellStatusResult]rpcResp.Result:%s", rpcResp.Result)
 	err = json.Unmarshal(rpcResp.Result, respResult)
 	if err != nil {
-		err = fmt.Errorf("[callAria2c]json.Unmarshal rpcResp.Resul error:%s, rawBody:%s", err, respData)
+		err = fmt.Errorf("[callAria2c]json.Unmarshal rpcResp.Resul error:%s, rawBody:%s", err, redactSecret(string(respData)))
 		return err
 	}
 	return nil
 }
 
-var isAria2cRunning bool
+// aria2cHTTPTransport posts the json-rpc request to aria2c
+type aria2cHTTPTransport struct {
+	httpClient *http.Client
+	requestURL string
+	// default is 3
+	maxRetry int
+}
+
+func (t *aria2cHTTPTransport) roundTrip(req *aria2cRPCRequest) (respData []byte, err error) {
+	reqData, err := json.Marshal(req)
+	if err != nil {
+		err = fmt.Errorf("[callAria2c]marshal rpc req to json error:%s", err)
+		return nil, err
+	}
+	var resp *http.Response
+	maxRetry := t.maxRetry
+	if maxRetry == 0 {
+		maxRetry = 3
+	}
+	for retry := 1; retry <= maxRetry; retry++ {
+		resp, err = t.httpClient.Post(t.requestURL, "application/json-rpc", bytes.NewReader(reqData))
+		if err != nil {
+			err = fmt.Errorf("[callAria2c]do request error:%s, is aria2c process running? ", err)
+			log.Warnf("%s, retry... %d/%d", err, retry, maxRetry)
+			time.Sleep(time.Second)
+		} else {
+			break
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	respData, err = ioutil.ReadAll(resp.Body)
+	if err != nil {
+		err = fmt.Errorf("[callAria2c]read rpc resp error:%s", err)
+		return nil, err
+	}
+	return respData, nil
+}
 
 func IsAria2cRunning() bool {
-	return isAria2cRunning
+	if isExternalAria2c() {
+		// the external aria2c may be started or stopped at any time
+		_, err := NewAria2cRPCClient().GetVersion()
+		return err == nil
+	}
+	return aria2cSupervisor != nil && aria2cSupervisor.Running()
 }
 
-func hasAria2c() bool {
-	output, _ := exec.Command("hash", "aria2c").Output()
-	if len(output) == 0 {
-		return true
+// Aria2cStatus is the health of aria2c reported by the api
+type Aria2cStatus struct {
+	Mode    string
+	RPC     string
+	Dir     string
+	Running bool
+	Version string
+	Error   string
+	// the times the spawned aria2c was restarted
+	Restarts int
+}
+
+func GetAria2cStatus(downloadDir string) Aria2cStatus {
+	status := Aria2cStatus{
+		Mode: "spawn",
+		RPC:  aria2cRPCURL(),
+		Dir:  aria2cDir(downloadDir),
 	}
-	return false
+	if isExternalAria2c() {
+		status.Mode = "external"
+	} else if aria2cSupervisor != nil {
+		status.Restarts = aria2cSupervisor.Restarts()
+	}
+	version, err := NewAria2cRPCClient().GetVersion()
+	if err != nil {
+		status.Error = redactSecret(err.Error())
+		return status
+	}
+	status.Running = true
+	status.Version = version.Version
+	return status
 }
 
-func Aria2Worker(downloadDir string) (pid int) {
-	if hasAria2c() {
-		killCmd := exec.Command("sh")
-		killCmd.Stdin = strings.NewReader(fmt.Sprintf(`lsof -i :%d|grep LISTEN|awk '{printf $2"\n"}'|xargs -I {} kill -9 {}`, *aria2cPort))
-		err := killCmd.Run()
-		if err != nil {
-			log.Warnf("kill error:%s", err)
-		}
-		cmd := exec.Command("aria2c",
-			"--dir="+downloadDir,
-			"--enable-rpc",
-			fmt.Sprintf("--rpc-listen-port=%d", *aria2cPort),
-			"--rpc-listen-all=false",
-			// https://github.com/ngosang/trackerslist
-			"--bt-tracker=udp://tracker.skyts.net:6969/announce,udp://tracker.safe.moe:6969/announce,udp://tracker.piratepublic.com:1337/announce,udp://tracker.pirateparty.gr:6969/announce,udp://tracker.coppersurfer.tk:6969/announce,udp://tracker.leechers-paradise.org:6969/announce,udp://allesanddro.de:1337/announce,udp://9.rarbg.com:2710/announce,http://p4p.arenabg.com:1337/announce,udp://p4p.arenabg.com:1337/announce,udp://tracker.opentrackr.org:1337/announce,http://tracker.opentrackr.org:1337/announce,udp://public.popcorn-tracker.org:6969/announce,udp://tracker2.christianbro.pw:6969/announce,udp://tracker1.xku.tv:6969/announce,udp://tracker1.wasabii.com.tw:6969/announce,udp://tracker.zer0day.to:1337/announce,udp://tracker.mg64.net:6969/announce,udp://peerfect.org:6969/announce,udp://open.facedatabg.net:6969/announc")
-		output, err := cmd.StdoutPipe()
-		if err != nil {
-			log.Errorf("[Aria2Worker]cmd.StdoutPipe error:%s", err)
-		}
-		err = cmd.Start()
-		isAria2cRunning = true
-		if err != nil {
-			log.Errorf("[Aria2Worker]aria2c can not start, err:%s", err.Error())
-			isAria2cRunning = false
-		}
-		go func(output io.ReadCloser) {
-			defer func() {
-				if rec := recover(); rec != nil {
-					log.Errorf("[Aria2Worker]panic:%v", rec)
-				}
-			}()
-			// log aria2c stdout
-			scanner := bufio.NewScanner(output)
-			var outString string
-			for scanner.Scan() {
-				// 不能让空输出刷屏
-				outString = scanner.Text()
-				if strings.TrimSpace(outString) != "" {
-					log.Debugf("[aria2c][stdout]%s", outString)
-				}
-			}
-			cmd.Wait()
-		}(output)
-		return cmd.Process.Pid
-	} else {
-		log.Errorf("[Aria2Worker]aria2c not install, cannot download magnet")
+func (m *TasksManager) Aria2cHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(GetAria2cStatus(m.downloadDir))
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// ConnectAria2c checks the external aria2c, fdp does not spawn aria2c then
+func ConnectAria2c() {
+	version, err := NewAria2cRPCClient().GetVersion()
+	if err != nil {
+		log.Errorf("[ConnectAria2c]external aria2c %s is not available:%s", aria2cRPCURL(), err)
+		return
+	}
+	log.Infof("[ConnectAria2c]connected to external aria2c %s, version:%s", aria2cRPCURL(), version.Version)
+}
+
+// writeAria2cConf writes the rpc secret to a conf file which only the owner can read
+func writeAria2cConf() (confPath string, err error) {
+	fp, err := ioutil.TempFile("", "fdp-aria2c-*.conf")
+	if err != nil {
+		return "", fmt.Errorf("create aria2c conf error:%s", err)
+	}
+	defer fp.Close()
+	_, err = fmt.Fprintf(fp, "rpc-secret=%s\n", *aria2cSecret)
+	if err != nil {
+		os.Remove(fp.Name())
+		return "", fmt.Errorf("write aria2c conf error:%s", err)
 	}
-	return 0
+	return fp.Name(), nil
 }
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"github.com/hanjm/log"
+	"sync"
+	"time"
+)
+
+// the progress of all the magnet tasks is polled in one batch, the notifications of aria2c update the task at once
+var aria2cPollInterval = 5 * time.Second
+
+var aria2cMonitor = NewAria2cMonitor()
+
+// aria2cStatusUpdate is the status of a download sent to the task which subscribes its gid
+type aria2cStatusUpdate struct {
+	GID    string
+	Result *Aria2cTellStatusResult
+	Err    error
+}
+
+// Aria2cMonitor polls the status of the subscribed downloads with aria2.tellActive and system.multicall,
+// and polls the download at once when aria2c notifies its state is changed
+type Aria2cMonitor struct {
+	mutex       sync.Mutex
+	subscribers map[string]chan *aria2cStatusUpdate
+	notified    chan string
+	startOnce   sync.Once
+}
+
+func NewAria2cMonitor() *Aria2cMonitor {
+	return &Aria2cMonitor{
+		subscribers: make(map[string]chan *aria2cStatusUpdate),
+		notified:    make(chan string, 64),
+	}
+}
+
+// Subscribe sends the status updates of gid to updates, the stale update is dropped if the task is slow
+func (m *Aria2cMonitor) Subscribe(gid string, updates chan *aria2cStatusUpdate) {
+	m.startOnce.Do(func() {
+		go m.Run()
+	})
+	m.mutex.Lock()
+	m.subscribers[gid] = updates
+	m.mutex.Unlock()
+	m.Notify("subscribe", gid)
+}
+
+// Unsubscribe removes all the gids subscribed by updates
+func (m *Aria2cMonitor) Unsubscribe(updates chan *aria2cStatusUpdate) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for gid, ch := range m.subscribers {
+		if ch == updates {
+			delete(m.subscribers, gid)
+		}
+	}
+}
+
+// Notify is called with the notifications of aria2c, like aria2.onDownloadComplete
+func (m *Aria2cMonitor) Notify(method string, gid string) {
+	log.Debugf("[Aria2cMonitor]%s %s", method, gid)
+	select {
+	case m.notified <- gid:
+	default:
+		// the next poll updates it
+	}
+}
+
+func (m *Aria2cMonitor) Run() {
+	timer := time.NewTimer(aria2cPollInterval)
+	defer timer.Stop()
+	for {
+		select {
+		case <-timer.C:
+			m.pollAll()
+			timer.Reset(aria2cPollInterval)
+		case gid := <-m.notified:
+			if m.subscribed(gid) {
+				m.poll([]string{gid})
+			}
+		}
+	}
+}
+
+func (m *Aria2cMonitor) subscribed(gid string) bool {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	_, ok := m.subscribers[gid]
+	return ok
+}
+
+func (m *Aria2cMonitor) gids() []string {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	gids := make([]string, 0, len(m.subscribers))
+	for gid := range m.subscribers {
+		gids = append(gids, gid)
+	}
+	return gids
+}
+
+// pollAll gets the active downloads by aria2.tellActive, and the others by system.multicall
+func (m *Aria2cMonitor) pollAll() {
+	gids := m.gids()
+	if len(gids) == 0 {
+		return
+	}
+	active, err := NewAria2cRPCClient().TellActive()
+	if err != nil {
+		for _, gid := range gids {
+			m.dispatch(&aria2cStatusUpdate{GID: gid, Err: err})
+		}
+		return
+	}
+	activeGIDs := make(map[string]bool, len(active))
+	for _, result := range active {
+		activeGIDs[result.GID] = true
+		m.dispatch(&aria2cStatusUpdate{GID: result.GID, Result: result})
+	}
+	var others []string
+	for _, gid := range gids {
+		if !activeGIDs[gid] {
+			others = append(others, gid)
+		}
+	}
+	m.poll(others)
+}
+
+func (m *Aria2cMonitor) poll(gids []string) {
+	if len(gids) == 0 {
+		return
+	}
+	results, errs, err := NewAria2cRPCClient().TellStatusMulti(gids)
+	for i, gid := range gids {
+		if err != nil {
+			m.dispatch(&aria2cStatusUpdate{GID: gid, Err: err})
+			continue
+		}
+		m.dispatch(&aria2cStatusUpdate{GID: gid, Result: results[i], Err: errs[i]})
+	}
+}
+
+func (m *Aria2cMonitor) dispatch(update *aria2cStatusUpdate) {
+	m.mutex.Lock()
+	updates, ok := m.subscribers[update.GID]
+	m.mutex.Unlock()
+	if !ok {
+		return
+	}
+	// keep the latest update only
+	for {
+		select {
+		case updates <- update:
+			return
+		default:
+		}
+		select {
+		case <-updates:
+		default:
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"github.com/hanjm/log"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// aria2cProxy is the CONNECT proxy of the urls downloaded by aria2c, it is started on the first use.
+// aria2c follows the redirects by itself, every connection it makes is checked by the egress policy and the host rules of url policy here
+var aria2cProxy struct {
+	mutex    sync.Mutex
+	addr     string
+	password string
+}
+
+const aria2cProxyUser = "fdp"
+
+// aria2cProxyOptions returns the proxy options of the aria2c download, the proxy tunnels http, https and ftp
+func aria2cProxyOptions() (proxy string, user string, password string, err error) {
+	aria2cProxy.mutex.Lock()
+	defer aria2cProxy.mutex.Unlock()
+	if aria2cProxy.addr == "" {
+		secret := make([]byte, 16)
+		if _, err := rand.Read(secret); err != nil {
+			return "", "", "", fmt.Errorf("generate the password of aria2c proxy error:%s", err)
+		}
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			return "", "", "", fmt.Errorf("listen the aria2c proxy error:%s", err)
+		}
+		password := hex.EncodeToString(secret)
+		server := &http.Server{Handler: &egressProxy{user: aria2cProxyUser, password: password}}
+		go func() {
+			log.Errorf("the aria2c proxy exits:%s", server.Serve(listener))
+		}()
+		aria2cProxy.addr, aria2cProxy.password = listener.Addr().String(), password
+	}
+	return "http://" + aria2cProxy.addr, aria2cProxyUser, aria2cProxy.password, nil
+}
+
+// egressProxy is the CONNECT proxy which dials by the egress policy
+type egressProxy struct {
+	user     string
+	password string
+}
+
+func (p *egressProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodConnect {
+		http.Error(w, "only CONNECT is supported", http.StatusMethodNotAllowed)
+		return
+	}
+	if user, password, ok := (&http.Request{Header: http.Header{"Authorization": r.Header["Proxy-Authorization"]}}).BasicAuth(); !ok || user != p.user || password != p.password {
+		w.Header().Set("Proxy-Authenticate", `Basic realm="fdp"`)
+		http.Error(w, "proxy authentication required", http.StatusProxyAuthRequired)
+		return
+	}
+	host, _, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := urlPolicy.CheckHost(host); err != nil {
+		log.Warnf("[egressProxy]%s", err)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
+	defer cancel()
+	conn, err := egressPolicy.DialContext(ctx, "tcp", r.Host)
+	if err != nil {
+		log.Warnf("[egressProxy]dial %s error:%s", r.Host, err)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	defer conn.Close()
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "hijacking is not supported", http.StatusInternalServerError)
+		return
+	}
+	client, buffered, err := hijacker.Hijack()
+	if err != nil {
+		log.Warnf("[egressProxy]hijack error:%s", err)
+		return
+	}
+	defer client.Close()
+	if _, err := client.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n")); err != nil {
+		return
+	}
+	done := make(chan struct{})
+	go func() {
+		io.Copy(conn, buffered)
+		// the half close lets the server see EOF, the other direction is finished by the server
+		if c, ok := conn.(*net.TCPConn); ok {
+			c.CloseWrite()
+		}
+		close(done)
+	}()
+	io.Copy(client, conn)
+	client.Close()
+	<-done
+}
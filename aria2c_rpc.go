@@ -0,0 +1,368 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Aria2cOptions is the options of aria2c download, see https://aria2.github.io/manual/en/html/aria2c.html#input-file
+// the values are strings as aria2c expects, the empty ones are not sent
+type Aria2cOptions struct {
+	Dir                    string        `json:"dir,omitempty"`
+	Out                    string        `json:"out,omitempty"`
+	GID                    string        `json:"gid,omitempty"`
+	Header                 aria2cStrings `json:"header,omitempty"`
+	AllProxy               string        `json:"all-proxy,omitempty"`
+	AllProxyUser           string        `json:"all-proxy-user,omitempty"`
+	AllProxyPasswd         string        `json:"all-proxy-passwd,omitempty"`
+	ProxyMethod            string        `json:"proxy-method,omitempty"`
+	Split                  string        `json:"split,omitempty"`
+	MaxConnectionPerServer string        `json:"max-connection-per-server,omitempty"`
+	MaxDownloadLimit       string        `json:"max-download-limit,omitempty"`
+	MaxUploadLimit         string        `json:"max-upload-limit,omitempty"`
+	Pause                  string        `json:"pause,omitempty"`
+	PauseMetadata          string        `json:"pause-metadata,omitempty"`
+	SelectFile             string        `json:"select-file,omitempty"`
+	FollowTorrent          string        `json:"follow-torrent,omitempty"`
+	BtMetadataOnly         string        `json:"bt-metadata-only,omitempty"`
+	BtSaveMetadata         string        `json:"bt-save-metadata,omitempty"`
+	BtTracker              string        `json:"bt-tracker,omitempty"`
+	CheckIntegrity         string        `json:"check-integrity,omitempty"`
+	SeedRatio              string        `json:"seed-ratio,omitempty"`
+	SeedTime               string        `json:"seed-time,omitempty"`
+	// global options
+	MaxConcurrentDownloads  string `json:"max-concurrent-downloads,omitempty"`
+	MaxOverallDownloadLimit string `json:"max-overall-download-limit,omitempty"`
+	MaxOverallUploadLimit   string `json:"max-overall-upload-limit,omitempty"`
+	SaveSession             string `json:"save-session,omitempty"`
+}
+
+// aria2cStrings is the multi-value option, aria2c accepts a list and returns the values separated by "\n"
+type aria2cStrings []string
+
+func (s *aria2cStrings) UnmarshalJSON(data []byte) error {
+	var values []string
+	if err := json.Unmarshal(data, &values); err == nil {
+		*s = values
+		return nil
+	}
+	var value string
+	if err := json.Unmarshal(data, &value); err != nil {
+		return err
+	}
+	*s = nil
+	for _, v := range strings.Split(value, "\n") {
+		if v != "" {
+			*s = append(*s, v)
+		}
+	}
+	return nil
+}
+
+// Aria2cError is the error returned by aria2c's json-rpc
+type Aria2cError struct {
+	Method  string
+	Code    int64
+	Message string
+}
+
+func (e *Aria2cError) Error() string {
+	return fmt.Sprintf("[callAria2c]aria2 %s return error, code:%d, message:%s", e.Method, e.Code, e.Message)
+}
+
+// IsAria2cNotFound reports whether aria2c does not know the gid, e.g. its result is removed or aria2c is restarted
+func IsAria2cNotFound(err error) bool {
+	var aria2cErr *Aria2cError
+	return errors.As(err, &aria2cErr) && strings.Contains(aria2cErr.Message, "is not found")
+}
+
+// IsAria2cUnauthorized reports whether the rpc secret is wrong
+func IsAria2cUnauthorized(err error) bool {
+	var aria2cErr *Aria2cError
+	return errors.As(err, &aria2cErr) && aria2cErr.Message == "Unauthorized"
+}
+
+// Aria2cErrorCode is the errorCode of the download, same as the exit status of aria2c
+// see https://aria2.github.io/manual/en/html/aria2c.html#exit-status
+type Aria2cErrorCode int
+
+const (
+	Aria2cErrorFinished Aria2cErrorCode = iota
+	Aria2cErrorUnknown
+	Aria2cErrorTimeout
+	Aria2cErrorResourceNotFound
+	Aria2cErrorMaxFileNotFound
+	Aria2cErrorTooSlow
+	Aria2cErrorNetwork
+	Aria2cErrorInProgress
+	Aria2cErrorCannotResume
+	Aria2cErrorNotEnoughDiskSpace
+	Aria2cErrorPieceLengthChanged
+	Aria2cErrorDuplicateDownload
+	Aria2cErrorDuplicateInfoHash
+	Aria2cErrorFileAlreadyExists
+	Aria2cErrorFileRenamingFailed
+	Aria2cErrorFileOpen
+	Aria2cErrorFileCreate
+	Aria2cErrorFileIO
+	Aria2cErrorDirCreate
+	Aria2cErrorNameResolution
+	Aria2cErrorMetalinkParse
+	Aria2cErrorFTPCommand
+	Aria2cErrorHTTPResponseHeader
+	Aria2cErrorTooManyRedirects
+	Aria2cErrorHTTPAuthorization
+	Aria2cErrorBencodeParse
+	Aria2cErrorTorrentCorrupted
+	Aria2cErrorMagnetURI
+	Aria2cErrorBadOption
+	Aria2cErrorServerOverload
+	Aria2cErrorRPCRequestParse
+	Aria2cErrorReserved
+	Aria2cErrorChecksum
+)
+
+var aria2cErrorCodeDescriptions = []string{
+	"all downloads were successful",
+	"an unknown error occurred",
+	"time out occurred",
+	"a resource was not found",
+	"aria2 saw the specified number of \"resource not found\" error",
+	"a download aborted because download speed was too slow",
+	"network problem occurred",
+	"there were unfinished downloads",
+	"remote server did not support resume when resume was required to complete download",
+	"there was not enough disk space available",
+	"piece length was different from one in .aria2 control file",
+	"aria2 was downloading same file at that moment",
+	"aria2 was downloading same info hash torrent at that moment",
+	"file already existed",
+	"renaming file failed",
+	"aria2 could not open existing file",
+	"aria2 could not create new file or truncate existing file",
+	"file I/O error occurred",
+	"aria2 could not create directory",
+	"name resolution failed",
+	"aria2 could not parse Metalink document",
+	"FTP command failed",
+	"HTTP response header was bad or unexpected",
+	"too many redirects occurred",
+	"HTTP authorization failed",
+	"aria2 could not parse bencoded file",
+	"\".torrent\" file was corrupted or missing information that aria2 needed",
+	"magnet URI was bad",
+	"bad/unrecognized option was given or unexpected option argument was given",
+	"the remote server was unable to handle the request due to a temporary overloading or maintenance",
+	"aria2 could not parse JSON-RPC request",
+	"reserved, not used",
+	"checksum validation failed",
+}
+
+func (c Aria2cErrorCode) String() string {
+	if c >= 0 && int(c) < len(aria2cErrorCodeDescriptions) {
+		return aria2cErrorCodeDescriptions[c]
+	}
+	return fmt.Sprintf("unknown error code %d", int(c))
+}
+
+// Aria2cDownloadError is the error of the download reported by aria2.tellStatus
+type Aria2cDownloadError struct {
+	GID     string
+	Code    Aria2cErrorCode
+	Message string
+}
+
+func (e *Aria2cDownloadError) Error() string {
+	return fmt.Sprintf("aria2c download error, code:%d(%s), message:%s", int(e.Code), e.Code, e.Message)
+}
+
+// Err returns the error of download, nil if it has no error
+func (r *Aria2cTellStatusResult) Err() error {
+	if r.Status != "error" {
+		return nil
+	}
+	code, _ := strconv.Atoi(r.ErrorCode)
+	return &Aria2cDownloadError{GID: r.GID, Code: Aria2cErrorCode(code), Message: r.ErrorMessage}
+}
+
+type Aria2cFile struct {
+	CompletedLength int64               `json:"completedLength,string"`
+	Index           int                 `json:"index,string"`
+	Length          int64               `json:"length,string"`
+	Path            string              `json:"path"`
+	Selected        bool                `json:"selected,string"`
+	URIs            []map[string]string `json:"uris"`
+}
+
+// Aria2cBittorrent is the information retrieved from the torrent file
+type Aria2cBittorrent struct {
+	AnnounceList [][]string `json:"announceList"`
+	Comment      string     `json:"comment"`
+	CreationDate int64      `json:"creationDate"`
+	Mode         string     `json:"mode"`
+	Info         struct {
+		Name string `json:"name"`
+	} `json:"info"`
+}
+
+type Aria2cPeer struct {
+	PeerID        string `json:"peerId"`
+	IP            string `json:"ip"`
+	Port          int    `json:"port,string"`
+	Bitfield      string `json:"bitfield"`
+	AmChoking     bool   `json:"amChoking,string"`
+	PeerChoking   bool   `json:"peerChoking,string"`
+	DownloadSpeed int64  `json:"downloadSpeed,string"`
+	UploadSpeed   int64  `json:"uploadSpeed,string"`
+	Seeder        bool   `json:"seeder,string"`
+}
+
+type Aria2cServers struct {
+	Index   int `json:"index,string"`
+	Servers []struct {
+		URI           string `json:"uri"`
+		CurrentURI    string `json:"currentUri"`
+		DownloadSpeed int64  `json:"downloadSpeed,string"`
+	} `json:"servers"`
+}
+
+type Aria2cGlobalStat struct {
+	DownloadSpeed   int64 `json:"downloadSpeed,string"`
+	UploadSpeed     int64 `json:"uploadSpeed,string"`
+	NumActive       int   `json:"numActive,string"`
+	NumWaiting      int   `json:"numWaiting,string"`
+	NumStopped      int   `json:"numStopped,string"`
+	NumStoppedTotal int   `json:"numStoppedTotal,string"`
+}
+
+// AddMetalink returns the gids of the downloads defined in the metalink
+func (c *Aria2cRPCClient) AddMetalink(base64Content string, options *Aria2cOptions) (taskGIDs []string, err error) {
+	params := []interface{}{base64Content}
+	if options != nil {
+		params = append(params, options)
+	}
+	return taskGIDs, c.callAria2cAndUnmarshal("aria2.addMetalink", "addMetalink", params, &taskGIDs)
+}
+
+func (c *Aria2cRPCClient) Pause(taskGID string) error {
+	return c.callGIDMethod("aria2.pause", taskGID)
+}
+
+// ForcePause pauses the download without the actions which take time, like contacting BitTorrent trackers
+func (c *Aria2cRPCClient) ForcePause(taskGID string) error {
+	return c.callGIDMethod("aria2.forcePause", taskGID)
+}
+
+func (c *Aria2cRPCClient) Unpause(taskGID string) error {
+	return c.callGIDMethod("aria2.unpause", taskGID)
+}
+
+func (c *Aria2cRPCClient) Remove(taskGID string) error {
+	return c.callGIDMethod("aria2.remove", taskGID)
+}
+
+func (c *Aria2cRPCClient) ForceRemove(taskGID string) error {
+	return c.callGIDMethod("aria2.forceRemove", taskGID)
+}
+
+// callGIDMethod calls the method which returns the gid of the download
+func (c *Aria2cRPCClient) callGIDMethod(method string, taskGID string) error {
+	var respResult string
+	return c.callAria2cAndUnmarshal(method, taskGID, []interface{}{taskGID}, &respResult)
+}
+
+func (c *Aria2cRPCClient) GetFiles(taskGID string) ([]Aria2cFile, error) {
+	var respResult []Aria2cFile
+	return respResult, c.callAria2cAndUnmarshal("aria2.getFiles", taskGID, []interface{}{taskGID}, &respResult)
+}
+
+func (c *Aria2cRPCClient) GetPeers(taskGID string) ([]Aria2cPeer, error) {
+	var respResult []Aria2cPeer
+	return respResult, c.callAria2cAndUnmarshal("aria2.getPeers", taskGID, []interface{}{taskGID}, &respResult)
+}
+
+func (c *Aria2cRPCClient) GetServers(taskGID string) ([]Aria2cServers, error) {
+	var respResult []Aria2cServers
+	return respResult, c.callAria2cAndUnmarshal("aria2.getServers", taskGID, []interface{}{taskGID}, &respResult)
+}
+
+// TellWaiting returns the waiting and paused downloads, offset may be negative to count from the last
+func (c *Aria2cRPCClient) TellWaiting(offset int, num int) ([]*Aria2cTellStatusResult, error) {
+	var respResult []*Aria2cTellStatusResult
+	return respResult, c.callAria2cAndUnmarshal("aria2.tellWaiting", "tellWaiting", []interface{}{offset, num}, &respResult)
+}
+
+// TellStopped returns the completed, error and removed downloads
+func (c *Aria2cRPCClient) TellStopped(offset int, num int) ([]*Aria2cTellStatusResult, error) {
+	var respResult []*Aria2cTellStatusResult
+	return respResult, c.callAria2cAndUnmarshal("aria2.tellStopped", "tellStopped", []interface{}{offset, num}, &respResult)
+}
+
+func (c *Aria2cRPCClient) GetOption(taskGID string) (*Aria2cOptions, error) {
+	var respResult = Aria2cOptions{}
+	return &respResult, c.callAria2cAndUnmarshal("aria2.getOption", taskGID, []interface{}{taskGID}, &respResult)
+}
+
+// ChangeOption changes the options of the download dynamically, some options can not be changed when it is active
+func (c *Aria2cRPCClient) ChangeOption(taskGID string, options *Aria2cOptions) error {
+	return c.callOKMethod("aria2.changeOption", taskGID, []interface{}{taskGID, options})
+}
+
+func (c *Aria2cRPCClient) GetGlobalOption() (*Aria2cOptions, error) {
+	var respResult = Aria2cOptions{}
+	return &respResult, c.callAria2cAndUnmarshal("aria2.getGlobalOption", "getGlobalOption", []interface{}{}, &respResult)
+}
+
+func (c *Aria2cRPCClient) ChangeGlobalOption(options *Aria2cOptions) error {
+	return c.callOKMethod("aria2.changeGlobalOption", "changeGlobalOption", []interface{}{options})
+}
+
+func (c *Aria2cRPCClient) GetGlobalStat() (*Aria2cGlobalStat, error) {
+	var respResult = Aria2cGlobalStat{}
+	return &respResult, c.callAria2cAndUnmarshal("aria2.getGlobalStat", "getGlobalStat", []interface{}{}, &respResult)
+}
+
+// SaveSession saves the current session to the file specified by the save-session option
+func (c *Aria2cRPCClient) SaveSession() error {
+	return c.callOKMethod("aria2.saveSession", "saveSession", []interface{}{})
+}
+
+func (c *Aria2cRPCClient) RemoveDownloadResult(taskGID string) error {
+	return c.callOKMethod("aria2.removeDownloadResult", taskGID, []interface{}{taskGID})
+}
+
+// callOKMethod calls the method which returns "OK"
+func (c *Aria2cRPCClient) callOKMethod(method string, requestID string, params []interface{}) error {
+	var respResult string
+	err := c.callAria2cAndUnmarshal(method, requestID, params, &respResult)
+	if err != nil {
+		return err
+	}
+	if respResult != "OK" {
+		return fmt.Errorf("result expect 'ok', not %s", respResult)
+	}
+	return nil
+}
+
+// unmarshalAria2cCallResult unmarshals the result of a call in system.multicall,
+// which is an array with one item, or a fault struct
+func unmarshalAria2cCallResult(method string, data json.RawMessage, respResult interface{}) error {
+	var result []json.RawMessage
+	if err := json.Unmarshal(data, &result); err != nil || len(result) == 0 {
+		var fault struct {
+			Code    int64  `json:"code"`
+			Message string `json:"message"`
+		}
+		if err := json.Unmarshal(data, &fault); err != nil {
+			return fmt.Errorf("[callAria2c]json.Unmarshal multicall result error:%s, rawBody:%s", err, redactSecret(string(data)))
+		}
+		return &Aria2cError{Method: method, Code: fault.Code, Message: redactSecret(fault.Message)}
+	}
+	if err := json.Unmarshal(result[0], respResult); err != nil {
+		return fmt.Errorf("[callAria2c]json.Unmarshal multicall result error:%s, rawBody:%s", err, redactSecret(string(data)))
+	}
+	return nil
+}
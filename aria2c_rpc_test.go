@@ -0,0 +1,172 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+// newFakeAria2cServer answers the json-rpc methods with the raw results, the unknown methods return the "GID not found" error
+func newFakeAria2cServer(t *testing.T, results map[string]string, requests chan []interface{}) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			ID     string        `json:"id"`
+			Method string        `json:"method"`
+			Params []interface{} `json:"params"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Errorf("decode request error:%s", err)
+			return
+		}
+		if requests != nil {
+			requests <- append([]interface{}{req.Method}, req.Params...)
+		}
+		result, ok := results[req.Method]
+		if !ok {
+			fmt.Fprintf(w, `{"id":"%s","jsonrpc":"2.0","error":{"code":1,"message":"GID 2089b05ecca3d829 is not found"}}`, req.ID)
+			return
+		}
+		fmt.Fprintf(w, `{"id":"%s","jsonrpc":"2.0","result":%s}`, req.ID, result)
+	}))
+}
+
+func TestAria2cRPCClient_Methods(t *testing.T) {
+	const gid = "2089b05ecca3d829"
+	status := `{"gid":"2089b05ecca3d829","status":"active","totalLength":"100","completedLength":"10"}`
+	requests := make(chan []interface{}, 1)
+	server := newFakeAria2cServer(t, map[string]string{
+		"aria2.addMetalink":        `["2089b05ecca3d829","d2703803b52216d1"]`,
+		"aria2.pause":              `"2089b05ecca3d829"`,
+		"aria2.forcePause":         `"2089b05ecca3d829"`,
+		"aria2.unpause":            `"2089b05ecca3d829"`,
+		"aria2.remove":             `"2089b05ecca3d829"`,
+		"aria2.forceRemove":        `"2089b05ecca3d829"`,
+		"aria2.getFiles":           `[{"index":"1","path":"/downloads/file","length":"100","completedLength":"10","selected":"true","uris":[]}]`,
+		"aria2.getPeers":           `[{"peerId":"%2DAR","ip":"1.2.3.4","port":"6881","bitfield":"ff","amChoking":"true","peerChoking":"false","downloadSpeed":"10","uploadSpeed":"20","seeder":"true"}]`,
+		"aria2.getServers":         `[{"index":"1","servers":[{"uri":"http://a/","currentUri":"http://b/","downloadSpeed":"10"}]}]`,
+		"aria2.tellActive":         `[` + status + `]`,
+		"aria2.tellWaiting":        `[` + status + `]`,
+		"aria2.tellStopped":        `[` + status + `]`,
+		"aria2.getOption":          `{"dir":"/downloads","header":"A: 1\nB: 2","split":"5"}`,
+		"aria2.changeOption":       `"OK"`,
+		"aria2.getGlobalOption":    `{"max-concurrent-downloads":"5"}`,
+		"aria2.changeGlobalOption": `"OK"`,
+		"aria2.getGlobalStat":      `{"downloadSpeed":"10","uploadSpeed":"20","numActive":"1","numWaiting":"2","numStopped":"3","numStoppedTotal":"4"}`,
+		"aria2.getVersion":         `{"version":"1.37.0","enabledFeatures":["BitTorrent"]}`,
+		"aria2.saveSession":        `"OK"`,
+		"system.multicall":         `[[` + status + `],{"code":1,"message":"GID d2703803b52216d1 is not found"}]`,
+	}, requests)
+	defer server.Close()
+	c := newAria2cRPCClient(server.URL, "s3cret")
+	for _, test := range []struct {
+		method string
+		call   func() (interface{}, error)
+		expect interface{}
+		params []interface{}
+	}{
+		{"aria2.addMetalink", func() (interface{}, error) {
+			return c.AddMetalink("bWV0YWxpbms=", &Aria2cOptions{Dir: "/downloads"})
+		}, []string{gid, "d2703803b52216d1"}, []interface{}{"token:s3cret", "bWV0YWxpbms=", map[string]interface{}{"dir": "/downloads"}}},
+		{"aria2.pause", func() (interface{}, error) { return nil, c.Pause(gid) }, nil, []interface{}{"token:s3cret", gid}},
+		{"aria2.forcePause", func() (interface{}, error) { return nil, c.ForcePause(gid) }, nil, nil},
+		{"aria2.unpause", func() (interface{}, error) { return nil, c.Unpause(gid) }, nil, nil},
+		{"aria2.remove", func() (interface{}, error) { return nil, c.Remove(gid) }, nil, nil},
+		{"aria2.forceRemove", func() (interface{}, error) { return nil, c.ForceRemove(gid) }, nil, nil},
+		{"aria2.getFiles", func() (interface{}, error) {
+			files, err := c.GetFiles(gid)
+			return files[0].Path, err
+		}, "/downloads/file", nil},
+		{"aria2.getPeers", func() (interface{}, error) {
+			peers, err := c.GetPeers(gid)
+			return peers[0].Port, err
+		}, 6881, nil},
+		{"aria2.getServers", func() (interface{}, error) {
+			servers, err := c.GetServers(gid)
+			return servers[0].Servers[0].CurrentURI, err
+		}, "http://b/", nil},
+		{"aria2.tellActive", func() (interface{}, error) {
+			results, err := c.TellActive()
+			return results[0].GID, err
+		}, gid, nil},
+		{"aria2.tellWaiting", func() (interface{}, error) {
+			results, err := c.TellWaiting(0, 10)
+			return results[0].CompletedLength, err
+		}, int64(10), []interface{}{"token:s3cret", float64(0), float64(10)}},
+		{"aria2.tellStopped", func() (interface{}, error) {
+			results, err := c.TellStopped(-1, 10)
+			return results[0].TotalLength, err
+		}, int64(100), []interface{}{"token:s3cret", float64(-1), float64(10)}},
+		{"aria2.getOption", func() (interface{}, error) {
+			options, err := c.GetOption(gid)
+			return []string(options.Header), err
+		}, []string{"A: 1", "B: 2"}, nil},
+		{"aria2.changeOption", func() (interface{}, error) {
+			return nil, c.ChangeOption(gid, &Aria2cOptions{MaxDownloadLimit: "1M"})
+		}, nil, []interface{}{"token:s3cret", gid, map[string]interface{}{"max-download-limit": "1M"}}},
+		{"aria2.getGlobalOption", func() (interface{}, error) {
+			options, err := c.GetGlobalOption()
+			return options.MaxConcurrentDownloads, err
+		}, "5", nil},
+		{"aria2.changeGlobalOption", func() (interface{}, error) {
+			return nil, c.ChangeGlobalOption(&Aria2cOptions{BtTracker: "udp://a/announce"})
+		}, nil, []interface{}{"token:s3cret", map[string]interface{}{"bt-tracker": "udp://a/announce"}}},
+		{"aria2.getGlobalStat", func() (interface{}, error) {
+			stat, err := c.GetGlobalStat()
+			return *stat, err
+		}, Aria2cGlobalStat{10, 20, 1, 2, 3, 4}, []interface{}{"token:s3cret"}},
+		{"aria2.getVersion", func() (interface{}, error) {
+			version, err := c.GetVersion()
+			return version.Version, err
+		}, "1.37.0", nil},
+		{"aria2.saveSession", func() (interface{}, error) { return nil, c.SaveSession() }, nil, nil},
+		{"system.multicall", func() (interface{}, error) {
+			results, errs, err := c.TellStatusMulti([]string{gid, "d2703803b52216d1"})
+			return []interface{}{results[0].GID, results[1] == nil, IsAria2cNotFound(errs[1])}, err
+		}, []interface{}{gid, true, true}, []interface{}{[]interface{}{
+			map[string]interface{}{"methodName": "aria2.tellStatus", "params": []interface{}{"token:s3cret", gid}},
+			map[string]interface{}{"methodName": "aria2.tellStatus", "params": []interface{}{"token:s3cret", "d2703803b52216d1"}},
+		}}},
+	} {
+		result, err := test.call()
+		if err != nil {
+			t.Errorf("%s error:%s", test.method, err)
+			continue
+		}
+		if !reflect.DeepEqual(result, test.expect) {
+			t.Errorf("%s expect %#v, got %#v", test.method, test.expect, result)
+		}
+		request := <-requests
+		if request[0] != test.method {
+			t.Errorf("expect method %s, got %s", test.method, request[0])
+		}
+		if test.params != nil && !reflect.DeepEqual(request[1:], test.params) {
+			t.Errorf("%s expect params %#v, got %#v", test.method, test.params, request[1:])
+		}
+	}
+}
+
+func TestAria2cRPCClient_Errors(t *testing.T) {
+	server := newFakeAria2cServer(t, map[string]string{
+		"aria2.tellStatus": `{"gid":"2089b05ecca3d829","status":"error","errorCode":"9","errorMessage":"no space"}`,
+	}, nil)
+	defer server.Close()
+	c := newAria2cRPCClient(server.URL, "")
+	err := c.Pause("2089b05ecca3d829")
+	if aria2cErr, ok := err.(*Aria2cError); !ok || aria2cErr.Method != "aria2.pause" || !IsAria2cNotFound(err) || IsAria2cUnauthorized(err) {
+		t.Fatalf("expect not found error, got %#v", err)
+	}
+	result, err := c.TellStatus("2089b05ecca3d829")
+	if err != nil {
+		t.Fatal(err)
+	}
+	downloadErr, ok := result.Err().(*Aria2cDownloadError)
+	if !ok || downloadErr.Code != Aria2cErrorNotEnoughDiskSpace || downloadErr.Code.String() != "there was not enough disk space available" {
+		t.Fatalf("unexpected download error:%#v", result.Err())
+	}
+	if Aria2cErrorChecksum != 32 {
+		t.Fatalf("unexpected error code of checksum:%d", Aria2cErrorChecksum)
+	}
+}
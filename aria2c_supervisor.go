@@ -0,0 +1,425 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/hanjm/log"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// aria2cSupervisor supervises the aria2c spawned by fdp, it is nil if the external aria2c is used
+var aria2cSupervisor *Aria2cSupervisor
+
+var (
+	aria2cReadyTimeout   = 30 * time.Second
+	aria2cPingInterval   = 30 * time.Second
+	aria2cMaxPingFailure = 3
+	aria2cMinBackoff     = time.Second
+	aria2cMaxBackoff     = time.Minute
+	aria2cStopTimeout    = 10 * time.Second
+)
+
+// Aria2cSupervisor starts aria2c, pings it periodically and restarts it with backoff when it exits or hangs
+type Aria2cSupervisor struct {
+	downloadDir string
+	binPath     string
+	newCmd      func(args []string) *exec.Cmd
+	mutex       sync.RWMutex
+	pid         int
+	running     bool
+	// generation is increased every time aria2c becomes ready, the downloads of the previous aria2c are lost
+	generation int
+	ready      chan struct{}
+	readyOnce  sync.Once
+	stop       chan struct{}
+	stopOnce   sync.Once
+	done       chan struct{}
+}
+
+func NewAria2cSupervisor(downloadDir string) (*Aria2cSupervisor, error) {
+	binPath, err := exec.LookPath("aria2c")
+	if err != nil {
+		return nil, fmt.Errorf("aria2c not install, cannot download magnet:%s", err)
+	}
+	s := &Aria2cSupervisor{
+		downloadDir: downloadDir,
+		binPath:     binPath,
+		ready:       make(chan struct{}),
+		stop:        make(chan struct{}),
+		done:        make(chan struct{}),
+	}
+	s.newCmd = func(args []string) *exec.Cmd {
+		return exec.Command(s.binPath, args...)
+	}
+	return s, nil
+}
+
+// StartAria2c starts the supervisor and waits for aria2c is ready
+func StartAria2c(downloadDir string) *Aria2cSupervisor {
+	s, err := NewAria2cSupervisor(downloadDir)
+	if err != nil {
+		log.Errorf("[StartAria2c]%s", err)
+		return nil
+	}
+	if err := initAria2cSecret(); err != nil {
+		log.Errorf("[StartAria2c]%s", err)
+		return nil
+	}
+	if err := killStaleAria2c(); err != nil {
+		log.Errorf("[StartAria2c]%s", err)
+		return nil
+	}
+	aria2cSupervisor = s
+	go s.Run()
+	if !s.WaitReady(aria2cReadyTimeout) {
+		log.Errorf("[StartAria2c]aria2c is not ready in %s", aria2cReadyTimeout)
+	}
+	return s
+}
+
+// killStaleAria2c kills the aria2c left by the previous fdp process if it still listens on -aria2cPort,
+// only the pid in -aria2cPidFile is killed, the port used by the other process is an error
+func killStaleAria2c() error {
+	addr := fmt.Sprintf("127.0.0.1:%d", *aria2cPort)
+	if portFree(addr) {
+		removeAria2cPidFile()
+		return nil
+	}
+	if *aria2cPidFile == "" {
+		return fmt.Errorf("the aria2c port %d is used by another process, -aria2cPidFile is not set", *aria2cPort)
+	}
+	data, err := ioutil.ReadFile(*aria2cPidFile)
+	if err != nil {
+		return fmt.Errorf("the aria2c port %d is used by the process which is not spawned by fdp, read pid file error:%s", *aria2cPort, err)
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil || pid <= 0 {
+		return fmt.Errorf("invalid aria2c pid file %s:%q", *aria2cPidFile, data)
+	}
+	// the pid may be reused by another process after aria2c exited, it is killed only if it is known as the aria2c of the port
+	if err := checkAria2cProcess(pid); err != nil {
+		log.Warnf("[StartAria2c]skip killing pid %d of %s:%s", pid, *aria2cPidFile, err)
+		return fmt.Errorf("the aria2c port %d is used by another process, pid %d of %s is not aria2c:%s", *aria2cPort, pid, *aria2cPidFile, err)
+	}
+	process, err := os.FindProcess(pid)
+	if err == nil {
+		err = process.Kill()
+	}
+	if err != nil {
+		return fmt.Errorf("kill the previous aria2c %d error:%s", pid, err)
+	}
+	log.Warnf("[StartAria2c]killed the aria2c %d left by the previous fdp process", pid)
+	for i := 0; i < 50; i++ {
+		if portFree(addr) {
+			removeAria2cPidFile()
+			return nil
+		}
+		time.Sleep(time.Millisecond * 100)
+	}
+	return fmt.Errorf("the aria2c port %d is not released after killing %d", *aria2cPort, pid)
+}
+
+// checkAria2cProcess checks the command line of pid is the aria2c spawned for -aria2cPort,
+// the process is unknown if its command line can not be read, like the os without /proc
+func checkAria2cProcess(pid int) error {
+	cmdline, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/cmdline", pid))
+	if err != nil {
+		return fmt.Errorf("read the command line error:%s", err)
+	}
+	var rpc, port bool
+	for _, arg := range strings.Split(string(cmdline), "\x00") {
+		rpc = rpc || arg == "--enable-rpc"
+		port = port || arg == fmt.Sprintf("--rpc-listen-port=%d", *aria2cPort)
+	}
+	if !rpc || !port {
+		return fmt.Errorf("the command line does not match")
+	}
+	return nil
+}
+
+// portFree returns whether addr can be listened
+func portFree(addr string) bool {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return false
+	}
+	listener.Close()
+	return true
+}
+
+func writeAria2cPidFile(pid int) {
+	if *aria2cPidFile == "" {
+		return
+	}
+	if err := ioutil.WriteFile(*aria2cPidFile, []byte(strconv.Itoa(pid)+"\n"), 0644); err != nil {
+		log.Warnf("[Aria2cSupervisor]write pid file error:%s", err)
+	}
+}
+
+func removeAria2cPidFile() {
+	if *aria2cPidFile != "" {
+		os.Remove(*aria2cPidFile)
+	}
+}
+
+func aria2cArgs(confPath string, downloadDir string) []string {
+	args := []string{
+		"--conf-path=" + confPath,
+		"--dir=" + downloadDir,
+		"--enable-rpc",
+		fmt.Sprintf("--rpc-listen-port=%d", *aria2cPort),
+		"--rpc-listen-all=false",
+		// the trackers are refreshed by trackerList, the restarted aria2c starts with the latest ones
+		"--bt-tracker=" + trackerList.String(),
+	}
+	if *aria2cSession != "" {
+		args = append(args,
+			"--input-file="+*aria2cSession,
+			"--save-session="+*aria2cSession,
+			"--save-session-interval=60",
+			// the magnet continues without fetching the metadata again
+			"--bt-save-metadata=true",
+			"--bt-load-saved-metadata=true",
+		)
+	}
+	return args
+}
+
+// Run keeps aria2c running until Stop is called
+func (s *Aria2cSupervisor) Run() {
+	defer close(s.done)
+	backoff := aria2cMinBackoff
+	for {
+		startTime := time.Now()
+		err := s.runOnce()
+		select {
+		case <-s.stop:
+			log.Infof("[Aria2cSupervisor]aria2c stopped")
+			return
+		default:
+		}
+		// aria2c had been running stably, it is not a crash loop
+		if time.Since(startTime) > aria2cMaxBackoff {
+			backoff = aria2cMinBackoff
+		}
+		log.Errorf("[Aria2cSupervisor]%s, restart after %s", err, backoff)
+		select {
+		case <-s.stop:
+			return
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > aria2cMaxBackoff {
+			backoff = aria2cMaxBackoff
+		}
+	}
+}
+
+// runOnce starts aria2c and returns when it exits, hangs or is stopped
+func (s *Aria2cSupervisor) runOnce() error {
+	confPath, err := writeAria2cConf()
+	if err != nil {
+		return err
+	}
+	defer os.Remove(confPath)
+	if *aria2cSession != "" {
+		// aria2c can not start with the input file which does not exist
+		fp, err := os.OpenFile(*aria2cSession, os.O_CREATE|os.O_RDONLY, 0600)
+		if err != nil {
+			return fmt.Errorf("create aria2c session error:%s", err)
+		}
+		fp.Close()
+	}
+	cmd := s.newCmd(aria2cArgs(confPath, s.downloadDir))
+	output, err := cmd.StdoutPipe()
+	if err != nil {
+		return fmt.Errorf("cmd.StdoutPipe error:%s", err)
+	}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("aria2c can not start, err:%s", err)
+	}
+	exited := make(chan error, 1)
+	go func() {
+		logAria2cOutput(output)
+		exited <- cmd.Wait()
+	}()
+	s.mutex.Lock()
+	s.pid = cmd.Process.Pid
+	s.mutex.Unlock()
+	// runOnce returns after aria2c exits
+	writeAria2cPidFile(cmd.Process.Pid)
+	defer removeAria2cPidFile()
+	log.Infof("[Aria2cSupervisor]aria2c pid is %d", cmd.Process.Pid)
+	defer s.setRunning(false)
+	kill := func() {
+		cmd.Process.Kill()
+		<-exited
+	}
+	if err := s.waitAria2cReady(exited); err != nil {
+		kill()
+		return err
+	}
+	s.setRunning(true)
+	ticker := time.NewTicker(aria2cPingInterval)
+	defer ticker.Stop()
+	failures := 0
+	for {
+		select {
+		case err := <-exited:
+			return fmt.Errorf("aria2c exited:%v", err)
+		case <-ticker.C:
+			_, err := newAria2cPingClient().GetVersion()
+			if err == nil {
+				failures = 0
+				continue
+			}
+			failures++
+			log.Warnf("[Aria2cSupervisor]ping aria2c error:%s, %d/%d", redactSecret(err.Error()), failures, aria2cMaxPingFailure)
+			if failures >= aria2cMaxPingFailure {
+				kill()
+				return fmt.Errorf("aria2c is not responding")
+			}
+		case <-s.stop:
+			// let aria2c save its control files, kill it if it does not exit in time
+			s.setRunning(false)
+			if err := newAria2cPingClient().Shutdown(); err != nil {
+				log.Warnf("[Aria2cSupervisor]shutdown aria2c error:%s", redactSecret(err.Error()))
+				cmd.Process.Signal(os.Interrupt)
+			}
+			select {
+			case <-exited:
+			case <-time.After(aria2cStopTimeout):
+				log.Warnf("[Aria2cSupervisor]aria2c does not exit in %s, kill it", aria2cStopTimeout)
+				kill()
+			}
+			return nil
+		}
+	}
+}
+
+// waitAria2cReady waits for aria2c answers aria2.getVersion
+func (s *Aria2cSupervisor) waitAria2cReady(exited chan error) error {
+	deadline := time.Now().Add(aria2cReadyTimeout)
+	for time.Now().Before(deadline) {
+		version, err := newAria2cPingClient().GetVersion()
+		if err == nil {
+			log.Infof("[Aria2cSupervisor]aria2c %s is ready", version.Version)
+			return nil
+		}
+		select {
+		case err := <-exited:
+			exited <- err
+			return fmt.Errorf("aria2c exited before ready:%v", err)
+		case <-s.stop:
+			return fmt.Errorf("aria2c is stopped before ready")
+		case <-time.After(time.Millisecond * 500):
+		}
+	}
+	return fmt.Errorf("aria2c is not ready in %s", aria2cReadyTimeout)
+}
+
+func (s *Aria2cSupervisor) setRunning(running bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if running && !s.running {
+		s.generation++
+		s.readyOnce.Do(func() {
+			close(s.ready)
+		})
+	}
+	s.running = running
+}
+
+func (s *Aria2cSupervisor) Running() bool {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.running
+}
+
+func (s *Aria2cSupervisor) Pid() int {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.pid
+}
+
+// Generation changes when aria2c is restarted
+func (s *Aria2cSupervisor) Generation() int {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.generation
+}
+
+func (s *Aria2cSupervisor) Restarts() int {
+	if generation := s.Generation(); generation > 1 {
+		return generation - 1
+	}
+	return 0
+}
+
+// WaitReady waits for aria2c is ready for the first time
+func (s *Aria2cSupervisor) WaitReady(timeout time.Duration) bool {
+	select {
+	case <-s.ready:
+		return true
+	case <-s.done:
+		return false
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// Stop shuts aria2c down and waits for the supervisor exits
+func (s *Aria2cSupervisor) Stop() {
+	s.stopOnce.Do(func() {
+		close(s.stop)
+	})
+	<-s.done
+}
+
+// aria2cGeneration returns the generation of the spawned aria2c, 0 for the external aria2c
+func aria2cGeneration() int {
+	if aria2cSupervisor == nil {
+		return 0
+	}
+	return aria2cSupervisor.Generation()
+}
+
+// newAria2cPingClient returns the client which fails fast, for the health checks
+func newAria2cPingClient() *Aria2cRPCClient {
+	return &Aria2cRPCClient{
+		transport: &aria2cHTTPTransport{
+			httpClient: &http.Client{
+				Timeout: 5 * time.Second,
+			},
+			requestURL: fmt.Sprintf("http://127.0.0.1:%d/jsonrpc", *aria2cPort),
+			maxRetry:   1,
+		},
+		secret: *aria2cSecret,
+	}
+}
+
+func logAria2cOutput(output io.Reader) {
+	defer func() {
+		if rec := recover(); rec != nil {
+			log.Errorf("[Aria2cSupervisor]panic:%v", rec)
+		}
+	}()
+	// log aria2c stdout
+	scanner := bufio.NewScanner(output)
+	var outString string
+	for scanner.Scan() {
+		// 不能让空输出刷屏
+		outString = scanner.Text()
+		if strings.TrimSpace(outString) != "" {
+			log.Debugf("[aria2c][stdout]%s", redactSecret(outString))
+		}
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// TestAria2cHelperProcess is not a real test, it is the fake aria2c started by the supervisor
+func TestAria2cHelperProcess(t *testing.T) {
+	if os.Getenv("FDP_FAKE_ARIA2C") != "1" {
+		return
+	}
+	var port string
+	for _, arg := range os.Args {
+		if strings.HasPrefix(arg, "--rpc-listen-port=") {
+			port = strings.TrimPrefix(arg, "--rpc-listen-port=")
+		}
+	}
+	http.HandleFunc("/jsonrpc", func(w http.ResponseWriter, r *http.Request) {
+		var req aria2cRPCRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		switch req.Method {
+		case "aria2.getVersion":
+			fmt.Fprintf(w, `{"id":"%s","jsonrpc":"2.0","result":{"version":"fake","enabledFeatures":[]}}`, req.ID)
+		case "aria2.shutdown":
+			fmt.Fprintf(w, `{"id":"%s","jsonrpc":"2.0","result":"OK"}`, req.ID)
+			go func() {
+				time.Sleep(time.Millisecond * 100)
+				os.Exit(0)
+			}()
+		}
+	})
+	http.ListenAndServe("127.0.0.1:"+port, nil)
+	os.Exit(1)
+}
+
+func TestAria2cSupervisor_Restart(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := listener.Addr().(*net.TCPAddr).Port
+	listener.Close()
+	sessionDir, err := ioutil.TempDir("", "fdp-aria2c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(sessionDir)
+	oldPort, oldSecret, oldSession, oldBackoff := *aria2cPort, *aria2cSecret, *aria2cSession, aria2cMinBackoff
+	*aria2cPort, *aria2cSecret, *aria2cSession, aria2cMinBackoff = port, "s3cret", sessionDir+"/aria2.session", time.Millisecond*100
+	defer func() {
+		*aria2cPort, *aria2cSecret, *aria2cSession, aria2cMinBackoff = oldPort, oldSecret, oldSession, oldBackoff
+	}()
+	setFlag(t, "aria2cPidFile", sessionDir+"/aria2c.pid")
+	s := &Aria2cSupervisor{
+		downloadDir: os.TempDir(),
+		ready:       make(chan struct{}),
+		stop:        make(chan struct{}),
+		done:        make(chan struct{}),
+		newCmd: func(args []string) *exec.Cmd {
+			cmd := exec.Command(os.Args[0], append([]string{"-test.run=TestAria2cHelperProcess", "--"}, args...)...)
+			cmd.Env = append(os.Environ(), "FDP_FAKE_ARIA2C=1")
+			return cmd
+		},
+	}
+	go s.Run()
+	if !s.WaitReady(10 * time.Second) {
+		t.Fatal("aria2c expect ready")
+	}
+	if _, err := os.Stat(*aria2cSession); err != nil {
+		t.Fatalf("the session file expect created:%s", err)
+	}
+	pid := s.Pid()
+	if data, _ := ioutil.ReadFile(*aria2cPidFile); string(data) != fmt.Sprintf("%d\n", pid) {
+		t.Fatalf("expect the pid file of %d, got %q", pid, data)
+	}
+	syscall.Kill(pid, syscall.SIGKILL)
+	for i := 0; i < 100 && !(s.Generation() == 2 && s.Running()); i++ {
+		time.Sleep(time.Millisecond * 100)
+	}
+	if s.Generation() != 2 || !s.Running() || s.Pid() == pid {
+		t.Fatalf("aria2c expect restarted, generation:%d, pid:%d", s.Generation(), s.Pid())
+	}
+	pid = s.Pid()
+	s.Stop()
+	if s.Running() {
+		t.Fatal("aria2c expect stopped")
+	}
+	if err := syscall.Kill(pid, 0); err == nil {
+		t.Fatal("aria2c process expect exited")
+	}
+	if _, err := os.Stat(*aria2cPidFile); !os.IsNotExist(err) {
+		t.Fatalf("the pid file expect removed:%v", err)
+	}
+}
+
+func TestKillStaleAria2c(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fdp-aria2c-pid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	setFlag(t, "aria2cPort", fmt.Sprint(listener.Addr().(*net.TCPAddr).Port))
+	setFlag(t, "aria2cPidFile", dir+"/aria2c.pid")
+
+	// the port used by the process which is not spawned by fdp is not killed
+	if err := killStaleAria2c(); err == nil || !strings.Contains(err.Error(), "not spawned by fdp") {
+		t.Fatalf("expect the unknown listener kept, got %v", err)
+	}
+	// the pid which is reused by another process is not killed
+	ioutil.WriteFile(*aria2cPidFile, []byte(fmt.Sprintf("%d\n", os.Getpid())), 0644)
+	if err := killStaleAria2c(); err == nil || !strings.Contains(err.Error(), "does not match") {
+		t.Fatalf("expect the reused pid kept, got %v", err)
+	}
+	// the pid whose command line can not be read is not killed
+	exitedCmd := exec.Command(os.Args[0], "-test.run=^$")
+	if err := exitedCmd.Run(); err != nil {
+		t.Fatal(err)
+	}
+	ioutil.WriteFile(*aria2cPidFile, []byte(fmt.Sprintf("%d\n", exitedCmd.Process.Pid)), 0644)
+	if err := killStaleAria2c(); err == nil || !strings.Contains(err.Error(), "read the command line") {
+		t.Fatalf("expect the unknown pid kept, got %v", err)
+	}
+	listener.Close()
+
+	// the aria2c left by the previous fdp process is killed by its pid file
+	cmd := exec.Command(os.Args[0], "-test.run=TestAria2cHelperProcess", "--", "--enable-rpc", fmt.Sprintf("--rpc-listen-port=%d", *aria2cPort))
+	cmd.Env = append(os.Environ(), "FDP_FAKE_ARIA2C=1")
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	exited := make(chan struct{})
+	go func() {
+		cmd.Wait()
+		close(exited)
+	}()
+	defer cmd.Process.Kill()
+	for i := 0; i < 100 && portFree(fmt.Sprintf("127.0.0.1:%d", *aria2cPort)); i++ {
+		time.Sleep(time.Millisecond * 50)
+	}
+	ioutil.WriteFile(*aria2cPidFile, []byte(fmt.Sprintf("%d\n", cmd.Process.Pid)), 0644)
+	if err := killStaleAria2c(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-exited:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the previous aria2c expect killed")
+	}
+	if _, err := os.Stat(*aria2cPidFile); !os.IsNotExist(err) {
+		t.Fatalf("the pid file expect removed:%v", err)
+	}
+	// the free port needs no pid file
+	if err := killStaleAria2c(); err != nil {
+		t.Fatal(err)
+	}
+}
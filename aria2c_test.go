@@ -1,19 +1,29 @@
 package main
 
 import (
+	"encoding/json"
 	"flag"
+	"fmt"
+	"github.com/gorilla/websocket"
 	"github.com/hanjm/log"
-	"syscall"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
 
 func withTestEnv(fn func()) {
 	flag.Parse()
-	pid := Aria2Worker("download")
-	log.Infof("aria2c pid is %d", pid)
-	time.Sleep(time.Second)
-	defer syscall.Kill(pid, syscall.SIGQUIT)
+	supervisor := StartAria2c("download")
+	if supervisor == nil {
+		log.Fatal("aria2c is not started")
+	}
+	defer supervisor.Stop()
 	fn()
 }
 
@@ -22,7 +32,7 @@ func TestAria2cRPCClient_AddURI(t *testing.T) {
 		withTestEnv(
 			func() {
 				rpcClient := NewAria2cRPCClient()
-				taskGID, err := rpcClient.AddURI("http://github.com")
+				taskGID, err := rpcClient.AddURI("http://github.com", nil)
 				if err != nil {
 					t.Fatal(err)
 				}
@@ -36,7 +46,7 @@ func TestAria2cRPCClient_TellStatus(t *testing.T) {
 		withTestEnv(
 			func() {
 				rpcClient := NewAria2cRPCClient()
-				taskGID, err := rpcClient.AddURI("https://github.com/hashicorp/consul/archive/v0.9.3.tar.gz")
+				taskGID, err := rpcClient.AddURI("https://github.com/hashicorp/consul/archive/v0.9.3.tar.gz", nil)
 				if err != nil {
 					t.Fatal(err)
 				}
@@ -55,7 +65,7 @@ func TestAria2cRPCClient_TellStatus(t *testing.T) {
 		withTestEnv(
 			func() {
 				rpcClient := NewAria2cRPCClient()
-				taskGID, err := rpcClient.AddURI("magnet:?xt=urn:btih:09c4beba230a770051207d07a8fb76cf43477523")
+				taskGID, err := rpcClient.AddURI("magnet:?xt=urn:btih:09c4beba230a770051207d07a8fb76cf43477523", nil)
 				if err != nil {
 					t.Fatal(err)
 				}
@@ -76,7 +86,7 @@ func TestAria2cRPCClient_RemoveDownloadResult(t *testing.T) {
 	withTestEnv(
 		func() {
 			rpcClient := NewAria2cRPCClient()
-			taskGID, err := rpcClient.AddURI("http://github.com")
+			taskGID, err := rpcClient.AddURI("http://github.com", nil)
 			if err != nil {
 				t.Fatal(err)
 			}
@@ -89,3 +99,500 @@ func TestAria2cRPCClient_RemoveDownloadResult(t *testing.T) {
 			}
 		})
 }
+
+func TestAria2cRPCClient_Secret(t *testing.T) {
+	const secret = "s3cret"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			ID     string        `json:"id"`
+			Params []interface{} `json:"params"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		if req.ID == "multicall" {
+			// every call carries the token once
+			calls, _ := req.Params[0].([]interface{})
+			call, _ := calls[0].(map[string]interface{})
+			params, _ := call["params"].([]interface{})
+			if len(calls) != 1 || !reflect.DeepEqual(params, []interface{}{"token:" + secret, "2089b05ecca3d829"}) {
+				w.Write([]byte(`{"id":"` + req.ID + `","jsonrpc":"2.0","error":{"code":1,"message":"Unauthorized"}}`))
+				return
+			}
+			w.Write([]byte(`{"id":"` + req.ID + `","jsonrpc":"2.0","result":[["OK"]]}`))
+			return
+		}
+		if len(req.Params) == 0 || req.Params[0] != "token:"+secret {
+			w.Write([]byte(`{"id":"` + req.ID + `","jsonrpc":"2.0","error":{"code":1,"message":"Unauthorized"}}`))
+			return
+		}
+		w.Write([]byte(`{"id":"` + req.ID + `","jsonrpc":"2.0","result":"2089b05ecca3d829"}`))
+	}))
+	defer server.Close()
+	rpcClient := newAria2cRPCClient(server.URL, secret)
+	taskGID, err := rpcClient.AddURI("http://github.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if taskGID != "2089b05ecca3d829" {
+		t.Fatalf("unexpected taskGID:%s", taskGID)
+	}
+	// the calls reused by the caller are not changed by the token
+	calls := []Aria2cMethodCall{{MethodName: "aria2.pause", Params: []interface{}{taskGID}}}
+	for i := 0; i < 2; i++ {
+		if _, err := rpcClient.Multicall(calls); err != nil {
+			t.Fatalf("multicall %d error:%s", i, err)
+		}
+	}
+	if !reflect.DeepEqual(calls[0].Params, []interface{}{taskGID}) {
+		t.Fatalf("expect the params of calls kept, got %v", calls[0].Params)
+	}
+	rpcClient.secret = "wrong"
+	if _, err := rpcClient.AddURI("http://github.com", nil); err == nil {
+		t.Fatal("wrong secret expect error")
+	}
+}
+
+func TestAria2cRPCClient_WebSocket(t *testing.T) {
+	upgrader := websocket.Upgrader{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			var req struct {
+				ID     string        `json:"id"`
+				Method string        `json:"method"`
+				Params []interface{} `json:"params"`
+			}
+			if err := conn.ReadJSON(&req); err != nil {
+				return
+			}
+			// the notification without id is ignored by the client
+			conn.WriteMessage(websocket.TextMessage, []byte(`{"jsonrpc":"2.0","method":"aria2.onDownloadStart","params":[{"gid":"1"}]}`))
+			if req.Method != "aria2.getVersion" || req.Params[0] != "token:s3cret" {
+				conn.WriteMessage(websocket.TextMessage, []byte(`{"id":"`+req.ID+`","jsonrpc":"2.0","error":{"code":1,"message":"Unauthorized"}}`))
+				continue
+			}
+			conn.WriteMessage(websocket.TextMessage, []byte(`{"id":"`+req.ID+`","jsonrpc":"2.0","result":{"version":"1.37.0","enabledFeatures":["BitTorrent"]}}`))
+		}
+	}))
+	defer server.Close()
+	rpcClient := newAria2cRPCClient("ws"+strings.TrimPrefix(server.URL, "http")+"/jsonrpc", "s3cret")
+	for i := 0; i < 3; i++ {
+		version, err := rpcClient.GetVersion()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if version.Version != "1.37.0" {
+			t.Fatalf("unexpected version:%+v", version)
+		}
+	}
+}
+
+func TestMagnetTask_DownloadNotification(t *testing.T) {
+	upgrader := websocket.Upgrader{}
+	var status = "active"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		var writeMutex sync.Mutex
+		write := func(format string, a ...interface{}) {
+			writeMutex.Lock()
+			defer writeMutex.Unlock()
+			conn.WriteMessage(websocket.TextMessage, []byte(fmt.Sprintf(format, a...)))
+		}
+		for {
+			var req struct {
+				ID     string            `json:"id"`
+				Method string            `json:"method"`
+				Params []json.RawMessage `json:"params"`
+			}
+			if err := conn.ReadJSON(&req); err != nil {
+				return
+			}
+			switch req.Method {
+			case "aria2.getVersion":
+				write(`{"id":"%s","jsonrpc":"2.0","result":{"version":"1.37.0"}}`, req.ID)
+			case "aria2.addUri":
+				write(`{"id":"%s","jsonrpc":"2.0","result":"2089b05ecca3d829"}`, req.ID)
+			case "aria2.tellActive":
+				write(`{"id":"%s","jsonrpc":"2.0","result":[]}`, req.ID)
+			case "system.multicall":
+				var calls []Aria2cMethodCall
+				json.Unmarshal(req.Params[0], &calls)
+				if len(calls) != 1 || calls[0].Params[0] != "token:s3cret" {
+					write(`{"id":"%s","jsonrpc":"2.0","error":{"code":1,"message":"Unauthorized"}}`, req.ID)
+					continue
+				}
+				write(`{"id":"%s","jsonrpc":"2.0","result":[[{"gid":"2089b05ecca3d829","status":"%s","totalLength":"100","completedLength":"100","files":[{"path":"/data/fdp/ubuntu.iso"}]}]]}`, req.ID, status)
+				if status == "active" {
+					status = "complete"
+					go write(`{"jsonrpc":"2.0","method":"aria2.onDownloadComplete","params":[{"gid":"2089b05ecca3d829"}]}`)
+				}
+			case "aria2.tellStatus":
+				write(`{"id":"%s","jsonrpc":"2.0","result":{"gid":"2089b05ecca3d829","status":"complete"}}`, req.ID)
+			case "aria2.removeDownloadResult":
+				write(`{"id":"%s","jsonrpc":"2.0","result":"OK"}`, req.ID)
+			}
+		}
+	}))
+	defer server.Close()
+	oldRPC, oldDir, oldSecret, oldInterval := *aria2cRPC, *aria2cDirFlag, *aria2cSecret, aria2cPollInterval
+	*aria2cRPC, *aria2cDirFlag, *aria2cSecret = "ws"+strings.TrimPrefix(server.URL, "http")+"/jsonrpc", "/data/fdp", "s3cret"
+	// the task must be completed by the notification, not by the periodic polling
+	aria2cPollInterval = time.Hour
+	defer func() {
+		*aria2cRPC, *aria2cDirFlag, *aria2cSecret, aria2cPollInterval = oldRPC, oldDir, oldSecret, oldInterval
+	}()
+	task := NewMagnetTask("magnet:?xt=urn:btih:09c4beba230a770051207d07a8fb76cf43477523")
+	if err := task.Download(os.TempDir(), 1024, 10*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if !task.IsCompleted() || task.FileName() != "ubuntu.iso" {
+		t.Fatalf("unexpected task info:%+v", task.TaskInfo)
+	}
+}
+
+func TestMagnetTask_RestoreAndRebind(t *testing.T) {
+	task := NewMagnetTask("magnet:?xt=urn:btih:09c4beba230a770051207d07a8fb76cf43477523")
+	task.addGID("2089b05ecca3d829")
+	task.addGID("d2703803b52216d1")
+	task.infoHash = "09c4beba230a770051207d07a8fb76cf43477523"
+	data, err := json.Marshal(task)
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored, err := restoreTask(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mt, ok := restored.(*MagnetTask)
+	if !ok || len(mt.gids) != 2 || mt.infoHash != task.infoHash || mt.SourceURL != task.SourceURL {
+		t.Fatalf("unexpected restored task:%+v", restored)
+	}
+	// aria2c has the download restored from its session
+	server := newFakeAria2cServer(t, map[string]string{
+		"aria2.tellStatus": `{"gid":"d2703803b52216d1","status":"paused"}`,
+	}, nil)
+	if gid := mt.findAria2cDownload(newAria2cRPCClient(server.URL, "")); gid != "d2703803b52216d1" {
+		t.Fatalf("expect re-bind to the latest gid, got %s", gid)
+	}
+	server.Close()
+	// the gids are lost, the download is found by info hash
+	server = newFakeAria2cServer(t, map[string]string{
+		"aria2.tellActive":  `[{"gid":"0123456789abcdef","status":"active","infoHash":"09C4BEBA230A770051207D07A8FB76CF43477523"}]`,
+		"aria2.tellWaiting": `[]`,
+	}, nil)
+	defer server.Close()
+	if gid := mt.findAria2cDownload(newAria2cRPCClient(server.URL, "")); gid != "0123456789abcdef" || len(mt.gids) != 3 {
+		t.Fatalf("expect re-bind by info hash, got %s, gids:%v", gid, mt.gids)
+	}
+}
+
+func TestMagnetTask_ReattachAfterRestart(t *testing.T) {
+	const gid = "2089b05ecca3d829"
+	var mutex sync.Mutex
+	var adds int
+	var status = "active"
+	var restarting bool
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			ID     string            `json:"id"`
+			Method string            `json:"method"`
+			Params []json.RawMessage `json:"params"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		mutex.Lock()
+		defer mutex.Unlock()
+		result := `"OK"`
+		switch req.Method {
+		case "aria2.getVersion":
+			result = `{"version":"1.37.0"}`
+		case "aria2.addUri":
+			adds++
+			result = `"` + gid + `"`
+		case "aria2.tellActive", "aria2.tellWaiting":
+			result = "[]"
+		case "aria2.tellStatus", "system.multicall":
+			if restarting {
+				// the poll fails while aria2c is restarted
+				restarting = false
+				fmt.Fprintf(w, `{"id":"%s","jsonrpc":"2.0","error":{"code":1,"message":"connection refused"}}`, req.ID)
+				return
+			}
+			result = `{"gid":"` + gid + `","status":"` + status + `","totalLength":"100","completedLength":"100","files":[{"path":"/data/fdp/ubuntu.iso"}]}`
+			if req.Method == "system.multicall" {
+				result = "[[" + result + "]]"
+			}
+		}
+		fmt.Fprintf(w, `{"id":"%s","jsonrpc":"2.0","result":%s}`, req.ID, result)
+	}))
+	defer server.Close()
+	oldRPC, oldDir, oldSupervisor := *aria2cRPC, *aria2cDirFlag, aria2cSupervisor
+	*aria2cRPC, *aria2cDirFlag = server.URL, "/data/fdp"
+	supervisor := &Aria2cSupervisor{generation: 1, running: true}
+	aria2cSupervisor = supervisor
+	task := NewMagnetTask("magnet:?xt=urn:btih:09c4beba230a770051207d07a8fb76cf43477523")
+	done := make(chan error, 1)
+	go func() {
+		done <- task.Download(os.TempDir(), 1024, 10*time.Second)
+	}()
+	defer func() {
+		task.Cancel()
+		<-done
+		*aria2cRPC, *aria2cDirFlag, aria2cSupervisor = oldRPC, oldDir, oldSupervisor
+	}()
+	for i := 0; i < 100; i++ {
+		mutex.Lock()
+		added := adds
+		mutex.Unlock()
+		if added == 1 {
+			break
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	// aria2c is restarted and restores the download from its session with the same gid
+	supervisor.mutex.Lock()
+	supervisor.generation = 2
+	supervisor.mutex.Unlock()
+	mutex.Lock()
+	restarting, status = true, "complete"
+	mutex.Unlock()
+	aria2cMonitor.Notify("test", gid)
+	select {
+	case err := <-done:
+		done <- err
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expect the task completed after aria2c is restarted")
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	if adds != 1 || !task.IsCompleted() {
+		t.Fatalf("expect the restored download re-bound rather than added again, adds:%d", adds)
+	}
+}
+
+func TestMagnetTask_SelectFiles(t *testing.T) {
+	const metadataGID, torrentGID = "2089b05ecca3d829", "d2703803b52216d1"
+	var mutex sync.Mutex
+	var torrentStatus = `"status":"paused","totalLength":"300","completedLength":"0"`
+	var selectFile string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			ID     string            `json:"id"`
+			Method string            `json:"method"`
+			Params []json.RawMessage `json:"params"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		mutex.Lock()
+		defer mutex.Unlock()
+		result := `"OK"`
+		switch req.Method {
+		case "aria2.getVersion":
+			result = `{"version":"1.37.0"}`
+		case "aria2.addUri":
+			var options Aria2cOptions
+			json.Unmarshal(req.Params[1], &options)
+			if options.FollowTorrent != "mem" || options.PauseMetadata != "true" {
+				t.Errorf("expect metadata only options, got %+v", options)
+			}
+			result = `"` + metadataGID + `"`
+		case "aria2.tellActive":
+			result = `[]`
+		case "system.multicall":
+			var calls []Aria2cMethodCall
+			json.Unmarshal(req.Params[0], &calls)
+			selected := func(index string) string {
+				return fmt.Sprint(selectFile == "" || strings.Contains(","+selectFile+",", ","+index+","))
+			}
+			var results []string
+			for _, call := range calls {
+				if call.Params[0] == metadataGID {
+					results = append(results, `[{"gid":"`+metadataGID+`","status":"complete","followedBy":["`+torrentGID+`"],"files":[{"index":"1","path":"[METADATA]ubuntu"}]}]`)
+					continue
+				}
+				results = append(results, `[{"gid":"`+torrentGID+`",`+torrentStatus+`,"files":[`+
+					`{"index":"1","path":"/data/fdp/ubuntu/a.iso","length":"100","completedLength":"0","selected":"`+selected("1")+`"},`+
+					`{"index":"2","path":"/data/fdp/ubuntu/b.iso","length":"200","completedLength":"0","selected":"`+selected("2")+`"}]}]`)
+			}
+			result = "[" + strings.Join(results, ",") + "]"
+		case "aria2.changeOption":
+			var options Aria2cOptions
+			json.Unmarshal(req.Params[1], &options)
+			selectFile = options.SelectFile
+		case "aria2.unpause":
+			torrentStatus = `"status":"complete","totalLength":"200","completedLength":"200"`
+			result = `"` + torrentGID + `"`
+		case "aria2.tellStatus":
+			result = `{"status":"complete"}`
+		}
+		fmt.Fprintf(w, `{"id":"%s","jsonrpc":"2.0","result":%s}`, req.ID, result)
+	}))
+	defer server.Close()
+	oldRPC, oldDir, oldInterval := *aria2cRPC, *aria2cDirFlag, aria2cPollInterval
+	*aria2cRPC, *aria2cDirFlag, aria2cPollInterval = server.URL, "/data/fdp", time.Millisecond*50
+	defer func() {
+		*aria2cRPC, *aria2cDirFlag, aria2cPollInterval = oldRPC, oldDir, oldInterval
+	}()
+	task := NewMagnetTask("magnet:?xt=urn:btih:09c4beba230a770051207d07a8fb76cf43477523")
+	task.AwaitingSelection = true
+	done := make(chan error, 1)
+	go func() {
+		done <- task.Download(os.TempDir(), 1024, 10*time.Second)
+	}()
+	var err error
+	for i := 0; i < 100; i++ {
+		if err = task.SelectFiles([]int{2}); err == nil {
+			break
+		}
+		time.Sleep(time.Millisecond * 50)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	if selectFile != "2" || task.AwaitingSelection || task.FileName() != "ubuntu" {
+		t.Fatalf("unexpected selection:%s, task:%+v", selectFile, task.TaskInfo)
+	}
+	if len(task.Files) != 2 || task.Files[0].Selected || !task.Files[1].Selected || task.Files[1].Path != "ubuntu/b.iso" {
+		t.Fatalf("unexpected files:%+v", task.Files)
+	}
+}
+
+func TestMagnetTask_FollowedBy(t *testing.T) {
+	const metadataGID, torrentGID = "2089b05ecca3d829", "d2703803b52216d1"
+	var mutex sync.Mutex
+	var torrentPolls, added int
+	var metadataPolledAfterFollow bool
+	removed := make(map[string]bool)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			ID     string            `json:"id"`
+			Method string            `json:"method"`
+			Params []json.RawMessage `json:"params"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		mutex.Lock()
+		defer mutex.Unlock()
+		result := `"OK"`
+		switch req.Method {
+		case "aria2.getVersion":
+			result = `{"version":"1.37.0"}`
+		case "aria2.addUri":
+			added++
+			result = `"` + metadataGID + `"`
+		case "aria2.tellActive":
+			result = `[]`
+		case "aria2.removeDownloadResult":
+			var gid string
+			json.Unmarshal(req.Params[len(req.Params)-1], &gid)
+			removed[gid] = true
+		case "system.multicall":
+			var calls []Aria2cMethodCall
+			json.Unmarshal(req.Params[0], &calls)
+			var results []string
+			for _, call := range calls {
+				if call.Params[0] == metadataGID {
+					metadataPolledAfterFollow = metadataPolledAfterFollow || torrentPolls > 0
+					results = append(results, `[{"gid":"`+metadataGID+`","status":"complete","followedBy":["`+torrentGID+`"],"files":[{"index":"1","path":"[METADATA]ubuntu"}]}]`)
+					continue
+				}
+				// the followed download is finished on its second poll
+				status := "active"
+				if torrentPolls++; torrentPolls > 1 {
+					status = "complete"
+				}
+				results = append(results, `[{"gid":"`+torrentGID+`","status":"`+status+`","totalLength":"100","completedLength":"100","files":[{"index":"1","path":"/data/fdp/ubuntu/a.iso","length":"100","completedLength":"100","selected":"true"}]}]`)
+			}
+			result = "[" + strings.Join(results, ",") + "]"
+		case "aria2.tellStatus":
+			result = `{"status":"complete"}`
+		}
+		fmt.Fprintf(w, `{"id":"%s","jsonrpc":"2.0","result":%s}`, req.ID, result)
+	}))
+	defer server.Close()
+	oldRPC, oldDir, oldInterval := *aria2cRPC, *aria2cDirFlag, aria2cPollInterval
+	*aria2cRPC, *aria2cDirFlag, aria2cPollInterval = server.URL, "/data/fdp", time.Millisecond*50
+	defer func() {
+		*aria2cRPC, *aria2cDirFlag, aria2cPollInterval = oldRPC, oldDir, oldInterval
+	}()
+	task := NewMagnetTask("magnet:?xt=urn:btih:09c4beba230a770051207d07a8fb76cf43477523")
+	done := make(chan error, 1)
+	go func() {
+		done <- task.Download(os.TempDir(), 1024, 10*time.Second)
+	}()
+	// the monitor started by other tests may not poll periodically, both gids are notified until the task is done
+	var err error
+	for notified := false; !notified; {
+		select {
+		case err = <-done:
+			notified = true
+		case <-time.After(time.Millisecond * 20):
+			aria2cMonitor.Notify("test", metadataGID)
+			aria2cMonitor.Notify("test", torrentGID)
+		}
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	if metadataPolledAfterFollow || torrentPolls < 2 {
+		t.Fatalf("expect only the followed download polled, metadata polled:%v, torrent polls:%d", metadataPolledAfterFollow, torrentPolls)
+	}
+	if !task.IsCompleted() || task.FileName() != "ubuntu" {
+		t.Fatalf("unexpected task:%+v", task.TaskInfo)
+	}
+	// all the downloads of the chain are released
+	if !removed[metadataGID] || !removed[torrentGID] || added != 1 {
+		t.Fatalf("expect both downloads removed, got %v, added %d", removed, added)
+	}
+}
+
+func TestMagnetTask_CancelBeforeStart(t *testing.T) {
+	var added int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			ID     string `json:"id"`
+			Method string `json:"method"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		result := `"OK"`
+		switch req.Method {
+		case "aria2.getVersion":
+			result = `{"version":"1.37.0"}`
+		case "aria2.addUri":
+			atomic.AddInt32(&added, 1)
+			result = `"2089b05ecca3d829"`
+		case "aria2.tellActive":
+			result = `[]`
+		}
+		fmt.Fprintf(w, `{"id":"%s","jsonrpc":"2.0","result":%s}`, req.ID, result)
+	}))
+	defer server.Close()
+	oldRPC := *aria2cRPC
+	*aria2cRPC = server.URL
+	defer func() {
+		*aria2cRPC = oldRPC
+	}()
+	// the task is deleted before the download queue starts it
+	task := NewMagnetTask("magnet:?xt=urn:btih:09c4beba230a770051207d07a8fb76cf43477523")
+	task.Cancel()
+	if err := task.Download(os.TempDir(), 1024, 10*time.Second); err == nil || !strings.Contains(err.Error(), "canceled") {
+		t.Fatalf("expect the canceled task not started, got %v", err)
+	}
+	if atomic.LoadInt32(&added) != 0 {
+		t.Fatal("expect the canceled task not added to aria2c")
+	}
+}
@@ -0,0 +1,591 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/hanjm/log"
+	"net/http"
+	"net/url"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// the engines of http(s)/ftp url, chosen by the engine param of task
+const (
+	URLEngineNative = "native"
+	URLEngineAria2c = "aria2c"
+)
+
+// the bounds of the aria2c options of url, max-connection-per-server is limited to 16 by aria2c
+const (
+	aria2cMaxSplit                  = 64
+	aria2cMaxConnectionPerServerMax = 16
+)
+
+var aria2cHostFlags stringsFlag
+
+func init() {
+	flag.Var(&aria2cHostFlags, "aria2cHost", "the http(s)/ftp urls of the host are downloaded by aria2c, hostname[;split=N;max-connection-per-server=N;header=Name: value], .example.com matches the subdomains, can be set multiple times")
+}
+
+// aria2cHostRules are parsed from -aria2cHost, the first matching rule is used
+var aria2cHostRules []*Aria2cHostRule
+
+// Aria2cURIOptions are the options of the url downloaded by aria2c, the zero value means the default of aria2c
+type Aria2cURIOptions struct {
+	Split                  int      `json:",omitempty"`
+	MaxConnectionPerServer int      `json:",omitempty"`
+	Header                 []string `json:",omitempty"`
+}
+
+// Aria2cHostRule routes the urls of the host to aria2c with the options
+type Aria2cHostRule struct {
+	Host    string
+	Options Aria2cURIOptions
+}
+
+// ParseAria2cHostRule parses the rule like ".example.com;split=8;max-connection-per-server=8;header=Referer: https://example.com/"
+func ParseAria2cHostRule(rule string) (*Aria2cHostRule, error) {
+	parts := strings.Split(rule, ";")
+	host := strings.ToLower(strings.TrimPrefix(strings.TrimSpace(parts[0]), "*"))
+	if host == "" || strings.ContainsAny(host, "/: ") {
+		return nil, fmt.Errorf("invalid aria2c host rule %s:expect hostname", rule)
+	}
+	r := &Aria2cHostRule{Host: host}
+	for _, part := range parts[1:] {
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid aria2c host rule %s:expect option=value, got %s", rule, part)
+		}
+		if err := r.Options.set(strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1])); err != nil {
+			return nil, fmt.Errorf("invalid aria2c host rule %s:%s", rule, err)
+		}
+	}
+	return r, nil
+}
+
+// ParseAria2cHostRules parses the rules of -aria2cHost
+func ParseAria2cHostRules(rules []string) ([]*Aria2cHostRule, error) {
+	var list []*Aria2cHostRule
+	for _, rule := range rules {
+		r, err := ParseAria2cHostRule(rule)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, r)
+	}
+	return list, nil
+}
+
+// aria2cHostRuleOf returns the rule matching the host of url, nil if none matches
+func aria2cHostRuleOf(sourceURL string) *Aria2cHostRule {
+	u, err := url.Parse(sourceURL)
+	if err != nil {
+		return nil
+	}
+	for _, rule := range aria2cHostRules {
+		if matchHost([]string{rule.Host}, u.Hostname()) {
+			return rule
+		}
+	}
+	return nil
+}
+
+// the params of task and the aria2c options they set
+var aria2cURIParams = []struct{ param, option string }{
+	{"split", "split"},
+	{"maxConnectionPerServer", "max-connection-per-server"},
+	{"header", "header"},
+}
+
+// ParseAria2cURIOptions parses the aria2c options of the task params split, maxConnectionPerServer and header, header can be set multiple times
+func ParseAria2cURIOptions(values url.Values) (*Aria2cURIOptions, error) {
+	options := &Aria2cURIOptions{}
+	for _, p := range aria2cURIParams {
+		for _, v := range values[p.param] {
+			if v = strings.TrimSpace(v); v == "" {
+				continue
+			}
+			if err := options.set(p.option, v); err != nil {
+				return nil, fmt.Errorf("param %s is invalid:%s", p.param, err)
+			}
+		}
+	}
+	return options, nil
+}
+
+func (o *Aria2cURIOptions) set(option string, value string) error {
+	switch option {
+	case "split":
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 || n > aria2cMaxSplit {
+			return fmt.Errorf("split expect 1-%d, got %s", aria2cMaxSplit, value)
+		}
+		o.Split = n
+	case "max-connection-per-server":
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 || n > aria2cMaxConnectionPerServerMax {
+			return fmt.Errorf("max-connection-per-server expect 1-%d, got %s", aria2cMaxConnectionPerServerMax, value)
+		}
+		o.MaxConnectionPerServer = n
+	case "header":
+		if !isValidHeader(value) {
+			return fmt.Errorf("header expect 'Name: value', got %q", value)
+		}
+		o.Header = append(o.Header, value)
+	default:
+		return fmt.Errorf("unknown option %s, expect split, max-connection-per-server or header", option)
+	}
+	return nil
+}
+
+// isValidHeader reports whether the header is "Name: value" in one line
+func isValidHeader(header string) bool {
+	i := strings.Index(header, ":")
+	if i <= 0 || strings.ContainsAny(header, "\r\n") {
+		return false
+	}
+	return strings.IndexFunc(header[:i], func(r rune) bool {
+		return r <= ' ' || r >= 0x7f || strings.ContainsRune(`()<>@,;:\"/[]?={}`, r)
+	}) == -1
+}
+
+func (o *Aria2cURIOptions) empty() bool {
+	return o == nil || (o.Split == 0 && o.MaxConnectionPerServer == 0 && len(o.Header) == 0)
+}
+
+// merge returns the options overridden by the non-zero options of other, the headers are appended
+func (o Aria2cURIOptions) merge(other *Aria2cURIOptions) Aria2cURIOptions {
+	o.Header = append([]string(nil), o.Header...)
+	if other == nil {
+		return o
+	}
+	if other.Split > 0 {
+		o.Split = other.Split
+	}
+	if other.MaxConnectionPerServer > 0 {
+		o.MaxConnectionPerServer = other.MaxConnectionPerServer
+	}
+	o.Header = append(o.Header, other.Header...)
+	return o
+}
+
+// newURLTask creates the task of http(s)/ftp url. it is downloaded by aria2c if the engine is aria2c, the aria2c options are set,
+// or the url matches a -aria2cHost rule while the local aria2c is running, otherwise it is downloaded by HTTPTask or FTPTask
+func newURLTask(ctx context.Context, sourceURL string, engine string, options *Aria2cURIOptions) (Task, error) {
+	if err := urlPolicy.CheckURL(sourceURL); err != nil {
+		return nil, err
+	}
+	if err := egressPolicy.CheckURL(ctx, sourceURL); err != nil {
+		return nil, err
+	}
+	rule := aria2cHostRuleOf(sourceURL)
+	var useAria2c bool
+	switch engine {
+	case URLEngineAria2c:
+		// aria2c does not download ftps
+		if !isURLEngineSource(sourceURL) {
+			return nil, fmt.Errorf("aria2c downloads http(s)/ftp url only")
+		}
+		useAria2c = true
+	case URLEngineNative:
+	case "":
+		useAria2c = isURLEngineSource(sourceURL) && (!options.empty() || (rule != nil && isLocalAria2c() && IsAria2cRunning()))
+	default:
+		return nil, fmt.Errorf("engine expect native or aria2c, not %s", engine)
+	}
+	if useAria2c && !isLocalAria2c() {
+		// the connections of aria2c are checked by the egress policy through the proxy listening on the loopback address
+		return nil, fmt.Errorf("the aria2c engine needs aria2c running on this host, %s is not", *aria2cRPC)
+	}
+	if !useAria2c {
+		if !options.empty() {
+			return nil, fmt.Errorf("split, maxConnectionPerServer and header are the options of aria2c engine")
+		}
+		if isPresignedS3URL(sourceURL) {
+			// the presigned url of s3 is downloaded by the parallel ranges and verified by ETag
+			return NewS3Task(sourceURL)
+		}
+		if strings.HasPrefix(sourceURL, "http://") || strings.HasPrefix(sourceURL, "https://") {
+			return NewHTTPTask(sourceURL), nil
+		}
+		return NewFTPTask(sourceURL)
+	}
+	var merged Aria2cURIOptions
+	if rule != nil {
+		merged = rule.Options
+	}
+	return NewAria2cURITask(sourceURL, merged.merge(options)), nil
+}
+
+// isURLEngineSource reports whether the engine of the source url can be chosen
+func isURLEngineSource(sourceURL string) bool {
+	for _, scheme := range []string{"http://", "https://", "ftp://"} {
+		if strings.HasPrefix(sourceURL, scheme) {
+			return true
+		}
+	}
+	return false
+}
+
+// Aria2cURITask downloads the http(s)/ftp url by aria2.addUri, it looks like HTTPTask in the api
+type Aria2cURITask struct {
+	TaskType int
+	TaskInfo
+	// the options are not in TaskInfo, the headers may have credentials which are not pushed to the page
+	options Aria2cURIOptions
+	// downloadURL is the final url after the redirects checked by preflight, aria2c downloads it
+	downloadURL string
+	gid         string
+	canceled    bool
+	cancel      context.CancelFunc
+	done        chan struct{}
+	mutex       sync.Mutex
+}
+
+// aria2cURITaskRecord is the Aria2cURITask in the backup file, the gid is kept for aria2c's session
+type aria2cURITaskRecord struct {
+	TaskType int
+	TaskInfo
+	Options Aria2cURIOptions
+	GID     string `json:",omitempty"`
+}
+
+// MarshalJSON returns the task pushed to the page, the headers are not in it
+func (t *Aria2cURITask) MarshalJSON() ([]byte, error) {
+	t.mutex.Lock()
+	record := aria2cURITaskRecord{
+		TaskType: t.TaskType,
+		TaskInfo: t.TaskInfo,
+		Options:  t.options,
+		GID:      t.gid,
+	}
+	t.mutex.Unlock()
+	record.Options.Header = nil
+	return json.Marshal(&record)
+}
+
+// MarshalRecord returns the task in the backup file, the headers are kept for resuming
+func (t *Aria2cURITask) MarshalRecord() ([]byte, error) {
+	t.mutex.Lock()
+	record := aria2cURITaskRecord{
+		TaskType: t.TaskType,
+		TaskInfo: t.TaskInfo,
+		Options:  t.options,
+		GID:      t.gid,
+	}
+	t.mutex.Unlock()
+	return json.Marshal(&record)
+}
+
+func (t *Aria2cURITask) UnmarshalJSON(data []byte) error {
+	var record aria2cURITaskRecord
+	if err := json.Unmarshal(data, &record); err != nil {
+		return err
+	}
+	t.TaskType, t.TaskInfo, t.options, t.gid = record.TaskType, record.TaskInfo, record.Options, record.GID
+	return nil
+}
+
+func NewAria2cURITask(sourceURL string, options Aria2cURIOptions) *Aria2cURITask {
+	return &Aria2cURITask{
+		TaskType: DownloadTaskTypeHTTP,
+		TaskInfo: TaskInfo{
+			SourceURL: sourceURL,
+			FileName:  getSafeFilename(sourceURL),
+			Backend:   BackendAria2c,
+		},
+		options: options,
+	}
+}
+
+// aria2cOptions returns the options of the task's aria2c download, the file is named as HTTPTask names it.
+// aria2c connects through the egress proxy, so the redirects followed by aria2c are checked too
+func (t *Aria2cURITask) aria2cOptions(remoteDir string) (*Aria2cOptions, error) {
+	proxy, user, password, err := aria2cProxyOptions()
+	if err != nil {
+		return nil, err
+	}
+	options := &Aria2cOptions{
+		Dir:            remoteDir,
+		Out:            t.FileName(),
+		Header:         aria2cStrings(t.options.Header),
+		AllProxy:       proxy,
+		AllProxyUser:   user,
+		AllProxyPasswd: password,
+		ProxyMethod:    "tunnel",
+	}
+	if t.options.Split > 0 {
+		options.Split = strconv.Itoa(t.options.Split)
+	}
+	if t.options.MaxConnectionPerServer > 0 {
+		options.MaxConnectionPerServer = strconv.Itoa(t.options.MaxConnectionPerServer)
+	}
+	return options, nil
+}
+
+// preflight requests the http(s) url like HTTPTask, the redirects, status, content type and size are checked before aria2c downloads it.
+// the file is named by Content-Disposition, it returns the final url
+func (t *Aria2cURITask) preflight(ctx context.Context, limitByteSize int64) (string, error) {
+	if !strings.HasPrefix(t.SourceURL, "http://") && !strings.HasPrefix(t.SourceURL, "https://") {
+		// ftp is not redirected
+		return t.SourceURL, nil
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, t.SourceURL, nil)
+	if err != nil {
+		return "", fmt.Errorf("create request error:%s", err)
+	}
+	for _, header := range t.options.Header {
+		kv := strings.SplitN(header, ":", 2)
+		req.Header.Add(strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1]))
+	}
+	httpClient := &http.Client{
+		Transport: &http.Transport{
+			DialContext:         egressPolicy.DialContext,
+			TLSHandshakeTimeout: 20 * time.Second,
+		},
+		CheckRedirect: checkRedirect,
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		t.setViolations(err)
+		return "", fmt.Errorf("http.Client error:%s", err)
+	}
+	// only the headers are used, the connection is closed without reading the body
+	resp.Body.Close()
+	if resp.StatusCode >= http.StatusBadRequest {
+		return "", fmt.Errorf("the status of sourceUrl is %s", resp.Status)
+	}
+	if attachmentName := attachmentFilename(resp); attachmentName != "" {
+		t.TaskInfo.FileName = attachmentName
+	}
+	if err := urlPolicy.CheckResponse(resp, t.FileName()); err != nil {
+		t.setViolations(err)
+		return "", err
+	}
+	if resp.ContentLength > limitByteSize {
+		return "", fmt.Errorf("the content length of sourceUrl is too big:%d, limit:%d", resp.ContentLength, limitByteSize)
+	}
+	return resp.Request.URL.String(), nil
+}
+
+func (t *Aria2cURITask) Download(downloadDir string, limitByteSize int64, limitTimeout time.Duration) (err error) {
+	if !IsAria2cRunning() {
+		return t.Errorf("aria2c is not running, cannot download %s", t.SourceURL)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), limitTimeout)
+	defer cancel()
+	done := make(chan struct{})
+	defer close(done)
+	t.mutex.Lock()
+	t.cancel, t.done = cancel, done
+	canceled := t.canceled
+	t.mutex.Unlock()
+	if canceled {
+		// the task is deleted before it starts, it is not added to aria2c
+		return t.Errorf("task canceled")
+	}
+	aria2cRPCClient := NewAria2cRPCClient()
+	// the aria2c download is not left behind, the partial file is removed like the magnet task's
+	defer func() {
+		t.mutex.Lock()
+		gid := t.gid
+		t.gid = ""
+		removeFile := err != nil && (*aria2cCleanPartial || t.canceled)
+		t.mutex.Unlock()
+		if gid != "" {
+			removeAria2cDownload(aria2cRPCClient, gid)
+		}
+		if removeFile {
+			fs := NewConfinedFS(downloadDir)
+			for _, name := range []string{t.FileName(), t.FileName() + ".aria2"} {
+				if err := fs.RemoveAll(name); err != nil {
+					log.Warnf("[Aria2cURITask]remove %s error:%s", name, err)
+				}
+			}
+		}
+	}()
+	remoteDir := aria2cDir(downloadDir)
+	generation := aria2cGeneration()
+	t.mutex.Lock()
+	gid := t.gid
+	t.gid = ""
+	t.mutex.Unlock()
+	// the download restored from aria2c's session uses the proxy of the last run, it is re-added and continued from the .aria2 control file
+	if gid != "" {
+		removeAria2cDownload(aria2cRPCClient, gid)
+	}
+	downloadURL, err := t.preflight(ctx, limitByteSize)
+	if err != nil {
+		return t.Errorf("%s", err)
+	}
+	t.mutex.Lock()
+	t.downloadURL = downloadURL
+	t.mutex.Unlock()
+	if gid, err = t.addToAria2c(aria2cRPCClient, remoteDir); err != nil {
+		return t.Errorf("%s", err)
+	}
+	updates := make(chan *aria2cStatusUpdate, 1)
+	defer aria2cMonitor.Unsubscribe(updates)
+	aria2cMonitor.Subscribe(gid, updates)
+	log.Infof("create HTTP task by aria2c: source:%s filename:%s, taskGID:%s", t.SourceURL, t.FileName(), gid)
+	t.StartTime = time.Now()
+	for complete := false; !complete; {
+		select {
+		case update := <-updates:
+			if update.GID != gid {
+				continue
+			}
+			result, err := update.Result, update.Err
+			if err != nil {
+				if aria2cSupervisor == nil {
+					return t.Errorf("call aria2c TellStatus error:%s", err)
+				}
+				if current := aria2cGeneration(); current != generation && aria2cSupervisor.Running() {
+					log.Infof("aria2c is restarted, re-attach task:%s", t.SourceURL)
+					aria2cMonitor.Unsubscribe(updates)
+					// the download restored by aria2c from -aria2cSession is re-bound, adding it again conflicts with it,
+					// otherwise it is added again and continued from the .aria2 control file
+					if restoredGID := t.findAria2cDownload(aria2cRPCClient); restoredGID != "" {
+						gid = restoredGID
+					} else if gid, err = t.addToAria2c(aria2cRPCClient, remoteDir); err != nil {
+						return t.Errorf("%s", err)
+					}
+					aria2cMonitor.Subscribe(gid, updates)
+					generation = current
+				} else {
+					log.Warnf("call aria2c TellStatus error:%s, wait for aria2c is restarted", err)
+				}
+				continue
+			}
+			switch result.Status {
+			case "error":
+				return t.Errorf("%s", result.Err())
+			case "removed":
+				return t.Errorf("aria2c download is removed, taskGID:%s", gid)
+			}
+			if result.TotalLength > limitByteSize {
+				return t.Errorf("the content length of sourceUrl is too big:%d, limit:%d", result.TotalLength, limitByteSize)
+			}
+			complete = result.Completed()
+			t.TaskInfo.ContentLength = result.TotalLength
+			t.Size = result.CompletedLength
+			t.Duration = time.Now().Sub(t.StartTime)
+			t.Speed = result.DownloadSpeed
+			// aria2c renames the file if the name exists
+			if realFilename := topLevelPath(remoteDir, result.GetFilePath()); realFilename != "" {
+				t.TaskInfo.FileName = realFilename
+			}
+		case <-ctx.Done():
+			if ctx.Err() == context.DeadlineExceeded {
+				return t.Errorf("task timeout:%s", limitTimeout)
+			}
+			return t.Errorf("task canceled")
+		}
+	}
+	t.TaskInfo.IsCompleted = true
+	t.TaskInfo.ContentLength = t.Size
+	t.Duration = time.Now().Sub(t.StartTime)
+	t.Speed = calculateDownloadSpeed(t.Size, t.Duration)
+	log.Infof("complete HTTP task by aria2c: length:%s source:%s filename:%s, duration:%s", getHumanSizeString(t.TaskInfo.ContentLength), t.SourceURL, t.TaskInfo.FileName, t.Duration)
+	return nil
+}
+
+func (t *Aria2cURITask) addToAria2c(aria2cRPCClient *Aria2cRPCClient, remoteDir string) (string, error) {
+	options, err := t.aria2cOptions(remoteDir)
+	if err != nil {
+		return "", err
+	}
+	t.mutex.Lock()
+	downloadURL := t.downloadURL
+	t.mutex.Unlock()
+	gid, err := aria2cRPCClient.AddURI(downloadURL, options)
+	if err != nil {
+		return "", fmt.Errorf("call aria2c AddURI error:%s", err)
+	}
+	t.mutex.Lock()
+	t.gid = gid
+	t.mutex.Unlock()
+	return gid, nil
+}
+
+// findAria2cDownload returns the download of the task which aria2c still has, "" if aria2c does not have it.
+// the download is found by its gid, or by the download url if aria2c gives it another gid
+func (t *Aria2cURITask) findAria2cDownload(aria2cRPCClient *Aria2cRPCClient) string {
+	t.mutex.Lock()
+	gid, downloadURL := t.gid, t.downloadURL
+	t.mutex.Unlock()
+	if gid != "" {
+		result, err := aria2cRPCClient.TellStatus(gid)
+		if err == nil && result.Status != "removed" && result.Status != "error" {
+			return gid
+		}
+	}
+	active, err := aria2cRPCClient.TellActive()
+	if err != nil {
+		return ""
+	}
+	waiting, err := aria2cRPCClient.TellWaiting(0, 1000)
+	if err != nil {
+		return ""
+	}
+	for _, result := range append(active, waiting...) {
+		for _, file := range result.Files {
+			for _, uri := range file.URIs {
+				if uri["uri"] == downloadURL {
+					t.mutex.Lock()
+					t.gid = result.GID
+					t.mutex.Unlock()
+					return result.GID
+				}
+			}
+		}
+	}
+	return ""
+}
+
+// Cancel stops the downloading task and waits for its aria2c download is released, the partial file is removed
+func (t *Aria2cURITask) Cancel() {
+	t.mutex.Lock()
+	cancel, done := t.cancel, t.done
+	t.canceled = true
+	t.mutex.Unlock()
+	if cancel == nil {
+		return
+	}
+	cancel()
+	<-done
+}
+
+func (t *Aria2cURITask) infoMutex() *sync.Mutex {
+	return &t.mutex
+}
+
+func (t *Aria2cURITask) IsCompleted() bool {
+	return t.TaskInfo.IsCompleted
+}
+
+func (t *Aria2cURITask) FileName() string {
+	return t.TaskInfo.FileName
+}
+
+func (t *Aria2cURITask) ContentLength() int64 {
+	return t.TaskInfo.ContentLength
+}
+
+func (t *Aria2cURITask) Errorf(format string, a ...interface{}) (err error) {
+	err = fmt.Errorf(format, a...)
+	_, file, line, ok := runtime.Caller(1)
+	if ok {
+		log.Errorf("[%s:%d]%s", file, line, err.Error())
+	}
+	t.TaskInfo.IsError = true
+	t.TaskInfo.IsCompleted = true
+	t.TaskInfo.Error = err.Error()
+	return err
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParseAria2cHostRule(t *testing.T) {
+	rule, err := ParseAria2cHostRule("*.Example.com;split=8;max-connection-per-server=4;header=Referer: https://example.com/;header=X-Token: a=b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := &Aria2cHostRule{Host: ".example.com", Options: Aria2cURIOptions{Split: 8, MaxConnectionPerServer: 4, Header: []string{"Referer: https://example.com/", "X-Token: a=b"}}}
+	if !reflect.DeepEqual(rule, expect) {
+		t.Fatalf("unexpected rule:%+v", rule)
+	}
+	for _, invalid := range []string{"", "http://example.com", "example.com;split", "example.com;split=0", "example.com;max-connection-per-server=17",
+		"example.com;header=Referer", "example.com;header=Bad Name: 1", "example.com;dir=/tmp"} {
+		if _, err := ParseAria2cHostRule(invalid); err == nil {
+			t.Errorf("expect invalid rule:%s", invalid)
+		}
+	}
+	options, err := ParseAria2cURIOptions(url.Values{"split": {"2"}, "header": {"A: 1", " "}})
+	if err != nil || options.Split != 2 || len(options.Header) != 1 {
+		t.Fatalf("unexpected options:%+v %v", options, err)
+	}
+	if _, err := ParseAria2cURIOptions(url.Values{"header": {"A: 1\r\nB: 2"}}); err == nil {
+		t.Fatal("expect the header of multiple lines rejected")
+	}
+	if merged := expect.Options.merge(options); merged.Split != 2 || merged.MaxConnectionPerServer != 4 || len(merged.Header) != 3 || len(expect.Options.Header) != 2 {
+		t.Fatalf("unexpected merged options:%+v", merged)
+	}
+}
+
+// newFakeAria2cURIServer returns the aria2c which completes the uri download at once, it is polled when the task subscribes it
+func newFakeAria2cURIServer(t *testing.T) (*httptest.Server, func() *Aria2cOptions) {
+	const gid = "2089b05ecca3d829"
+	var mutex sync.Mutex
+	var added *Aria2cOptions
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			ID     string            `json:"id"`
+			Method string            `json:"method"`
+			Params []json.RawMessage `json:"params"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		mutex.Lock()
+		defer mutex.Unlock()
+		result := `"OK"`
+		switch req.Method {
+		case "aria2.getVersion":
+			result = `{"version":"1.37.0"}`
+		case "aria2.addUri":
+			added = &Aria2cOptions{}
+			json.Unmarshal(req.Params[1], added)
+			result = `"` + gid + `"`
+		case "aria2.tellActive":
+			result = `[]`
+		case "system.multicall":
+			result = `[[{"gid":"` + gid + `","status":"complete","totalLength":"100","completedLength":"100","files":[{"index":"1","path":"/data/fdp/` + added.Out + `"}]}]]`
+		case "aria2.tellStatus":
+			result = `{"gid":"` + gid + `","status":"complete"}`
+		}
+		fmt.Fprintf(w, `{"id":"%s","jsonrpc":"2.0","result":%s}`, req.ID, result)
+	}))
+	return server, func() *Aria2cOptions {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return added
+	}
+}
+
+func TestAria2cURITask(t *testing.T) {
+	server, added := newFakeAria2cURIServer(t)
+	defer server.Close()
+	// the url is requested before it is added to aria2c, the redirect is followed and the file is named by Content-Disposition
+	source := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/ubuntu.iso" {
+			http.Redirect(w, r, "/download?id=1", http.StatusFound)
+			return
+		}
+		if r.Header.Get("Referer") != "http://1.2.3.4/" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.Header().Set("Content-Disposition", "attachment; filename=ubuntu-24.04.iso")
+		w.Write(make([]byte, 100))
+	}))
+	defer source.Close()
+	policy, err := ParseEgressPolicy("127.0.0.0/8", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldRPC, oldDir, oldInterval, oldRules, oldPolicy := *aria2cRPC, *aria2cDirFlag, aria2cPollInterval, aria2cHostRules, egressPolicy
+	*aria2cRPC, *aria2cDirFlag, aria2cPollInterval, egressPolicy = server.URL, "/data/fdp", time.Millisecond*50, policy
+	aria2cHostRules = []*Aria2cHostRule{
+		{Host: "127.0.0.1", Options: Aria2cURIOptions{Split: 8, Header: []string{"Referer: http://1.2.3.4/"}}},
+		{Host: "1.2.3.4", Options: Aria2cURIOptions{Split: 8}},
+	}
+	defer func() {
+		*aria2cRPC, *aria2cDirFlag, aria2cPollInterval, aria2cHostRules, egressPolicy = oldRPC, oldDir, oldInterval, oldRules, oldPolicy
+	}()
+	// the url of host rule is downloaded by aria2c, the options of task are merged
+	task, err := NewDownloadTaskByEngine(source.URL+"/ubuntu.iso", "", &Aria2cURIOptions{MaxConnectionPerServer: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	uriTask, ok := task.(*Aria2cURITask)
+	if !ok || task.Info().Backend != BackendAria2c || uriTask.TaskType != DownloadTaskTypeHTTP {
+		t.Fatalf("expect aria2c task, got %T %+v", task, task.Info())
+	}
+	if err := task.Download(os.TempDir(), 1024, 10*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	options := added()
+	if !strings.HasSuffix(options.Out, "ubuntu-24.04.iso") || options.Dir != "/data/fdp" || options.Split != "8" || options.MaxConnectionPerServer != "4" || len(options.Header) != 1 {
+		t.Fatalf("unexpected aria2c options:%+v", options)
+	}
+	// aria2c connects through the egress proxy
+	if !strings.HasPrefix(options.AllProxy, "http://127.0.0.1:") || options.AllProxyPasswd == "" || options.ProxyMethod != "tunnel" {
+		t.Fatalf("unexpected aria2c proxy options:%+v", options)
+	}
+	if !task.IsCompleted() || task.Info().IsError || task.FileName() != options.Out || task.ContentLength() != 100 || task.Info().Size != 100 {
+		t.Fatalf("unexpected task:%+v", task.Info())
+	}
+	// the options are saved in the backup file, not in the task info
+	if data, _ := json.Marshal(task); strings.Contains(string(data), "Referer") {
+		t.Fatalf("expect the headers not pushed:%s", data)
+	}
+	data, err := marshalTaskRecord(task)
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored, err := restoreTask(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rt, ok := restored.(*Aria2cURITask); !ok || rt.options.Split != 8 || rt.options.MaxConnectionPerServer != 4 || len(rt.options.Header) != 1 || !rt.IsCompleted() {
+		t.Fatalf("unexpected restored task:%+v", restored)
+	}
+	// the response is checked by the url policy before aria2c downloads it
+	oldURLPolicy := urlPolicy
+	urlPolicy = &URLPolicy{MaxRedirects: 10, DenyExtensions: []string{".iso"}}
+	task, _ = NewDownloadTaskByEngine(source.URL+"/ubuntu.img", URLEngineAria2c, &Aria2cURIOptions{Header: []string{"Referer: http://1.2.3.4/"}})
+	source.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Disposition", "attachment; filename=ubuntu.iso")
+	})
+	err = task.Download(os.TempDir(), 1024, 10*time.Second)
+	urlPolicy = oldURLPolicy
+	if err == nil || len(task.Info().Violations) != 1 {
+		t.Fatalf("expect the response rejected by the url policy, got %v %+v", err, task.Info())
+	}
+	// the task deleted before it starts is not added to aria2c
+	options = added()
+	task, _ = NewDownloadTaskByEngine(source.URL+"/ubuntu.iso", URLEngineAria2c, nil)
+	task.(Canceler).Cancel()
+	if err := task.Download(os.TempDir(), 1024, 10*time.Second); err == nil || added() != options {
+		t.Fatalf("expect the canceled task not added, got %v", err)
+	}
+	// the native engine ignores the host rule
+	if task, err := NewDownloadTaskByEngine("http://1.2.3.4/ubuntu.iso", URLEngineNative, nil); err != nil || task.Info().Backend != BackendHTTP {
+		t.Fatalf("expect http task, got %+v %v", task, err)
+	}
+	if task, err := NewDownloadTask("ftp://1.2.3.4/ubuntu.iso"); err != nil || task.Info().Backend != BackendAria2c {
+		t.Fatalf("expect ftp downloaded by aria2c, got %+v %v", task, err)
+	}
+	if task, err := NewDownloadTaskByEngine("ftp://1.2.3.4/ubuntu.iso", URLEngineNative, nil); err != nil || task.Info().Backend != BackendFTP {
+		t.Fatalf("expect ftp task, got %+v %v", task, err)
+	}
+	// the url of other hosts is downloaded by HTTPTask unless aria2c is chosen
+	if task, err := NewDownloadTask("http://1.2.3.5/ubuntu.iso"); err != nil || task.Info().Backend != BackendHTTP {
+		t.Fatalf("expect http task, got %+v %v", task, err)
+	}
+	if task, err := NewDownloadTaskByEngine("http://1.2.3.5/ubuntu.iso", URLEngineAria2c, nil); err != nil || task.Info().Backend != BackendAria2c {
+		t.Fatalf("expect aria2c task, got %+v %v", task, err)
+	}
+	for _, invalid := range []struct {
+		url     string
+		engine  string
+		options *Aria2cURIOptions
+	}{
+		{"http://1.2.3.5/a", "curl", nil},
+		{"http://1.2.3.5/a", URLEngineNative, &Aria2cURIOptions{Split: 2}},
+		{"ftps://1.2.3.5/a", URLEngineAria2c, nil},
+		{"magnet:?xt=urn:btih:09c4beba230a770051207d07a8fb76cf43477523", URLEngineAria2c, nil},
+	} {
+		if _, err := NewDownloadTaskByEngine(invalid.url, invalid.engine, invalid.options); err == nil {
+			t.Errorf("expect %s by engine %q rejected", invalid.url, invalid.engine)
+		}
+	}
+	// the remote aria2c can not connect the egress proxy
+	*aria2cRPC = "http://192.168.1.2:6800/jsonrpc"
+	if _, err := NewDownloadTaskByEngine("http://1.2.3.5/ubuntu.iso", URLEngineAria2c, nil); err == nil {
+		t.Error("expect the aria2c engine rejected for the remote aria2c")
+	}
+	if task, err := NewDownloadTask("http://1.2.3.4/ubuntu.iso"); err != nil || task.Info().Backend != BackendHTTP {
+		t.Fatalf("expect http task for the remote aria2c, got %+v %v", task, err)
+	}
+}
+
+func TestAria2cURITask_FindAria2cDownload(t *testing.T) {
+	task := NewAria2cURITask("http://example.com/ubuntu.iso", Aria2cURIOptions{})
+	task.gid, task.downloadURL = "2089b05ecca3d829", "http://mirror.example.com/ubuntu.iso"
+	// aria2c has the download restored from its session
+	server := newFakeAria2cServer(t, map[string]string{
+		"aria2.tellStatus": `{"gid":"2089b05ecca3d829","status":"active"}`,
+	}, nil)
+	if gid := task.findAria2cDownload(newAria2cRPCClient(server.URL, "")); gid != "2089b05ecca3d829" {
+		t.Fatalf("expect re-bind to the gid, got %s", gid)
+	}
+	server.Close()
+	// the gid is not found, the download is found by its url
+	server = newFakeAria2cServer(t, map[string]string{
+		"aria2.tellActive":  `[{"gid":"0123456789abcdef","status":"active","files":[{"path":"/data/fdp/other.iso","uris":[{"uri":"http://example.com/other.iso","status":"used"}]}]}]`,
+		"aria2.tellWaiting": `[{"gid":"d2703803b52216d1","status":"paused","files":[{"path":"/data/fdp/ubuntu.iso","uris":[{"uri":"http://mirror.example.com/ubuntu.iso","status":"used"}]}]}]`,
+	}, nil)
+	if gid := task.findAria2cDownload(newAria2cRPCClient(server.URL, "")); gid != "d2703803b52216d1" || task.gid != gid {
+		t.Fatalf("expect re-bind by url, got %s", gid)
+	}
+	server.Close()
+	// aria2c does not have it, it is added again
+	server = newFakeAria2cServer(t, map[string]string{
+		"aria2.tellActive":  `[]`,
+		"aria2.tellWaiting": `[]`,
+	}, nil)
+	defer server.Close()
+	if gid := task.findAria2cDownload(newAria2cRPCClient(server.URL, "")); gid != "" {
+		t.Fatalf("expect no download, got %s", gid)
+	}
+}
+
+func TestEgressProxy(t *testing.T) {
+	target := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "ok")
+	}))
+	defer target.Close()
+	proxy := httptest.NewServer(&egressProxy{user: "fdp", password: "secret"})
+	defer proxy.Close()
+	get := func(user string) (string, error) {
+		proxyURL, _ := url.Parse(proxy.URL)
+		proxyURL.User = url.UserPassword(user, "secret")
+		transport := target.Client().Transport.(*http.Transport).Clone()
+		transport.Proxy = http.ProxyURL(proxyURL)
+		resp, err := (&http.Client{Transport: transport}).Get(target.URL)
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		data, err := ioutil.ReadAll(resp.Body)
+		return string(data), err
+	}
+	// the loopback address is denied by the default egress policy
+	if _, err := get("fdp"); err == nil {
+		t.Fatal("expect the loopback address denied")
+	}
+	policy, err := ParseEgressPolicy("127.0.0.0/8", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	withEgressPolicy(policy, func() {
+		if body, err := get("fdp"); err != nil || body != "ok" {
+			t.Fatalf("expect the tunnel, got %q %v", body, err)
+		}
+		if _, err := get("other"); err == nil {
+			t.Fatal("expect the proxy authentication required")
+		}
+		oldURLPolicy := urlPolicy
+		urlPolicy = &URLPolicy{DenyHosts: []string{"127.0.0.1"}}
+		defer func() {
+			urlPolicy = oldURLPolicy
+		}()
+		if _, err := get("fdp"); err == nil {
+			t.Fatal("expect the denied host rejected")
+		}
+	})
+}
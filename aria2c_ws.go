@@ -0,0 +1,164 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/websocket"
+	"github.com/hanjm/log"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// aria2cWSTransports shares one websocket connection for each aria2c rpc url
+var (
+	aria2cWSTransportsMutex sync.Mutex
+	aria2cWSTransports      = make(map[string]*aria2cWSTransport)
+)
+
+// aria2cWSTransport sends the json-rpc requests over aria2c's websocket, the responses are matched by request id
+type aria2cWSTransport struct {
+	url        string
+	seq        uint64
+	mutex      sync.Mutex
+	writeMutex sync.Mutex
+	conn       *websocket.Conn
+	pending    map[string]chan []byte
+}
+
+func getAria2cWSTransport(url string) *aria2cWSTransport {
+	aria2cWSTransportsMutex.Lock()
+	defer aria2cWSTransportsMutex.Unlock()
+	t, ok := aria2cWSTransports[url]
+	if !ok {
+		t = &aria2cWSTransport{
+			url:     url,
+			pending: make(map[string]chan []byte),
+		}
+		aria2cWSTransports[url] = t
+	}
+	return t
+}
+
+func (t *aria2cWSTransport) roundTrip(req *aria2cRPCRequest) (respData []byte, err error) {
+	const maxRetry = 3
+	for retry := 1; retry <= maxRetry; retry++ {
+		respData, err = t.call(req)
+		if err == nil {
+			return respData, nil
+		}
+		log.Warnf("[callAria2c]websocket %s, retry... %d/%d", err, retry, maxRetry)
+		time.Sleep(time.Second)
+	}
+	return nil, fmt.Errorf("[callAria2c]websocket %s, is aria2c process running? ", err)
+}
+
+func (t *aria2cWSTransport) call(req *aria2cRPCRequest) ([]byte, error) {
+	conn, err := t.connect()
+	if err != nil {
+		return nil, err
+	}
+	req.ID = strconv.FormatUint(atomic.AddUint64(&t.seq, 1), 10)
+	reqData, err := json.Marshal(req)
+	if err != nil {
+		return nil, fmt.Errorf("marshal rpc req to json error:%s", err)
+	}
+	respChan := make(chan []byte, 1)
+	t.mutex.Lock()
+	t.pending[req.ID] = respChan
+	t.mutex.Unlock()
+	defer func() {
+		t.mutex.Lock()
+		delete(t.pending, req.ID)
+		t.mutex.Unlock()
+	}()
+	t.writeMutex.Lock()
+	err = conn.WriteMessage(websocket.TextMessage, reqData)
+	t.writeMutex.Unlock()
+	if err != nil {
+		t.closeConn(conn)
+		return nil, fmt.Errorf("write error:%s", err)
+	}
+	select {
+	case respData, ok := <-respChan:
+		if !ok {
+			return nil, fmt.Errorf("connection closed")
+		}
+		return respData, nil
+	case <-time.After(time.Minute):
+		return nil, fmt.Errorf("wait response timeout")
+	}
+}
+
+func (t *aria2cWSTransport) connect() (*websocket.Conn, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.conn != nil {
+		return t.conn, nil
+	}
+	dialer := websocket.Dialer{HandshakeTimeout: 20 * time.Second}
+	conn, _, err := dialer.Dial(t.url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("dial error:%s", err)
+	}
+	t.conn = conn
+	go t.readLoop(conn)
+	return conn, nil
+}
+
+// readLoop dispatches the responses to the waiting requests
+func (t *aria2cWSTransport) readLoop(conn *websocket.Conn) {
+	defer func() {
+		if rec := recover(); rec != nil {
+			log.Errorf("[aria2cWSTransport]readLoop panic:%v", rec)
+		}
+	}()
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			log.Warnf("[aria2cWSTransport]read error:%s", err)
+			t.closeConn(conn)
+			return
+		}
+		var msg struct {
+			ID     string `json:"id"`
+			Method string `json:"method"`
+			Params []struct {
+				GID string `json:"gid"`
+			} `json:"params"`
+		}
+		if err := json.Unmarshal(data, &msg); err != nil {
+			log.Warnf("[aria2cWSTransport]unmarshal message error:%s", err)
+			continue
+		}
+		if msg.ID == "" {
+			// the notifications of aria2c have no id, like aria2.onDownloadComplete
+			for _, param := range msg.Params {
+				aria2cMonitor.Notify(msg.Method, param.GID)
+			}
+			continue
+		}
+		t.mutex.Lock()
+		respChan := t.pending[msg.ID]
+		delete(t.pending, msg.ID)
+		t.mutex.Unlock()
+		if respChan != nil {
+			respChan <- data
+		}
+	}
+}
+
+// closeConn closes the connection and fails its pending requests, the next request reconnects
+func (t *aria2cWSTransport) closeConn(conn *websocket.Conn) {
+	t.mutex.Lock()
+	if t.conn == conn {
+		t.conn = nil
+		for id, respChan := range t.pending {
+			close(respChan)
+			delete(t.pending, id)
+		}
+	}
+	t.mutex.Unlock()
+	conn.Close()
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Backend is the downloader of some kinds of source urls, like http or BitTorrent.
+// the backends are registered by RegisterBackend in init, NewDownloadTask and the backup file dispatch the tasks by them
+type Backend struct {
+	// Name is the serialization type tag, it is saved as TaskInfo.Backend in the backup file
+	Name string
+	// Schemes are the url schemes handled by the backend, like http and https
+	Schemes []string
+	// Detect reports whether the source is handled by the backend, for the source which has no scheme, like base64 of torrent
+	Detect func(sourceURL string) bool
+	// New creates the task of the source, the backend checks the url policies of the source
+	New func(ctx context.Context, sourceURL string) (Task, error)
+	// Restore returns the empty task to unmarshal the record of backup file into
+	Restore func() Task
+	// Resumable means the partial files are kept when the task is restarted, the backend resumes them
+	Resumable bool
+}
+
+var backends = struct {
+	mutex sync.RWMutex
+	list  []*Backend
+}{}
+
+// the backup file written before the registry tags the tasks by TaskType
+var legacyBackends = map[int]string{
+	DownloadTaskTypeHTTP:   BackendHTTP,
+	DownloadTaskTypeMagnet: BackendBitTorrent,
+}
+
+// RegisterBackend adds the backend to the registry, it panics if the name or a scheme is registered twice
+func RegisterBackend(b *Backend) {
+	backends.mutex.Lock()
+	defer backends.mutex.Unlock()
+	if b.Name == "" || b.New == nil || b.Restore == nil {
+		panic("backend expect name, New and Restore")
+	}
+	for _, v := range backends.list {
+		if v.Name == b.Name {
+			panic("backend is registered twice:" + b.Name)
+		}
+		for _, scheme := range b.Schemes {
+			if v.handlesScheme(scheme) {
+				panic(fmt.Sprintf("backend scheme %s is registered by %s", scheme, v.Name))
+			}
+		}
+	}
+	backends.list = append(backends.list, b)
+}
+
+// Backends returns the registered backends
+func Backends() []*Backend {
+	backends.mutex.RLock()
+	defer backends.mutex.RUnlock()
+	return append([]*Backend(nil), backends.list...)
+}
+
+func (b *Backend) handlesScheme(scheme string) bool {
+	for _, v := range b.Schemes {
+		if strings.EqualFold(v, scheme) {
+			return true
+		}
+	}
+	return false
+}
+
+// backendOf returns the backend of the source url, the scheme is matched before the detectors
+func backendOf(sourceURL string) *Backend {
+	list := Backends()
+	if i := strings.Index(sourceURL, ":"); i > 0 {
+		scheme := sourceURL[:i]
+		for _, b := range list {
+			if b.handlesScheme(scheme) {
+				return b
+			}
+		}
+	}
+	for _, b := range list {
+		if b.Detect != nil && b.Detect(sourceURL) {
+			return b
+		}
+	}
+	return nil
+}
+
+// backendByName returns the backend of the type tag
+func backendByName(name string) *Backend {
+	for _, b := range Backends() {
+		if b.Name == name {
+			return b
+		}
+	}
+	return nil
+}
+
+// backendOfTask returns the backend of the task, nil if the backend is not registered
+func backendOfTask(task Task) *Backend {
+	return backendByName(task.Info().Backend)
+}
+
+// supportedSources describes the sources of the registered backends for the error message
+func supportedSources() string {
+	var sources []string
+	for _, b := range Backends() {
+		sources = append(sources, b.Schemes...)
+		if b.Detect != nil {
+			sources = append(sources, b.Name)
+		}
+	}
+	sort.Strings(sources)
+	return strings.Join(sources, ", ")
+}
+
+// taskRecorder is the task whose record in the backup file has the secrets, like the password of url,
+// its MarshalJSON is the payload pushed to the page and returned by the trash api, which has no secret
+type taskRecorder interface {
+	MarshalRecord() ([]byte, error)
+}
+
+// marshalTaskRecord returns the record of task in the backup file and the trash, it is converted back by restoreTask
+func marshalTaskRecord(task Task) ([]byte, error) {
+	if r, ok := task.(taskRecorder); ok {
+		return r.MarshalRecord()
+	}
+	return json.Marshal(task)
+}
+
+// restoreTask converts the task record of backup file to the task of its backend
+func restoreTask(record json.RawMessage) (Task, error) {
+	var tag struct {
+		Backend  string
+		TaskType int
+	}
+	if err := json.Unmarshal(record, &tag); err != nil {
+		return nil, fmt.Errorf("json.Unmarshal task error:%s", err)
+	}
+	if tag.Backend == "" {
+		tag.Backend = legacyBackends[tag.TaskType]
+	}
+	b := backendByName(tag.Backend)
+	if b == nil {
+		return nil, fmt.Errorf("unknown task backend:%s, type:%d", tag.Backend, tag.TaskType)
+	}
+	task := b.Restore()
+	if err := json.Unmarshal(record, task); err != nil {
+		return nil, fmt.Errorf("json.Unmarshal %s task error:%s", b.Name, err)
+	}
+	task.Info().Backend = b.Name
+	return task, nil
+}
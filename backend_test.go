@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+// resetBackends replaces the registry by the list, the backends registered by the test are removed
+func resetBackends(list []*Backend) {
+	backends.mutex.Lock()
+	defer backends.mutex.Unlock()
+	backends.list = list
+}
+
+func TestBackendRegistry(t *testing.T) {
+	defer resetBackends(Backends())
+	RegisterBackend(&Backend{
+		Name:    "fake",
+		Schemes: []string{"fake"},
+		New: func(ctx context.Context, sourceURL string) (Task, error) {
+			task := NewHTTPTask(sourceURL)
+			task.TaskInfo.Backend = "fake"
+			return task, nil
+		},
+		Restore: func() Task {
+			return &HTTPTask{}
+		},
+		Resumable: true,
+	})
+	task, err := NewDownloadTask("FAKE://a/b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if backend := backendOfTask(task); backend == nil || backend.Name != "fake" || !backend.Resumable {
+		t.Fatalf("expect the task of fake backend, got %+v", task.Info())
+	}
+	if _, err := NewDownloadTask("gopher://a/b"); err == nil || !strings.Contains(err.Error(), "fake") || !strings.Contains(err.Error(), "magnet") {
+		t.Fatalf("expect the unknown scheme rejected, got %v", err)
+	}
+	if backend := backendOf(base64.StdEncoding.EncodeToString([]byte(testSingleFileTorrent))); backend == nil || backend.Name != BackendBitTorrent {
+		t.Fatal("expect the base64 torrent detected")
+	}
+	// the scheme can not be registered twice
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Fatal("expect panic of the duplicate scheme")
+			}
+		}()
+		RegisterBackend(&Backend{Name: "fake2", Schemes: []string{"http"}, New: newBitTorrentTask, Restore: func() Task { return &HTTPTask{} }})
+	}()
+	// the tasks are restored by the type tag, and the records written before the registry by TaskType
+	data, _ := json.Marshal(task)
+	restored, err := restoreTask(data)
+	if err != nil || restored.Info().Backend != "fake" || restored.Info().SourceURL != "FAKE://a/b" {
+		t.Fatalf("unexpected restored task:%+v %v", restored, err)
+	}
+	restored, err = restoreTask([]byte(`{"TaskType":1,"SourceURL":"magnet:?xt=urn:btih:09c4beba230a770051207d07a8fb76cf43477523"}`))
+	if _, ok := restored.(*MagnetTask); !ok || err != nil || restored.Info().Backend != BackendBitTorrent {
+		t.Fatalf("expect the legacy magnet task restored, got %+v %v", restored, err)
+	}
+	restored, err = restoreTask([]byte(`{"TaskType":0,"SourceURL":"http://a/b"}`))
+	if _, ok := restored.(*HTTPTask); !ok || err != nil || restored.Info().Backend != BackendHTTP {
+		t.Fatalf("expect the legacy http task restored, got %+v %v", restored, err)
+	}
+	if _, err := restoreTask([]byte(`{"Backend":"unknown"}`)); err == nil {
+		t.Fatal("expect the unknown backend rejected")
+	}
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strconv"
+)
+
+// the nesting depth of the torrent files is small, the deeper data is rejected
+const bencodeMaxDepth = 64
+
+// BencodeDecode decodes the bencoded data to string, int64, []interface{} and map[string]interface{},
+// the data must be exactly one value
+func BencodeDecode(data []byte) (interface{}, error) {
+	d := &bencodeDecoder{data: data}
+	v, err := d.decode()
+	if err != nil {
+		return nil, err
+	}
+	if d.pos != len(data) {
+		return nil, fmt.Errorf("bencode: %d bytes of trailing data", len(data)-d.pos)
+	}
+	return v, nil
+}
+
+// BencodeDecodePrefix decodes the first value of data and returns its length, the data after it is left to the caller,
+// like the piece appended to the dict of ut_metadata message
+func BencodeDecodePrefix(data []byte) (interface{}, int, error) {
+	d := &bencodeDecoder{data: data}
+	v, err := d.decode()
+	if err != nil {
+		return nil, 0, err
+	}
+	return v, d.pos, nil
+}
+
+// BencodeRawValue returns the raw bytes of the value of key in the top level dict,
+// the info hash is the hash of the raw info dict rather than the re-encoded one
+func BencodeRawValue(data []byte, key string) ([]byte, error) {
+	d := &bencodeDecoder{data: data, rawKey: key}
+	v, err := d.decode()
+	if err != nil {
+		return nil, err
+	}
+	if d.pos != len(data) {
+		return nil, fmt.Errorf("bencode: %d bytes of trailing data", len(data)-d.pos)
+	}
+	if _, ok := v.(map[string]interface{}); !ok || d.raw == nil {
+		return nil, fmt.Errorf("bencode: key %s is not found", key)
+	}
+	return d.raw, nil
+}
+
+type bencodeDecoder struct {
+	data  []byte
+	pos   int
+	depth int
+	// the raw value of rawKey in the top level dict
+	rawKey string
+	raw    []byte
+}
+
+func (d *bencodeDecoder) decode() (interface{}, error) {
+	if d.pos >= len(d.data) {
+		return nil, fmt.Errorf("bencode: unexpected end of data")
+	}
+	switch c := d.data[d.pos]; {
+	case c == 'i':
+		return d.decodeInt()
+	case c >= '0' && c <= '9':
+		return d.decodeString()
+	case c == 'l':
+		return d.decodeList()
+	case c == 'd':
+		return d.decodeDict()
+	default:
+		return nil, fmt.Errorf("bencode: invalid character %q at %d", c, d.pos)
+	}
+}
+
+func (d *bencodeDecoder) decodeInt() (int64, error) {
+	start := d.pos + 1
+	end := start
+	for end < len(d.data) && d.data[end] != 'e' {
+		end++
+	}
+	if end >= len(d.data) {
+		return 0, fmt.Errorf("bencode: unterminated integer at %d", d.pos)
+	}
+	s := string(d.data[start:end])
+	// leading zeros and -0 are not allowed
+	if s == "" || s == "-0" || (len(s) > 1 && s[0] == '0') || (len(s) > 2 && s[0] == '-' && s[1] == '0') {
+		return 0, fmt.Errorf("bencode: invalid integer %q at %d", s, d.pos)
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("bencode: invalid integer %q at %d", s, d.pos)
+	}
+	d.pos = end + 1
+	return n, nil
+}
+
+func (d *bencodeDecoder) decodeString() (string, error) {
+	colon := d.pos
+	for colon < len(d.data) && d.data[colon] != ':' {
+		colon++
+	}
+	if colon >= len(d.data) {
+		return "", fmt.Errorf("bencode: invalid string length at %d", d.pos)
+	}
+	s := string(d.data[d.pos:colon])
+	if len(s) > 1 && s[0] == '0' {
+		return "", fmt.Errorf("bencode: invalid string length %q at %d", s, d.pos)
+	}
+	length, err := strconv.Atoi(s)
+	if err != nil || length < 0 || length > len(d.data)-colon-1 {
+		return "", fmt.Errorf("bencode: invalid string length %q at %d", s, d.pos)
+	}
+	d.pos = colon + 1 + length
+	return string(d.data[colon+1 : d.pos]), nil
+}
+
+func (d *bencodeDecoder) decodeList() ([]interface{}, error) {
+	if d.depth++; d.depth > bencodeMaxDepth {
+		return nil, fmt.Errorf("bencode: nesting is too deep at %d", d.pos)
+	}
+	defer func() {
+		d.depth--
+	}()
+	d.pos++
+	list := []interface{}{}
+	for {
+		if d.pos >= len(d.data) {
+			return nil, fmt.Errorf("bencode: unterminated list")
+		}
+		if d.data[d.pos] == 'e' {
+			d.pos++
+			return list, nil
+		}
+		v, err := d.decode()
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, v)
+	}
+}
+
+func (d *bencodeDecoder) decodeDict() (map[string]interface{}, error) {
+	if d.depth++; d.depth > bencodeMaxDepth {
+		return nil, fmt.Errorf("bencode: nesting is too deep at %d", d.pos)
+	}
+	defer func() {
+		d.depth--
+	}()
+	d.pos++
+	dict := map[string]interface{}{}
+	for {
+		if d.pos >= len(d.data) {
+			return nil, fmt.Errorf("bencode: unterminated dict")
+		}
+		if d.data[d.pos] == 'e' {
+			d.pos++
+			return dict, nil
+		}
+		if c := d.data[d.pos]; c < '0' || c > '9' {
+			return nil, fmt.Errorf("bencode: dict key is not string at %d", d.pos)
+		}
+		key, err := d.decodeString()
+		if err != nil {
+			return nil, err
+		}
+		start := d.pos
+		v, err := d.decode()
+		if err != nil {
+			return nil, err
+		}
+		if d.depth == 1 && d.rawKey != "" && key == d.rawKey {
+			d.raw = d.data[start:d.pos]
+		}
+		dict[key] = v
+	}
+}
+
+// BencodeRaw is the bencoded value which is written as it is
+type BencodeRaw []byte
+
+// BencodeEncode encodes string, []byte, int, int64, []string, []interface{}, map[string]interface{} and BencodeRaw,
+// the keys of dict are sorted
+func BencodeEncode(v interface{}) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	if err := bencodeEncode(buf, v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func bencodeEncode(buf *bytes.Buffer, v interface{}) error {
+	switch v := v.(type) {
+	case string:
+		buf.WriteString(strconv.Itoa(len(v)))
+		buf.WriteByte(':')
+		buf.WriteString(v)
+	case []byte:
+		buf.WriteString(strconv.Itoa(len(v)))
+		buf.WriteByte(':')
+		buf.Write(v)
+	case int:
+		fmt.Fprintf(buf, "i%de", v)
+	case int64:
+		fmt.Fprintf(buf, "i%de", v)
+	case BencodeRaw:
+		buf.Write(v)
+	case []string:
+		buf.WriteByte('l')
+		for _, s := range v {
+			bencodeEncode(buf, s)
+		}
+		buf.WriteByte('e')
+	case []interface{}:
+		buf.WriteByte('l')
+		for _, e := range v {
+			if err := bencodeEncode(buf, e); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte('e')
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		buf.WriteByte('d')
+		for _, key := range keys {
+			bencodeEncode(buf, key)
+			if err := bencodeEncode(buf, v[key]); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte('e')
+	default:
+		return fmt.Errorf("bencode: unsupported type %T", v)
+	}
+	return nil
+}
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"github.com/hanjm/log"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var btDHTNodes = flag.String("btDHTNodes", "router.bittorrent.com:6881,dht.transmissionbt.com:6881,router.utorrent.com:6881",
+	"the comma separated bootstrap nodes of DHT, the native BitTorrent engine finds the peers of magnets and torrents by DHT, empty to disable DHT")
+
+var (
+	// the torrent looks up the peers by DHT again after the interval, or after the retry interval if no peer is found
+	btDHTInterval      = 15 * time.Minute
+	btDHTRetryInterval = time.Minute
+	btDHTQueryTimeout  = 5 * time.Second
+)
+
+const (
+	// the nodes queried in parallel, and the closest nodes which end the lookup once they are all queried
+	btDHTAlpha   = 8
+	btDHTClosest = 8
+	// a lookup stops after the queries
+	btDHTMaxQueries = 200
+	// the nodes learned by the lookups, they are queried before the bootstrap nodes
+	btDHTMaxNodes = 256
+	// the compact node info of BEP 5, the 20 bytes id and the 6 bytes address
+	btDHTNodeLength = 26
+)
+
+// btDHT is the read-only DHT node of BEP 5 and BEP 43, it finds the peers by get_peers and announces the port of engine
+// to the closest nodes. it does not answer the queries of other nodes, and the nodes are checked by the egress policy
+type btDHT struct {
+	conn      net.PacketConn
+	id        [20]byte
+	port      int
+	bootstrap []string
+
+	mutex        sync.Mutex
+	transactions map[string]*btDHTTransaction
+	next         uint16
+	// the nodes which responded, addr to id
+	nodes map[string][20]byte
+}
+
+type btDHTTransaction struct {
+	addr     string
+	response chan map[string]interface{}
+}
+
+// btDHTNode is the node found by the lookup
+type btDHTNode struct {
+	id   [20]byte
+	addr string
+}
+
+// newBTDHT listens on the udp port, port is the tcp port of engine announced to the nodes
+func newBTDHT(port int, bootstrap []string) (*btDHT, error) {
+	conn, err := net.ListenPacket("udp", ":"+strconv.Itoa(port))
+	if err != nil {
+		return nil, fmt.Errorf("listen DHT port error:%s", err)
+	}
+	d := &btDHT{
+		conn:         conn,
+		port:         port,
+		bootstrap:    bootstrap,
+		transactions: make(map[string]*btDHTTransaction),
+		nodes:        make(map[string][20]byte),
+	}
+	rand.Read(d.id[:])
+	go d.read()
+	return d, nil
+}
+
+// parseBTDHTNodes parses the comma separated host:port list of -btDHTNodes
+func parseBTDHTNodes(nodes string) []string {
+	var list []string
+	for _, node := range strings.Split(nodes, ",") {
+		if node = strings.TrimSpace(node); node != "" {
+			list = append(list, node)
+		}
+	}
+	return list
+}
+
+func (d *btDHT) Close() {
+	d.conn.Close()
+}
+
+// read dispatches the responses to the queries, the queries of other nodes are ignored
+func (d *btDHT) read() {
+	buf := make([]byte, 65536)
+	for {
+		n, addr, err := d.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		v, err := BencodeDecode(buf[:n])
+		if err != nil {
+			continue
+		}
+		msg, ok := v.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		tid, _ := msg["t"].(string)
+		if y, _ := msg["y"].(string); y != "r" && y != "e" {
+			continue
+		}
+		d.mutex.Lock()
+		tx := d.transactions[tid]
+		// the response must come from the queried node
+		if tx != nil && tx.addr == addr.String() {
+			delete(d.transactions, tid)
+		} else {
+			tx = nil
+		}
+		d.mutex.Unlock()
+		if tx != nil {
+			tx.response <- msg
+		}
+	}
+}
+
+// query sends the query to the node and waits for its response, the address is checked by the egress policy
+func (d *btDHT) query(ctx context.Context, addr string, method string, args map[string]interface{}) (map[string]interface{}, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	ips, err := egressPolicy.resolve(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	udpAddr, err := net.ResolveUDPAddr("udp", net.JoinHostPort(ips[0].String(), port))
+	if err != nil {
+		return nil, err
+	}
+	args["id"] = string(d.id[:])
+	tx := &btDHTTransaction{addr: udpAddr.String(), response: make(chan map[string]interface{}, 1)}
+	d.mutex.Lock()
+	d.next++
+	tid := string([]byte{byte(d.next >> 8), byte(d.next)})
+	d.transactions[tid] = tx
+	d.mutex.Unlock()
+	defer func() {
+		d.mutex.Lock()
+		delete(d.transactions, tid)
+		d.mutex.Unlock()
+	}()
+	// ro tells the nodes not to add this node to their routing tables
+	packet, err := BencodeEncode(map[string]interface{}{"t": tid, "y": "q", "q": method, "a": args, "ro": 1})
+	if err != nil {
+		return nil, err
+	}
+	if _, err := d.conn.WriteTo(packet, udpAddr); err != nil {
+		return nil, err
+	}
+	timer := time.NewTimer(btDHTQueryTimeout)
+	defer timer.Stop()
+	select {
+	case msg := <-tx.response:
+		if e, ok := msg["e"].([]interface{}); ok {
+			return nil, fmt.Errorf("DHT node %s error:%v", addr, e)
+		}
+		r, ok := msg["r"].(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("invalid DHT response of %s", addr)
+		}
+		return r, nil
+	case <-timer.C:
+		return nil, fmt.Errorf("DHT node %s timeout", addr)
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// GetPeers looks up the peers of info hash from the closest nodes, the port is announced to them if announce is set
+func (d *btDHT) GetPeers(ctx context.Context, infoHash [20]byte, announce bool) []string {
+	d.mutex.Lock()
+	candidates := make([]btDHTNode, 0, len(d.nodes))
+	for addr, id := range d.nodes {
+		candidates = append(candidates, btDHTNode{id: id, addr: addr})
+	}
+	d.mutex.Unlock()
+	sortBTDHTNodes(candidates, infoHash)
+	// the bootstrap nodes have no id, they are queried first if no node is known
+	if len(candidates) < btDHTClosest {
+		for _, addr := range d.bootstrap {
+			candidates = append([]btDHTNode{{addr: addr}}, candidates...)
+		}
+	}
+	queried := make(map[string]bool)
+	tokens := make(map[string]string)
+	seen := make(map[string]bool)
+	var peers []string
+	var mutex sync.Mutex
+	for queries := 0; queries < btDHTMaxQueries && ctx.Err() == nil; {
+		// the closest nodes which are not queried
+		var batch []btDHTNode
+		for i, node := range candidates {
+			if i >= btDHTClosest+len(d.bootstrap) || len(batch) >= btDHTAlpha {
+				break
+			}
+			if !queried[node.addr] {
+				queried[node.addr] = true
+				batch = append(batch, node)
+			}
+		}
+		if len(batch) == 0 {
+			break
+		}
+		queries += len(batch)
+		var found []btDHTNode
+		var wg sync.WaitGroup
+		for _, node := range batch {
+			wg.Add(1)
+			go func(node btDHTNode) {
+				defer wg.Done()
+				r, err := d.query(ctx, node.addr, "get_peers", map[string]interface{}{"info_hash": string(infoHash[:])})
+				if err != nil {
+					log.Debugf("[btDHT]get_peers %s error:%s", node.addr, err)
+					return
+				}
+				d.addNode(node.addr, r)
+				mutex.Lock()
+				defer mutex.Unlock()
+				if token, ok := r["token"].(string); ok {
+					tokens[node.addr] = token
+				}
+				if values, ok := r["values"].([]interface{}); ok {
+					for _, v := range values {
+						if compact, ok := v.(string); ok {
+							for _, peer := range parseCompactPeers([]byte(compact), net.IPv4len) {
+								if !seen[peer] {
+									seen[peer] = true
+									peers = append(peers, peer)
+								}
+							}
+						}
+					}
+				}
+				if nodes, ok := r["nodes"].(string); ok {
+					found = append(found, parseBTDHTNodes26([]byte(nodes))...)
+				}
+			}(node)
+		}
+		wg.Wait()
+		for _, node := range found {
+			if !queried[node.addr] {
+				candidates = append(candidates, node)
+			}
+		}
+		sortBTDHTNodes(candidates, infoHash)
+	}
+	if announce {
+		d.announce(ctx, infoHash, candidates, tokens)
+	}
+	return peers
+}
+
+// announce tells the closest nodes which gave the tokens that the engine has the torrent
+func (d *btDHT) announce(ctx context.Context, infoHash [20]byte, nodes []btDHTNode, tokens map[string]string) {
+	var wg sync.WaitGroup
+	announced := 0
+	for _, node := range nodes {
+		token, ok := tokens[node.addr]
+		if !ok || announced >= btDHTClosest {
+			continue
+		}
+		announced++
+		wg.Add(1)
+		go func(addr string, token string) {
+			defer wg.Done()
+			args := map[string]interface{}{"info_hash": string(infoHash[:]), "port": d.port, "token": token}
+			if _, err := d.query(ctx, addr, "announce_peer", args); err != nil {
+				log.Debugf("[btDHT]announce_peer %s error:%s", addr, err)
+			}
+		}(node.addr, token)
+	}
+	wg.Wait()
+}
+
+// addNode remembers the node which responded
+func (d *btDHT) addNode(addr string, r map[string]interface{}) {
+	id, ok := r["id"].(string)
+	if !ok || len(id) != 20 {
+		return
+	}
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if _, ok := d.nodes[addr]; !ok && len(d.nodes) >= btDHTMaxNodes {
+		return
+	}
+	var nodeID [20]byte
+	copy(nodeID[:], id)
+	d.nodes[addr] = nodeID
+}
+
+// parseBTDHTNodes26 parses the compact node info of "nodes"
+func parseBTDHTNodes26(data []byte) []btDHTNode {
+	var nodes []btDHTNode
+	for i := 0; i+btDHTNodeLength <= len(data); i += btDHTNodeLength {
+		port := binary.BigEndian.Uint16(data[i+24 : i+26])
+		if port == 0 {
+			continue
+		}
+		node := btDHTNode{addr: net.JoinHostPort(net.IP(data[i+20:i+24]).String(), strconv.Itoa(int(port)))}
+		copy(node.id[:], data[i:i+20])
+		nodes = append(nodes, node)
+	}
+	return nodes
+}
+
+// sortBTDHTNodes sorts the nodes by the xor distance to the target, the nodes without id are kept first
+func sortBTDHTNodes(nodes []btDHTNode, target [20]byte) {
+	var zero [20]byte
+	distance := func(id [20]byte) []byte {
+		d := make([]byte, 20)
+		for i := range d {
+			d[i] = id[i] ^ target[i]
+		}
+		return d
+	}
+	sort.SliceStable(nodes, func(i, j int) bool {
+		if nodes[i].id == zero || nodes[j].id == zero {
+			return nodes[i].id == zero && nodes[j].id != zero
+		}
+		return bytes.Compare(distance(nodes[i].id), distance(nodes[j].id)) < 0
+	})
+}
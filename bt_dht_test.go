@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeDHTNode answers get_peers by its nodes and peers, and records the queries
+type fakeDHTNode struct {
+	conn  net.PacketConn
+	id    [20]byte
+	nodes []byte
+	peers []string
+	mutex sync.Mutex
+	// the methods of the queries received
+	queries []string
+	tokens  []string
+}
+
+func newFakeDHTNode(t *testing.T, nodes []byte, peers []string) *fakeDHTNode {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := &fakeDHTNode{conn: conn, nodes: nodes, peers: peers}
+	rand.Read(n.id[:])
+	go func() {
+		buf := make([]byte, 65536)
+		for {
+			size, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			v, _ := BencodeDecode(buf[:size])
+			msg, _ := v.(map[string]interface{})
+			args, _ := msg["a"].(map[string]interface{})
+			method, _ := msg["q"].(string)
+			n.mutex.Lock()
+			n.queries = append(n.queries, method)
+			if token, ok := args["token"].(string); ok {
+				n.tokens = append(n.tokens, token)
+			}
+			n.mutex.Unlock()
+			r := map[string]interface{}{"id": string(n.id[:])}
+			if method == "get_peers" {
+				r["token"] = "token-" + addr.String()
+				r["nodes"] = string(n.nodes)
+				var values []interface{}
+				for _, peer := range n.peers {
+					values = append(values, string(compactAddr(peer)))
+				}
+				if len(values) > 0 {
+					r["values"] = values
+				}
+			}
+			data, _ := BencodeEncode(map[string]interface{}{"t": msg["t"], "y": "r", "r": r})
+			conn.WriteTo(data, addr)
+		}
+	}()
+	return n
+}
+
+func (n *fakeDHTNode) Addr() string {
+	return n.conn.LocalAddr().String()
+}
+
+// compactInfo is the compact node info of the node which is returned to the other nodes
+func (n *fakeDHTNode) compactInfo() []byte {
+	return append(append([]byte{}, n.id[:]...), compactAddr(n.Addr())...)
+}
+
+func (n *fakeDHTNode) Queries() (queries []string, tokens []string) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	return append(queries, n.queries...), append(tokens, n.tokens...)
+}
+
+func compactAddr(addr string) []byte {
+	tcpAddr, _ := net.ResolveTCPAddr("tcp", addr)
+	data := make([]byte, 6)
+	copy(data, tcpAddr.IP.To4())
+	binary.BigEndian.PutUint16(data[4:], uint16(tcpAddr.Port))
+	return data
+}
+
+func TestBTDHT_GetPeers(t *testing.T) {
+	// the bootstrap node returns the node which knows the peers
+	closest := newFakeDHTNode(t, nil, []string{"127.0.0.2:6881", "127.0.0.3:6882"})
+	defer closest.conn.Close()
+	bootstrap := newFakeDHTNode(t, closest.compactInfo(), nil)
+	defer bootstrap.conn.Close()
+	d, err := newBTDHT(0, []string{bootstrap.Addr()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	var infoHash [20]byte
+	rand.Read(infoHash[:])
+
+	setEgressPolicy(t, "", "")
+	if peers := d.GetPeers(context.Background(), infoHash, true); len(peers) != 0 {
+		t.Fatalf("expect the loopback nodes denied, got %v", peers)
+	}
+	if queries, _ := bootstrap.Queries(); len(queries) != 0 {
+		t.Fatalf("expect the denied node not queried, got %v", queries)
+	}
+	setEgressPolicy(t, "127.0.0.0/8", "")
+	peers := d.GetPeers(context.Background(), infoHash, true)
+	if strings.Join(peers, ",") != "127.0.0.2:6881,127.0.0.3:6882" {
+		t.Fatalf("unexpected peers:%v", peers)
+	}
+	// the torrent is announced to the nodes by their tokens
+	queries, tokens := closest.Queries()
+	if strings.Join(queries, ",") != "get_peers,announce_peer" || len(tokens) != 1 || !strings.HasPrefix(tokens[0], "token-") {
+		t.Fatalf("unexpected queries of the closest node:%v %v", queries, tokens)
+	}
+	// the nodes which responded are queried rather than the bootstrap nodes again
+	d.mutex.Lock()
+	known := len(d.nodes)
+	d.mutex.Unlock()
+	if known != 2 {
+		t.Fatalf("expect 2 nodes remembered, got %d", known)
+	}
+}
+
+func TestBTEngine_DHT(t *testing.T) {
+	setEgressPolicy(t, "127.0.0.0/8", "")
+	setFlag(t, "btDHTNodes", "")
+	dir, err := ioutil.TempDir("", "fdp-dht")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	content := make([]byte, 50000)
+	rand.Read(content)
+	seederDir, leecherDir := filepath.Join(dir, "seeder"), filepath.Join(dir, "leecher")
+	os.MkdirAll(seederDir, 0777)
+	os.MkdirAll(leecherDir, 0777)
+	if err := ioutil.WriteFile(filepath.Join(seederDir, "a.bin"), content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	_, info, err := MakeTorrent(NewConfinedFS(seederDir), "a.bin", MakeTorrentOptions{PieceLength: 16384})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var infoHash [20]byte
+	hash, _ := hex.DecodeString(info.InfoHash)
+	copy(infoHash[:], hash)
+	// the seeder has no tracker and no DHT, the leecher finds it by the DHT node only
+	seeder, err := NewBTEngine(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer seeder.Close()
+	seed, err := seeder.AddTorrent(infoHash, info, seederDir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seed.Select([]bool{true})
+	seed.Start()
+	node := newFakeDHTNode(t, nil, []string{net.JoinHostPort("127.0.0.1", strconv.Itoa(seeder.Port()))})
+	defer node.conn.Close()
+	setFlag(t, "btDHTNodes", node.Addr())
+	leecher, err := NewBTEngine(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer leecher.Close()
+	if leecher.dht == nil {
+		t.Fatal("expect DHT enabled")
+	}
+	leech, err := leecher.AddTorrent(infoHash, nil, leecherDir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leech.Start()
+	select {
+	case <-leech.GotInfo():
+	case <-time.After(10 * time.Second):
+		t.Fatal("timeout fetching the metadata from the peer found by DHT")
+	}
+	leech.Select([]bool{true})
+	select {
+	case <-leech.Completed():
+	case <-time.After(10 * time.Second):
+		t.Fatal("timeout downloading from the peer found by DHT")
+	}
+	if data, err := ioutil.ReadFile(filepath.Join(leecherDir, "a.bin")); err != nil || !bytes.Equal(data, content) {
+		t.Fatalf("unexpected content:%v", err)
+	}
+}
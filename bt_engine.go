@@ -0,0 +1,1395 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"github.com/hanjm/log"
+	"net"
+	"os"
+	"path"
+	"sync"
+	"time"
+)
+
+var (
+	btEngineFlag = flag.String("btEngine", BTEngineAria2c, "the engine of torrent tasks, aria2c, native(the in-process engine, aria2c is not needed) or auto(native if aria2c is not running)")
+	btPort       = flag.Int("btPort", 6881, "the listen port of the native BitTorrent engine, 0 means random")
+)
+
+const (
+	BTEngineAria2c = "aria2c"
+	BTEngineNative = "native"
+	BTEngineAuto   = "auto"
+)
+
+const (
+	btMaxPeers = 50
+	// the requests sent to a peer before their blocks are received
+	btPipeline = 16
+	// the pieces missing from the other peers are requested from 2 peers at most at the end of download
+	btEndgamePeers = 2
+	// the peer which sends the corrupted pieces is disconnected
+	btMaxBadPieces  = 3
+	btClientVersion = "file_download_proxy"
+)
+
+var (
+	btDialTimeout    = 10 * time.Second
+	btPeerTimeout    = 3 * time.Minute
+	btRequestTimeout = 30 * time.Second
+	btKeepAlive      = 2 * time.Minute
+	// the torrent is removed after the stopped announce, it is not waited longer
+	btStoppedTimeout = 3 * time.Second
+)
+
+var errBTChoked = fmt.Errorf("choked by peer")
+
+// useNativeBTEngine reports whether the new torrent tasks are downloaded by the native engine
+func useNativeBTEngine() bool {
+	switch *btEngineFlag {
+	case BTEngineNative:
+		return true
+	case BTEngineAuto:
+		return !IsAria2cRunning()
+	}
+	return false
+}
+
+// BTEngine is the in-process BitTorrent engine, it downloads and seeds the torrents by the peer wire protocol,
+// the torrents share the listener and the peer id
+type BTEngine struct {
+	peerID   [20]byte
+	listener net.Listener
+	port     int
+	// nil if DHT is disabled
+	dht      *btDHT
+	mutex    sync.Mutex
+	torrents map[[20]byte]*btTorrent
+}
+
+// the engine of the native torrent tasks, it is started by the first task
+var btEngine struct {
+	once   sync.Once
+	engine *BTEngine
+	err    error
+}
+
+func getBTEngine() (*BTEngine, error) {
+	btEngine.once.Do(func() {
+		btEngine.engine, btEngine.err = NewBTEngine(*btPort)
+	})
+	return btEngine.engine, btEngine.err
+}
+
+// NewBTEngine listens on the port for the incoming peers, 0 means random
+func NewBTEngine(port int) (*BTEngine, error) {
+	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		return nil, fmt.Errorf("listen BitTorrent port error:%s", err)
+	}
+	e := &BTEngine{
+		listener: listener,
+		port:     listener.Addr().(*net.TCPAddr).Port,
+		torrents: make(map[[20]byte]*btTorrent),
+	}
+	// Azureus-style peer id, FD is Free Download Manager, fdp is FP
+	copy(e.peerID[:], "-FP0100-")
+	rand.Read(e.peerID[8:])
+	if bootstrap := parseBTDHTNodes(*btDHTNodes); len(bootstrap) > 0 {
+		if e.dht, err = newBTDHT(e.port, bootstrap); err != nil {
+			log.Warnf("DHT is disabled:%s", err)
+		}
+	}
+	go e.accept()
+	log.Infof("BitTorrent engine listens on port %d", e.port)
+	return e, nil
+}
+
+func (e *BTEngine) Port() int {
+	return e.port
+}
+
+// Close stops the listener and all the torrents
+func (e *BTEngine) Close() {
+	e.listener.Close()
+	if e.dht != nil {
+		e.dht.Close()
+	}
+	e.mutex.Lock()
+	torrents := e.torrents
+	e.torrents = make(map[[20]byte]*btTorrent)
+	e.mutex.Unlock()
+	for _, t := range torrents {
+		t.close()
+	}
+}
+
+func (e *BTEngine) accept() {
+	for {
+		conn, err := e.listener.Accept()
+		if err != nil {
+			return
+		}
+		go e.handleIncoming(conn)
+	}
+}
+
+// handleIncoming routes the incoming peer to its torrent by the info hash of handshake
+func (e *BTEngine) handleIncoming(conn net.Conn) {
+	conn.SetDeadline(time.Now().Add(btDialTimeout))
+	h, err := readBTHandshake(conn)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	e.mutex.Lock()
+	t := e.torrents[h.InfoHash]
+	e.mutex.Unlock()
+	if t == nil || h.PeerID == e.peerID {
+		conn.Close()
+		return
+	}
+	if err := writeBTHandshake(conn, btHandshake{InfoHash: h.InfoHash, PeerID: e.peerID, Extended: true}); err != nil {
+		conn.Close()
+		return
+	}
+	conn.SetDeadline(time.Time{})
+	t.addPeer(conn, conn.RemoteAddr().String(), h)
+}
+
+// AddTorrent adds the torrent whose files are in dir, info is nil for the magnet whose metadata is fetched from the peers.
+// the torrent is started by Start, and downloads the pieces of the files chosen by Select
+func (e *BTEngine) AddTorrent(infoHash [20]byte, info *TorrentInfo, dir string, trackers []string) (*btTorrent, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	t := &btTorrent{
+		engine:      e,
+		infoHash:    infoHash,
+		fs:          NewConfinedFS(dir),
+		trackers:    trackers,
+		ctx:         ctx,
+		cancel:      cancel,
+		gotInfo:     make(chan struct{}),
+		completed:   make(chan struct{}),
+		downloading: make(map[int]int),
+		peers:       make(map[*btPeer]bool),
+		dialed:      make(map[string]bool),
+		trackerErrs: make(map[string]*SwarmTracker),
+	}
+	if info != nil {
+		if err := t.setInfo(info); err != nil {
+			cancel()
+			return nil, err
+		}
+	}
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if _, ok := e.torrents[infoHash]; ok {
+		cancel()
+		return nil, fmt.Errorf("the torrent %x is downloading", infoHash)
+	}
+	e.torrents[infoHash] = t
+	return t, nil
+}
+
+// RemoveTorrent stops the torrent and closes its peers and files
+func (e *BTEngine) RemoveTorrent(t *btTorrent) {
+	e.mutex.Lock()
+	if e.torrents[t.infoHash] == t {
+		delete(e.torrents, t.infoHash)
+	}
+	e.mutex.Unlock()
+	t.close()
+}
+
+// btTorrent is the torrent in the engine
+type btTorrent struct {
+	engine   *BTEngine
+	infoHash [20]byte
+	fs       *ConfinedFS
+	trackers []string
+	ctx      context.Context
+	cancel   context.CancelFunc
+	// closed when the metadata is known
+	gotInfo chan struct{}
+	// closed when the selected files are completed at the first time
+	completed chan struct{}
+	// the goroutines of peers and trackers, the files are closed after they exit
+	wg sync.WaitGroup
+
+	mutex     sync.Mutex
+	closed    bool
+	info      *TorrentInfo
+	numPieces int
+	storage   *btStorage
+	have      btBitfield
+	// the pieces of the selected files, nil until the files are selected
+	wanted []bool
+	// the number of peers downloading the piece
+	downloading map[int]int
+	peers       map[*btPeer]bool
+	// the addresses connected or being connected
+	dialed           map[string]bool
+	fetchingMetadata bool
+	isCompleted      bool
+	// the payload of this session
+	uploaded      int64
+	downloaded    int64
+	uploadSpeed   int64
+	downloadSpeed int64
+	// the result of the last announce of trackers
+	trackerErrs map[string]*SwarmTracker
+	// the error which stops the torrent, like writing files
+	err error
+}
+
+// setInfo sets the metadata and the storage of files, t.mutex is held or the torrent is not added yet
+func (t *btTorrent) setInfo(info *TorrentInfo) error {
+	if info.InfoHash == "" || info.pieces == "" && info.Length > 0 {
+		return fmt.Errorf("the v2 only torrent is not supported")
+	}
+	numPieces := len(info.pieces) / sha1.Size
+	if int64(numPieces) != (info.Length+info.PieceLength-1)/info.PieceLength {
+		return fmt.Errorf("invalid torrent:%d pieces for length %d", numPieces, info.Length)
+	}
+	t.info, t.numPieces = info, numPieces
+	t.have = newBTBitfield(numPieces)
+	t.storage = newBTStorage(t.fs, info.Files)
+	close(t.gotInfo)
+	return nil
+}
+
+// GotInfo is closed when the metadata is known
+func (t *btTorrent) GotInfo() <-chan struct{} {
+	return t.gotInfo
+}
+
+// Completed is closed when the selected files are completed
+func (t *btTorrent) Completed() <-chan struct{} {
+	return t.completed
+}
+
+func (t *btTorrent) Info() *TorrentInfo {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.info
+}
+
+// Err returns the error which stops downloading
+func (t *btTorrent) Err() error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.err
+}
+
+func (t *btTorrent) fail(err error) {
+	t.mutex.Lock()
+	if t.err == nil {
+		t.err = err
+	}
+	t.mutex.Unlock()
+}
+
+// Start announces to the trackers and connects to the peers
+func (t *btTorrent) Start() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.closed {
+		return
+	}
+	go t.sampleSpeed()
+	for _, tracker := range t.trackers {
+		t.wg.Add(1)
+		go t.announceLoop(tracker)
+	}
+	if t.engine.dht != nil {
+		t.wg.Add(1)
+		go t.dhtLoop()
+	}
+}
+
+// AddPeer connects to the peer, like the peers of x.pe in magnet
+func (t *btTorrent) AddPeer(addr string) {
+	t.connect(addr)
+}
+
+func (t *btTorrent) close() {
+	t.mutex.Lock()
+	t.closed = true
+	t.mutex.Unlock()
+	t.cancel()
+	t.wg.Wait()
+	t.mutex.Lock()
+	storage := t.storage
+	t.mutex.Unlock()
+	if storage != nil {
+		storage.Close()
+	}
+}
+
+func (t *btTorrent) pieceLength(index int) int {
+	if index == t.numPieces-1 {
+		return int(t.info.Length - int64(index)*t.info.PieceLength)
+	}
+	return int(t.info.PieceLength)
+}
+
+// Select downloads the pieces of the selected files, the pieces on disk are verified rather than downloaded again
+func (t *btTorrent) Select(selected []bool) {
+	t.mutex.Lock()
+	storage, numPieces, pieceLength := t.storage, t.numPieces, t.info.PieceLength
+	t.mutex.Unlock()
+	wanted := make([]bool, numPieces)
+	for i, file := range storage.files {
+		if i >= len(selected) || !selected[i] {
+			continue
+		}
+		if file.Length == 0 {
+			if err := storage.touch(i); err != nil {
+				log.Warnf("[btTorrent]create %s error:%s", file.Path, err)
+			}
+			continue
+		}
+		start, end := storage.offsets[i], storage.offsets[i]+file.Length
+		for piece := start / pieceLength; piece <= (end-1)/pieceLength; piece++ {
+			wanted[piece] = true
+		}
+	}
+	for i := range wanted {
+		t.mutex.Lock()
+		verify := wanted[i] && !t.have.Has(i)
+		t.mutex.Unlock()
+		if verify && t.verifyPiece(i) {
+			t.mutex.Lock()
+			t.have.Set(i)
+			t.mutex.Unlock()
+		}
+	}
+	t.mutex.Lock()
+	t.wanted = wanted
+	t.checkCompleted()
+	peers := t.peerList()
+	t.mutex.Unlock()
+	for _, p := range peers {
+		p.wake()
+	}
+}
+
+// verifyPiece checks the piece on disk, it is false if the files are not written
+func (t *btTorrent) verifyPiece(index int) bool {
+	t.mutex.Lock()
+	offset, length := int64(index)*t.info.PieceLength, t.pieceLength(index)
+	hash := t.info.pieces[index*sha1.Size : (index+1)*sha1.Size]
+	t.mutex.Unlock()
+	data := make([]byte, length)
+	if err := t.storage.ReadAt(data, offset); err != nil {
+		return false
+	}
+	sum := sha1.Sum(data)
+	return string(sum[:]) == hash
+}
+
+// checkCompleted closes completed when all the wanted pieces are downloaded, t.mutex is held
+func (t *btTorrent) checkCompleted() {
+	if t.isCompleted || t.wanted == nil {
+		return
+	}
+	for i, wanted := range t.wanted {
+		if wanted && !t.have.Has(i) {
+			return
+		}
+	}
+	t.isCompleted = true
+	close(t.completed)
+}
+
+func (t *btTorrent) peerList() []*btPeer {
+	peers := make([]*btPeer, 0, len(t.peers))
+	for p := range t.peers {
+		peers = append(peers, p)
+	}
+	return peers
+}
+
+// btStats is the progress of the torrent
+type btStats struct {
+	// the length of the selected files and their completed length
+	Length    int64
+	Completed int64
+	// the completed length of each file
+	Files         []int64
+	Uploaded      int64
+	Downloaded    int64
+	UploadSpeed   int64
+	DownloadSpeed int64
+	Peers         int
+}
+
+func (t *btTorrent) Stats(selected []bool) *btStats {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	stats := &btStats{
+		Uploaded:      t.uploaded,
+		Downloaded:    t.downloaded,
+		UploadSpeed:   t.uploadSpeed,
+		DownloadSpeed: t.downloadSpeed,
+		Peers:         len(t.peers),
+	}
+	if t.info == nil {
+		return stats
+	}
+	pieceLength := t.info.PieceLength
+	for i, file := range t.storage.files {
+		start, end := t.storage.offsets[i], t.storage.offsets[i]+file.Length
+		var completed int64
+		for offset := start; offset < end; {
+			piece := offset / pieceLength
+			next := (piece + 1) * pieceLength
+			if next > end {
+				next = end
+			}
+			if t.have.Has(int(piece)) {
+				completed += next - offset
+			}
+			offset = next
+		}
+		stats.Files = append(stats.Files, completed)
+		if i < len(selected) && selected[i] {
+			stats.Length += file.Length
+			stats.Completed += completed
+		}
+	}
+	return stats
+}
+
+// sampleSpeed updates the speed of the torrent and its peers every second
+func (t *btTorrent) sampleSpeed() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	var uploaded, downloaded int64
+	for {
+		select {
+		case <-ticker.C:
+		case <-t.ctx.Done():
+			return
+		}
+		t.mutex.Lock()
+		t.uploadSpeed, t.downloadSpeed = t.uploaded-uploaded, t.downloaded-downloaded
+		uploaded, downloaded = t.uploaded, t.downloaded
+		for p := range t.peers {
+			p.uploadSpeed, p.downloadSpeed = p.uploaded-p.lastUploaded, p.downloaded-p.lastDownloaded
+			p.lastUploaded, p.lastDownloaded = p.uploaded, p.downloaded
+		}
+		t.mutex.Unlock()
+	}
+}
+
+// announceLoop announces to the tracker by its interval and connects to the returned peers,
+// stopped is announced when the torrent is removed
+func (t *btTorrent) announceLoop(tracker string) {
+	defer t.wg.Done()
+	event := "started"
+	completed := t.completed
+	select {
+	case <-completed:
+		// the files are completed before, it is not announced
+		completed = nil
+	default:
+	}
+	for {
+		response, err := btAnnounce(t.ctx, tracker, t.announceRequest(event))
+		status := &SwarmTracker{URL: tracker, Status: TrackerStatusOK, CheckedTime: time.Now()}
+		interval := btMinAnnounceInterval
+		if err != nil {
+			status.Status, status.Error = TrackerStatusError, err.Error()
+			if t.ctx.Err() == nil {
+				log.Debugf("[btTorrent]announce %s error:%s", tracker, err)
+			}
+		} else {
+			interval = response.Interval
+			for _, addr := range response.Peers {
+				t.connect(addr)
+			}
+		}
+		t.mutex.Lock()
+		t.trackerErrs[tracker] = status
+		t.mutex.Unlock()
+		event = ""
+		timer := time.NewTimer(interval)
+		select {
+		case <-timer.C:
+		case <-completed:
+			timer.Stop()
+			event, completed = "completed", nil
+		case <-t.ctx.Done():
+			timer.Stop()
+			if err == nil {
+				ctx, cancel := context.WithTimeout(context.Background(), btStoppedTimeout)
+				btAnnounce(ctx, tracker, t.announceRequest("stopped"))
+				cancel()
+			}
+			return
+		}
+	}
+}
+
+// dhtLoop looks up the peers by DHT and announces the torrent to the closest nodes,
+// the private torrents are skipped
+func (t *btTorrent) dhtLoop() {
+	defer t.wg.Done()
+	for {
+		if info := t.Info(); info != nil && info.Private {
+			return
+		}
+		peers := t.engine.dht.GetPeers(t.ctx, t.infoHash, true)
+		for _, addr := range peers {
+			t.connect(addr)
+		}
+		interval := btDHTInterval
+		if len(peers) == 0 {
+			interval = btDHTRetryInterval
+		}
+		timer := time.NewTimer(interval)
+		select {
+		case <-timer.C:
+		case <-t.ctx.Done():
+			timer.Stop()
+			return
+		}
+	}
+}
+
+func (t *btTorrent) announceRequest(event string) *btAnnounceRequest {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	request := &btAnnounceRequest{
+		InfoHash:   t.infoHash,
+		PeerID:     t.engine.peerID,
+		Port:       t.engine.port,
+		Uploaded:   t.uploaded,
+		Downloaded: t.downloaded,
+		Event:      event,
+	}
+	switch {
+	case t.info == nil:
+		// the length is not known yet, the peer is a leecher
+		request.Left = btMetadataPieceSize
+	case t.wanted == nil:
+		request.Left = t.info.Length
+	default:
+		for i, wanted := range t.wanted {
+			if wanted && !t.have.Has(i) {
+				request.Left += int64(t.pieceLength(i))
+			}
+		}
+	}
+	return request
+}
+
+// connect dials the peer in background, the egress policy is applied
+func (t *btTorrent) connect(addr string) {
+	t.mutex.Lock()
+	if t.closed || t.dialed[addr] || len(t.peers) >= btMaxPeers {
+		t.mutex.Unlock()
+		return
+	}
+	t.dialed[addr] = true
+	t.mutex.Unlock()
+	go func() {
+		conn, err := t.dial(addr)
+		if err != nil {
+			t.mutex.Lock()
+			delete(t.dialed, addr)
+			t.mutex.Unlock()
+			log.Debugf("[btTorrent]connect peer %s error:%s", addr, err)
+			return
+		}
+		t.addPeer(conn, addr, btHandshake{})
+	}()
+}
+
+func (t *btTorrent) dial(addr string) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(t.ctx, btDialTimeout)
+	defer cancel()
+	conn, err := egressPolicy.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(btDialTimeout))
+	err = writeBTHandshake(conn, btHandshake{InfoHash: t.infoHash, PeerID: t.engine.peerID, Extended: true})
+	var h btHandshake
+	if err == nil {
+		h, err = readBTHandshake(conn)
+	}
+	if err == nil && (h.InfoHash != t.infoHash || h.PeerID == t.engine.peerID) {
+		err = fmt.Errorf("unexpected handshake")
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return &btConn{Conn: conn, handshake: h}, nil
+}
+
+// btConn is the connection after handshake
+type btConn struct {
+	net.Conn
+	handshake btHandshake
+}
+
+func (t *btTorrent) addPeer(conn net.Conn, addr string, h btHandshake) {
+	if c, ok := conn.(*btConn); ok {
+		h = c.handshake
+	}
+	p := &btPeer{
+		t:           t,
+		conn:        conn,
+		addr:        addr,
+		id:          h.PeerID,
+		extended:    h.Extended,
+		notify:      make(chan struct{}, 1),
+		blocks:      make(chan []byte, btPipeline*2),
+		metadata:    make(chan *btMetadataPiece, 1),
+		peerChoking: true,
+		amChoking:   true,
+	}
+	t.mutex.Lock()
+	if t.closed || len(t.peers) >= btMaxPeers {
+		t.mutex.Unlock()
+		conn.Close()
+		return
+	}
+	for other := range t.peers {
+		if other.id == p.id {
+			t.mutex.Unlock()
+			conn.Close()
+			return
+		}
+	}
+	t.peers[p] = true
+	t.dialed[addr] = true
+	t.wg.Add(1)
+	t.mutex.Unlock()
+	go p.run()
+}
+
+// pickPiece returns the first wanted piece the peer has which is not being downloaded, a piece being downloaded by other
+// peers is picked at the end of download. interesting tells whether the peer has the wanted pieces
+func (t *btTorrent) pickPiece(p *btPeer) (index int, interesting bool) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.wanted == nil || t.err != nil {
+		return -1, false
+	}
+	index, endgame := -1, -1
+	for i, wanted := range t.wanted {
+		if !wanted || t.have.Has(i) || !p.bitfield.Has(i) {
+			continue
+		}
+		interesting = true
+		if p.peerChoking {
+			break
+		}
+		if n := t.downloading[i]; n == 0 {
+			index = i
+			break
+		} else if endgame < 0 && n < btEndgamePeers {
+			endgame = i
+		}
+	}
+	if p.peerChoking {
+		return -1, interesting
+	}
+	if index < 0 {
+		index = endgame
+	}
+	if index >= 0 {
+		t.downloading[index]++
+	}
+	return index, interesting
+}
+
+func (t *btTorrent) releasePiece(index int) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.downloading[index]--; t.downloading[index] <= 0 {
+		delete(t.downloading, index)
+	}
+}
+
+var errBTBadPiece = fmt.Errorf("piece hash mismatch")
+
+// finishPiece verifies and writes the downloaded piece, and tells the peers we have it
+func (t *btTorrent) finishPiece(index int, data []byte) error {
+	defer t.releasePiece(index)
+	t.mutex.Lock()
+	hash, offset := t.info.pieces[index*sha1.Size:(index+1)*sha1.Size], int64(index)*t.info.PieceLength
+	duplicate := t.have.Has(index)
+	t.mutex.Unlock()
+	sum := sha1.Sum(data)
+	if string(sum[:]) != hash {
+		return errBTBadPiece
+	}
+	if duplicate {
+		return nil
+	}
+	if err := t.storage.WriteAt(data, offset); err != nil {
+		err = fmt.Errorf("write piece %d error:%s", index, err)
+		t.fail(err)
+		return err
+	}
+	t.mutex.Lock()
+	t.have.Set(index)
+	t.checkCompleted()
+	peers := t.peerList()
+	t.mutex.Unlock()
+	go func() {
+		for _, p := range peers {
+			p.send(btHaveMessage(index))
+		}
+	}()
+	return nil
+}
+
+// Swarm returns the peers and trackers of the torrent
+func (t *btTorrent) Swarm() *Swarm {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	swarm := &Swarm{
+		Status:        "active",
+		InfoHash:      hex.EncodeToString(t.infoHash[:]),
+		Connections:   len(t.peers),
+		DownloadSpeed: t.downloadSpeed,
+		UploadSpeed:   t.uploadSpeed,
+		NumPieces:     t.numPieces,
+	}
+	if t.info != nil {
+		swarm.PieceLength = t.info.PieceLength
+		swarm.CompletedPieces = t.have.Count(t.numPieces)
+		swarm.Bitfield = hex.EncodeToString(t.have)
+		swarm.PieceMap = pieceMap(swarm.Bitfield, t.numPieces)
+	}
+	for p := range t.peers {
+		var progress float64
+		if t.numPieces > 0 {
+			progress = float64(p.bitfield.Count(t.numPieces)) / float64(t.numPieces)
+		}
+		seeder := t.numPieces > 0 && progress == 1
+		if seeder {
+			swarm.NumSeeders++
+		}
+		swarm.Peers = append(swarm.Peers, SwarmPeer{
+			Address:       p.addr,
+			PeerID:        string(bytes.TrimRight(p.id[:], "\x00")),
+			Client:        peerClient(string(p.id[:])),
+			DownloadSpeed: p.downloadSpeed,
+			UploadSpeed:   p.uploadSpeed,
+			Progress:      progress,
+			Seeder:        seeder,
+			AmChoking:     p.amChoking,
+			PeerChoking:   p.peerChoking,
+		})
+	}
+	for _, tracker := range t.trackers {
+		status := SwarmTracker{URL: tracker, Tier: 1, Source: "torrent"}
+		if result, ok := t.trackerErrs[tracker]; ok {
+			status.Status, status.Error, status.CheckedTime = result.Status, result.Error, result.CheckedTime
+		}
+		swarm.Trackers = append(swarm.Trackers, status)
+	}
+	return swarm
+}
+
+// btStorage maps the pieces to the files, the files are concatenated in the order of torrent
+type btStorage struct {
+	fs      *ConfinedFS
+	files   []TorrentFile
+	offsets []int64
+	mutex   sync.Mutex
+	handles map[int]*os.File
+}
+
+func newBTStorage(fs *ConfinedFS, files []TorrentFile) *btStorage {
+	s := &btStorage{fs: fs, files: files, handles: make(map[int]*os.File)}
+	var offset int64
+	for _, file := range files {
+		s.offsets = append(s.offsets, offset)
+		offset += file.Length
+	}
+	return s
+}
+
+// open returns the handle of file, the file is created for writing
+func (s *btStorage) open(i int, create bool) (*os.File, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if fp, ok := s.handles[i]; ok {
+		return fp, nil
+	}
+	name := s.files[i].Path
+	flag := os.O_RDWR
+	if create {
+		if err := s.fs.MkdirAll(path.Dir(name), 0777); err != nil {
+			return nil, err
+		}
+		flag |= os.O_CREATE
+	}
+	fp, err := s.fs.OpenFile(name, flag, 0644)
+	if err != nil {
+		return nil, err
+	}
+	s.handles[i] = fp
+	return fp, nil
+}
+
+// touch creates the empty file
+func (s *btStorage) touch(i int) error {
+	_, err := s.open(i, true)
+	return err
+}
+
+// each calls fn with the parts of p in the files
+func (s *btStorage) each(p []byte, offset int64, fn func(i int, part []byte, fileOffset int64) error) error {
+	end := offset + int64(len(p))
+	for i, file := range s.files {
+		start, fileEnd := s.offsets[i], s.offsets[i]+file.Length
+		if fileEnd <= offset || start >= end || file.Length == 0 {
+			continue
+		}
+		from, to := maxInt64(start, offset), minInt64(fileEnd, end)
+		if err := fn(i, p[from-offset:to-offset], from-start); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *btStorage) ReadAt(p []byte, offset int64) error {
+	return s.each(p, offset, func(i int, part []byte, fileOffset int64) error {
+		fp, err := s.open(i, false)
+		if err != nil {
+			return err
+		}
+		_, err = fp.ReadAt(part, fileOffset)
+		return err
+	})
+}
+
+func (s *btStorage) WriteAt(p []byte, offset int64) error {
+	return s.each(p, offset, func(i int, part []byte, fileOffset int64) error {
+		fp, err := s.open(i, true)
+		if err != nil {
+			return err
+		}
+		_, err = fp.WriteAt(part, fileOffset)
+		return err
+	})
+}
+
+func (s *btStorage) Close() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for i, fp := range s.handles {
+		fp.Close()
+		delete(s.handles, i)
+	}
+}
+
+func minInt64(a int64, b int64) int64 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func maxInt64(a int64, b int64) int64 {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// btMetadataPiece is the data or reject message of ut_metadata
+type btMetadataPiece struct {
+	Type  int64
+	Piece int64
+	Data  []byte
+}
+
+// btPeer is the connection to a peer of the torrent
+type btPeer struct {
+	t        *btTorrent
+	conn     net.Conn
+	addr     string
+	id       [20]byte
+	extended bool
+	// wakes the downloader when the peer unchokes or has new pieces
+	notify     chan struct{}
+	blocks     chan []byte
+	metadata   chan *btMetadataPiece
+	writeMutex sync.Mutex
+	badPieces  int
+
+	// guarded by t.mutex
+	bitfield       btBitfield
+	peerChoking    bool
+	peerInterested bool
+	amChoking      bool
+	amInterested   bool
+	// the extended message id of ut_metadata told by the peer, 0 means unsupported
+	utMetadata     byte
+	metadataSize   int
+	uploaded       int64
+	downloaded     int64
+	lastUploaded   int64
+	lastDownloaded int64
+	uploadSpeed    int64
+	downloadSpeed  int64
+}
+
+func (p *btPeer) wake() {
+	select {
+	case p.notify <- struct{}{}:
+	default:
+	}
+}
+
+func (p *btPeer) send(msg *btMessage) error {
+	p.writeMutex.Lock()
+	defer p.writeMutex.Unlock()
+	p.conn.SetWriteDeadline(time.Now().Add(btRequestTimeout))
+	_, err := p.conn.Write(msg.encode())
+	return err
+}
+
+// run reads the messages of peer until the connection is closed or the torrent is removed
+func (p *btPeer) run() {
+	t := p.t
+	ctx, cancel := context.WithCancel(t.ctx)
+	downloaded := make(chan struct{})
+	defer func() {
+		cancel()
+		p.conn.Close()
+		<-downloaded
+		t.mutex.Lock()
+		delete(t.peers, p)
+		delete(t.dialed, p.addr)
+		t.mutex.Unlock()
+		t.wg.Done()
+	}()
+	go func() {
+		<-ctx.Done()
+		p.conn.Close()
+	}()
+	// the bitfield is the first message after handshake
+	if err := p.start(); err != nil {
+		close(downloaded)
+		return
+	}
+	go func() {
+		defer close(downloaded)
+		defer cancel()
+		p.download(ctx)
+	}()
+	for {
+		p.conn.SetReadDeadline(time.Now().Add(btPeerTimeout))
+		msg, err := readBTMessage(p.conn)
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Debugf("[btPeer]read %s error:%s", p.addr, err)
+			}
+			return
+		}
+		if msg == nil {
+			continue
+		}
+		if err := p.handle(msg); err != nil {
+			log.Debugf("[btPeer]handle message %d of %s error:%s", msg.ID, p.addr, err)
+			return
+		}
+	}
+}
+
+// start sends our bitfield and the extension handshake
+func (p *btPeer) start() error {
+	t := p.t
+	t.mutex.Lock()
+	var bitfield btBitfield
+	if t.info != nil && t.have.Count(t.numPieces) > 0 {
+		bitfield = append(bitfield, t.have...)
+	}
+	var metadataSize int
+	if t.info != nil {
+		metadataSize = len(t.info.info)
+	}
+	t.mutex.Unlock()
+	if bitfield != nil {
+		if err := p.send(&btMessage{ID: btMsgBitfield, Payload: bitfield}); err != nil {
+			return err
+		}
+	}
+	if !p.extended {
+		return nil
+	}
+	handshake := map[string]interface{}{
+		"m": map[string]interface{}{"ut_metadata": btExtendedMetadata},
+		"v": btClientVersion,
+	}
+	if metadataSize > 0 {
+		handshake["metadata_size"] = metadataSize
+	}
+	msg, err := btExtendedMessage(btExtendedHandshake, handshake, nil)
+	if err != nil {
+		return err
+	}
+	return p.send(msg)
+}
+
+func (p *btPeer) handle(msg *btMessage) error {
+	t := p.t
+	switch msg.ID {
+	case btMsgChoke, btMsgUnchoke:
+		t.mutex.Lock()
+		p.peerChoking = msg.ID == btMsgChoke
+		t.mutex.Unlock()
+		p.wake()
+	case btMsgInterested:
+		// the interested peers are unchoked, the number of peers is limited by btMaxPeers
+		t.mutex.Lock()
+		unchoke := p.amChoking
+		p.peerInterested, p.amChoking = true, false
+		t.mutex.Unlock()
+		if unchoke {
+			return p.send(&btMessage{ID: btMsgUnchoke})
+		}
+	case btMsgNotInterested:
+		t.mutex.Lock()
+		p.peerInterested = false
+		t.mutex.Unlock()
+	case btMsgHave:
+		if len(msg.Payload) != 4 {
+			return fmt.Errorf("invalid have message")
+		}
+		index := int(uint32(msg.Payload[0])<<24 | uint32(msg.Payload[1])<<16 | uint32(msg.Payload[2])<<8 | uint32(msg.Payload[3]))
+		if index >= btMaxMessageLength*8 {
+			return fmt.Errorf("invalid have message")
+		}
+		t.mutex.Lock()
+		p.bitfield.Set(index)
+		t.mutex.Unlock()
+		p.wake()
+	case btMsgBitfield:
+		t.mutex.Lock()
+		p.bitfield = append(btBitfield(nil), msg.Payload...)
+		t.mutex.Unlock()
+		p.wake()
+	case btMsgRequest:
+		return p.serve(msg.Payload)
+	case btMsgPiece:
+		select {
+		case p.blocks <- msg.Payload:
+		default:
+		}
+	case btMsgExtended:
+		return p.handleExtended(msg.Payload)
+	}
+	return nil
+}
+
+// serve sends the requested block of the piece we have
+func (p *btPeer) serve(payload []byte) error {
+	t := p.t
+	index, begin, length, err := parseBTRequest(payload)
+	if err != nil {
+		return err
+	}
+	t.mutex.Lock()
+	ok := !p.amChoking && t.info != nil && t.have.Has(index) && length > 0 && length <= 8*btBlockSize && begin+length <= t.pieceLength(index)
+	var offset int64
+	if ok {
+		offset = int64(index)*t.info.PieceLength + int64(begin)
+	}
+	t.mutex.Unlock()
+	if !ok {
+		return nil
+	}
+	block := make([]byte, length)
+	if err := t.storage.ReadAt(block, offset); err != nil {
+		return fmt.Errorf("read piece %d error:%s", index, err)
+	}
+	if err := p.send(btPieceMessage(index, begin, block)); err != nil {
+		return err
+	}
+	t.mutex.Lock()
+	p.uploaded += int64(length)
+	t.uploaded += int64(length)
+	t.mutex.Unlock()
+	return nil
+}
+
+func (p *btPeer) handleExtended(payload []byte) error {
+	t := p.t
+	id, dict, data, err := parseBTExtended(payload)
+	if err != nil {
+		return err
+	}
+	switch id {
+	case btExtendedHandshake:
+		m, _ := dict["m"].(map[string]interface{})
+		utMetadata, _ := m["ut_metadata"].(int64)
+		metadataSize, _ := dict["metadata_size"].(int64)
+		t.mutex.Lock()
+		if utMetadata > 0 && utMetadata < 256 {
+			p.utMetadata = byte(utMetadata)
+		}
+		if metadataSize > 0 && metadataSize <= torrentMaxSize {
+			p.metadataSize = int(metadataSize)
+		}
+		t.mutex.Unlock()
+		p.wake()
+	case btExtendedMetadata:
+		msgType, _ := dict["msg_type"].(int64)
+		piece, _ := dict["piece"].(int64)
+		if msgType == btMetadataRequest {
+			return p.serveMetadata(piece)
+		}
+		select {
+		case p.metadata <- &btMetadataPiece{Type: msgType, Piece: piece, Data: data}:
+		default:
+		}
+	}
+	return nil
+}
+
+// serveMetadata sends the piece of metadata, or rejects it if the metadata is not known
+func (p *btPeer) serveMetadata(piece int64) error {
+	t := p.t
+	t.mutex.Lock()
+	var metadata []byte
+	if t.info != nil {
+		metadata = t.info.info
+	}
+	utMetadata := p.utMetadata
+	t.mutex.Unlock()
+	if utMetadata == 0 {
+		return nil
+	}
+	start := piece * btMetadataPieceSize
+	if metadata == nil || piece < 0 || start >= int64(len(metadata)) {
+		msg, err := btExtendedMessage(utMetadata, map[string]interface{}{"msg_type": btMetadataReject, "piece": piece}, nil)
+		if err != nil {
+			return err
+		}
+		return p.send(msg)
+	}
+	end := minInt64(start+btMetadataPieceSize, int64(len(metadata)))
+	msg, err := btExtendedMessage(utMetadata, map[string]interface{}{
+		"msg_type":   btMetadataData,
+		"piece":      piece,
+		"total_size": len(metadata),
+	}, metadata[start:end])
+	if err != nil {
+		return err
+	}
+	return p.send(msg)
+}
+
+// download fetches the metadata and the pieces from the peer until the connection is closed
+func (p *btPeer) download(ctx context.Context) {
+	t := p.t
+	keepAlive := time.NewTicker(btKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		if err := p.fetchMetadata(ctx); err != nil {
+			log.Debugf("[btPeer]fetch metadata from %s error:%s", p.addr, err)
+			return
+		}
+		index, interesting := t.pickPiece(p)
+		if err := p.setInterested(interesting); err != nil {
+			return
+		}
+		if index < 0 {
+			select {
+			case <-p.notify:
+			case <-keepAlive.C:
+				if err := p.send(nil); err != nil {
+					return
+				}
+			case <-time.After(time.Second):
+			case <-ctx.Done():
+				return
+			}
+			continue
+		}
+		data, err := p.fetchPiece(ctx, index)
+		if err != nil {
+			t.releasePiece(index)
+			if err == errBTChoked {
+				continue
+			}
+			if ctx.Err() == nil {
+				log.Debugf("[btPeer]download piece %d from %s error:%s", index, p.addr, err)
+			}
+			return
+		}
+		if err := t.finishPiece(index, data); err != nil {
+			log.Warnf("[btPeer]piece %d from %s error:%s", index, p.addr, err)
+			if p.badPieces++; err != errBTBadPiece || p.badPieces >= btMaxBadPieces {
+				return
+			}
+		}
+	}
+}
+
+func (p *btPeer) setInterested(interested bool) error {
+	t := p.t
+	t.mutex.Lock()
+	changed := p.amInterested != interested
+	p.amInterested = interested
+	t.mutex.Unlock()
+	if !changed {
+		return nil
+	}
+	if interested {
+		return p.send(&btMessage{ID: btMsgInterested})
+	}
+	return p.send(&btMessage{ID: btMsgNotInterested})
+}
+
+// fetchPiece requests the blocks of the piece in pipeline
+func (p *btPeer) fetchPiece(ctx context.Context, index int) ([]byte, error) {
+	t := p.t
+	t.mutex.Lock()
+	length := t.pieceLength(index)
+	t.mutex.Unlock()
+	// the blocks of the piece downloaded before are dropped
+	for len(p.blocks) > 0 {
+		<-p.blocks
+	}
+	data := make([]byte, length)
+	numBlocks := (length + btBlockSize - 1) / btBlockSize
+	received := make([]bool, numBlocks)
+	remaining, next, inflight := numBlocks, 0, 0
+	timer := time.NewTimer(btRequestTimeout)
+	defer timer.Stop()
+	for remaining > 0 {
+		for ; inflight < btPipeline && next < numBlocks; next++ {
+			begin := next * btBlockSize
+			if err := p.send(btRequestMessage(btMsgRequest, index, begin, minInt(btBlockSize, length-begin))); err != nil {
+				return nil, err
+			}
+			inflight++
+		}
+		select {
+		case payload := <-p.blocks:
+			i, begin, block, err := parseBTPiece(payload)
+			if err != nil || i != index || begin%btBlockSize != 0 || begin >= length {
+				continue
+			}
+			n := begin / btBlockSize
+			if received[n] || len(block) != minInt(btBlockSize, length-begin) {
+				continue
+			}
+			copy(data[begin:], block)
+			received[n] = true
+			remaining--
+			inflight--
+			t.mutex.Lock()
+			p.downloaded += int64(len(block))
+			t.downloaded += int64(len(block))
+			t.mutex.Unlock()
+			if !timer.Stop() {
+				<-timer.C
+			}
+			timer.Reset(btRequestTimeout)
+		case <-p.notify:
+			t.mutex.Lock()
+			choked := p.peerChoking
+			t.mutex.Unlock()
+			if choked {
+				// the requests are discarded by the peer
+				return nil, errBTChoked
+			}
+		case <-timer.C:
+			return nil, fmt.Errorf("request timeout")
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	return data, nil
+}
+
+// fetchMetadata fetches the metadata of magnet by ut_metadata, one peer fetches it at a time
+func (p *btPeer) fetchMetadata(ctx context.Context) error {
+	t := p.t
+	t.mutex.Lock()
+	if t.info != nil || t.fetchingMetadata || p.utMetadata == 0 || p.metadataSize == 0 {
+		t.mutex.Unlock()
+		return nil
+	}
+	t.fetchingMetadata = true
+	utMetadata, size := p.utMetadata, p.metadataSize
+	t.mutex.Unlock()
+	defer func() {
+		t.mutex.Lock()
+		t.fetchingMetadata = false
+		t.mutex.Unlock()
+	}()
+	metadata := make([]byte, 0, size)
+	for piece := 0; piece*btMetadataPieceSize < size; piece++ {
+		msg, err := btExtendedMessage(utMetadata, map[string]interface{}{"msg_type": btMetadataRequest, "piece": piece}, nil)
+		if err != nil {
+			return err
+		}
+		if err := p.send(msg); err != nil {
+			return err
+		}
+		select {
+		case m := <-p.metadata:
+			if m.Type != btMetadataData || m.Piece != int64(piece) {
+				return fmt.Errorf("metadata piece %d is rejected", piece)
+			}
+			metadata = append(metadata, m.Data...)
+		case <-time.After(btRequestTimeout):
+			return fmt.Errorf("metadata request timeout")
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	if sum := sha1.Sum(metadata); len(metadata) != size || sum != t.infoHash {
+		return fmt.Errorf("metadata hash mismatch")
+	}
+	torrent, err := BencodeEncode(map[string]interface{}{"info": BencodeRaw(metadata)})
+	if err != nil {
+		return err
+	}
+	info, err := ParseTorrent(torrent)
+	if err != nil {
+		t.fail(err)
+		return err
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.info == nil {
+		if err := t.setInfo(info); err != nil {
+			if t.err == nil {
+				t.err = err
+			}
+			return err
+		}
+		log.Infof("[btTorrent]fetched metadata of %x from %s", t.infoHash, p.addr)
+	}
+	return nil
+}
+
+func minInt(a int, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
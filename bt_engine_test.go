@@ -0,0 +1,288 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newFakeTracker returns the http tracker which returns the compact peers announced to it
+func newFakeTracker() (*httptest.Server, func(infoHash string) int) {
+	var mutex sync.Mutex
+	swarms := make(map[string]map[string]string)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		infoHash, peerID := query.Get("info_hash"), query.Get("peer_id")
+		port, _ := strconv.Atoi(query.Get("port"))
+		mutex.Lock()
+		defer mutex.Unlock()
+		peers := swarms[infoHash]
+		if peers == nil {
+			peers = make(map[string]string)
+			swarms[infoHash] = peers
+		}
+		if query.Get("event") == "stopped" {
+			delete(peers, peerID)
+		} else {
+			peers[peerID] = net.JoinHostPort("127.0.0.1", strconv.Itoa(port))
+		}
+		var compact []byte
+		for _, addr := range peers {
+			host, port, _ := net.SplitHostPort(addr)
+			n, _ := strconv.Atoi(port)
+			peer := make([]byte, 6)
+			copy(peer, net.ParseIP(host).To4())
+			binary.BigEndian.PutUint16(peer[4:], uint16(n))
+			compact = append(compact, peer...)
+		}
+		data, _ := BencodeEncode(map[string]interface{}{"interval": 60, "peers": compact})
+		w.Write(data)
+	}))
+	count := func(infoHash string) int {
+		hash, _ := hex.DecodeString(infoHash)
+		mutex.Lock()
+		defer mutex.Unlock()
+		return len(swarms[string(hash)])
+	}
+	return server, count
+}
+
+func waitFor(t *testing.T, timeout time.Duration, what string, fn func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(timeout); !fn(); time.Sleep(20 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout waiting for %s", what)
+		}
+	}
+}
+
+func TestBTEngine(t *testing.T) {
+	setEgressPolicy(t, "127.0.0.0/8", "")
+	setFlag(t, "btPort", "0")
+	setFlag(t, "btDHTNodes", "")
+	oldTrackers := trackerList
+	trackerList = NewTrackerList(nil)
+	defer func() {
+		trackerList = oldTrackers
+	}()
+	tracker, peers := newFakeTracker()
+	defer tracker.Close()
+	var dirs []string
+	tempDir := func() string {
+		dir, err := ioutil.TempDir("", "fdp-bt")
+		if err != nil {
+			t.Fatal(err)
+		}
+		dirs = append(dirs, dir)
+		return dir
+	}
+	defer func() {
+		for _, dir := range dirs {
+			os.RemoveAll(dir)
+		}
+	}()
+	// the seeder has the files of torrent
+	seederDir := tempDir()
+	content := make([]byte, 70100)
+	rand.Read(content)
+	files := map[string][]byte{"d/a.bin": content[:40000], "d/b.bin": content[40000:70000], "d/c.txt": content[70000:]}
+	for name, data := range files {
+		os.MkdirAll(filepath.Join(seederDir, "d"), 0777)
+		if err := ioutil.WriteFile(filepath.Join(seederDir, name), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	torrent, info, err := MakeTorrent(NewConfinedFS(seederDir), "d", MakeTorrentOptions{PieceLength: 16384, Trackers: []string{tracker.URL + "/announce"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	seeder, err := NewBTEngine(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer seeder.Close()
+	var infoHash [20]byte
+	hash, _ := hex.DecodeString(info.InfoHash)
+	copy(infoHash[:], hash)
+	seed, err := seeder.AddTorrent(infoHash, info, seederDir, []string{tracker.URL + "/announce"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	seed.Select([]bool{true, true, true})
+	if stats := seed.Stats([]bool{true, true, true}); stats.Completed != int64(len(content)) {
+		t.Fatalf("expect the files of seeder verified, got %+v", stats)
+	}
+	seed.Start()
+	waitFor(t, 5*time.Second, "the seeder announced", func() bool { return peers(info.InfoHash) == 1 })
+	download := func(task *NativeTorrentTask, dir string) chan error {
+		errs := make(chan error, 1)
+		go func() {
+			errs <- task.Download(dir, 1024*1024, time.Minute)
+		}()
+		return errs
+	}
+
+	// the selected files of torrent are downloaded
+	dir := tempDir()
+	mt, _, err := NewTorrentTask(torrent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	task := newNativeTorrentTask(mt)
+	task.AwaitingSelection = true
+	errs := download(task, dir)
+	waitFor(t, 5*time.Second, "the files of torrent", func() bool {
+		task.mutex.Lock()
+		defer task.mutex.Unlock()
+		return len(task.Files) == 3 && task.torrent != nil
+	})
+	if err := task.SelectFiles([]int{1, 3}); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"d/a.bin", "d/c.txt"} {
+		if data, err := ioutil.ReadFile(filepath.Join(dir, name)); err != nil || !bytes.Equal(data, files[name]) {
+			t.Fatalf("unexpected content of %s:%v", name, err)
+		}
+	}
+	if task.Size != 40100 || task.ContentLength() != 40100 || task.Files[1].CompletedLength == 30000 || task.SourceURL != dir+"/"+info.InfoHash+".torrent" {
+		t.Fatalf("unexpected task:%+v", task.TaskInfo)
+	}
+
+	// the pieces on disk are verified rather than downloaded again
+	dir = tempDir()
+	os.MkdirAll(filepath.Join(dir, "d"), 0777)
+	ioutil.WriteFile(filepath.Join(dir, "d/a.bin"), files["d/a.bin"], 0644)
+	uploaded := seed.Stats(nil).Uploaded
+	mt, _, _ = NewTorrentTask(torrent)
+	task = newNativeTorrentTask(mt)
+	if err := <-download(task, dir); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := ioutil.ReadFile(filepath.Join(dir, "d/b.bin")); err != nil || !bytes.Equal(data, files["d/b.bin"]) {
+		t.Fatalf("unexpected content of resumed b.bin:%v", err)
+	}
+	if resumed := seed.Stats(nil).Uploaded - uploaded; resumed > int64(len(content)-2*16384) {
+		t.Fatalf("expect the first 2 pieces resumed, uploaded %d", resumed)
+	}
+
+	// the metadata of magnet is fetched from the peers, the task seeds until the ratio is reached
+	dir = tempDir()
+	magnet := info.Magnet()
+	magnet.Trackers = []string{tracker.URL + "/announce"}
+	task = newNativeTorrentTask(NewMagnetTask(magnet.String()))
+	task.SeedPolicy = "ratio:1"
+	if err := <-download(task, dir); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := ioutil.ReadFile(filepath.Join(dir, "d/b.bin")); err != nil || !bytes.Equal(data, files["d/b.bin"]) {
+		t.Fatalf("unexpected content of magnet:%v", err)
+	}
+	if data, err := task.Torrent(dir); err != nil || !bytes.Contains(data, info.info) {
+		t.Fatalf("expect the magnet converted to torrent:%v", err)
+	}
+	task.mutex.Lock()
+	seeding := task.Seeding
+	task.mutex.Unlock()
+	if !seeding {
+		t.Fatal("expect the magnet task seeding")
+	}
+	if swarm, err := task.Swarm(); err != nil || swarm.Status != "seeding" || swarm.CompletedPieces != 5 || swarm.Trackers[0].Status != TrackerStatusOK {
+		t.Fatalf("unexpected swarm:%+v %v", swarm, err)
+	}
+	// the seeder leaves, another peer downloads from the task
+	seeder.RemoveTorrent(seed)
+	waitFor(t, 5*time.Second, "the seeder stopped", func() bool { return peers(info.InfoHash) == 1 })
+	leecher, err := NewBTEngine(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer leecher.Close()
+	leech, err := leecher.AddTorrent(infoHash, info, tempDir(), []string{tracker.URL + "/announce"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	leech.Select([]bool{true, true, true})
+	leech.Start()
+	select {
+	case <-leech.Completed():
+	case <-time.After(10 * time.Second):
+		t.Fatal("timeout downloading from the seeding task")
+	}
+	waitFor(t, 5*time.Second, "the seeding stopped by ratio", func() bool {
+		task.mutex.Lock()
+		defer task.mutex.Unlock()
+		return !task.Seeding
+	})
+	if task.Ratio < 1 || task.Uploaded < int64(len(content)) {
+		t.Fatalf("unexpected ratio:%f, uploaded:%d", task.Ratio, task.Uploaded)
+	}
+	// the files are kept after seeding
+	if _, err := os.Stat(filepath.Join(dir, "d/a.bin")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNativeTorrentTask_CancelBeforeStart(t *testing.T) {
+	setFlag(t, "btPort", "0")
+	setFlag(t, "btDHTNodes", "")
+	dir, err := ioutil.TempDir("", "fdp-bt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	mt, _, err := NewTorrentTask([]byte(testSingleFileTorrent))
+	if err != nil {
+		t.Fatal(err)
+	}
+	task := newNativeTorrentTask(mt)
+	// the task is deleted before the download queue starts it
+	task.Cancel()
+	if err := task.Download(dir, 1024*1024, time.Minute); err == nil || !strings.Contains(err.Error(), "canceled") {
+		t.Fatalf("expect the canceled task not started, got %v", err)
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 0 {
+		t.Fatalf("expect nothing downloaded, got %d files", len(files))
+	}
+}
+
+func TestNativeTorrentTask_Restore(t *testing.T) {
+	mt, _, err := NewTorrentTask([]byte(testSingleFileTorrent))
+	if err != nil {
+		t.Fatal(err)
+	}
+	task := newNativeTorrentTask(mt)
+	task.Files = []TaskFile{{Index: 1, Path: "a", Length: 1, Selected: true}}
+	data, err := task.MarshalJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored, err := restoreTask(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nt, ok := restored.(*NativeTorrentTask)
+	if !ok || nt.InfoHash() != mt.InfoHash() || len(nt.Files) != 1 || nt.TaskType != DownloadTaskTypeMagnet {
+		t.Fatalf("unexpected restored task:%+v", restored)
+	}
+	if backend := backendOfTask(nt); backend == nil || !backend.Resumable {
+		t.Fatal("expect the native task resumable")
+	}
+	if err := nt.SelectFiles([]int{1}); err == nil {
+		t.Fatal("expect the task which is not downloading rejected")
+	}
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// the peer wire protocol of BEP 3, with the extension protocol of BEP 10 for the metadata exchange of BEP 9
+const (
+	btProtocol = "BitTorrent protocol"
+	// the block is the unit of request, the clients reject the larger requests
+	btBlockSize = 16 * 1024
+	// the largest message is the bitfield of the torrent which has millions of pieces
+	btMaxMessageLength = 1024 * 1024
+	// the metadata is exchanged in pieces of 16KB
+	btMetadataPieceSize = 16 * 1024
+	// the extended message id of extension handshake, and the id of ut_metadata told to the peers
+	btExtendedHandshake = 0
+	btExtendedMetadata  = 1
+)
+
+const (
+	btMsgChoke byte = iota
+	btMsgUnchoke
+	btMsgInterested
+	btMsgNotInterested
+	btMsgHave
+	btMsgBitfield
+	btMsgRequest
+	btMsgPiece
+	btMsgCancel
+	btMsgExtended byte = 20
+)
+
+// the msg_type of ut_metadata
+const (
+	btMetadataRequest = 0
+	btMetadataData    = 1
+	btMetadataReject  = 2
+)
+
+// btHandshake is the first message of the peer connection
+type btHandshake struct {
+	InfoHash [20]byte
+	PeerID   [20]byte
+	// Extended means the peer supports the extension protocol
+	Extended bool
+}
+
+func writeBTHandshake(w io.Writer, h btHandshake) error {
+	buf := make([]byte, 68)
+	buf[0] = byte(len(btProtocol))
+	copy(buf[1:20], btProtocol)
+	if h.Extended {
+		buf[25] |= 0x10
+	}
+	copy(buf[28:48], h.InfoHash[:])
+	copy(buf[48:68], h.PeerID[:])
+	_, err := w.Write(buf)
+	return err
+}
+
+func readBTHandshake(r io.Reader) (h btHandshake, err error) {
+	buf := make([]byte, 68)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return h, err
+	}
+	if int(buf[0]) != len(btProtocol) || string(buf[1:20]) != btProtocol {
+		return h, fmt.Errorf("invalid handshake")
+	}
+	h.Extended = buf[25]&0x10 != 0
+	copy(h.InfoHash[:], buf[28:48])
+	copy(h.PeerID[:], buf[48:68])
+	return h, nil
+}
+
+// btMessage is the message after handshake, nil is the keep-alive
+type btMessage struct {
+	ID      byte
+	Payload []byte
+}
+
+func readBTMessage(r io.Reader) (*btMessage, error) {
+	var length uint32
+	if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+		return nil, err
+	}
+	if length == 0 {
+		return nil, nil
+	}
+	if length > btMaxMessageLength {
+		return nil, fmt.Errorf("message is too long:%d", length)
+	}
+	buf := make([]byte, length)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+	return &btMessage{ID: buf[0], Payload: buf[1:]}, nil
+}
+
+func (m *btMessage) encode() []byte {
+	if m == nil {
+		return make([]byte, 4)
+	}
+	buf := make([]byte, 5+len(m.Payload))
+	binary.BigEndian.PutUint32(buf[0:4], uint32(1+len(m.Payload)))
+	buf[4] = m.ID
+	copy(buf[5:], m.Payload)
+	return buf
+}
+
+// btRequestMessage returns the request or cancel message of the block
+func btRequestMessage(id byte, index int, begin int, length int) *btMessage {
+	payload := make([]byte, 12)
+	binary.BigEndian.PutUint32(payload[0:4], uint32(index))
+	binary.BigEndian.PutUint32(payload[4:8], uint32(begin))
+	binary.BigEndian.PutUint32(payload[8:12], uint32(length))
+	return &btMessage{ID: id, Payload: payload}
+}
+
+func parseBTRequest(payload []byte) (index int, begin int, length int, err error) {
+	if len(payload) != 12 {
+		return 0, 0, 0, fmt.Errorf("invalid request message")
+	}
+	return int(binary.BigEndian.Uint32(payload[0:4])), int(binary.BigEndian.Uint32(payload[4:8])), int(binary.BigEndian.Uint32(payload[8:12])), nil
+}
+
+func btPieceMessage(index int, begin int, block []byte) *btMessage {
+	payload := make([]byte, 8+len(block))
+	binary.BigEndian.PutUint32(payload[0:4], uint32(index))
+	binary.BigEndian.PutUint32(payload[4:8], uint32(begin))
+	copy(payload[8:], block)
+	return &btMessage{ID: btMsgPiece, Payload: payload}
+}
+
+func parseBTPiece(payload []byte) (index int, begin int, block []byte, err error) {
+	if len(payload) < 8 {
+		return 0, 0, nil, fmt.Errorf("invalid piece message")
+	}
+	return int(binary.BigEndian.Uint32(payload[0:4])), int(binary.BigEndian.Uint32(payload[4:8])), payload[8:], nil
+}
+
+func btHaveMessage(index int) *btMessage {
+	payload := make([]byte, 4)
+	binary.BigEndian.PutUint32(payload, uint32(index))
+	return &btMessage{ID: btMsgHave, Payload: payload}
+}
+
+// btExtendedMessage returns the extended message of the bencoded dict, the data is appended after the dict
+func btExtendedMessage(id byte, dict map[string]interface{}, data []byte) (*btMessage, error) {
+	encoded, err := BencodeEncode(dict)
+	if err != nil {
+		return nil, err
+	}
+	payload := bytes.NewBuffer([]byte{id})
+	payload.Write(encoded)
+	payload.Write(data)
+	return &btMessage{ID: btMsgExtended, Payload: payload.Bytes()}, nil
+}
+
+// parseBTExtended returns the extended message id, the dict and the data after the dict
+func parseBTExtended(payload []byte) (id byte, dict map[string]interface{}, data []byte, err error) {
+	if len(payload) < 2 {
+		return 0, nil, nil, fmt.Errorf("invalid extended message")
+	}
+	v, n, err := BencodeDecodePrefix(payload[1:])
+	if err != nil {
+		return 0, nil, nil, fmt.Errorf("invalid extended message:%s", err)
+	}
+	dict, ok := v.(map[string]interface{})
+	if !ok {
+		return 0, nil, nil, fmt.Errorf("invalid extended message:not dict")
+	}
+	return payload[0], dict, payload[1+n:], nil
+}
+
+// btBitfield is the pieces a peer has, the highest bit of the first byte is piece 0
+type btBitfield []byte
+
+func newBTBitfield(numPieces int) btBitfield {
+	return make(btBitfield, (numPieces+7)/8)
+}
+
+func (b btBitfield) Has(index int) bool {
+	return index >= 0 && index/8 < len(b) && b[index/8]&(0x80>>uint(index%8)) != 0
+}
+
+// Set sets the piece, the bitfield grows if the peer tells a have before the number of pieces is known
+func (b *btBitfield) Set(index int) {
+	if index < 0 {
+		return
+	}
+	for index/8 >= len(*b) {
+		*b = append(*b, 0)
+	}
+	(*b)[index/8] |= 0x80 >> uint(index%8)
+}
+
+func (b btBitfield) Count(numPieces int) int {
+	count := 0
+	for i := 0; i < numPieces; i++ {
+		if b.Has(i) {
+			count++
+		}
+	}
+	return count
+}
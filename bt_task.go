@@ -0,0 +1,549 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/hanjm/log"
+	"io/ioutil"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+// NativeTorrentTask downloads the magnet or torrent by the in-process BitTorrent engine, aria2c is not needed.
+// the partial files are verified and continued when the task is restarted
+type NativeTorrentTask struct {
+	TaskType int
+	TaskInfo
+	infoHash string
+	// the torrent in the engine while downloading or seeding
+	torrent  *btTorrent
+	canceled bool
+	cancel   context.CancelFunc
+	done     chan struct{}
+	mutex    sync.Mutex
+}
+
+// nativeTorrentTaskRecord is the NativeTorrentTask in the backup file
+type nativeTorrentTaskRecord struct {
+	TaskType int
+	TaskInfo
+	InfoHash string `json:",omitempty"`
+}
+
+func (t *NativeTorrentTask) MarshalJSON() ([]byte, error) {
+	t.mutex.Lock()
+	record := nativeTorrentTaskRecord{
+		TaskType: t.TaskType,
+		TaskInfo: t.TaskInfo,
+		InfoHash: t.infoHash,
+	}
+	t.mutex.Unlock()
+	return json.Marshal(&record)
+}
+
+func (t *NativeTorrentTask) UnmarshalJSON(data []byte) error {
+	var record nativeTorrentTaskRecord
+	if err := json.Unmarshal(data, &record); err != nil {
+		return err
+	}
+	t.TaskType, t.TaskInfo, t.infoHash = record.TaskType, record.TaskInfo, record.InfoHash
+	return nil
+}
+
+// newNativeTorrentTask converts the torrent task to the task of native engine
+func newNativeTorrentTask(task *MagnetTask) *NativeTorrentTask {
+	t := &NativeTorrentTask{
+		TaskType: task.TaskType,
+		TaskInfo: task.TaskInfo,
+		infoHash: task.infoHash,
+	}
+	t.TaskInfo.Backend = BackendBitTorrentNative
+	return t
+}
+
+// torrentTaskOfEngine returns the torrent task downloaded by the engine of -btEngine
+func torrentTaskOfEngine(task *MagnetTask) TorrentTask {
+	if useNativeBTEngine() {
+		return newNativeTorrentTask(task)
+	}
+	return task
+}
+
+func (t *NativeTorrentTask) Download(downloadDir string, limitByteSize int64, limitTimeout time.Duration) (err error) {
+	engine, err := getBTEngine()
+	if err != nil {
+		return t.Errorf("%s", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), limitTimeout)
+	defer cancel()
+	done := make(chan struct{})
+	defer close(done)
+	t.mutex.Lock()
+	t.cancel, t.done = cancel, done
+	canceled := t.canceled
+	t.mutex.Unlock()
+	if canceled {
+		// the task is deleted before it starts
+		return t.Errorf("task canceled")
+	}
+	fs := NewConfinedFS(downloadDir)
+	info, trackers, err := t.source(downloadDir)
+	if err != nil {
+		return t.Errorf("%s", err)
+	}
+	bt, err := engine.AddTorrent(t.hash(), info, downloadDir, trackers)
+	if err != nil {
+		return t.Errorf("%s", err)
+	}
+	// the torrent is removed from the engine unless it is seeding
+	var seeding bool
+	defer func() {
+		if seeding && err == nil {
+			t.startSeeding(engine, bt)
+			return
+		}
+		engine.RemoveTorrent(bt)
+		t.mutex.Lock()
+		t.torrent = nil
+		// the files of created torrent are downloaded before, they are never removed
+		removeFiles := err != nil && t.CreatedTorrent == "" && (*aria2cCleanPartial || t.canceled)
+		t.mutex.Unlock()
+		if info := bt.Info(); removeFiles && info != nil {
+			if err := fs.RemoveAll(info.Name); err != nil {
+				log.Warnf("remove partial file %s error:%s", info.Name, err)
+			}
+			log.Infof("removed partial file %s", info.Name)
+		}
+	}()
+	t.mutex.Lock()
+	t.torrent = bt
+	t.mutex.Unlock()
+	bt.Start()
+	log.Infof("create native torrent task: sourceURL:%s, infoHash:%s, trackers:%d", t.SourceURL, t.InfoHash(), len(trackers))
+	t.StartTime = time.Now()
+	if info == nil {
+		select {
+		case <-bt.GotInfo():
+		case <-ctx.Done():
+			return t.ctxErr(ctx, limitTimeout)
+		}
+		info = bt.Info()
+		// saved like the metadata of aria2c, the magnet can be converted to torrent and restarted without fetching it again
+		data, err := BencodeEncode(map[string]interface{}{"info": BencodeRaw(info.info)})
+		if err == nil {
+			err = fs.WriteFile(info.InfoHash+".torrent", data, 0644)
+		}
+		if err != nil {
+			log.Warnf("save metadata of %s error:%s", info.InfoHash, err)
+		}
+	}
+	t.setFiles(info)
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	// the selection given to the engine, the files selected while downloading are applied by the next tick
+	var selected []bool
+	completed := bt.Completed()
+	for {
+		t.mutex.Lock()
+		awaiting, current := t.AwaitingSelection, selectedTaskFiles(t.Files)
+		t.mutex.Unlock()
+		if !awaiting && !equalBools(selected, current) {
+			if length := selectedLength(info, current); length > limitByteSize {
+				return t.Errorf("the length of selected files is too big:%d, limit:%d", length, limitByteSize)
+			}
+			bt.Select(current)
+			selected = current
+		}
+		if err := bt.Err(); err != nil {
+			return t.Errorf("%s", err)
+		}
+		if selected != nil {
+			stats := bt.Stats(selected)
+			t.update(stats)
+			if stats.Completed == stats.Length {
+				break
+			}
+		}
+		select {
+		case <-ticker.C:
+		case <-completed:
+			completed = nil
+		case <-ctx.Done():
+			return t.ctxErr(ctx, limitTimeout)
+		}
+	}
+	t.TaskInfo.IsCompleted = true
+	t.Duration = time.Now().Sub(t.StartTime)
+	t.Speed = calculateDownloadSpeed(t.Size, t.Duration)
+	log.Infof("complete native torrent task: length:%s filename:%s, duration:%s", getHumanSizeString(t.TaskInfo.ContentLength), t.FileName(), t.Duration)
+	if policy := t.seedPolicy(); policy.Mode != "" && policy.Mode != SeedModeNone {
+		seeding = true
+	}
+	return nil
+}
+
+func (t *NativeTorrentTask) ctxErr(ctx context.Context, timeout time.Duration) error {
+	if ctx.Err() == context.DeadlineExceeded {
+		return t.Errorf("task timeout:%s", timeout)
+	}
+	return t.Errorf("task canceled")
+}
+
+// source returns the metadata and the trackers of the task, the metadata is nil for the magnet which is not fetched yet.
+// the base64 torrent is saved as <info hash>.torrent and the sourceURL is changed to it, like MagnetTask
+func (t *NativeTorrentTask) source(downloadDir string) (*TorrentInfo, []string, error) {
+	fs := NewConfinedFS(downloadDir)
+	t.mutex.Lock()
+	sourceURL, taskTrackers := t.SourceURL, t.Trackers
+	t.mutex.Unlock()
+	var info *TorrentInfo
+	var infoHash string
+	var trackers []string
+	if strings.HasPrefix(sourceURL, "magnet:") {
+		magnet, err := ParseMagnet(sourceURL)
+		if err != nil {
+			return nil, nil, err
+		}
+		if magnet.InfoHash == "" {
+			return nil, nil, fmt.Errorf("the magnet of v2 only torrent is not supported")
+		}
+		infoHash, trackers = magnet.InfoHash, magnet.Trackers
+		// the metadata fetched before is reused
+		if data, err := fs.ReadFile(infoHash + ".torrent"); err == nil {
+			if saved, err := ParseTorrent(data); err == nil && saved.InfoHash == infoHash {
+				info = saved
+			}
+		}
+	} else {
+		data, err := base64.StdEncoding.DecodeString(sourceURL)
+		isBase64 := err == nil
+		if !isBase64 {
+			// the torrent file in downloadDir, for reDownload torrent
+			if data, err = ioutil.ReadFile(sourceURL); err != nil {
+				return nil, nil, fmt.Errorf("read torrent file error:%s", err)
+			}
+		}
+		if info, err = ParseTorrent(data); err != nil {
+			return nil, nil, err
+		}
+		if info.InfoHash == "" {
+			return nil, nil, fmt.Errorf("the v2 only torrent is not supported")
+		}
+		infoHash = info.InfoHash
+		for _, tier := range info.Trackers {
+			trackers = append(trackers, tier...)
+		}
+		if isBase64 {
+			torrentFilename := infoHash + ".torrent"
+			if err := fs.WriteFile(torrentFilename, data, 0644); err != nil {
+				log.Warnf("save torrent file error:%s", err)
+			} else {
+				t.mutex.Lock()
+				t.SourceURL = downloadDir + "/" + torrentFilename
+				t.mutex.Unlock()
+			}
+		}
+	}
+	t.mutex.Lock()
+	t.infoHash = infoHash
+	t.mutex.Unlock()
+	return info, dedupeTrackers(append(append(trackers, taskTrackers...), trackerList.Trackers()...)), nil
+}
+
+// hash returns the binary info hash
+func (t *NativeTorrentTask) hash() (hash [20]byte) {
+	data, _ := hex.DecodeString(t.InfoHash())
+	copy(hash[:], data)
+	return hash
+}
+
+// setFiles sets the files of torrent, the selection of the task restored from the backup file is kept
+func (t *NativeTorrentTask) setFiles(info *TorrentInfo) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.TaskInfo.FileName = info.Name
+	if len(t.Files) == len(info.Files) {
+		return
+	}
+	t.Files = make([]TaskFile, 0, len(info.Files))
+	for i, file := range info.Files {
+		t.Files = append(t.Files, TaskFile{Index: i + 1, Path: file.Path, Length: file.Length, Selected: true})
+	}
+}
+
+// update updates the progress of task and its files
+func (t *NativeTorrentTask) update(stats *btStats) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.TaskInfo.ContentLength = stats.Length
+	t.Size = stats.Completed
+	t.Duration = time.Now().Sub(t.StartTime)
+	t.Speed = stats.DownloadSpeed
+	t.UploadSpeed = stats.UploadSpeed
+	for i := range t.Files {
+		if i < len(stats.Files) {
+			t.Files[i].CompletedLength = stats.Files[i]
+		}
+	}
+}
+
+// selectedTaskFiles returns whether the files are selected in the order of torrent
+func selectedTaskFiles(files []TaskFile) []bool {
+	selected := make([]bool, len(files))
+	for i, file := range files {
+		selected[i] = file.Selected
+	}
+	return selected
+}
+
+func selectedLength(info *TorrentInfo, selected []bool) int64 {
+	var length int64
+	for i, file := range info.Files {
+		if i < len(selected) && selected[i] {
+			length += file.Length
+		}
+	}
+	return length
+}
+
+func equalBools(a []bool, b []bool) bool {
+	if a == nil || b == nil || len(a) != len(b) {
+		return a == nil && b == nil
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// InfoHash returns the info hash of torrent
+func (t *NativeTorrentTask) InfoHash() string {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.infoHash
+}
+
+// Cancel stops the downloading task, the partial files are removed too. the seeding task stops seeding and keeps its files
+func (t *NativeTorrentTask) Cancel() {
+	t.mutex.Lock()
+	cancel, done := t.cancel, t.done
+	t.canceled = true
+	t.mutex.Unlock()
+	if cancel == nil {
+		return
+	}
+	cancel()
+	<-done
+}
+
+// SelectFiles chooses the files of torrent to download, it starts the task which is awaiting selection,
+// and the selection can be changed while the torrent is downloading
+func (t *NativeTorrentTask) SelectFiles(indexes []int) error {
+	if len(indexes) == 0 {
+		return fmt.Errorf("select at least one file")
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.torrent == nil || t.TaskInfo.IsCompleted {
+		return fmt.Errorf("task is not downloading")
+	}
+	if len(t.Files) == 0 {
+		return fmt.Errorf("the files of torrent are not known yet")
+	}
+	selected := make(map[int]bool, len(indexes))
+	for _, index := range indexes {
+		if index < 1 || index > len(t.Files) {
+			return fmt.Errorf("file index %d is out of range 1-%d", index, len(t.Files))
+		}
+		selected[index] = true
+	}
+	for i := range t.Files {
+		t.Files[i].Selected = selected[t.Files[i].Index]
+	}
+	t.AwaitingSelection = false
+	log.Infof("select files of task %s:%s", t.TaskInfo.FileName, selectFileOption(t.Files))
+	return nil
+}
+
+// seedPolicy returns the policy of the task, the global policy is used if the task does not set it
+func (t *NativeTorrentTask) seedPolicy() SeedPolicy {
+	t.mutex.Lock()
+	s := t.SeedPolicy
+	t.mutex.Unlock()
+	return taskSeedPolicy(t.FileName(), s)
+}
+
+// SetSeedPolicy changes the seeding policy of task, the seeding task checks it every second
+func (t *NativeTorrentTask) SetSeedPolicy(policy SeedPolicy) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.SeedPolicy = policy.String()
+	return nil
+}
+
+// startSeeding hands the completed torrent over to the seeding goroutine, Cancel stops seeding
+func (t *NativeTorrentTask) startSeeding(engine *BTEngine, bt *btTorrent) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	t.mutex.Lock()
+	t.cancel, t.done = cancel, done
+	t.torrent = bt
+	t.Seeding = true
+	t.mutex.Unlock()
+	log.Infof("start seeding task:%s, policy:%s", t.FileName(), t.seedPolicy())
+	go t.seed(ctx, engine, bt, done)
+}
+
+// seed updates the upload speed and ratio until the seeding policy is satisfied or the task is canceled,
+// the completed files are kept
+func (t *NativeTorrentTask) seed(ctx context.Context, engine *BTEngine, bt *btTorrent, done chan struct{}) {
+	defer close(done)
+	defer func() {
+		engine.RemoveTorrent(bt)
+		t.mutex.Lock()
+		t.torrent = nil
+		t.Seeding, t.UploadSpeed = false, 0
+		t.mutex.Unlock()
+		log.Infof("stop seeding task:%s, uploaded:%s, ratio:%.2f", t.FileName(), getHumanSizeString(t.Uploaded), t.Ratio)
+	}()
+	t.mutex.Lock()
+	// the uploaded of the previous sessions, and the seeding time is counted from the completion
+	uploaded, selected := t.Uploaded, selectedTaskFiles(t.Files)
+	start := t.StartTime.Add(t.Duration)
+	t.mutex.Unlock()
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		stats := bt.Stats(selected)
+		t.mutex.Lock()
+		t.UploadSpeed = stats.UploadSpeed
+		t.Uploaded = uploaded + stats.Uploaded
+		if t.TaskInfo.ContentLength > 0 {
+			t.Ratio = float64(t.Uploaded) / float64(t.TaskInfo.ContentLength)
+		}
+		ratio := t.Ratio
+		t.mutex.Unlock()
+		switch policy := t.seedPolicy(); policy.Mode {
+		case SeedModeRatio:
+			if ratio >= policy.Ratio {
+				return
+			}
+		case SeedModeHours:
+			if time.Since(start) >= time.Duration(policy.Hours*float64(time.Hour)) {
+				return
+			}
+		case SeedModeForever:
+		default:
+			return
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// ResumeSeeding verifies the completed files of the task restored from the backup and seeds them again
+func (t *NativeTorrentTask) ResumeSeeding(downloadDir string) {
+	err := func() error {
+		engine, err := getBTEngine()
+		if err != nil {
+			return err
+		}
+		info, trackers, err := t.source(downloadDir)
+		if err != nil {
+			return err
+		}
+		if info == nil {
+			return fmt.Errorf("the metadata is not found")
+		}
+		bt, err := engine.AddTorrent(t.hash(), info, downloadDir, trackers)
+		if err != nil {
+			return err
+		}
+		t.mutex.Lock()
+		selected := selectedTaskFiles(t.Files)
+		t.mutex.Unlock()
+		bt.Select(selected)
+		if stats := bt.Stats(selected); stats.Completed != stats.Length {
+			engine.RemoveTorrent(bt)
+			return fmt.Errorf("the files are changed")
+		}
+		bt.Start()
+		t.startSeeding(engine, bt)
+		return nil
+	}()
+	if err != nil {
+		t.mutex.Lock()
+		t.Seeding, t.UploadSpeed = false, 0
+		t.mutex.Unlock()
+		log.Infof("resume seeding task %s error:%s", t.FileName(), err)
+	}
+}
+
+// Swarm returns the peers and trackers of the torrent in the engine
+func (t *NativeTorrentTask) Swarm() (*Swarm, error) {
+	t.mutex.Lock()
+	bt, seeding := t.torrent, t.Seeding
+	t.mutex.Unlock()
+	if bt == nil {
+		return nil, fmt.Errorf("task is not downloading or seeding")
+	}
+	swarm := bt.Swarm()
+	if seeding {
+		swarm.Status = "seeding"
+	}
+	return swarm, nil
+}
+
+// Torrent returns the torrent file of task, the magnet is converted to torrent with the metadata fetched from the peers
+func (t *NativeTorrentTask) Torrent(downloadDir string) ([]byte, error) {
+	t.mutex.Lock()
+	sourceURL, infoHash := t.SourceURL, t.infoHash
+	t.mutex.Unlock()
+	return sourceTorrent(downloadDir, sourceURL, infoHash)
+}
+
+// Magnet returns the magnet link of task, the torrent is converted to magnet with its trackers and web seeds
+func (t *NativeTorrentTask) Magnet(downloadDir string) (*Magnet, error) {
+	t.mutex.Lock()
+	sourceURL, infoHash, trackers := t.SourceURL, t.infoHash, t.Trackers
+	t.mutex.Unlock()
+	return sourceMagnet(downloadDir, sourceURL, infoHash, trackers)
+}
+
+func (t *NativeTorrentTask) infoMutex() *sync.Mutex {
+	return &t.mutex
+}
+
+func (t *NativeTorrentTask) IsCompleted() bool {
+	return t.TaskInfo.IsCompleted
+}
+
+func (t *NativeTorrentTask) FileName() string {
+	return t.TaskInfo.FileName
+}
+
+func (t *NativeTorrentTask) ContentLength() int64 {
+	return t.TaskInfo.ContentLength
+}
+
+func (t *NativeTorrentTask) Errorf(format string, a ...interface{}) (err error) {
+	err = fmt.Errorf(format, a...)
+	_, file, line, ok := runtime.Caller(1)
+	if ok {
+		log.Errorf("[%s:%d]%s", file, line, err.Error())
+	}
+	t.TaskInfo.IsError = true
+	t.TaskInfo.IsCompleted = true
+	t.TaskInfo.Error = err.Error()
+	return err
+}
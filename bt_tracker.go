@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// the interval of announce if the tracker does not tell, and the bounds of the interval told by the tracker
+var (
+	btAnnounceInterval    = 30 * time.Minute
+	btMinAnnounceInterval = time.Minute
+	btAnnounceTimeout     = 15 * time.Second
+)
+
+// btAnnounceRequest is the announce of BEP 3 and BEP 15
+type btAnnounceRequest struct {
+	InfoHash   [20]byte
+	PeerID     [20]byte
+	Port       int
+	Uploaded   int64
+	Downloaded int64
+	Left       int64
+	// started, completed, stopped or empty
+	Event string
+}
+
+type btAnnounceResponse struct {
+	Interval time.Duration
+	// the addresses of peers, host:port
+	Peers []string
+}
+
+// btAnnounce announces to the http or udp tracker, the egress policy is applied
+func btAnnounce(ctx context.Context, tracker string, request *btAnnounceRequest) (*btAnnounceResponse, error) {
+	u, err := url.Parse(tracker)
+	if err != nil {
+		return nil, fmt.Errorf("invalid tracker:%s", err)
+	}
+	ctx, cancel := context.WithTimeout(ctx, btAnnounceTimeout)
+	defer cancel()
+	var response *btAnnounceResponse
+	switch u.Scheme {
+	case "udp":
+		response, err = btAnnounceUDP(ctx, u.Host, request)
+	case "http", "https":
+		response, err = btAnnounceHTTP(ctx, tracker, request)
+	default:
+		return nil, errTrackerProbeUnsupported
+	}
+	if err != nil {
+		return nil, err
+	}
+	if response.Interval <= 0 {
+		response.Interval = btAnnounceInterval
+	} else if response.Interval < btMinAnnounceInterval {
+		response.Interval = btMinAnnounceInterval
+	}
+	return response, nil
+}
+
+func btAnnounceHTTP(ctx context.Context, tracker string, request *btAnnounceRequest) (*btAnnounceResponse, error) {
+	query := url.Values{
+		"info_hash":  {string(request.InfoHash[:])},
+		"peer_id":    {string(request.PeerID[:])},
+		"port":       {strconv.Itoa(request.Port)},
+		"uploaded":   {strconv.FormatInt(request.Uploaded, 10)},
+		"downloaded": {strconv.FormatInt(request.Downloaded, 10)},
+		"left":       {strconv.FormatInt(request.Left, 10)},
+		"compact":    {"1"},
+		"numwant":    {"50"},
+	}
+	if request.Event != "" {
+		query.Set("event", request.Event)
+	}
+	separator := "?"
+	if strings.Contains(tracker, "?") {
+		separator = "&"
+	}
+	req, err := http.NewRequest(http.MethodGet, tracker+separator+query.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialContext: egressPolicy.DialContext,
+		},
+		CheckRedirect: checkRedirect,
+	}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("tracker responds %s", resp.Status)
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, btMaxMessageLength+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > btMaxMessageLength {
+		return nil, fmt.Errorf("announce response is too large")
+	}
+	v, err := BencodeDecode(data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid announce response:%s", err)
+	}
+	dict, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("invalid announce response:not dict")
+	}
+	if reason, ok := dict["failure reason"].(string); ok {
+		return nil, fmt.Errorf("tracker failure:%s", reason)
+	}
+	response := &btAnnounceResponse{}
+	if interval, ok := dict["interval"].(int64); ok {
+		response.Interval = time.Duration(interval) * time.Second
+	}
+	switch peers := dict["peers"].(type) {
+	case string:
+		response.Peers = parseCompactPeers([]byte(peers), net.IPv4len)
+	case []interface{}:
+		// the peer list of dicts, it is returned by the trackers ignoring compact
+		for _, p := range peers {
+			peer, ok := p.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			ip, _ := peer["ip"].(string)
+			port, _ := peer["port"].(int64)
+			if ip != "" && port > 0 && port < 65536 {
+				response.Peers = append(response.Peers, net.JoinHostPort(ip, strconv.FormatInt(port, 10)))
+			}
+		}
+	}
+	if peers, ok := dict["peers6"].(string); ok {
+		response.Peers = append(response.Peers, parseCompactPeers([]byte(peers), net.IPv6len)...)
+	}
+	return response, nil
+}
+
+// parseCompactPeers parses the ip and port of peers, the ip is 4 or 16 bytes
+func parseCompactPeers(data []byte, ipLen int) []string {
+	var peers []string
+	size := ipLen + 2
+	for i := 0; i+size <= len(data); i += size {
+		ip := net.IP(data[i : i+ipLen])
+		port := binary.BigEndian.Uint16(data[i+ipLen : i+size])
+		if port == 0 {
+			continue
+		}
+		peers = append(peers, net.JoinHostPort(ip.String(), strconv.Itoa(int(port))))
+	}
+	return peers
+}
+
+// the events of udp announce
+var btUDPEvents = map[string]uint32{"": 0, "completed": 1, "started": 2, "stopped": 3}
+
+func btAnnounceUDP(ctx context.Context, addr string, request *btAnnounceRequest) (*btAnnounceResponse, error) {
+	conn, err := egressPolicy.DialContext(ctx, "udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	connectionID, err := udpTrackerConnect(conn)
+	if err != nil {
+		return nil, err
+	}
+	transactionID := rand.Uint32()
+	packet := make([]byte, 98)
+	binary.BigEndian.PutUint64(packet[0:8], connectionID)
+	binary.BigEndian.PutUint32(packet[8:12], 1)
+	binary.BigEndian.PutUint32(packet[12:16], transactionID)
+	copy(packet[16:36], request.InfoHash[:])
+	copy(packet[36:56], request.PeerID[:])
+	binary.BigEndian.PutUint64(packet[56:64], uint64(request.Downloaded))
+	binary.BigEndian.PutUint64(packet[64:72], uint64(request.Left))
+	binary.BigEndian.PutUint64(packet[72:80], uint64(request.Uploaded))
+	binary.BigEndian.PutUint32(packet[80:84], btUDPEvents[request.Event])
+	binary.BigEndian.PutUint32(packet[88:92], rand.Uint32())
+	binary.BigEndian.PutUint32(packet[92:96], 50)
+	binary.BigEndian.PutUint16(packet[96:98], uint16(request.Port))
+	if _, err := conn.Write(packet); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 20+6*200)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return nil, err
+	}
+	if n >= 8 && binary.BigEndian.Uint32(buf[0:4]) == 3 && binary.BigEndian.Uint32(buf[4:8]) == transactionID {
+		return nil, fmt.Errorf("tracker failure:%s", buf[8:n])
+	}
+	if n < 20 || binary.BigEndian.Uint32(buf[0:4]) != 1 || binary.BigEndian.Uint32(buf[4:8]) != transactionID {
+		return nil, fmt.Errorf("invalid announce response")
+	}
+	return &btAnnounceResponse{
+		Interval: time.Duration(binary.BigEndian.Uint32(buf[8:12])) * time.Second,
+		Peers:    parseCompactPeers(buf[20:n], net.IPv4len),
+	}, nil
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var (
+	ErrPathEscapes = errors.New("path escapes the download dir")
+	ErrPathInvalid = errors.New("path is invalid")
+)
+
+// ConfinedFS confines the file operations to the root dir, the path which escapes the root dir
+// by "..", absolute path or symlink is rejected. name is always relative to the root dir, separated by "/".
+type ConfinedFS struct {
+	root string
+}
+
+func NewConfinedFS(root string) *ConfinedFS {
+	return &ConfinedFS{root: root}
+}
+
+// Resolve returns the real path of name, the symlinks are resolved
+func (fs *ConfinedFS) Resolve(name string) (string, error) {
+	return fs.resolve(name, true)
+}
+
+// resolve returns the path of name on disk, the symlinks of the parent dirs are always resolved,
+// the last element is resolved only if followLast, so the symlink itself can be removed or renamed
+func (fs *ConfinedFS) resolve(name string, followLast bool) (string, error) {
+	if strings.IndexByte(name, 0) != -1 {
+		return "", ErrPathInvalid
+	}
+	rel := filepath.Clean(filepath.FromSlash(strings.TrimPrefix(name, "/")))
+	if rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) || filepath.IsAbs(rel) {
+		return "", ErrPathEscapes
+	}
+	root, err := fs.rootPath()
+	if err != nil {
+		return "", err
+	}
+	if rel == "." {
+		return root, nil
+	}
+	dir, base := filepath.Split(rel)
+	if dir, err = evalExistingSymlinks(filepath.Join(root, dir)); err != nil {
+		return "", err
+	}
+	path := filepath.Join(dir, base)
+	if followLast {
+		if path, err = evalExistingSymlinks(path); err != nil {
+			return "", err
+		}
+	}
+	if !isWithin(root, path) {
+		return "", ErrPathEscapes
+	}
+	return path, nil
+}
+
+func (fs *ConfinedFS) rootPath() (string, error) {
+	root, err := filepath.Abs(fs.root)
+	if err != nil {
+		return "", err
+	}
+	return filepath.EvalSymlinks(root)
+}
+
+// evalExistingSymlinks resolves the symlinks of the longest existing prefix of path, the rest of path is kept
+func evalExistingSymlinks(path string) (string, error) {
+	var rest []string
+	for {
+		resolved, err := filepath.EvalSymlinks(path)
+		if err == nil {
+			for i := len(rest) - 1; i >= 0; i-- {
+				resolved = filepath.Join(resolved, rest[i])
+			}
+			return resolved, nil
+		}
+		if !os.IsNotExist(err) {
+			return "", err
+		}
+		parent := filepath.Dir(path)
+		if parent == path {
+			return "", err
+		}
+		rest = append(rest, filepath.Base(path))
+		path = parent
+	}
+}
+
+func isWithin(root string, path string) bool {
+	rel, err := filepath.Rel(root, path)
+	if err != nil {
+		return false
+	}
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// resolveEntry resolves name which must be an entry inside the root dir, not the root dir itself
+func (fs *ConfinedFS) resolveEntry(name string) (string, error) {
+	path, err := fs.resolve(name, false)
+	if err != nil {
+		return "", err
+	}
+	if root, err := fs.rootPath(); err != nil || root == path {
+		return "", ErrPathInvalid
+	}
+	return path, nil
+}
+
+// resolveWritable resolves name for writing, writing through the symlink is allowed only if its target is confined
+func (fs *ConfinedFS) resolveWritable(name string) (string, error) {
+	path, err := fs.resolveEntry(name)
+	if err != nil {
+		return "", err
+	}
+	if fi, err := os.Lstat(path); err != nil || fi.Mode()&os.ModeSymlink == 0 {
+		return path, nil
+	}
+	target, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		// dangling symlink, the target can not be checked
+		return "", ErrPathInvalid
+	}
+	root, err := fs.rootPath()
+	if err != nil {
+		return "", err
+	}
+	if !isWithin(root, target) || root == target {
+		return "", ErrPathEscapes
+	}
+	return target, nil
+}
+
+func (fs *ConfinedFS) Stat(name string) (os.FileInfo, error) {
+	path, err := fs.Resolve(name)
+	if err != nil {
+		return nil, err
+	}
+	return os.Stat(path)
+}
+
+func (fs *ConfinedFS) ReadDir(name string) ([]os.FileInfo, error) {
+	path, err := fs.Resolve(name)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadDir(path)
+}
+
+func (fs *ConfinedFS) ReadFile(name string) ([]byte, error) {
+	path, err := fs.Resolve(name)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadFile(path)
+}
+
+func (fs *ConfinedFS) WriteFile(name string, data []byte, perm os.FileMode) error {
+	path, err := fs.resolveWritable(name)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, data, perm)
+}
+
+// Create creates or truncates the file
+func (fs *ConfinedFS) Create(name string) (*os.File, error) {
+	path, err := fs.resolveWritable(name)
+	if err != nil {
+		return nil, err
+	}
+	return os.Create(path)
+}
+
+// OpenFile is the confined os.OpenFile
+func (fs *ConfinedFS) OpenFile(name string, flag int, perm os.FileMode) (*os.File, error) {
+	path, err := fs.resolveWritable(name)
+	if err != nil {
+		return nil, err
+	}
+	return os.OpenFile(path, flag, perm)
+}
+
+func (fs *ConfinedFS) MkdirAll(name string, perm os.FileMode) error {
+	path, err := fs.Resolve(name)
+	if err != nil {
+		return err
+	}
+	return os.MkdirAll(path, perm)
+}
+
+// Remove removes the file or empty dir, the symlink itself is removed rather than its target
+func (fs *ConfinedFS) Remove(name string) error {
+	path, err := fs.resolveEntry(name)
+	if err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
+
+// RemoveAll removes the file or dir recursively, the root dir itself can not be removed
+func (fs *ConfinedFS) RemoveAll(name string) error {
+	path, err := fs.resolveEntry(name)
+	if err != nil {
+		return err
+	}
+	return os.RemoveAll(path)
+}
+
+// Rename moves oldname to newname, both are confined
+func (fs *ConfinedFS) Rename(oldname string, newname string) error {
+	oldpath, err := fs.resolveEntry(oldname)
+	if err != nil {
+		return err
+	}
+	newpath, err := fs.resolveEntry(newname)
+	if err != nil {
+		return err
+	}
+	return os.Rename(oldpath, newpath)
+}
+
+// Open implements http.FileSystem, so the files can be served by http.FileServer
+func (fs *ConfinedFS) Open(name string) (http.File, error) {
+	path, err := fs.Resolve(name)
+	if err != nil {
+		if err == ErrPathEscapes || err == ErrPathInvalid {
+			return nil, os.ErrPermission
+		}
+		return nil, err
+	}
+	return os.Open(path)
+}
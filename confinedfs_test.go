@@ -0,0 +1,177 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// withConfinedEnv builds the dirs:
+//
+//	base/secret.txt
+//	base/download/file.txt
+//	base/download/dir/inner.txt
+//	base/download/escape -> base
+//	base/download/inside -> base/download/dir
+//	base/download/dangling -> base/missing.txt
+func withConfinedEnv(t *testing.T, fn func(base string, fs *ConfinedFS)) {
+	base, err := ioutil.TempDir("", "fdp-confined")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(base)
+	root := filepath.Join(base, "download")
+	mustWrite := func(path string) {
+		if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(path), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mustWrite(filepath.Join(base, "secret.txt"))
+	mustWrite(filepath.Join(root, "file.txt"))
+	mustWrite(filepath.Join(root, "dir", "inner.txt"))
+	for link, target := range map[string]string{
+		"escape":   base,
+		"inside":   filepath.Join(root, "dir"),
+		"dangling": filepath.Join(base, "missing.txt"),
+	} {
+		if err := os.Symlink(target, filepath.Join(root, link)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fn(base, NewConfinedFS(root))
+}
+
+var hostileNames = []string{
+	"..",
+	"../",
+	"../secret.txt",
+	"dir/../../secret.txt",
+	"./../secret.txt",
+	"escape/secret.txt",
+	"inside/../../secret.txt",
+	"file.txt\x00.jpg",
+}
+
+func TestConfinedFS_HostileNames(t *testing.T) {
+	withConfinedEnv(t, func(base string, fs *ConfinedFS) {
+		for _, name := range hostileNames {
+			if _, err := fs.Stat(name); err == nil {
+				t.Errorf("Stat(%q) expect error", name)
+			}
+			if _, err := fs.ReadFile(name); err == nil {
+				t.Errorf("ReadFile(%q) expect error", name)
+			}
+			if err := fs.WriteFile(name, []byte("pwned"), 0644); err == nil {
+				t.Errorf("WriteFile(%q) expect error", name)
+			}
+			if err := fs.RemoveAll(name); err == nil {
+				t.Errorf("RemoveAll(%q) expect error", name)
+			}
+			if err := fs.Rename("file.txt", name); err == nil {
+				t.Errorf("Rename(file.txt, %q) expect error", name)
+			}
+		}
+		if _, err := os.Stat(filepath.Join(base, "secret.txt")); err != nil {
+			t.Fatalf("secret.txt is removed:%s", err)
+		}
+		if _, err := os.Stat(filepath.Join(base, "download", "file.txt")); err != nil {
+			t.Fatalf("file.txt is moved:%s", err)
+		}
+	})
+}
+
+func TestConfinedFS_Root(t *testing.T) {
+	withConfinedEnv(t, func(base string, fs *ConfinedFS) {
+		for _, name := range []string{"", ".", "/", "dir/..", "./"} {
+			if err := fs.RemoveAll(name); err == nil {
+				t.Errorf("RemoveAll(%q) expect error", name)
+			}
+			if err := fs.Rename(name, "moved"); err == nil {
+				t.Errorf("Rename(%q) expect error", name)
+			}
+		}
+		if _, err := fs.ReadDir("."); err != nil {
+			t.Fatalf("ReadDir root error:%s", err)
+		}
+	})
+}
+
+func TestConfinedFS_Symlinks(t *testing.T) {
+	withConfinedEnv(t, func(base string, fs *ConfinedFS) {
+		// the symlink inside the root dir is followed
+		data, err := fs.ReadFile("inside/inner.txt")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != filepath.Join(base, "download", "dir", "inner.txt") {
+			t.Fatalf("unexpected content:%s", data)
+		}
+		// writing through the dangling symlink must not create the file outside
+		if err := fs.WriteFile("dangling", []byte("pwned"), 0644); err == nil {
+			t.Fatal("WriteFile(dangling) expect error")
+		}
+		if _, err := os.Stat(filepath.Join(base, "missing.txt")); !os.IsNotExist(err) {
+			t.Fatal("missing.txt is created")
+		}
+		// removing the symlink removes the link itself, not its target
+		if err := fs.RemoveAll("escape"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := os.Stat(filepath.Join(base, "secret.txt")); err != nil {
+			t.Fatalf("secret.txt is removed:%s", err)
+		}
+	})
+}
+
+func TestConfinedFS_Open(t *testing.T) {
+	withConfinedEnv(t, func(base string, fs *ConfinedFS) {
+		server := httptest.NewServer(http.FileServer(fs))
+		defer server.Close()
+		for _, name := range []string{"/escape/secret.txt", "/inside/../../secret.txt", "/..%2fsecret.txt"} {
+			resp, err := http.Get(server.URL + name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode == http.StatusOK {
+				t.Errorf("GET %s expect fail", name)
+			}
+		}
+		resp, err := http.Get(server.URL + "/file.txt")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("GET /file.txt status:%d", resp.StatusCode)
+		}
+	})
+}
+
+func TestTasksManager_TaskHandlerHostileFilename(t *testing.T) {
+	withConfinedEnv(t, func(base string, fs *ConfinedFS) {
+		m := NewTasksManager(filepath.Join(base, "download"), 1024, time.Minute)
+		m.ListFiles()
+		for _, query := range []string{"filename=..", "filename=%2e%2e", "filename=../secret.txt", "filename=.", "filename=" + trashDirName, "filename=escape%2f..", "filename="} {
+			for _, method := range []string{http.MethodGet, http.MethodDelete} {
+				w := httptest.NewRecorder()
+				m.TaskHandler(w, httptest.NewRequest(method, "/file_download_proxy/task?"+query, nil))
+				if method == http.MethodGet && w.Code == http.StatusTemporaryRedirect {
+					t.Errorf("%s %s expect fail, redirect to %s", method, query, w.Header().Get("Location"))
+				}
+			}
+		}
+		for _, name := range []string{"secret.txt", "download/file.txt", "download/dir/inner.txt"} {
+			if _, err := os.Stat(filepath.Join(base, name)); err != nil {
+				t.Fatalf("%s is removed:%s", name, err)
+			}
+		}
+	})
+}
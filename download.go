@@ -4,16 +4,19 @@ import (
 	"bufio"
 	"context"
 	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/hanjm/log"
 	"io"
 	"io/ioutil"
-	"net"
 	"net/http"
-	"os"
+	"path/filepath"
 	"regexp"
 	"runtime"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -22,17 +25,183 @@ type Task interface {
 	IsCompleted() bool
 	FileName() string
 	ContentLength() int64
+	Info() *TaskInfo
 }
 
+// Canceler is implemented by the task which can be stopped while downloading
+type Canceler interface {
+	// Cancel stops the download and releases its resources, it returns after the task is stopped
+	Cancel()
+}
+
+// FileSelector is implemented by the task which can choose the files to download, like the torrent
+type FileSelector interface {
+	// SelectFiles chooses the files by their indexes, the index starts from 1
+	SelectFiles(indexes []int) error
+}
+
+// TorrentTask is the task of BitTorrent, it is downloaded by aria2c or the native engine
+type TorrentTask interface {
+	Task
+	Canceler
+	FileSelector
+	// InfoHash returns the hex info hash, it is empty if it is not known yet
+	InfoHash() string
+	Torrent(downloadDir string) ([]byte, error)
+	Magnet(downloadDir string) (*Magnet, error)
+	SetSeedPolicy(policy SeedPolicy) error
+	// ResumeSeeding continues seeding the task restored from the backup file
+	ResumeSeeding(downloadDir string)
+	Swarm() (*Swarm, error)
+}
+
+// the backends of http, aria2c and BitTorrent
+const (
+	BackendHTTP             = "http"
+	BackendAria2c           = "aria2c"
+	BackendBitTorrent       = "bittorrent"
+	BackendBitTorrentNative = "bittorrent-native"
+)
+
+func init() {
+	RegisterBackend(&Backend{
+		Name:    BackendHTTP,
+		Schemes: []string{"http", "https"},
+		New: func(ctx context.Context, sourceURL string) (Task, error) {
+			// the url matching a -aria2cHost rule is downloaded by aria2c
+			return newURLTask(ctx, sourceURL, "", nil)
+		},
+		Restore: func() Task {
+			return &HTTPTask{}
+		},
+	})
+	// the http(s)/ftp urls downloaded by aria2.addUri, the urls are dispatched to the http and ftp backends
+	RegisterBackend(&Backend{
+		Name: BackendAria2c,
+		New: func(ctx context.Context, sourceURL string) (Task, error) {
+			return newURLTask(ctx, sourceURL, "", nil)
+		},
+		Restore: func() Task {
+			return &Aria2cURITask{}
+		},
+		// aria2c continues the partial file from its .aria2 control file
+		Resumable: true,
+	})
+	RegisterBackend(&Backend{
+		Name:    BackendBitTorrent,
+		Schemes: []string{"magnet"},
+		Detect:  IsBase64Torrent,
+		New:     newBitTorrentTask,
+		Restore: func() Task {
+			return &MagnetTask{}
+		},
+		// aria2c continues the partial files from its session
+		Resumable: true,
+	})
+	// the torrent tasks of -btEngine native, the sources are dispatched to the bittorrent backend
+	RegisterBackend(&Backend{
+		Name: BackendBitTorrentNative,
+		New: func(ctx context.Context, sourceURL string) (Task, error) {
+			task, err := newMagnetTask(ctx, sourceURL)
+			if err != nil {
+				return nil, err
+			}
+			return newNativeTorrentTask(task), nil
+		},
+		Restore: func() Task {
+			return &NativeTorrentTask{}
+		},
+		// the pieces on disk are verified and kept
+		Resumable: true,
+	})
+}
+
+// newBitTorrentTask creates the task of magnet link or base64 of torrent file, it is downloaded by the engine of -btEngine
+func newBitTorrentTask(ctx context.Context, sourceURL string) (Task, error) {
+	task, err := newMagnetTask(ctx, sourceURL)
+	if err != nil {
+		return nil, err
+	}
+	return torrentTaskOfEngine(task), nil
+}
+
+// newMagnetTask creates the MagnetTask of magnet link or base64 of torrent file
+func newMagnetTask(ctx context.Context, sourceURL string) (*MagnetTask, error) {
+	if !strings.HasPrefix(sourceURL, "magnet:") {
+		data, _ := base64.StdEncoding.DecodeString(sourceURL)
+		task, info, err := NewTorrentTask(data)
+		if err != nil {
+			return nil, err
+		}
+		magnet := info.Magnet()
+		if err := checkTorrentURLs(ctx, append(magnet.Trackers, magnet.WebSeeds...)); err != nil {
+			return nil, err
+		}
+		return task, nil
+	}
+	if err := urlPolicy.CheckURL(sourceURL); err != nil {
+		return nil, err
+	}
+	magnet, err := ParseMagnet(sourceURL)
+	if err != nil {
+		return nil, err
+	}
+	if magnet.InfoHash == "" {
+		return nil, fmt.Errorf("the magnet of v2 only torrent is not supported")
+	}
+	if err := egressPolicy.CheckMagnet(ctx, sourceURL); err != nil {
+		return nil, err
+	}
+	for _, u := range append(magnet.Trackers, magnet.WebSeeds...) {
+		if err := urlPolicy.CheckURL(u); err != nil {
+			return nil, err
+		}
+	}
+	task := NewMagnetTask(sourceURL)
+	// the display name is replaced by the real name once aria2c fetches the metadata
+	if isSafeTorrentPath(magnet.Name) {
+		task.TaskInfo.FileName = magnet.Name
+	}
+	task.infoHash = magnet.hash()
+	return task, nil
+}
+
+// checkTorrentURLs checks the trackers and web seeds of torrent by the url policy and egress policy, the engine connects them
+func checkTorrentURLs(ctx context.Context, urls []string) error {
+	for _, u := range urls {
+		if err := urlPolicy.CheckURL(u); err != nil {
+			return err
+		}
+		if err := egressPolicy.CheckURL(ctx, u); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// NewDownloadTask creates the task of the source url by its backend
 func NewDownloadTask(sourceURL string) (Task, error) {
-	switch {
-	case strings.HasPrefix(sourceURL, "http"):
-		return NewHTTPTask(sourceURL), nil
-	case strings.HasPrefix(sourceURL, "magnet:?xt=urn:btih:") || IsBase64String(sourceURL):
-		return NewMagnetTask(sourceURL), nil
-	default:
-		return nil, fmt.Errorf("sourceURL expect http or magnet, not %s", sourceURL)
+	backend := backendOf(sourceURL)
+	if backend == nil {
+		return nil, fmt.Errorf("sourceURL expect %s, not %s", supportedSources(), sourceURL)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	return backend.New(ctx, sourceURL)
+}
+
+// NewDownloadTaskByEngine creates the task of http(s)/ftp url by the engine, native or aria2c, options are the aria2c options of the url.
+// the empty engine and options mean the task is created by the backend of url
+func NewDownloadTaskByEngine(sourceURL string, engine string, options *Aria2cURIOptions) (Task, error) {
+	if engine == "" && options.empty() {
+		return NewDownloadTask(sourceURL)
+	}
+	if !isURLEngineSource(sourceURL) {
+		return nil, fmt.Errorf("only the http(s)/ftp url can choose the engine and aria2c options")
 	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	return newURLTask(ctx, sourceURL, engine, options)
 }
 
 const (
@@ -44,19 +213,76 @@ type TaskInfo struct {
 	SourceURL     string
 	StartTime     time.Time
 	FileName      string
-	ContentLength int64         // B 总大小
-	Size          int64         // B 已下载的大小
-	Duration      time.Duration // s 耗时
-	Speed         int64         // B/s 速度
-	IsCompleted   bool          // 是否完成
-	IsError       bool          // 是否出错
-	Error         string        // 错误消息
+	ContentLength int64             // B 总大小
+	Size          int64             // B 已下载的大小
+	Duration      time.Duration     // s 耗时
+	Speed         int64             // B/s 速度
+	IsCompleted   bool              // 是否完成
+	IsError       bool              // 是否出错
+	Error         string            // 错误消息
+	Violations    []PolicyViolation // 被策略拒绝的原因
+	// 保留的文件不会被自动清理
+	Pinned bool
+	// 最近一次通过/download/下载的时间
+	LastDownloadTime time.Time
+	// 种子内的文件及其进度
+	Files []TaskFile `json:",omitempty"`
+	// 只下载了种子的元数据, 等待选择要下载的文件
+	AwaitingSelection bool
+	// 做种策略, none/ratio:X/hours:N/forever, 为空时使用全局的-seed
+	SeedPolicy string `json:",omitempty"`
+	// 下载完成后正在做种
+	Seeding     bool
+	UploadSpeed int64   // B/s 上传速度
+	Uploaded    int64   // B 已上传的大小
+	Ratio       float64 // 分享率
+	// 任务的下载后端, 备份文件按它恢复任务
+	Backend string `json:",omitempty"`
+	// 创建任务时额外添加的tracker
+	Trackers []string `json:",omitempty"`
+	// 由已下载的文件生成的种子的info hash, 种子保存为<info hash>.torrent
+	CreatedTorrent string `json:",omitempty"`
+	// 正在后台计算种子的hash, 完成后设置CreatedTorrent
+	CreatingTorrent bool `json:",omitempty"`
+	// 生成种子的错误
+	CreateTorrentError string `json:",omitempty"`
+}
+
+// TaskFile is the file in the torrent, its path is relative to downloadDir
+type TaskFile struct {
+	Index           int
+	Path            string
+	Length          int64
+	CompletedLength int64
+	Selected        bool
+}
+
+func (i *TaskInfo) Info() *TaskInfo {
+	return i
+}
+
+// infoLocker is the task whose info is guarded by its mutex
+type infoLocker interface {
+	infoMutex() *sync.Mutex
+}
+
+// lockTaskInfo locks the info of task for the fields written by the tasks manager, like Pinned and LastDownloadTime
+func lockTaskInfo(task Task) (unlock func()) {
+	locker, ok := task.(infoLocker)
+	if !ok {
+		return func() {}
+	}
+	mutex := locker.infoMutex()
+	mutex.Lock()
+	return mutex.Unlock
 }
 
 // download http content
 type HTTPTask struct {
 	TaskType int
 	TaskInfo
+	// guards the fields written by the tasks manager
+	mutex sync.Mutex
 }
 
 func NewHTTPTask(sourceUrl string) *HTTPTask {
@@ -65,6 +291,7 @@ func NewHTTPTask(sourceUrl string) *HTTPTask {
 		TaskInfo: TaskInfo{
 			SourceURL: sourceUrl,
 			FileName:  getSafeFilename(sourceUrl),
+			Backend:   BackendHTTP,
 		}}
 }
 
@@ -72,24 +299,21 @@ func (t *HTTPTask) Download(downloadDir string, limitByteSize int64, limitTimeou
 	var httpClient = &http.Client{
 		Timeout: limitTimeout,
 		Transport: &http.Transport{
-			Dial: (&net.Dialer{
-				Timeout: 20 * time.Second,
-			}).Dial,
+			// the destination is checked after DNS resolution, on every connection and redirect
+			DialContext:         egressPolicy.DialContext,
 			TLSHandshakeTimeout: 20 * time.Second,
 		},
+		CheckRedirect: checkRedirect,
 	}
 	t.StartTime = time.Now()
 	resp, err := httpClient.Get(t.SourceURL)
 	if err != nil {
+		t.setViolations(err)
 		return t.Errorf("http.Client error:%s", err)
 	}
 	defer resp.Body.Close()
 	t.TaskInfo.ContentLength = resp.ContentLength
-	contentDisposition := strings.SplitN(resp.Header.Get("Content-Disposition"), "=", 2)
-	var attachmentName string
-	if len(contentDisposition) > 1 {
-		attachmentName = contentDisposition[1]
-	}
+	attachmentName := attachmentFilename(resp)
 	if t.TaskInfo.ContentLength <= 0 {
 		resp.Body.Close()
 		//一些资源是动态生成的,请求第一次是chunked stream,Header不带Content-Length,第二次请求就有Content-length
@@ -101,19 +325,20 @@ func (t *HTTPTask) Download(downloadDir string, limitByteSize int64, limitTimeou
 	}
 	// if header has attach filename, update it
 	if attachmentName != "" {
-		attachmentName2 := getSafeFilename(attachmentName)
-		if attachmentName2 != t.TaskInfo.FileName {
-			t.TaskInfo.FileName = attachmentName2
-		}
+		t.TaskInfo.FileName = attachmentName
+	}
+	if err := urlPolicy.CheckResponse(resp, t.TaskInfo.FileName); err != nil {
+		t.setViolations(err)
+		return t.Errorf("%s", err)
 	}
 	log.Infof("create HTTP task: length:%s source:%s filename:%s", getHumanSizeString(t.TaskInfo.ContentLength), t.SourceURL, t.TaskInfo.FileName)
 	if t.TaskInfo.ContentLength > limitByteSize {
 		return t.Errorf("the content length of sourceUrl is too big:%d, limit:%d", t.TaskInfo.ContentLength, limitByteSize)
 	}
 	// write file
-	filename := downloadDir + "/" + t.TaskInfo.FileName
-	os.Remove(filename)
-	fp, err := os.Create(filename)
+	fs := NewConfinedFS(downloadDir)
+	fs.Remove(t.TaskInfo.FileName)
+	fp, err := fs.Create(t.TaskInfo.FileName)
 	if err != nil {
 		return t.Errorf("create file error:%s", err)
 	}
@@ -161,6 +386,27 @@ func (t *HTTPTask) Download(downloadDir string, limitByteSize int64, limitTimeou
 	return nil
 }
 
+// attachmentFilename returns the safe filename of the Content-Disposition header, empty if the header has no filename
+func attachmentFilename(resp *http.Response) string {
+	contentDisposition := strings.SplitN(resp.Header.Get("Content-Disposition"), "=", 2)
+	if len(contentDisposition) < 2 || contentDisposition[1] == "" {
+		return ""
+	}
+	return getSafeFilename(contentDisposition[1])
+}
+
+// setViolations records the structured reasons if err is caused by the URL policy
+func (i *TaskInfo) setViolations(err error) {
+	var policyErr *PolicyError
+	if errors.As(err, &policyErr) {
+		i.Violations = policyErr.Violations
+	}
+}
+
+func (t *HTTPTask) infoMutex() *sync.Mutex {
+	return &t.mutex
+}
+
 func (t *HTTPTask) IsCompleted() bool {
 	return t.TaskInfo.IsCompleted
 }
@@ -189,6 +435,45 @@ func (t *HTTPTask) Errorf(format string, a ...interface{}) (err error) {
 type MagnetTask struct {
 	TaskType int
 	TaskInfo
+	// the aria2c downloads owned by the task, include the followedBy downloads
+	gids []string
+	// the info hash of torrent, it finds the download restored by aria2c if the gids are lost
+	infoHash string
+	// the top level paths written by aria2c, relative to downloadDir
+	paths    []string
+	canceled bool
+	cancel   context.CancelFunc
+	done     chan struct{}
+	mutex    sync.Mutex
+}
+
+// magnetTaskRecord is the MagnetTask in the backup file, the gids are kept for aria2c's session
+type magnetTaskRecord struct {
+	TaskType int
+	TaskInfo
+	GIDs     []string `json:",omitempty"`
+	InfoHash string   `json:",omitempty"`
+}
+
+func (t *MagnetTask) MarshalJSON() ([]byte, error) {
+	t.mutex.Lock()
+	record := magnetTaskRecord{
+		TaskType: t.TaskType,
+		TaskInfo: t.TaskInfo,
+		GIDs:     append([]string(nil), t.gids...),
+		InfoHash: t.infoHash,
+	}
+	t.mutex.Unlock()
+	return json.Marshal(&record)
+}
+
+func (t *MagnetTask) UnmarshalJSON(data []byte) error {
+	var record magnetTaskRecord
+	if err := json.Unmarshal(data, &record); err != nil {
+		return err
+	}
+	t.TaskType, t.TaskInfo, t.gids, t.infoHash = record.TaskType, record.TaskInfo, record.GIDs, record.InfoHash
+	return nil
 }
 
 func NewMagnetTask(sourceUrl string) *MagnetTask {
@@ -197,14 +482,41 @@ func NewMagnetTask(sourceUrl string) *MagnetTask {
 		TaskInfo: TaskInfo{
 			SourceURL: sourceUrl,
 			FileName:  getSafeFilename(sourceUrl),
+			Backend:   BackendBitTorrent,
 		}}
 }
 func (t *MagnetTask) Download(downloadDir string, limitByteSize int64, limitTimeout time.Duration) (err error) {
 	if !IsAria2cRunning() {
 		return t.Errorf("aria2c is not running, cannot download magnet")
 	}
+	timeout := limitTimeout
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	done := make(chan struct{})
+	defer close(done)
+	t.mutex.Lock()
+	t.cancel, t.done = cancel, done
+	canceled := t.canceled
+	t.mutex.Unlock()
+	if canceled {
+		// the task is deleted before it starts, it is not added to aria2c
+		return t.Errorf("task canceled")
+	}
 	aria2cRPCClient := NewAria2cRPCClient()
+	// whatever the download end with, the aria2c downloads should not be left behind, unless they are seeding
 	var taskGID string
+	var seeding bool
+	defer func() {
+		if seeding && err == nil {
+			t.startSeeding(aria2cRPCClient, downloadDir, taskGID)
+			return
+		}
+		t.mutex.Lock()
+		// the files of created torrent are downloaded before, they are never removed
+		removeFiles := err != nil && t.CreatedTorrent == "" && (*aria2cCleanPartial || t.canceled)
+		t.mutex.Unlock()
+		t.releaseAria2c(aria2cRPCClient, downloadDir, removeFiles)
+	}()
 	// magnet? / torrent? / torrent file in downloadDir
 	var isMagnetLink bool
 	var torrentBase64 string
@@ -221,42 +533,81 @@ func (t *MagnetTask) Download(downloadDir string, limitByteSize int64, limitTime
 		isMagnetLink = false
 		torrentBase64 = t.SourceURL
 	}
-	if isMagnetLink {
-		taskGID, err = aria2cRPCClient.AddURI(t.SourceURL)
-		if err != nil {
-			return t.Errorf("call aria2c AddURI error:%s", err)
-		}
+	// the external aria2c may see the download dir at a different path
+	remoteDir := aria2cDir(downloadDir)
+	options := t.aria2cOptions(remoteDir, isMagnetLink)
+	// the spawned aria2c loses its downloads when it is restarted, they are added again
+	generation := aria2cGeneration()
+	// the restored task is re-bound to its download restored from aria2c's session
+	if taskGID = t.findAria2cDownload(aria2cRPCClient); taskGID != "" {
+		log.Infof("re-bind Magnet task: sourceURL:%s, taskGID:%s", t.SourceURL, taskGID)
+	} else if taskGID, err = t.addToAria2c(aria2cRPCClient, isMagnetLink, torrentBase64, options); err != nil {
+		return t.Errorf("%s", err)
 	} else {
-		taskGID, err = aria2cRPCClient.AddTorrent(torrentBase64)
-		if err != nil {
-			return t.Errorf("call aria2c AddTorrent error:%s", err)
-		}
+		// the download is released with the others of the task even if it is canceled right now
+		t.resetGIDs()
+		t.addGID(taskGID)
+	}
+	if !isMagnetLink {
 		// save to file and change the sourceURL
-		torrentFilename := fmt.Sprintf("%s/%s.torrent", downloadDir, torrentBase64[:16])
-		fp, err := os.Create(torrentFilename)
-		if err != nil {
-			log.Warnf("os.Create file error:%s", err)
+		torrentFilename := strings.Replace(torrentBase64[:16], "/", "_", -1) + ".torrent"
+		if info, err := ParseTorrent(data); err == nil {
+			// named like the metadata saved by aria2c for magnet
+			torrentFilename = info.hash() + ".torrent"
 		}
-		_, err = fp.Write(data)
-		if err != nil {
-			log.Warnf("fp.Write error:%s", err)
+		if err := NewConfinedFS(downloadDir).WriteFile(torrentFilename, data, 0644); err != nil {
+			log.Warnf("save torrent file error:%s", err)
 		}
-		t.SourceURL = torrentFilename
+		// the source is pushed to the page while downloading
+		t.mutex.Lock()
+		t.SourceURL = downloadDir + "/" + torrentFilename
+		t.mutex.Unlock()
 	}
+	// the status is polled in batch with other tasks and pushed by aria2c's notifications
+	updates := make(chan *aria2cStatusUpdate, 1)
+	defer aria2cMonitor.Unsubscribe(updates)
+	aria2cMonitor.Subscribe(taskGID, updates)
 	log.Infof("create Magnet task: sourceURL:%s, taskGID:%s", t.SourceURL, taskGID)
 	t.StartTime = time.Now()
-	timeout := limitTimeout
-	ctx, cancel := context.WithTimeout(context.Background(), timeout)
-	defer cancel()
-MagnetLoop:
-	complete := false
-	ticker := time.NewTicker(time.Second * 5)
-	for !complete {
+	for complete := false; !complete; {
 		select {
-		case <-ticker.C:
-			result, err := aria2cRPCClient.TellStatus(taskGID)
+		case update := <-updates:
+			if update.GID != taskGID {
+				// the download is followed by another one
+				continue
+			}
+			result, err := update.Result, update.Err
 			if err != nil {
-				return t.Errorf("call aria2c TellStatus error:%s", err)
+				if aria2cSupervisor == nil {
+					return t.Errorf("call aria2c TellStatus error:%s", err)
+				}
+				if current := aria2cGeneration(); current != generation && aria2cSupervisor.Running() {
+					log.Infof("aria2c is restarted, re-attach task:%s", t.SourceURL)
+					aria2cMonitor.Unsubscribe(updates)
+					// the download is restored by aria2c from -aria2cSession, adding it again conflicts with it
+					if restoredGID := t.findAria2cDownload(aria2cRPCClient); restoredGID != "" {
+						taskGID = restoredGID
+					} else {
+						// aria2c continues from the .aria2 control file
+						t.resetGIDs()
+						options = t.aria2cOptions(remoteDir, isMagnetLink)
+						if taskGID, err = t.addToAria2c(aria2cRPCClient, isMagnetLink, torrentBase64, options); err != nil {
+							return t.Errorf("%s", err)
+						}
+						t.addGID(taskGID)
+					}
+					aria2cMonitor.Subscribe(taskGID, updates)
+					generation = current
+				} else {
+					log.Warnf("call aria2c TellStatus error:%s, wait for aria2c is restarted", err)
+				}
+				continue
+			}
+			switch result.Status {
+			case "error":
+				return t.Errorf("%s", result.Err())
+			case "removed":
+				return t.Errorf("aria2c download is removed, taskGID:%s", taskGID)
 			}
 			// update break condition
 			complete = result.Completed()
@@ -265,49 +616,313 @@ MagnetLoop:
 			t.Size = result.CompletedLength
 			t.Duration = time.Now().Sub(t.StartTime)
 			t.Speed = result.DownloadSpeed
-			if !complete && result.CompletedLength > 0 && result.CompletedLength == result.TotalLength {
-				// why aria2c wait so long time even it seems the download task is completed, may be as a seeder?
-				log.Infof("force to set task status complete, status:%+v", result)
-				time.Sleep(time.Second * 5)
-				log.Infof("force to set task status complete, status:%+v", result)
-				complete = true
+			if !complete && result.Seeder {
+				// the payload is done, aria2c keeps the download active as a seeder by the seeding policy
+				complete, seeding = true, true
 			}
 			// 磁力链接建立任务时无法指定文件名 获得真实文件名后需要重命名
-			realFilename := strings.TrimPrefix(result.GetFilePath(), downloadDir+"/")
-			pos := strings.Index(realFilename, "/")
-			if pos != -1 && pos < len(realFilename)-1 {
-				realFilename = realFilename[:pos]
+			var files []TaskFile
+			for _, file := range result.Files {
+				// the metadata download of magnet has no file in downloadDir
+				if path := topLevelPath(remoteDir, file.Path); path != "" {
+					t.addPath(path)
+					files = append(files, TaskFile{
+						Index:           file.Index,
+						Path:            strings.TrimPrefix(file.Path, remoteDir+"/"),
+						Length:          file.Length,
+						CompletedLength: file.CompletedLength,
+						Selected:        file.Selected,
+					})
+				}
+			}
+			if len(files) > 0 {
+				t.mutex.Lock()
+				t.Files = files
+				t.mutex.Unlock()
+			}
+			if realFilename := topLevelPath(remoteDir, result.GetFilePath()); realFilename != "" {
+				// SelectFiles reads the name while the task is downloading
+				t.mutex.Lock()
+				t.TaskInfo.FileName = realFilename
+				t.mutex.Unlock()
+			}
+			if result.InfoHash != "" {
+				t.mutex.Lock()
+				t.infoHash = result.InfoHash
+				t.mutex.Unlock()
 			}
-			t.TaskInfo.FileName = realFilename
 			// 检查是否有继续下载磁力链接包含的其他文件
-			followedBys := result.FollowedBy
-			for _, followedTaskGID := range followedBys {
-				taskGID = followedTaskGID
+			if len(result.FollowedBy) > 0 {
+				// the updates of the finished metadata download would replace the followed one's in the channel
+				aria2cMonitor.Unsubscribe(updates)
+				for _, followedTaskGID := range result.FollowedBy {
+					t.addGID(followedTaskGID)
+					taskGID = followedTaskGID
+					log.Debugf("follow task:%s, task status:%+v", followedTaskGID, result)
+				}
+				aria2cMonitor.Subscribe(taskGID, updates)
 				complete = false
-				log.Debugf("goto MagnetLoop: task status:%+v", result)
-				goto MagnetLoop
 			}
 		case <-ctx.Done():
 			if ctx.Err() == context.DeadlineExceeded {
 				return t.Errorf("task timeout:%s", timeout)
 			}
+			return t.Errorf("task canceled")
 		}
 	}
-	err = aria2cRPCClient.RemoveDownloadResult(taskGID)
-	if err != nil {
-		log.Warnf("RemoveDownloadResult error:%s", err)
-	}
 	t.TaskInfo.IsCompleted = true
 	t.Duration = time.Now().Sub(t.StartTime)
 	t.Speed = calculateDownloadSpeed(t.Size, t.Duration)
 	return nil
 }
 
+// InfoHash returns the info hash of torrent, it is empty if the task is restored from the old backup and is not started yet
+func (t *MagnetTask) InfoHash() string {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.infoHash
+}
+
+// Cancel stops the downloading task and waits for its aria2c downloads are released,
+// the partial files are removed too. the completed task which is seeding stops seeding and keeps its files
+func (t *MagnetTask) Cancel() {
+	t.mutex.Lock()
+	cancel, done := t.cancel, t.done
+	t.canceled = true
+	t.mutex.Unlock()
+	if cancel == nil {
+		return
+	}
+	cancel()
+	<-done
+}
+
+// aria2cOptions returns the options of the task's aria2c download
+func (t *MagnetTask) aria2cOptions(remoteDir string, isMagnetLink bool) *Aria2cOptions {
+	options := &Aria2cOptions{Dir: remoteDir}
+	if isMagnetLink {
+		// the metadata is saved as <info hash>.torrent, the magnet can be converted to torrent
+		options.BtSaveMetadata = "true"
+	}
+	t.seedPolicy().setAria2cOptions(options)
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if len(t.Trackers) > 0 {
+		// the bt-tracker of download replaces the global one
+		options.BtTracker = strings.Join(dedupeTrackers(append(trackerList.Trackers(), t.Trackers...)), ",")
+	}
+	if t.AwaitingSelection {
+		// only the metadata is fetched, the torrent is paused until the files are selected
+		if isMagnetLink {
+			options.FollowTorrent = "mem"
+			options.PauseMetadata = "true"
+		} else {
+			options.Pause = "true"
+		}
+		return options
+	}
+	if t.CreatedTorrent != "" {
+		// the files are verified and seeded, rather than downloaded again
+		options.CheckIntegrity = "true"
+	}
+	options.SelectFile = selectFileOption(t.Files)
+	return options
+}
+
+// SelectFiles chooses the files of torrent to download, it starts the task which is awaiting selection,
+// and the selection can be changed while the torrent is downloading
+func (t *MagnetTask) SelectFiles(indexes []int) error {
+	if len(indexes) == 0 {
+		return fmt.Errorf("select at least one file")
+	}
+	t.mutex.Lock()
+	var gid string
+	if len(t.gids) > 0 {
+		gid = t.gids[len(t.gids)-1]
+	}
+	awaiting, files, filename := t.AwaitingSelection, append([]TaskFile(nil), t.Files...), t.TaskInfo.FileName
+	t.mutex.Unlock()
+	if gid == "" || t.IsCompleted() {
+		return fmt.Errorf("task is not downloading")
+	}
+	if len(files) == 0 {
+		return fmt.Errorf("the files of torrent are not known yet")
+	}
+	selected := make(map[int]bool, len(indexes))
+	for _, index := range indexes {
+		if index < 1 || index > len(files) {
+			return fmt.Errorf("file index %d is out of range 1-%d", index, len(files))
+		}
+		selected[index] = true
+	}
+	for i := range files {
+		files[i].Selected = selected[files[i].Index]
+	}
+	aria2cRPCClient := NewAria2cRPCClient()
+	err := aria2cRPCClient.ChangeOption(gid, &Aria2cOptions{SelectFile: selectFileOption(files)})
+	if err != nil {
+		return fmt.Errorf("change select-file error:%s", err)
+	}
+	if awaiting {
+		if err := aria2cRPCClient.Unpause(gid); err != nil {
+			return fmt.Errorf("start torrent error:%s", err)
+		}
+	}
+	t.mutex.Lock()
+	t.Files, t.AwaitingSelection = files, false
+	t.mutex.Unlock()
+	// update the task at once, aria2c over http can not notify it
+	aria2cMonitor.Notify("select", gid)
+	log.Infof("select files of task %s:%s", filename, selectFileOption(files))
+	return nil
+}
+
+// selectFileOption returns the select-file option of aria2c, "" if the files are not known yet
+func selectFileOption(files []TaskFile) string {
+	var indexes []string
+	for _, file := range files {
+		if file.Selected {
+			indexes = append(indexes, strconv.Itoa(file.Index))
+		}
+	}
+	return strings.Join(indexes, ",")
+}
+
+func (t *MagnetTask) addToAria2c(aria2cRPCClient *Aria2cRPCClient, isMagnetLink bool, torrentBase64 string, options *Aria2cOptions) (taskGID string, err error) {
+	if isMagnetLink {
+		taskGID, err = aria2cRPCClient.AddURI(t.SourceURL, options)
+		if err != nil {
+			return "", fmt.Errorf("call aria2c AddURI error:%s", err)
+		}
+		return taskGID, nil
+	}
+	taskGID, err = aria2cRPCClient.AddTorrent(torrentBase64, options)
+	if err != nil {
+		return "", fmt.Errorf("call aria2c AddTorrent error:%s", err)
+	}
+	return taskGID, nil
+}
+
+func (t *MagnetTask) resetGIDs() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.gids = nil
+}
+
+func (t *MagnetTask) addGID(gid string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	for _, v := range t.gids {
+		if v == gid {
+			return
+		}
+	}
+	t.gids = append(t.gids, gid)
+}
+
+// findAria2cDownload returns the latest download of the task which aria2c still has, "" if aria2c does not have it.
+// the download is found by its gid, or by the info hash if the gids are lost
+func (t *MagnetTask) findAria2cDownload(aria2cRPCClient *Aria2cRPCClient) string {
+	t.mutex.Lock()
+	gids, infoHash := append([]string(nil), t.gids...), t.infoHash
+	t.mutex.Unlock()
+	for i := len(gids) - 1; i >= 0; i-- {
+		result, err := aria2cRPCClient.TellStatus(gids[i])
+		if err == nil && result.Status != "removed" && result.Status != "error" {
+			return gids[i]
+		}
+	}
+	if infoHash == "" {
+		return ""
+	}
+	active, err := aria2cRPCClient.TellActive()
+	if err != nil {
+		return ""
+	}
+	waiting, err := aria2cRPCClient.TellWaiting(0, 1000)
+	if err != nil {
+		return ""
+	}
+	for _, result := range append(active, waiting...) {
+		if strings.EqualFold(result.InfoHash, infoHash) {
+			t.addGID(result.GID)
+			return result.GID
+		}
+	}
+	return ""
+}
+
+func (t *MagnetTask) addPath(path string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	for _, v := range t.paths {
+		if v == path {
+			return
+		}
+	}
+	t.paths = append(t.paths, path)
+}
+
+// releaseAria2c force removes all the aria2c downloads of the task and their download results,
+// removeFiles decides whether the files and .aria2 control files written by aria2c are removed
+func (t *MagnetTask) releaseAria2c(aria2cRPCClient *Aria2cRPCClient, downloadDir string, removeFiles bool) {
+	t.mutex.Lock()
+	gids, paths := t.gids, t.paths
+	t.gids, t.paths = nil, nil
+	t.mutex.Unlock()
+	for _, gid := range gids {
+		removeAria2cDownload(aria2cRPCClient, gid)
+	}
+	if !removeFiles {
+		return
+	}
+	fs := NewConfinedFS(downloadDir)
+	for _, path := range paths {
+		for _, name := range []string{path, path + ".aria2"} {
+			if err := fs.RemoveAll(name); err != nil {
+				log.Warnf("[releaseAria2c]remove %s error:%s", name, err)
+			}
+		}
+		log.Infof("[releaseAria2c]removed partial file %s", path)
+	}
+}
+
+// removeAria2cDownload force removes the aria2c download if it is not stopped, and removes its download result
+func removeAria2cDownload(aria2cRPCClient *Aria2cRPCClient, gid string) {
+	result, err := aria2cRPCClient.TellStatus(gid)
+	if err != nil {
+		log.Warnf("[releaseAria2c]TellStatus %s error:%s", gid, err)
+		return
+	}
+	if !result.Stopped() {
+		if err := aria2cRPCClient.ForceRemove(gid); err != nil {
+			log.Warnf("[releaseAria2c]ForceRemove %s error:%s", gid, err)
+		}
+		// forceRemove returns before aria2c stops the download
+		for i := 0; i < 10 && !result.Stopped(); i++ {
+			time.Sleep(time.Millisecond * 500)
+			if result, err = aria2cRPCClient.TellStatus(gid); err != nil {
+				break
+			}
+		}
+	}
+	if err := aria2cRPCClient.RemoveDownloadResult(gid); err != nil {
+		log.Warnf("[releaseAria2c]RemoveDownloadResult %s error:%s", gid, err)
+	}
+}
+
+func (t *MagnetTask) infoMutex() *sync.Mutex {
+	return &t.mutex
+}
+
 func (t *MagnetTask) IsCompleted() bool {
 	return t.TaskInfo.IsCompleted
 }
 
 func (t *MagnetTask) FileName() string {
+	// the name is changed to the name of torrent while downloading
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
 	return t.TaskInfo.FileName
 }
 
@@ -328,6 +943,19 @@ func (t *MagnetTask) Errorf(format string, a ...interface{}) (err error) {
 }
 
 //utils
+
+// topLevelPath returns the first path element of the file path reported by aria2c, relative to downloadDir
+func topLevelPath(downloadDir string, filePath string) string {
+	path := strings.TrimPrefix(filePath, downloadDir+"/")
+	if path == filePath && filepath.IsAbs(filePath) {
+		return ""
+	}
+	if pos := strings.Index(path, "/"); pos != -1 {
+		path = path[:pos]
+	}
+	return path
+}
+
 var safeFilenameRegexp = regexp.MustCompile(`[\w\d\-.]+`)
 
 func getSafeFilename(str string) string {
@@ -360,11 +988,3 @@ func calculateDownloadSpeed(byteSize int64, duration time.Duration) (bytePerSeco
 	}
 	return byteSize * 1e9 / int64(duration)
 }
-
-func IsBase64String(str string) bool {
-	_, err := base64.StdEncoding.DecodeString(str)
-	if err != nil {
-		return false
-	}
-	return true
-}
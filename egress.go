@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// the destinations which are blocked by default: loopback, link-local, private and reserved ranges
+var defaultDeniedCIDRs = mustParseCIDRs(
+	"0.0.0.0/8", "10.0.0.0/8", "100.64.0.0/10", "127.0.0.0/8", "169.254.0.0/16", "172.16.0.0/12",
+	"192.0.0.0/24", "192.168.0.0/16", "198.18.0.0/15", "224.0.0.0/4", "240.0.0.0/4",
+	"::/128", "::1/128", "64:ff9b::/96", "fc00::/7", "fe80::/10", "ff00::/8",
+)
+
+// egressPolicy is applied to all the URLs fetched by the server or handed to aria2c
+var egressPolicy = &EgressPolicy{}
+
+// EgressPolicy decides which destinations the server may connect to when downloading,
+// the rules are checked in order: denied hosts, allowed hosts, denied CIDRs, allowed CIDRs, default denied CIDRs
+type EgressPolicy struct {
+	AllowCIDRs []*net.IPNet
+	DenyCIDRs  []*net.IPNet
+	// hostname, or domain suffix starts with "." which matches all its subdomains
+	AllowHosts []string
+	DenyHosts  []string
+}
+
+// EgressError is returned when the destination is not allowed by the egress policy
+type EgressError struct {
+	Host   string
+	IP     net.IP
+	Reason string
+}
+
+func (e *EgressError) Error() string {
+	if e.IP != nil {
+		return fmt.Sprintf("egress to %s(%s) is denied: %s", e.Host, e.IP, e.Reason)
+	}
+	return fmt.Sprintf("egress to %s is denied: %s", e.Host, e.Reason)
+}
+
+// ParseEgressPolicy parses the comma separated allow and deny lists, each item is a CIDR, an IP or a hostname
+func ParseEgressPolicy(allow string, deny string) (*EgressPolicy, error) {
+	p := &EgressPolicy{}
+	var err error
+	if p.AllowCIDRs, p.AllowHosts, err = parseEgressRules(allow); err != nil {
+		return nil, err
+	}
+	if p.DenyCIDRs, p.DenyHosts, err = parseEgressRules(deny); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func parseEgressRules(rules string) (cidrs []*net.IPNet, hosts []string, err error) {
+	for _, rule := range strings.Split(rules, ",") {
+		rule = strings.ToLower(strings.TrimSpace(rule))
+		switch {
+		case rule == "":
+		case strings.Contains(rule, "/"):
+			_, cidr, err := net.ParseCIDR(rule)
+			if err != nil {
+				return nil, nil, fmt.Errorf("invalid egress rule %s:%s", rule, err)
+			}
+			cidrs = append(cidrs, cidr)
+		case net.ParseIP(rule) != nil:
+			ip := net.ParseIP(rule)
+			bits := 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			cidrs = append(cidrs, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+		default:
+			hosts = append(hosts, strings.TrimPrefix(rule, "*"))
+		}
+	}
+	return cidrs, hosts, nil
+}
+
+func mustParseCIDRs(rules ...string) []*net.IPNet {
+	cidrs, _, err := parseEgressRules(strings.Join(rules, ","))
+	if err != nil {
+		panic(err)
+	}
+	return cidrs
+}
+
+func matchHost(patterns []string, host string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, pattern := range patterns {
+		if host == pattern || (strings.HasPrefix(pattern, ".") && (strings.HasSuffix(host, pattern) || host == pattern[1:])) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchCIDR(cidrs []*net.IPNet, ip net.IP) bool {
+	for _, cidr := range cidrs {
+		if cidr.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkHost checks the hostname rules, allowed reports the host is explicitly allowed, its IPs are not checked then
+func (p *EgressPolicy) checkHost(host string) (allowed bool, err error) {
+	if matchHost(p.DenyHosts, host) {
+		return false, &EgressError{Host: host, Reason: "host is in deny list"}
+	}
+	return matchHost(p.AllowHosts, host), nil
+}
+
+// CheckIP checks the resolved IP of host
+func (p *EgressPolicy) CheckIP(host string, ip net.IP) error {
+	switch {
+	case matchCIDR(p.DenyCIDRs, ip):
+		return &EgressError{Host: host, IP: ip, Reason: "ip is in deny list"}
+	case matchCIDR(p.AllowCIDRs, ip):
+		return nil
+	case matchCIDR(defaultDeniedCIDRs, ip):
+		return &EgressError{Host: host, IP: ip, Reason: "loopback, link-local, private or reserved ip"}
+	}
+	return nil
+}
+
+// resolve resolves host and returns the allowed IPs, all IPs of host must be allowed
+func (p *EgressPolicy) resolve(ctx context.Context, host string) ([]net.IP, error) {
+	allowed, err := p.checkHost(host)
+	if err != nil {
+		return nil, err
+	}
+	var ips []net.IP
+	if ip := net.ParseIP(host); ip != nil {
+		ips = []net.IP{ip}
+	} else {
+		addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		for _, addr := range addrs {
+			ips = append(ips, addr.IP)
+		}
+	}
+	if allowed {
+		return ips, nil
+	}
+	for _, ip := range ips {
+		if err := p.CheckIP(host, ip); err != nil {
+			return nil, err
+		}
+	}
+	return ips, nil
+}
+
+// CheckURL checks the scheme and the resolved host of URL, it is used for the URLs handed to aria2c
+// which the server can not check on connecting
+func (p *EgressPolicy) CheckURL(ctx context.Context, rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return fmt.Errorf("invalid url %s:%s", rawURL, err)
+	}
+	switch u.Scheme {
+	case "http", "https", "ftp", "ftps", "ftpes", "sftp", "scp", "udp", "ws", "wss":
+	default:
+		return &EgressError{Host: u.Host, Reason: "scheme " + u.Scheme + " is not allowed"}
+	}
+	if u.Hostname() == "" {
+		return &EgressError{Host: u.Host, Reason: "host is empty"}
+	}
+	_, err = p.resolve(ctx, u.Hostname())
+	return err
+}
+
+// CheckMagnet checks the trackers and web seeds of magnet link, they are fetched by aria2c
+func (p *EgressPolicy) CheckMagnet(ctx context.Context, magnet string) error {
+	u, err := url.Parse(magnet)
+	if err != nil {
+		return fmt.Errorf("invalid magnet %s:%s", magnet, err)
+	}
+	query := u.Query()
+	for _, key := range []string{"tr", "ws", "as"} {
+		for _, v := range query[key] {
+			if err := p.CheckURL(ctx, v); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// DialContext dials the first allowed IP of the host, the IP is checked on every connection
+// so the DNS rebinding and redirect to internal hosts are denied too
+func (p *EgressPolicy) DialContext(ctx context.Context, network string, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	ips, err := p.resolve(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	dialer := &net.Dialer{
+		Timeout: 20 * time.Second,
+	}
+	for _, ip := range ips {
+		var conn net.Conn
+		conn, err = dialer.DialContext(ctx, network, net.JoinHostPort(ip.String(), port))
+		if err == nil {
+			return conn, nil
+		}
+	}
+	return nil, err
+}
+
+// CheckRedirect checks the redirect before connecting, only http and https redirects are followed
+func (p *EgressPolicy) CheckRedirect(req *http.Request, via []*http.Request) error {
+	if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+		return &EgressError{Host: req.URL.Host, Reason: "redirect to scheme " + req.URL.Scheme + " is not allowed"}
+	}
+	_, err := p.checkHost(req.URL.Hostname())
+	return err
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestEgressPolicy_CheckIP(t *testing.T) {
+	policy, err := ParseEgressPolicy("10.1.0.0/16,192.168.1.1", "8.8.4.0/24")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for ip, allowed := range map[string]bool{
+		"127.0.0.1":        false,
+		"10.0.0.1":         false,
+		"10.1.2.3":         true,
+		"172.16.5.4":       false,
+		"192.168.1.1":      true,
+		"192.168.1.2":      false,
+		"169.254.169.254":  false,
+		"100.100.100.200":  false,
+		"0.0.0.0":          false,
+		"::1":              false,
+		"::ffff:127.0.0.1": false,
+		"fd00::1":          false,
+		"fe80::1":          false,
+		"8.8.8.8":          true,
+		"8.8.4.4":          false,
+		"2001:4860::8888":  true,
+	} {
+		err := policy.CheckIP("test", net.ParseIP(ip))
+		if allowed && err != nil {
+			t.Errorf("%s expect allowed, error:%s", ip, err)
+		}
+		if !allowed && err == nil {
+			t.Errorf("%s expect denied", ip)
+		}
+	}
+}
+
+func TestEgressPolicy_CheckURL(t *testing.T) {
+	policy, err := ParseEgressPolicy(".intranet.example", "evil.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	for rawURL, allowed := range map[string]bool{
+		"http://127.0.0.1:6902/jsonrpc":            false,
+		"http://localhost:6902/jsonrpc":            false,
+		"http://[::1]/":                            false,
+		"http://169.254.169.254/latest/meta-data/": false,
+		"http://2130706433/":                       false,
+		"file:///etc/passwd":                       false,
+		"gopher://8.8.8.8/":                        false,
+		"http://evil.example.com/":                 false,
+		"http://EVIL.example.com./":                false,
+		"http://8.8.8.8/":                          true,
+	} {
+		err := policy.CheckURL(ctx, rawURL)
+		if allowed && err != nil {
+			t.Errorf("%s expect allowed, error:%s", rawURL, err)
+		}
+		if !allowed && err == nil {
+			t.Errorf("%s expect denied", rawURL)
+		}
+	}
+	if err := policy.CheckMagnet(ctx, "magnet:?xt=urn:btih:09c4beba230a770051207d07a8fb76cf43477523&tr=udp://127.0.0.1:6969/announce"); err == nil {
+		t.Error("magnet with loopback tracker expect denied")
+	}
+}
+
+func withEgressPolicy(policy *EgressPolicy, fn func()) {
+	old := egressPolicy
+	egressPolicy = policy
+	defer func() {
+		egressPolicy = old
+	}()
+	fn()
+}
+
+// setEgressPolicy replaces the egress policy until the test ends, the tests allow their loopback servers by it
+func setEgressPolicy(t *testing.T, allow string, deny string) {
+	t.Helper()
+	policy, err := ParseEgressPolicy(allow, deny)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := egressPolicy
+	egressPolicy = policy
+	t.Cleanup(func() {
+		egressPolicy = old
+	})
+}
+
+// setFlag sets the command line flag until the test ends
+func setFlag(t *testing.T, name string, value string) {
+	t.Helper()
+	old := flag.Lookup(name).Value.String()
+	if err := flag.Set(name, value); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		flag.Set(name, old)
+	})
+}
+
+func TestHTTPTask_DownloadEgress(t *testing.T) {
+	downloadDir, err := ioutil.TempDir("", "fdp-egress")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(downloadDir)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/redirect" {
+			http.Redirect(w, r, "http://169.254.169.254/latest/meta-data/", http.StatusFound)
+			return
+		}
+		w.Write([]byte("secret"))
+	}))
+	defer server.Close()
+	t.Run("denyLoopback", func(t *testing.T) {
+		withEgressPolicy(&EgressPolicy{}, func() {
+			task := NewHTTPTask(server.URL + "/file")
+			if err := task.Download(downloadDir, 1024, time.Minute); err == nil {
+				t.Fatal("download from loopback expect denied")
+			}
+		})
+	})
+	t.Run("allowLoopback", func(t *testing.T) {
+		policy, _ := ParseEgressPolicy("127.0.0.1", "")
+		withEgressPolicy(policy, func() {
+			task := NewHTTPTask(server.URL + "/file")
+			if err := task.Download(downloadDir, 1024, time.Minute); err != nil {
+				t.Fatal(err)
+			}
+		})
+	})
+	t.Run("denyRedirect", func(t *testing.T) {
+		policy, _ := ParseEgressPolicy("127.0.0.1", "")
+		withEgressPolicy(policy, func() {
+			task := NewHTTPTask(server.URL + "/redirect")
+			if err := task.Download(downloadDir, 1024, time.Minute); err == nil {
+				t.Fatal("redirect to link-local expect denied")
+			}
+		})
+	})
+}
@@ -0,0 +1,392 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/hanjm/log"
+	"github.com/jlaffaye/ftp"
+	"io"
+	"net"
+	"net/textproto"
+	"net/url"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+// the backend of ftp, ftps(implicit TLS) and ftpes(explicit TLS, AUTH TLS)
+const BackendFTP = "ftp"
+
+// the transfer is resumed by REST after it is interrupted, at most ftpMaxRetries times
+var (
+	ftpMaxRetries = 3
+	ftpRetryDelay = 2 * time.Second
+	// the root CAs of ftps servers, nil means the system roots
+	ftpRootCAs *x509.CertPool
+)
+
+func init() {
+	RegisterBackend(&Backend{
+		Name:    BackendFTP,
+		Schemes: []string{"ftp", "ftps", "ftpes"},
+		New: func(ctx context.Context, sourceURL string) (Task, error) {
+			// the url matching a -aria2cHost rule is downloaded by aria2c
+			return newURLTask(ctx, sourceURL, "", nil)
+		},
+		Restore: func() Task {
+			return &FTPTask{}
+		},
+		// the partial file is continued by REST
+		Resumable: true,
+	})
+}
+
+// FTPTask downloads the file of ftp url in passive mode. the credentials are from the url, the netrc file, or anonymous
+type FTPTask struct {
+	TaskType int
+	TaskInfo
+	// the url with password, TaskInfo.SourceURL is redacted as it is pushed to the page
+	sourceURL string
+	canceled  bool
+	cancel    context.CancelFunc
+	done      chan struct{}
+	mutex     sync.Mutex
+}
+
+// ftpTaskRecord is the FTPTask in the backup file
+type ftpTaskRecord struct {
+	TaskType int
+	TaskInfo
+	URL string `json:",omitempty"`
+}
+
+// MarshalJSON returns the task pushed to the page, the url with the secret is not in it
+func (t *FTPTask) MarshalJSON() ([]byte, error) {
+	t.mutex.Lock()
+	record := ftpTaskRecord{
+		TaskType: t.TaskType,
+		TaskInfo: t.TaskInfo,
+	}
+	t.mutex.Unlock()
+	return json.Marshal(&record)
+}
+
+// MarshalRecord returns the task in the backup file, the url is kept for resuming
+func (t *FTPTask) MarshalRecord() ([]byte, error) {
+	t.mutex.Lock()
+	record := ftpTaskRecord{
+		TaskType: t.TaskType,
+		TaskInfo: t.TaskInfo,
+		URL:      t.sourceURL,
+	}
+	t.mutex.Unlock()
+	return json.Marshal(&record)
+}
+
+func (t *FTPTask) UnmarshalJSON(data []byte) error {
+	var record ftpTaskRecord
+	if err := json.Unmarshal(data, &record); err != nil {
+		return err
+	}
+	t.TaskType, t.TaskInfo, t.sourceURL = record.TaskType, record.TaskInfo, record.URL
+	return nil
+}
+
+func NewFTPTask(sourceURL string) (*FTPTask, error) {
+	u, err := url.Parse(sourceURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid url %s:%s", sourceURL, err)
+	}
+	if u.Path == "" || strings.HasSuffix(u.Path, "/") {
+		return nil, fmt.Errorf("the ftp url expect a file, got %s", u.Redacted())
+	}
+	return &FTPTask{
+		TaskType: DownloadTaskTypeHTTP,
+		TaskInfo: TaskInfo{
+			SourceURL: u.Redacted(),
+			// the user and password are not in the name
+			FileName: getSafeFilename(u.Host + u.Path),
+			Backend:  BackendFTP,
+		},
+		sourceURL: sourceURL,
+	}, nil
+}
+
+func (t *FTPTask) Download(downloadDir string, limitByteSize int64, limitTimeout time.Duration) (err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), limitTimeout)
+	defer cancel()
+	done := make(chan struct{})
+	defer close(done)
+	t.mutex.Lock()
+	t.cancel, t.done = cancel, done
+	canceled := t.canceled
+	t.mutex.Unlock()
+	if canceled {
+		// the task is deleted before it starts
+		return t.Errorf("task canceled")
+	}
+	fs := NewConfinedFS(downloadDir)
+	defer func() {
+		t.mutex.Lock()
+		canceled := t.canceled
+		t.mutex.Unlock()
+		// the partial file is kept for resuming, unless the task is canceled
+		if err != nil && canceled {
+			fs.Remove(t.TaskInfo.FileName)
+		}
+	}()
+	u, err := url.Parse(t.sourceURL)
+	if err != nil {
+		return t.Errorf("invalid url:%s", err)
+	}
+	t.StartTime = time.Now()
+	var offset int64
+	if info, err := fs.Stat(t.TaskInfo.FileName); err == nil {
+		offset = info.Size()
+	}
+	startOffset := offset
+	for retry := 0; ; retry++ {
+		var size int64
+		size, offset, err = t.transfer(ctx, u, fs, offset, limitByteSize)
+		if err == nil {
+			t.TaskInfo.ContentLength = size
+			break
+		}
+		if ctx.Err() == context.DeadlineExceeded {
+			return t.Errorf("task timeout:%s", limitTimeout)
+		}
+		if ctx.Err() != nil {
+			return t.Errorf("task canceled")
+		}
+		if _, ok := err.(*ftpPermanentError); ok || retry >= ftpMaxRetries {
+			return t.Errorf("%s", err)
+		}
+		log.Warnf("ftp transfer of %s error:%s, resume from %d, retry %d/%d", t.SourceURL, err, offset, retry+1, ftpMaxRetries)
+		select {
+		case <-time.After(ftpRetryDelay):
+		case <-ctx.Done():
+		}
+	}
+	t.TaskInfo.IsCompleted = true
+	t.Size = t.TaskInfo.ContentLength
+	t.Duration = time.Now().Sub(t.StartTime)
+	t.Speed = calculateDownloadSpeed(t.Size-startOffset, t.Duration)
+	log.Infof("complete FTP task: length:%s source:%s filename:%s, duration:%s", getHumanSizeString(t.TaskInfo.ContentLength), t.SourceURL, t.TaskInfo.FileName, t.Duration)
+	return nil
+}
+
+// ftpPermanentError is the error which is not fixed by retrying, like the login is failed or the file is too big
+type ftpPermanentError struct {
+	err error
+}
+
+func (e *ftpPermanentError) Error() string {
+	return e.err.Error()
+}
+
+// transfer downloads the file from offset, it returns the size of file and the offset reached
+func (t *FTPTask) transfer(ctx context.Context, u *url.URL, fs *ConfinedFS, offset int64, limitByteSize int64) (size int64, reached int64, err error) {
+	// the connections of the transfer are closed once it returns
+	ctx, stop := context.WithCancel(ctx)
+	defer stop()
+	conn, err := dialFTP(ctx, u)
+	if err != nil {
+		return 0, offset, err
+	}
+	defer conn.Quit()
+	path, err := url.PathUnescape(u.EscapedPath())
+	if err != nil {
+		return 0, offset, &ftpPermanentError{fmt.Errorf("invalid path:%s", err)}
+	}
+	// SIZE is not supported by some servers, the size is known once the transfer is done then
+	size, err = conn.FileSize(path)
+	if err != nil {
+		log.Warnf("ftp SIZE %s error:%s", t.SourceURL, err)
+		size = -1
+	}
+	if size > limitByteSize {
+		return 0, offset, &ftpPermanentError{fmt.Errorf("the content length of sourceUrl is too big:%d, limit:%d", size, limitByteSize)}
+	}
+	t.TaskInfo.ContentLength = size
+	if offset > size && size >= 0 {
+		// the file on the server is changed
+		offset = 0
+	}
+	if offset == size {
+		log.Infof("the file of FTP task is downloaded:%s", t.TaskInfo.FileName)
+		return size, offset, nil
+	}
+	log.Infof("create FTP task: length:%s source:%s filename:%s, offset:%d", getHumanSizeString(size), t.SourceURL, t.TaskInfo.FileName, offset)
+	resp, err := conn.RetrFrom(path, uint64(offset))
+	if err != nil {
+		var replyErr *textproto.Error
+		if errors.As(err, &replyErr) && replyErr.Code == ftp.StatusFileUnavailable {
+			return 0, offset, &ftpPermanentError{fmt.Errorf("ftp RETR %s error:%s", path, err)}
+		}
+		return 0, offset, fmt.Errorf("ftp RETR %s error:%s", path, err)
+	}
+	defer resp.Close()
+	flag := os.O_WRONLY | os.O_CREATE | os.O_APPEND
+	if offset == 0 {
+		flag |= os.O_TRUNC
+	}
+	fp, err := fs.OpenFile(t.TaskInfo.FileName, flag, 0644)
+	if err != nil {
+		return 0, offset, &ftpPermanentError{fmt.Errorf("create file error:%s", err)}
+	}
+	defer fp.Close()
+	buf := make([]byte, 32*1024)
+	for i := 0; ; i++ {
+		n, readErr := resp.Read(buf)
+		if n > 0 {
+			if _, err := fp.Write(buf[:n]); err != nil {
+				return size, offset, &ftpPermanentError{fmt.Errorf("body write error:%s", err)}
+			}
+			offset += int64(n)
+			t.Size = offset
+			if i%100 == 0 {
+				t.Duration = time.Now().Sub(t.StartTime)
+				t.Speed = calculateDownloadSpeed(t.Size, t.Duration)
+			}
+			if offset > limitByteSize {
+				return size, offset, &ftpPermanentError{fmt.Errorf("the content length of sourceUrl is too big:%d, limit:%d", offset, limitByteSize)}
+			}
+		}
+		if readErr == io.EOF {
+			break
+		}
+		if readErr != nil {
+			return size, offset, fmt.Errorf("body read error:%s", readErr)
+		}
+	}
+	if err := fp.Sync(); err != nil {
+		return size, offset, &ftpPermanentError{fmt.Errorf("sync file error:%s", err)}
+	}
+	// the transfer is completed once the server confirms it
+	if err := resp.Close(); err != nil {
+		var replyErr *textproto.Error
+		if errors.As(err, &replyErr) {
+			err = replyErr
+		}
+		return size, offset, fmt.Errorf("ftp transfer error:%s", err)
+	}
+	if size >= 0 && offset != size {
+		return size, offset, fmt.Errorf("ftp transfer is incomplete:%d/%d", offset, size)
+	}
+	return offset, offset, nil
+}
+
+// dialFTP connects and logs in the ftp server of url, the control and data connections are dialed under the egress policy
+func dialFTP(ctx context.Context, u *url.URL) (*ftp.ServerConn, error) {
+	port := u.Port()
+	if port == "" {
+		port = "21"
+		if u.Scheme == "ftps" {
+			port = "990"
+		}
+	}
+	var tlsConfig *tls.Config
+	if u.Scheme == "ftps" || u.Scheme == "ftpes" {
+		tlsConfig = &tls.Config{
+			ServerName: u.Hostname(),
+			RootCAs:    ftpRootCAs,
+			// the data connections resume the TLS session of control connection, some servers require it
+			ClientSessionCache: tls.NewLRUClientSessionCache(4),
+		}
+	}
+	// the connections are closed once ctx is done, the task is canceled or the transfer returns
+	var mutex sync.Mutex
+	var conns []net.Conn
+	dial := func(network, addr string) (net.Conn, error) {
+		conn, err := egressPolicy.DialContext(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		mutex.Lock()
+		defer mutex.Unlock()
+		// the first is the control connection, it is upgraded by the client after AUTH TLS for ftpes
+		if tlsConfig != nil && (len(conns) > 0 || u.Scheme == "ftps") {
+			conn = tls.Client(conn, tlsConfig)
+		}
+		conns = append(conns, conn)
+		return conn, nil
+	}
+	go func() {
+		<-ctx.Done()
+		mutex.Lock()
+		defer mutex.Unlock()
+		for _, conn := range conns {
+			conn.Close()
+		}
+	}()
+	options := []ftp.DialOption{ftp.DialWithContext(ctx), ftp.DialWithDialFunc(dial), ftp.DialWithShutTimeout(30 * time.Second)}
+	switch u.Scheme {
+	case "ftps":
+		options = append(options, ftp.DialWithTLS(tlsConfig))
+	case "ftpes":
+		options = append(options, ftp.DialWithExplicitTLS(tlsConfig))
+	}
+	conn, err := ftp.Dial(net.JoinHostPort(u.Hostname(), port), options...)
+	if err != nil {
+		return nil, fmt.Errorf("connect ftp server error:%s", err)
+	}
+	user, password := "anonymous", "anonymous"
+	if u.User != nil {
+		user = u.User.Username()
+		password, _ = u.User.Password()
+	} else if login, pass, ok := netrcLookup(u.Hostname()); ok && login != "" {
+		user, password = login, pass
+	}
+	if err := conn.Login(user, password); err != nil {
+		conn.Quit()
+		return nil, &ftpPermanentError{fmt.Errorf("ftp login as %s error:%s", user, err)}
+	}
+	return conn, nil
+}
+
+// Cancel stops the downloading task, the partial file is removed
+func (t *FTPTask) Cancel() {
+	t.mutex.Lock()
+	cancel, done := t.cancel, t.done
+	t.canceled = true
+	t.mutex.Unlock()
+	if cancel == nil {
+		return
+	}
+	cancel()
+	<-done
+}
+
+func (t *FTPTask) infoMutex() *sync.Mutex {
+	return &t.mutex
+}
+
+func (t *FTPTask) IsCompleted() bool {
+	return t.TaskInfo.IsCompleted
+}
+
+func (t *FTPTask) FileName() string {
+	return t.TaskInfo.FileName
+}
+
+func (t *FTPTask) ContentLength() int64 {
+	return t.TaskInfo.ContentLength
+}
+
+func (t *FTPTask) Errorf(format string, a ...interface{}) (err error) {
+	err = fmt.Errorf(format, a...)
+	_, file, line, ok := runtime.Caller(1)
+	if ok {
+		log.Errorf("[%s:%d]%s", file, line, err.Error())
+	}
+	t.TaskInfo.IsError = true
+	t.TaskInfo.IsCompleted = true
+	t.TaskInfo.Error = err.Error()
+	return err
+}
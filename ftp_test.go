@@ -0,0 +1,369 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeFTPServer is the in-process ftp server of one file, it supports passive mode, SIZE, REST and TLS
+type fakeFTPServer struct {
+	listener net.Listener
+	files    map[string][]byte
+	user     string
+	password string
+	// implicit TLS if tlsConfig is set and implicit, or AUTH TLS
+	tlsConfig *tls.Config
+	implicit  bool
+	// the first RETR is interrupted after the bytes, 0 means never
+	interruptAt int
+	mutex       sync.Mutex
+	commands    []string
+}
+
+func newFakeFTPServer(t *testing.T, s *fakeFTPServer) *fakeFTPServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.implicit {
+		listener = tls.NewListener(listener, s.tlsConfig)
+	}
+	s.listener = listener
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *fakeFTPServer) URL(scheme string, userinfo string) string {
+	return scheme + "://" + userinfo + s.listener.Addr().String()
+}
+
+func (s *fakeFTPServer) Close() {
+	s.listener.Close()
+}
+
+func (s *fakeFTPServer) Commands() []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]string(nil), s.commands...)
+}
+
+func (s *fakeFTPServer) serve(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	reply := func(format string, a ...interface{}) {
+		fmt.Fprintf(conn, format+"\r\n", a...)
+	}
+	reply("220 fake ftp ready")
+	var user string
+	var loggedIn, protected bool
+	var offset int64
+	var dataListener net.Listener
+	defer func() {
+		if dataListener != nil {
+			dataListener.Close()
+		}
+	}()
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		command, arg := line, ""
+		if i := strings.Index(line, " "); i > 0 {
+			command, arg = strings.ToUpper(line[:i]), line[i+1:]
+		}
+		s.mutex.Lock()
+		s.commands = append(s.commands, line)
+		s.mutex.Unlock()
+		switch command {
+		case "AUTH":
+			reply("234 AUTH TLS ok")
+			conn = tls.Server(conn, s.tlsConfig)
+			reader = bufio.NewReader(conn)
+		case "USER":
+			user = arg
+			reply("331 password required")
+		case "PASS":
+			if user != s.user || arg != s.password {
+				reply("530 login incorrect")
+				continue
+			}
+			loggedIn = true
+			reply("230 logged in")
+		case "FEAT":
+			reply("211-Features:\r\n SIZE\r\n REST STREAM\r\n EPSV\r\n211 End")
+		case "PBSZ":
+			reply("200 PBSZ=0")
+		case "PROT":
+			protected = arg == "P"
+			reply("200 PROT ok")
+		case "TYPE", "OPTS", "NOOP":
+			reply("200 ok")
+		case "EPSV", "PASV":
+			if !loggedIn {
+				reply("530 not logged in")
+				continue
+			}
+			if dataListener != nil {
+				dataListener.Close()
+			}
+			dataListener, _ = net.Listen("tcp", "127.0.0.1:0")
+			port := dataListener.Addr().(*net.TCPAddr).Port
+			if command == "EPSV" {
+				reply("229 Entering Extended Passive Mode (|||%d|)", port)
+			} else {
+				reply("227 Entering Passive Mode (127,0,0,1,%d,%d)", port/256, port%256)
+			}
+		case "SIZE":
+			data, ok := s.files[arg]
+			if !loggedIn || !ok {
+				reply("550 no such file")
+				continue
+			}
+			reply("213 %d", len(data))
+		case "REST":
+			offset, _ = strconv.ParseInt(arg, 10, 64)
+			reply("350 restarting at %d", offset)
+		case "RETR":
+			data, ok := s.files[arg]
+			if !loggedIn || !ok || dataListener == nil {
+				reply("550 no such file")
+				continue
+			}
+			dataConn, err := dataListener.Accept()
+			if err != nil {
+				return
+			}
+			if protected {
+				dataConn = tls.Server(dataConn, s.tlsConfig)
+			}
+			reply("150 opening data connection")
+			data = data[offset:]
+			s.mutex.Lock()
+			interruptAt := s.interruptAt
+			s.interruptAt = 0
+			s.mutex.Unlock()
+			if interruptAt > 0 && interruptAt < len(data) {
+				dataConn.Write(data[:interruptAt])
+				dataConn.Close()
+				reply("426 connection closed, transfer aborted")
+			} else {
+				dataConn.Write(data)
+				dataConn.Close()
+				reply("226 transfer complete")
+			}
+			offset = 0
+		case "QUIT":
+			reply("221 bye")
+			return
+		default:
+			reply("502 %s not implemented", command)
+		}
+	}
+}
+
+func TestParseNetrc(t *testing.T) {
+	machines := ParseNetrc(`# comment
+machine ftp.example.com login alice password s3cret
+macdef init
+cd /pub
+quit
+
+machine Mirror.example.org
+  login bob
+  account x
+  password p@ss
+default login anonymous password me@example.com
+`)
+	expect := []NetrcMachine{{"ftp.example.com", "alice", "s3cret"}, {"mirror.example.org", "bob", "p@ss"}, {"", "anonymous", "me@example.com"}}
+	if len(machines) != len(expect) {
+		t.Fatalf("unexpected machines:%+v", machines)
+	}
+	for i, m := range machines {
+		if *m != expect[i] {
+			t.Fatalf("unexpected machine %d:%+v", i, m)
+		}
+	}
+}
+
+func TestNetrcLookup(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fdp-netrc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	netrc := filepath.Join(dir, "netrc")
+	ioutil.WriteFile(netrc, []byte("machine ftp.example.com login alice password s3cret\ndefault login anonymous password me@example.com\n"), 0600)
+	setFlag(t, "netrc", "")
+	if _, _, ok := netrcLookup("ftp.example.com"); ok {
+		t.Fatal("expect no netrc read if -netrc is not set")
+	}
+	*netrcFile = netrc
+	if login, password, ok := netrcLookup("FTP.example.com"); !ok || login != "alice" || password != "s3cret" {
+		t.Fatalf("unexpected credentials:%s %s %v", login, password, ok)
+	}
+	// the default entry is not sent to the other hosts
+	if login, _, ok := netrcLookup("evil.example.com"); ok {
+		t.Fatalf("expect no credentials of other hosts, got %s", login)
+	}
+}
+
+func TestFTPTask(t *testing.T) {
+	setEgressPolicy(t, "127.0.0.0/8", "")
+	setFlag(t, "netrc", "")
+	oldDelay := ftpRetryDelay
+	ftpRetryDelay = 10 * time.Millisecond
+	defer func() {
+		ftpRetryDelay = oldDelay
+	}()
+	dir, err := ioutil.TempDir("", "fdp-ftp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	content := make([]byte, 100000)
+	rand.Read(content)
+	files := map[string][]byte{"/pub/data.bin": content}
+	download := func(sourceURL string) (*FTPTask, error) {
+		task, err := NewDownloadTask(sourceURL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ft, ok := task.(*FTPTask)
+		if !ok {
+			t.Fatalf("expect ftp task, got %T", task)
+		}
+		return ft, task.Download(dir, int64(len(content)), 10*time.Second)
+	}
+	expectContent := func(task *FTPTask) {
+		t.Helper()
+		data, err := ioutil.ReadFile(filepath.Join(dir, task.FileName()))
+		if err != nil || !bytes.Equal(data, content) {
+			t.Fatalf("unexpected content of %s:%v", task.FileName(), err)
+		}
+		if !task.IsCompleted() || task.Info().IsError || task.ContentLength() != int64(len(content)) || task.Info().Size != int64(len(content)) {
+			t.Fatalf("unexpected task:%+v", task.Info())
+		}
+	}
+
+	// the credentials in url, the interrupted transfer is resumed by REST
+	server := newFakeFTPServer(t, &fakeFTPServer{files: files, user: "alice", password: "s3cret", interruptAt: 30000})
+	defer server.Close()
+	task, err := download(server.URL("ftp", "alice:s3cret@") + "/pub/data.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectContent(task)
+	if strings.Contains(task.SourceURL, "s3cret") || strings.Contains(task.FileName(), "s3cret") {
+		t.Fatalf("expect the password hidden:%s %s", task.SourceURL, task.FileName())
+	}
+	commands := strings.Join(server.Commands(), "\n")
+	if !strings.Contains(commands, "REST 30000") || !strings.Contains(commands, "SIZE /pub/data.bin") {
+		t.Fatalf("expect resumed by REST:%s", commands)
+	}
+	// the password is not pushed to the page, it is kept in the backup file for resuming
+	if data, _ := json.Marshal(task); strings.Contains(string(data), "s3cret") {
+		t.Fatalf("expect the password not pushed:%s", data)
+	}
+	data, _ := marshalTaskRecord(task)
+	restored, err := restoreTask(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rt, ok := restored.(*FTPTask); !ok || rt.sourceURL != task.sourceURL || rt.SourceURL != task.SourceURL {
+		t.Fatalf("unexpected restored task:%+v", restored)
+	}
+
+	// the partial file of restarted task is continued
+	restarted, _ := NewDownloadTask(task.sourceURL)
+	restarted.Info().FileName = "partial.bin"
+	ioutil.WriteFile(filepath.Join(dir, "partial.bin"), content[:12345], 0644)
+	before := len(server.Commands())
+	if err := restarted.Download(dir, int64(len(content)), 10*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	expectContent(restarted.(*FTPTask))
+	if commands := strings.Join(server.Commands()[before:], "\n"); !strings.Contains(commands, "REST 12345") {
+		t.Fatalf("expect the partial file resumed:%s", commands)
+	}
+
+	// the credentials in netrc
+	netrc := filepath.Join(dir, "netrc")
+	ioutil.WriteFile(netrc, []byte("machine 127.0.0.1 login alice password s3cret\n"), 0600)
+	*netrcFile = netrc
+	task, err = download(server.URL("ftp", "") + "/pub/data.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectContent(task)
+
+	// the login failure and missing file are not retried
+	for _, sourceURL := range []string{server.URL("ftp", "alice:wrong@") + "/pub/data.bin", server.URL("ftp", "") + "/pub/missing.bin"} {
+		before := len(server.Commands())
+		if _, err := download(sourceURL); err == nil {
+			t.Fatalf("expect %s failed", sourceURL)
+		}
+		if logins := strings.Count(strings.Join(server.Commands()[before:], "\n"), "USER "); logins != 1 {
+			t.Fatalf("expect no retry of %s, logins:%d", sourceURL, logins)
+		}
+	}
+	// the file over the limit is rejected by SIZE
+	limit, _ := NewDownloadTask(server.URL("ftp", "") + "/pub/data.bin")
+	if err := limit.Download(dir, 1000, 10*time.Second); err == nil || !strings.Contains(err.Error(), "too big") {
+		t.Fatalf("expect the file too big, got %v", err)
+	}
+	// the task deleted before it starts does not connect
+	canceled, _ := NewDownloadTask(server.URL("ftp", "") + "/pub/data.bin")
+	canceled.(Canceler).Cancel()
+	before = len(server.Commands())
+	if err := canceled.Download(dir, int64(len(content)), 10*time.Second); err == nil || len(server.Commands()) != before {
+		t.Fatalf("expect the canceled task not started, got %v", err)
+	}
+
+	// ftps of implicit TLS and ftpes of AUTH TLS
+	tlsServer := httptest.NewTLSServer(nil)
+	defer tlsServer.Close()
+	oldRootCAs := ftpRootCAs
+	ftpRootCAs = x509.NewCertPool()
+	ftpRootCAs.AddCert(tlsServer.Certificate())
+	defer func() {
+		ftpRootCAs = oldRootCAs
+	}()
+	for _, scheme := range []string{"ftps", "ftpes"} {
+		server := newFakeFTPServer(t, &fakeFTPServer{files: files, user: "alice", password: "s3cret",
+			tlsConfig: tlsServer.TLS, implicit: scheme == "ftps", interruptAt: 40000})
+		task, err := download(server.URL(scheme, "alice:s3cret@") + "/pub/data.bin")
+		server.Close()
+		if err != nil {
+			t.Fatalf("%s:%s", scheme, err)
+		}
+		expectContent(task)
+		if commands := strings.Join(server.Commands(), "\n"); !strings.Contains(commands, "PROT P") || (scheme == "ftpes") != strings.Contains(commands, "AUTH TLS") {
+			t.Fatalf("unexpected commands of %s:%s", scheme, commands)
+		}
+	}
+}
@@ -16,14 +16,64 @@ func main() {
 		fileSizeLimitGB     = flag.Int64("limit", 5, "the limit size of download file, unit is 'GB'")
 		downloadTimeoutHour = flag.Int64("timeout", 48, "the limit time for finish download task, unit is 'Hour'")
 		basicAuth           = flag.String("auth", "", "http basic access authentication, username:password")
+		retentionDays       = flag.Int64("retentionDays", 0, "delete the completed files older than the days, 0 means never")
+		highWaterPercent    = flag.Int64("highWater", 0, "evict the least recently downloaded files when the files size exceeds the percent of limit, 0 means never")
+		trashDays           = flag.Int64("trashDays", 7, "purge the deleted files in trash older than the days, 0 means never")
+		egressAllow         = flag.String("egressAllow", "", "comma separated CIDRs, IPs or hostnames(.example.com matches the subdomains) which the download may connect to, even they are private")
+		egressDeny          = flag.String("egressDeny", "", "comma separated CIDRs, IPs or hostnames which the download may not connect to")
+		allowHosts          = flag.String("allowHosts", "", "comma separated hostnames(.example.com matches the subdomains) which can be downloaded from, empty means all")
+		denyHosts           = flag.String("denyHosts", "", "comma separated hostnames which can not be downloaded from")
+		denyMIMETypes       = flag.String("denyMIMETypes", "", "comma separated content types which can not be downloaded, e.g. application/x-msdownload,video/*")
+		denyExtensions      = flag.String("denyExtensions", "", "comma separated file extensions which can not be downloaded, e.g. .exe,.apk")
+		maxRedirects        = flag.Int("maxRedirects", 10, "the max number of redirects to follow")
+		allowURLs, denyURLs stringsFlag
 	)
+	flag.Var(&allowURLs, "allowURL", "the regexp which the url must match, can be set multiple times")
+	flag.Var(&denyURLs, "denyURL", "the regexp which the url must not match, can be set multiple times")
 	// 处理flag
 	flag.Parse()
-	err := os.MkdirAll(*downloadDir, 0777)
+	// the env is not the default of flag, so the secret is not printed by -h
+	if *aria2cSecret == "" {
+		*aria2cSecret = os.Getenv("ARIA2C_SECRET")
+	}
+	policy, err := ParseEgressPolicy(*egressAllow, *egressDeny)
+	if err != nil {
+		log.Fatalf("invalid egress policy:%s", err)
+	}
+	egressPolicy = policy
+	urlPolicy, err = ParseURLPolicy(*allowHosts, *denyHosts, allowURLs, denyURLs, *denyMIMETypes, *denyExtensions, *maxRedirects)
+	if err != nil {
+		log.Fatalf("invalid url policy:%s", err)
+	}
+	aria2cHostRules, err = ParseAria2cHostRules(aria2cHostFlags)
+	if err != nil {
+		log.Fatalf("%s", err)
+	}
+	if err := checkWebSeedURL(*webSeedURL); err != nil {
+		log.Fatalf("%s", err)
+	}
+	sshSigners, err = LoadSSHSigners(sshKeyFlags)
+	if err != nil {
+		log.Fatalf("%s", err)
+	}
+	if _, err := ParseSeedPolicy(*seedFlag); err != nil {
+		log.Fatalf("invalid seed policy:%s", err)
+	}
+	switch *btEngineFlag {
+	case BTEngineAria2c, BTEngineNative, BTEngineAuto:
+	default:
+		log.Fatalf("invalid BitTorrent engine:%s, expect aria2c, native or auto", *btEngineFlag)
+	}
+	err = os.MkdirAll(*downloadDir, 0777)
 	if err != nil && !os.IsExist(err) {
 		log.Fatalf("fail to create download dir:%s, err:%s", *downloadDir, err)
 	}
 	tasksManager := NewTasksManager(*downloadDir, *fileSizeLimitGB*1024*1024*1024, time.Duration(*downloadTimeoutHour)*time.Hour)
+	tasksManager.Retention = RetentionPolicy{
+		MaxAge:            time.Duration(*retentionDays) * 24 * time.Hour,
+		HighWaterByteSize: *fileSizeLimitGB * 1024 * 1024 * 1024 * *highWaterPercent / 100,
+		TrashMaxAge:       time.Duration(*trashDays) * 24 * time.Hour,
+	}
 	err = tasksManager.RestoreFromJSON()
 	if err != nil {
 		log.Errorf("tasksManager.RestoreFromJSON error:%s", err)
@@ -32,13 +82,24 @@ func main() {
 	// http server
 	go HTTPServer(tasksManager, *port, *basicAuth)
 	// aria2 worker
-	pid := Aria2Worker(*downloadDir)
-	log.Infof("aria2c pid is %d", pid)
-	defer syscall.Kill(pid, syscall.SIGQUIT)
+	var supervisor *Aria2cSupervisor
+	switch {
+	case *btEngineFlag == BTEngineNative:
+		// the torrents are downloaded in process, aria2c is not needed
+		log.Infof("the native BitTorrent engine is used, aria2c is not started")
+	case isExternalAria2c():
+		ConnectAria2c()
+	default:
+		supervisor = StartAria2c(*downloadDir)
+	}
+	// refresh the trackers of aria2c
+	go trackerList.RefreshWorker(*trackerFile, *trackerURL, time.Duration(*trackerRefreshHours)*time.Hour)
 	// ReDownloadUncompleted task
 	tasksManager.ReDownloadUncompleted()
 	// push download tasks info update worker
 	go tasksManager.PushTasksUpdateWorker()
+	// delete expired files
+	go tasksManager.RetentionWorker()
 	// signal SIGHUP reload index.html
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, syscall.SIGINT, syscall.SIGQUIT, syscall.SIGTERM, syscall.SIGSTOP, syscall.SIGUSR1, syscall.SIGUSR2)
@@ -62,6 +123,9 @@ func main() {
 			if err != nil {
 				log.Fatalf("tasksManager.BackupToJSON error:%s", err.Error())
 			}
+			if supervisor != nil {
+				supervisor.Stop()
+			}
 			return
 		}
 	}
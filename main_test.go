@@ -14,7 +14,7 @@ func TestTasksManager_WebSocketHandler(t *testing.T) {
 	const limitByteSize = 3 * 1024 * 1024 * 1024
 	const limitTimeout = time.Hour * 24
 	tasksManager := NewTasksManager(downloadDir, limitByteSize, limitTimeout)
-	go HTTPServer(tasksManager, "127.0.0.1:8081", 8081, "")
+	go HTTPServer(tasksManager, 8081, "")
 	go tasksManager.PushTasksUpdateWorker()
 	// build 10 tasks
 	var wg sync.WaitGroup
@@ -0,0 +1,339 @@
+package main
+
+import (
+	"crypto/sha1"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hanjm/log"
+)
+
+const (
+	// the auto piece length keeps the pieces about torrentTargetPieces
+	torrentTargetPieces   = 1500
+	torrentMinPieceLength = 16 * 1024
+	torrentMaxPieceLength = 16 * 1024 * 1024
+	torrentCreatedBy      = "file_download_proxy"
+)
+
+// the clients can not tell the url of fdp which is reachable by the peers, so the web seed is configured
+var webSeedURL = flag.String("webSeedURL", "", "the base url of /download/ as the web seed of the created torrents, e.g. https://fdp.example.com/download/, empty means no web seed")
+
+// checkWebSeedURL checks -webSeedURL is the http(s) url of dir, the name of torrent is appended to it by the clients
+func checkWebSeedURL(s string) error {
+	if s == "" {
+		return nil
+	}
+	u, err := url.Parse(s)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || !strings.HasSuffix(u.Path, "/") {
+		return fmt.Errorf("invalid web seed url, expect the http(s) url ends with /:%s", s)
+	}
+	return nil
+}
+
+// MakeTorrentOptions is the options of creating torrent
+type MakeTorrentOptions struct {
+	// 0 means auto
+	PieceLength int64
+	Trackers    []string
+	// the base url of the files, the name of torrent is appended by the clients, see BEP 19
+	WebSeeds []string
+}
+
+// MakeTorrent creates the v1 torrent of the file or dir in the download dir
+func MakeTorrent(fs *ConfinedFS, name string, options MakeTorrentOptions) ([]byte, *TorrentInfo, error) {
+	if !isSafeTorrentPath(name) {
+		return nil, nil, fmt.Errorf("invalid name:%s", name)
+	}
+	stat, err := fs.Stat(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	// the files are hashed in the order of their paths
+	var files []TorrentFile
+	if stat.IsDir() {
+		if files, err = listTorrentFiles(fs, name); err != nil {
+			return nil, nil, err
+		}
+		if len(files) == 0 {
+			return nil, nil, fmt.Errorf("%s has no file", name)
+		}
+	} else {
+		files = []TorrentFile{{Path: name, Length: stat.Size()}}
+	}
+	var length int64
+	for _, file := range files {
+		length += file.Length
+	}
+	pieceLength := options.PieceLength
+	if pieceLength == 0 {
+		pieceLength = autoPieceLength(length)
+	} else if err := checkPieceLength(pieceLength); err != nil {
+		return nil, nil, err
+	}
+	pieces, err := hashPieces(fs, files, pieceLength)
+	if err != nil {
+		return nil, nil, err
+	}
+	info := map[string]interface{}{
+		"name":         name,
+		"piece length": pieceLength,
+		"pieces":       pieces,
+	}
+	if stat.IsDir() {
+		list := make([]interface{}, 0, len(files))
+		for _, file := range files {
+			list = append(list, map[string]interface{}{
+				"length": file.Length,
+				"path":   strings.Split(strings.TrimPrefix(file.Path, name+"/"), "/"),
+			})
+		}
+		info["files"] = list
+	} else {
+		info["length"] = length
+	}
+	meta := map[string]interface{}{
+		"info":          info,
+		"created by":    torrentCreatedBy,
+		"creation date": time.Now().Unix(),
+	}
+	if len(options.Trackers) > 0 {
+		tiers := make([]interface{}, 0, len(options.Trackers))
+		for _, tracker := range options.Trackers {
+			tiers = append(tiers, []string{tracker})
+		}
+		meta["announce"] = options.Trackers[0]
+		meta["announce-list"] = tiers
+	}
+	if len(options.WebSeeds) > 0 {
+		meta["url-list"] = options.WebSeeds
+	}
+	data, err := BencodeEncode(meta)
+	if err != nil {
+		return nil, nil, err
+	}
+	t, err := ParseTorrent(data)
+	if err != nil {
+		return nil, nil, err
+	}
+	return data, t, nil
+}
+
+// listTorrentFiles lists the files in dir recursively, the control files of aria2c are skipped
+func listTorrentFiles(fs *ConfinedFS, dir string) ([]TorrentFile, error) {
+	infos, err := fs.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var files []TorrentFile
+	for _, info := range infos {
+		name := path.Join(dir, info.Name())
+		switch {
+		case info.IsDir():
+			children, err := listTorrentFiles(fs, name)
+			if err != nil {
+				return nil, err
+			}
+			files = append(files, children...)
+		case info.Mode().IsRegular() && !strings.HasSuffix(name, ".aria2"):
+			files = append(files, TorrentFile{Path: name, Length: info.Size()})
+		}
+	}
+	return files, nil
+}
+
+// autoPieceLength returns the power of 2 piece length which keeps the pieces about torrentTargetPieces
+func autoPieceLength(length int64) int64 {
+	pieceLength := int64(torrentMinPieceLength)
+	for pieceLength < torrentMaxPieceLength && length/pieceLength > torrentTargetPieces {
+		pieceLength *= 2
+	}
+	return pieceLength
+}
+
+// checkPieceLength checks the piece length is the power of 2 between 16KB and 16MB
+func checkPieceLength(pieceLength int64) error {
+	if pieceLength < torrentMinPieceLength || pieceLength > torrentMaxPieceLength || pieceLength&(pieceLength-1) != 0 {
+		return fmt.Errorf("piece length expect the power of 2 between %s and %s, not %d",
+			getHumanSizeString(torrentMinPieceLength), getHumanSizeString(torrentMaxPieceLength), pieceLength)
+	}
+	return nil
+}
+
+// hashPieces returns the sha1 of the pieces, the files are concatenated
+func hashPieces(fs *ConfinedFS, files []TorrentFile, pieceLength int64) ([]byte, error) {
+	var pieces []byte
+	piece := make([]byte, 0, pieceLength)
+	for _, file := range files {
+		if err := func() error {
+			fp, err := fs.Open(file.Path)
+			if err != nil {
+				return err
+			}
+			defer fp.Close()
+			var n int64
+			for {
+				read, err := io.ReadFull(fp, piece[len(piece):pieceLength])
+				piece = piece[:len(piece)+read]
+				n += int64(read)
+				if int64(len(piece)) == pieceLength {
+					sum := sha1.Sum(piece)
+					pieces = append(pieces, sum[:]...)
+					piece = piece[:0]
+				}
+				if err == io.EOF || err == io.ErrUnexpectedEOF {
+					break
+				}
+				if err != nil {
+					return err
+				}
+			}
+			if n != file.Length {
+				return fmt.Errorf("%s is changed while hashing", file.Path)
+			}
+			return nil
+		}(); err != nil {
+			return nil, fmt.Errorf("hash %s error:%s", file.Path, err)
+		}
+	}
+	if len(piece) > 0 {
+		sum := sha1.Sum(piece)
+		pieces = append(pieces, sum[:]...)
+	}
+	return pieces, nil
+}
+
+// createTorrent creates the torrent of the completed task in the background, it is saved as <info hash>.torrent in the download dir.
+// the params are pieceLength(bytes, empty means auto), trackers(the global trackers if empty), webSeed(default true if -webSeedURL is set)
+// and seed, the task is seeded by the engine of -btEngine with the seeding policy if seed is set.
+// CreatingTorrent of the task is set until the pieces are hashed, the torrent is got by GET once CreatedTorrent is set
+func (m *TasksManager) createTorrent(w http.ResponseWriter, r *http.Request, task Task) {
+	if _, ok := task.(TorrentTask); ok {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("the torrent task has its torrent"))
+		return
+	}
+	if !task.IsCompleted() {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("only the completed task can create torrent"))
+		return
+	}
+	var options MakeTorrentOptions
+	if v := r.PostFormValue("pieceLength"); v != "" {
+		pieceLength, err := strconv.ParseInt(v, 10, 64)
+		if err == nil {
+			err = checkPieceLength(pieceLength)
+		}
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("param pieceLength is invalid:" + v))
+			return
+		}
+		options.PieceLength = pieceLength
+	}
+	if v := r.PostFormValue("trackers"); strings.TrimSpace(v) != "" {
+		trackers, err := ParseTaskTrackers(v)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		options.Trackers = trackers
+	} else {
+		options.Trackers = trackerList.Trackers()
+	}
+	if webSeed, err := strconv.ParseBool(r.PostFormValue("webSeed")); *webSeedURL != "" && (err != nil || webSeed) {
+		options.WebSeeds = []string{*webSeedURL}
+	}
+	var seedPolicy SeedPolicy
+	if seed := r.PostFormValue("seed"); seed != "" {
+		policy, err := ParseSeedPolicy(seed)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		seedPolicy = policy
+	}
+	seed := seedPolicy.Mode != "" && seedPolicy.Mode != SeedModeNone
+	if seed && !useNativeBTEngine() && !IsAria2cRunning() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte("aria2c is not running, cannot seed torrent"))
+		return
+	}
+	info := task.Info()
+	unlock := lockTaskInfo(task)
+	creating := info.CreatingTorrent
+	info.CreatingTorrent, info.CreateTorrentError = true, ""
+	unlock()
+	if creating {
+		w.WriteHeader(http.StatusConflict)
+		w.Write([]byte("the torrent is being created"))
+		return
+	}
+	m.workers.Add(1)
+	go func() {
+		defer m.workers.Done()
+		m.makeTaskTorrent(task, options, seedPolicy)
+		m.PushTasksUpdate()
+	}()
+	w.WriteHeader(http.StatusAccepted)
+	w.Write([]byte("CREATE ACCEPTED"))
+	m.PushTasksUpdate()
+}
+
+// makeTaskTorrent hashes the files of task and saves the torrent, the result is set to the info of task
+func (m *TasksManager) makeTaskTorrent(task Task, options MakeTorrentOptions, seedPolicy SeedPolicy) {
+	data, info, err := MakeTorrent(m.fs, task.FileName(), options)
+	if err == nil {
+		if err = m.fs.WriteFile(info.InfoHash+".torrent", data, 0644); err != nil {
+			err = fmt.Errorf("save torrent error:%s", err)
+		}
+	}
+	taskInfo := task.Info()
+	unlock := lockTaskInfo(task)
+	taskInfo.CreatingTorrent = false
+	if err != nil {
+		taskInfo.CreateTorrentError = fmt.Sprintf("create torrent error:%s", err)
+	} else {
+		taskInfo.CreatedTorrent = info.InfoHash
+	}
+	unlock()
+	if err != nil {
+		log.Errorf("[TaskHandler]create torrent of %s error:%s", task.FileName(), err)
+		return
+	}
+	log.Infof("[TaskHandler]create torrent of %s:%s, piece length:%d", task.FileName(), info.InfoHash, info.PieceLength)
+	if seedPolicy.Mode != "" && seedPolicy.Mode != SeedModeNone {
+		// the task becomes the torrent task seeded by aria2c or the native engine
+		seeder := torrentTaskOfEngine(newCreatedTorrentTask(task, info, m.downloadDir+"/"+info.InfoHash+".torrent"))
+		seeder.Info().SeedPolicy = seedPolicy.String()
+		if m.replaceTask(task, seeder) {
+			m.startDownload(seeder)
+		}
+	}
+}
+
+// newCreatedTorrentTask returns the torrent task of the torrent created from the completed task, the files are verified and seeded
+func newCreatedTorrentTask(task Task, info *TorrentInfo, torrentPath string) *MagnetTask {
+	t := NewMagnetTask(torrentPath)
+	unlock := lockTaskInfo(task)
+	t.TaskInfo = *task.Info()
+	unlock()
+	t.TaskInfo.SourceURL, t.TaskInfo.Backend = torrentPath, BackendBitTorrent
+	t.TaskInfo.IsError, t.TaskInfo.Error = false, ""
+	t.TaskInfo.CreatingTorrent, t.TaskInfo.CreateTorrentError = false, ""
+	t.TaskInfo.Files = nil
+	for i, file := range info.Files {
+		t.TaskInfo.Files = append(t.TaskInfo.Files, TaskFile{Index: i + 1, Path: file.Path, Length: file.Length, CompletedLength: file.Length, Selected: true})
+	}
+	t.infoHash = info.InfoHash
+	return t
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMakeTorrent(t *testing.T) {
+	downloadDir, err := ioutil.TempDir("", "fdp-maketorrent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(downloadDir)
+	content := make([]byte, 40000)
+	rand.Read(content)
+	files := map[string][]byte{
+		"a.bin":            content,
+		"d/2.txt":          content[:100],
+		"d/2.txt.aria2":    []byte("control"),
+		"d/x/1.txt":        content[100:20000],
+		"empty/.gitignore": nil,
+	}
+	for name, data := range files {
+		os.MkdirAll(filepath.Dir(filepath.Join(downloadDir, name)), 0777)
+		if err := ioutil.WriteFile(filepath.Join(downloadDir, name), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fs := NewConfinedFS(downloadDir)
+	options := MakeTorrentOptions{PieceLength: 16384, Trackers: []string{"udp://t:80"}, WebSeeds: []string{"http://h/download/"}}
+	data, info, err := MakeTorrent(fs, "a.bin", options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Name != "a.bin" || info.Length != 40000 || info.PieceLength != 16384 ||
+		!reflect.DeepEqual(info.Trackers, [][]string{{"udp://t:80"}}) || !reflect.DeepEqual(info.WebSeeds, []string{"http://h/download/"}) {
+		t.Fatalf("unexpected torrent:%+v", info)
+	}
+	var pieces []byte
+	for i := 0; i < len(content); i += 16384 {
+		end := i + 16384
+		if end > len(content) {
+			end = len(content)
+		}
+		sum := sha1.Sum(content[i:end])
+		pieces = append(pieces, sum[:]...)
+	}
+	if !bytes.Contains(data, append([]byte("6:pieces60:"), pieces...)) {
+		t.Fatal("unexpected pieces")
+	}
+	// the files of dir are concatenated, the control files of aria2c are skipped
+	data, info, err = MakeTorrent(fs, "d", MakeTorrentOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha1.Sum(append(append([]byte(nil), content[:100]...), content[100:20000]...)[:16384])
+	if !reflect.DeepEqual(info.Files, []TorrentFile{{"d/2.txt", 100}, {"d/x/1.txt", 19900}}) || !bytes.Contains(data, sum[:]) {
+		t.Fatalf("unexpected torrent of dir:%+v", info)
+	}
+	if _, _, err := MakeTorrent(fs, "a.bin", MakeTorrentOptions{PieceLength: 1000}); err == nil {
+		t.Fatal("expect the invalid piece length rejected")
+	}
+	if _, _, err := MakeTorrent(fs, "..", MakeTorrentOptions{}); err == nil {
+		t.Fatal("expect the parent dir rejected")
+	}
+	if pieceLength := autoPieceLength(1 << 30); pieceLength != 1<<20 {
+		t.Fatalf("expect 1MB pieces for 1GB, got %d", pieceLength)
+	}
+	for s, valid := range map[string]bool{"": true, "https://fdp.example.com/download/": true, "https://fdp.example.com/download": false, "ftp://h/": false, "/download/": false} {
+		if err := checkWebSeedURL(s); (err == nil) != valid {
+			t.Fatalf("unexpected web seed url %s:%v", s, err)
+		}
+	}
+}
+
+func TestTasksManager_CreateTorrent(t *testing.T) {
+	const gid = "2089b05ecca3d829"
+	downloadDir, err := ioutil.TempDir("", "fdp-createtorrent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(downloadDir)
+	if err := ioutil.WriteFile(filepath.Join(downloadDir, "a.bin"), []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	setFlag(t, "webSeedURL", "http://fdp.example.com/download/")
+	m := NewTasksManager(downloadDir, 1024*1024, time.Minute)
+	task := NewHTTPTask("http://example.com/a.bin")
+	task.TaskInfo.FileName = "a.bin"
+	m.AddTask(task)
+	request := func(method string, path string, form url.Values) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path+"?filename=a.bin", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		m.TorrentHandler(w, req)
+		return w
+	}
+	if w := request(http.MethodPost, "/file_download_proxy/torrent", nil); w.Code != http.StatusBadRequest {
+		t.Fatalf("expect the uncompleted task rejected, got %d %s", w.Code, w.Body)
+	}
+	task.TaskInfo.IsCompleted = true
+	if w := request(http.MethodPost, "/file_download_proxy/torrent", url.Values{"pieceLength": {"1000"}}); w.Code != http.StatusBadRequest {
+		t.Fatalf("expect the invalid piece length rejected, got %d %s", w.Code, w.Body)
+	}
+	// the pieces are hashed in the background, the torrent is got once it is created
+	if w := request(http.MethodPost, "/file_download_proxy/torrent", url.Values{"trackers": {"udp://t:80"}}); w.Code != http.StatusAccepted {
+		t.Fatalf("expect accepted, got %d %s", w.Code, w.Body)
+	}
+	var w *httptest.ResponseRecorder
+	for i := 0; i < 100; i++ {
+		if w = request(http.MethodGet, "/file_download_proxy/torrent", nil); w.Code == http.StatusOK || !strings.Contains(w.Body.String(), "being created") {
+			break
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	info, err := ParseTorrent(w.Body.Bytes())
+	if err != nil {
+		t.Fatalf("expect the created torrent, got %d %s", w.Code, w.Body)
+	}
+	task.mutex.Lock()
+	if task.CreatedTorrent != info.InfoHash || task.CreatingTorrent || !reflect.DeepEqual(info.WebSeeds, []string{"http://fdp.example.com/download/"}) {
+		t.Fatalf("unexpected created torrent:%+v", info)
+	}
+	task.mutex.Unlock()
+	if w := request(http.MethodGet, "/file_download_proxy/magnet", nil); w.Body.String() != info.Magnet().String() {
+		t.Fatalf("unexpected magnet:%s", w.Body)
+	}
+	// seeded by aria2c, the files are verified rather than downloaded again
+	var mutex sync.Mutex
+	var checkIntegrity string
+	var forceRemoved bool
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			ID     string            `json:"id"`
+			Method string            `json:"method"`
+			Params []json.RawMessage `json:"params"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		mutex.Lock()
+		defer mutex.Unlock()
+		result := `"OK"`
+		switch req.Method {
+		case "aria2.getVersion":
+			result = `{"version":"1.37.0"}`
+		case "aria2.addTorrent":
+			var options Aria2cOptions
+			json.Unmarshal(req.Params[len(req.Params)-1], &options)
+			checkIntegrity = options.CheckIntegrity
+			result = `"` + gid + `"`
+		case "aria2.tellActive", "aria2.tellStatus", "system.multicall":
+			status := "active"
+			if forceRemoved {
+				status = "removed"
+			}
+			result = `{"gid":"` + gid + `","status":"` + status + `","seeder":"true","totalLength":"5","completedLength":"5",` +
+				`"files":[{"index":"1","path":"` + downloadDir + `/a.bin","length":"5","completedLength":"5","selected":"true"}]}`
+			switch req.Method {
+			case "aria2.tellActive":
+				result = "[" + result + "]"
+			case "system.multicall":
+				result = "[[" + result + "]]"
+			}
+		case "aria2.tellWaiting":
+			result = "[]"
+		case "aria2.forceRemove":
+			forceRemoved = true
+			result = `"` + gid + `"`
+		}
+		fmt.Fprintf(w, `{"id":"%s","jsonrpc":"2.0","result":%s}`, req.ID, result)
+	}))
+	defer server.Close()
+	// the poll interval read by the running monitor is not changed, the download is polled once it is subscribed
+	oldRPC, oldDir := *aria2cRPC, *aria2cDirFlag
+	*aria2cRPC, *aria2cDirFlag = server.URL, ""
+	defer func() {
+		*aria2cRPC, *aria2cDirFlag = oldRPC, oldDir
+	}()
+	if w := request(http.MethodPost, "/file_download_proxy/torrent", url.Values{"seed": {"forever"}, "webSeed": {"false"}}); w.Code != http.StatusAccepted {
+		t.Fatalf("expect accepted, got %d %s", w.Code, w.Body)
+	}
+	var mt *MagnetTask
+	for i := 0; i < 100 && mt == nil; i++ {
+		time.Sleep(time.Millisecond * 10)
+		mt, _ = m.GetTask("a.bin").(*MagnetTask)
+	}
+	if mt == nil {
+		t.Fatal("expect the task replaced by the torrent task")
+	}
+	mt.mutex.Lock()
+	torrentPath := mt.SourceURL
+	mt.mutex.Unlock()
+	if data, _ := ioutil.ReadFile(torrentPath); len(data) == 0 {
+		t.Fatal("expect the seeded torrent saved")
+	} else if seeded, _ := ParseTorrent(data); seeded == nil || len(seeded.WebSeeds) != 0 {
+		t.Fatalf("expect no web seed, got %+v", seeded)
+	}
+	var seeding bool
+	for i := 0; i < 100 && !seeding; i++ {
+		time.Sleep(time.Millisecond * 10)
+		mt.mutex.Lock()
+		seeding = mt.Seeding
+		mt.mutex.Unlock()
+	}
+	mutex.Lock()
+	if !seeding || checkIntegrity != "true" || mt.SeedPolicy != "forever" {
+		t.Fatalf("expect the verified files seeded, check-integrity:%s, task:%+v", checkIntegrity, mt.TaskInfo)
+	}
+	mutex.Unlock()
+	mt.Cancel()
+	if data, err := ioutil.ReadFile(filepath.Join(downloadDir, "a.bin")); err != nil || string(data) != "hello" {
+		t.Fatalf("the seeded file expect kept:%v", err)
+	}
+}
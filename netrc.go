@@ -0,0 +1,84 @@
+package main
+
+import (
+	"flag"
+	"github.com/hanjm/log"
+	"io/ioutil"
+	"strings"
+)
+
+var netrcFile = flag.String("netrc", "", "the netrc file of the credentials of ftp hosts, only the machine entries are used, no netrc is read if empty")
+
+// NetrcMachine is the credentials of a machine in the netrc file, the Name of "default" entry is empty
+type NetrcMachine struct {
+	Name     string
+	Login    string
+	Password string
+}
+
+// ParseNetrc parses the machine, default, login and password tokens, the macdef and account are skipped
+func ParseNetrc(data string) []*NetrcMachine {
+	var machines []*NetrcMachine
+	var machine *NetrcMachine
+	var key string
+	inMacdef := false
+	for _, line := range strings.Split(data, "\n") {
+		if inMacdef {
+			// the macro ends with an empty line
+			inMacdef = strings.TrimSpace(line) != ""
+			continue
+		}
+		if strings.HasPrefix(strings.TrimSpace(line), "#") {
+			continue
+		}
+		for _, token := range strings.Fields(line) {
+			if key == "" {
+				switch token {
+				case "default":
+					machine = &NetrcMachine{}
+					machines = append(machines, machine)
+				case "machine", "login", "password", "account", "macdef":
+					key = token
+				}
+				continue
+			}
+			switch key {
+			case "machine":
+				machine = &NetrcMachine{Name: strings.ToLower(token)}
+				machines = append(machines, machine)
+			case "login":
+				if machine != nil {
+					machine.Login = token
+				}
+			case "password":
+				if machine != nil {
+					machine.Password = token
+				}
+			case "macdef":
+				// the macro starts from the next line
+				inMacdef = true
+			}
+			key = ""
+		}
+	}
+	return machines
+}
+
+// netrcLookup returns the credentials of the machine entry of host in the -netrc file, the default entry is not used
+// so the credentials are not sent to the other hosts. nothing is read if -netrc is not set
+func netrcLookup(host string) (login string, password string, ok bool) {
+	if *netrcFile == "" {
+		return "", "", false
+	}
+	data, err := ioutil.ReadFile(*netrcFile)
+	if err != nil {
+		log.Warnf("read netrc %s error:%s", *netrcFile, err)
+		return "", "", false
+	}
+	for _, machine := range ParseNetrc(string(data)) {
+		if machine.Name != "" && machine.Name == strings.ToLower(host) {
+			return machine.Login, machine.Password, true
+		}
+	}
+	return "", "", false
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"github.com/hanjm/log"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+const retentionCheckInterval = time.Minute * 10
+
+// RetentionPolicy decides which completed files are deleted automatically, the pinned files are exempted
+type RetentionPolicy struct {
+	// the completed files older than MaxAge are deleted, 0 means never
+	MaxAge time.Duration
+	// the least recently downloaded files are evicted while the size of download dir exceeds HighWaterByteSize, 0 means never,
+	// the trash is emptied first
+	HighWaterByteSize int64
+	// the trash items older than TrashMaxAge are purged, 0 means never
+	TrashMaxAge time.Duration
+}
+
+func (p RetentionPolicy) Enabled() bool {
+	return p.MaxAge > 0 || p.HighWaterByteSize > 0 || p.TrashMaxAge > 0
+}
+
+// RetentionWorker applies the retention policy periodically
+func (m *TasksManager) RetentionWorker() {
+	defer func() {
+		if rec := recover(); rec != nil {
+			log.Errorf("retentionWorker panic:%s", rec)
+		}
+	}()
+	if !m.Retention.Enabled() {
+		return
+	}
+	log.Infof("[retention]maxAge:%s, highWater:%s, trashMaxAge:%s", m.Retention.MaxAge, getHumanSizeString(m.Retention.HighWaterByteSize), m.Retention.TrashMaxAge)
+	ticker := time.NewTicker(retentionCheckInterval)
+	defer ticker.Stop()
+	for {
+		m.ApplyRetentionPolicy()
+		<-ticker.C
+	}
+}
+
+// ApplyRetentionPolicy deletes the expired files and returns their filenames
+func (m *TasksManager) ApplyRetentionPolicy() (evicted []string) {
+	now := time.Now()
+	if m.Retention.TrashMaxAge > 0 {
+		m.PurgeExpiredTrash(m.Retention.TrashMaxAge)
+	}
+	type candidate struct {
+		filename   string
+		size       int64
+		lastAccess time.Time
+	}
+	var candidates []candidate
+	for _, task := range m.GetTasks() {
+		if !task.IsCompleted() {
+			continue
+		}
+		info := task.Info()
+		unlock := lockTaskInfo(task)
+		pinned, lastAccess, completeTime := info.Pinned, info.LastDownloadTime, info.StartTime.Add(info.Duration)
+		unlock()
+		if pinned {
+			continue
+		}
+		if m.Retention.MaxAge > 0 && now.Sub(completeTime) > m.Retention.MaxAge {
+			if m.evict(task.FileName(), "completed at "+completeTime.Format(time.RFC3339)) {
+				evicted = append(evicted, task.FileName())
+			}
+			continue
+		}
+		if lastAccess.Before(completeTime) {
+			lastAccess = completeTime
+		}
+		candidates = append(candidates, candidate{
+			filename:   task.FileName(),
+			size:       m.fileSize(task.FileName()),
+			lastAccess: lastAccess,
+		})
+	}
+	if m.Retention.HighWaterByteSize > 0 {
+		filesSize := m.FilesSize()
+		if filesSize > m.Retention.HighWaterByteSize {
+			filesSize = m.purgeTrashUntil(filesSize)
+		}
+		sort.Slice(candidates, func(i, j int) bool {
+			return candidates[i].lastAccess.Before(candidates[j].lastAccess)
+		})
+		for _, c := range candidates {
+			if filesSize <= m.Retention.HighWaterByteSize {
+				break
+			}
+			if m.evict(c.filename, "least recently downloaded at "+c.lastAccess.Format(time.RFC3339)) {
+				evicted = append(evicted, c.filename)
+				filesSize -= c.size
+			}
+		}
+	}
+	if len(evicted) > 0 {
+		m.PushTasksUpdate()
+	}
+	return evicted
+}
+
+func (m *TasksManager) evict(filename string, reason string) bool {
+	err := m.RemoveTask(filename)
+	if err != nil {
+		log.Errorf("[retention]evict %s error:%s", filename, err)
+		return false
+	}
+	log.Infof("[retention]evict %s, %s", filename, reason)
+	return true
+}
+
+// purgeTrashUntil purges the oldest trash items until filesSize drops to the high water mark
+func (m *TasksManager) purgeTrashUntil(filesSize int64) int64 {
+	items, err := m.ListTrash()
+	if err != nil {
+		log.Errorf("[retention]ListTrash error:%s", err)
+		return filesSize
+	}
+	for i := len(items) - 1; i >= 0 && filesSize > m.Retention.HighWaterByteSize; i-- {
+		if err := m.PurgeTrash(items[i].ID); err != nil {
+			log.Errorf("[retention]purge trash %s error:%s", items[i].ID, err)
+			continue
+		}
+		log.Infof("[retention]purge trash %s, deleted at %s", items[i].FileName, items[i].DeletedTime.Format(time.RFC3339))
+		filesSize -= items[i].Size
+	}
+	return filesSize
+}
+
+// TouchFile records the download time of the file, the retention policy evicts the least recently downloaded files first
+func (m *TasksManager) TouchFile(filename string) {
+	if task := m.GetTask(filename); task != nil {
+		unlock := lockTaskInfo(task)
+		task.Info().LastDownloadTime = time.Now()
+		unlock()
+	}
+}
+
+// FilesSize returns the size of all files in download dir
+func (m *TasksManager) FilesSize() int64 {
+	return m.fileSize(".")
+}
+
+// fileSize returns the size of the file or dir in download dir
+func (m *TasksManager) fileSize(name string) int64 {
+	path, err := m.fs.Resolve(name)
+	if err != nil {
+		return 0
+	}
+	return diskUsage(path)
+}
+
+func diskUsage(path string) (size int64) {
+	filepath.Walk(path, func(_ string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestTasksManager_ApplyRetentionPolicy(t *testing.T) {
+	now := time.Now()
+	type file struct {
+		name         string
+		size         int
+		completed    bool
+		pinned       bool
+		completeTime time.Time
+		downloadTime time.Time
+	}
+	for _, c := range []struct {
+		name    string
+		policy  RetentionPolicy
+		files   []file
+		evicted []string
+	}{
+		{
+			name:   "least recently downloaded first",
+			policy: RetentionPolicy{HighWaterByteSize: 250},
+			files: []file{
+				{name: "a", size: 100, completed: true, completeTime: now.Add(-3 * time.Hour), downloadTime: now.Add(-time.Minute)},
+				{name: "b", size: 100, completed: true, completeTime: now.Add(-2 * time.Hour)},
+				{name: "c", size: 100, completed: true, completeTime: now.Add(-time.Hour), downloadTime: now.Add(-90 * time.Minute)},
+			},
+			// a is downloaded recently, the download time of c before it is completed is ignored
+			evicted: []string{"b"},
+		},
+		{
+			name:   "evicted until under the high water",
+			policy: RetentionPolicy{HighWaterByteSize: 150},
+			files: []file{
+				{name: "a", size: 100, completed: true, completeTime: now.Add(-3 * time.Hour)},
+				{name: "b", size: 100, completed: true, completeTime: now.Add(-2 * time.Hour)},
+				{name: "c", size: 100, completed: true, completeTime: now.Add(-time.Hour)},
+			},
+			evicted: []string{"a", "b"},
+		},
+		{
+			name:   "pinned and uncompleted skipped",
+			policy: RetentionPolicy{HighWaterByteSize: 150},
+			files: []file{
+				{name: "a", size: 100, completed: true, pinned: true, completeTime: now.Add(-3 * time.Hour)},
+				{name: "b", size: 100, completeTime: now.Add(-2 * time.Hour)},
+				{name: "c", size: 100, completed: true, completeTime: now.Add(-time.Hour)},
+			},
+			evicted: []string{"c"},
+		},
+		{
+			name:   "older than max age",
+			policy: RetentionPolicy{MaxAge: 24 * time.Hour},
+			files: []file{
+				{name: "a", size: 100, completed: true, completeTime: now.Add(-48 * time.Hour), downloadTime: now},
+				{name: "b", size: 100, completed: true, pinned: true, completeTime: now.Add(-48 * time.Hour)},
+				{name: "c", size: 100, completed: true, completeTime: now.Add(-time.Hour)},
+			},
+			evicted: []string{"a"},
+		},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			downloadDir, err := ioutil.TempDir("", "fdp-retention")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(downloadDir)
+			m := NewTasksManager(downloadDir, 1<<40, time.Minute)
+			m.Retention = c.policy
+			for _, f := range c.files {
+				if err := ioutil.WriteFile(filepath.Join(downloadDir, f.name), make([]byte, f.size), 0644); err != nil {
+					t.Fatal(err)
+				}
+				task := NewHTTPTask("http://example.com/" + f.name)
+				task.TaskInfo.FileName = f.name
+				task.TaskInfo.IsCompleted = f.completed
+				task.TaskInfo.Pinned = f.pinned
+				task.TaskInfo.StartTime = f.completeTime.Add(-time.Minute)
+				task.TaskInfo.Duration = time.Minute
+				task.TaskInfo.LastDownloadTime = f.downloadTime
+				m.AddTask(task)
+			}
+			if evicted := m.ApplyRetentionPolicy(); !reflect.DeepEqual(evicted, c.evicted) {
+				t.Fatalf("expect evicted %v, got %v", c.evicted, evicted)
+			}
+			evicted := make(map[string]bool)
+			for _, name := range c.evicted {
+				evicted[name] = true
+			}
+			for _, f := range c.files {
+				_, err := os.Stat(filepath.Join(downloadDir, f.name))
+				if kept := m.GetTask(f.name) != nil; kept != (err == nil) || kept == evicted[f.name] {
+					t.Fatalf("unexpected %s, task kept:%v, file error:%v", f.name, kept, err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,739 @@
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/hanjm/log"
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// the backend of s3://bucket/key and the presigned urls of s3
+const BackendS3 = "s3"
+
+var (
+	s3Endpoint        = flag.String("s3Endpoint", "https://s3.amazonaws.com", "the endpoint of s3 urls, like http://127.0.0.1:9000 of MinIO or Ceph")
+	s3Region          = flag.String("s3Region", "", "the region of -s3Endpoint, empty means it is looked up by the bucket")
+	s3CredentialsFile = flag.String("s3Credentials", "", "the credentials file of s3, default is env AWS_SHARED_CREDENTIALS_FILE or ~/.aws/credentials, the env AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY are used first")
+	s3Profile         = flag.String("s3Profile", "", "the profile in the credentials file of s3, default is env AWS_PROFILE or default")
+	s3Concurrency     = flag.Int("s3Concurrency", 4, "the number of parallel ranged GETs of a s3 object")
+	s3Buckets         = flag.String("s3Buckets", "", "the comma separated buckets which can be downloaded by s3:// urls with the credentials of server, s3:// urls are rejected if empty")
+)
+
+// the object is downloaded by the ranges of s3PartSize, the transfer is retried at most s3MaxRetries times
+var (
+	s3PartSize   int64 = 8 << 20
+	s3MaxRetries       = 3
+	s3RetryDelay       = 2 * time.Second
+)
+
+func init() {
+	RegisterBackend(&Backend{
+		Name:    BackendS3,
+		Schemes: []string{"s3"},
+		New: func(ctx context.Context, sourceURL string) (Task, error) {
+			// the host of s3 url is the bucket of -s3Endpoint, which is set by the admin and not checked by the egress policy
+			if err := urlPolicy.CheckURL(sourceURL); err != nil {
+				return nil, err
+			}
+			return NewS3Task(sourceURL)
+		},
+		Restore: func() Task {
+			return &S3Task{}
+		},
+		// the objects which are verified by ETag are skipped
+		Resumable: true,
+	})
+}
+
+// isPresignedS3URL reports whether the http(s) url is signed by the query of s3 signature v4 or v2
+func isPresignedS3URL(sourceURL string) bool {
+	u, err := url.Parse(sourceURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return false
+	}
+	query := u.Query()
+	return query.Get("X-Amz-Signature") != "" || (query.Get("Signature") != "" && query.Get("AWSAccessKeyId") != "")
+}
+
+// redactPresignedURL hides the signature and credential of presigned url
+func redactPresignedURL(u *url.URL) string {
+	query := u.Query()
+	for _, key := range []string{"X-Amz-Signature", "X-Amz-Credential", "X-Amz-Security-Token", "Signature", "AWSAccessKeyId"} {
+		if query.Get(key) != "" {
+			query.Set(key, "xxxxx")
+		}
+	}
+	redacted := *u
+	redacted.RawQuery = query.Encode()
+	return redacted.Redacted()
+}
+
+// S3Task downloads the object of s3 url or presigned url, or the objects under the prefix into the task folder
+type S3Task struct {
+	TaskType int
+	TaskInfo
+	// the presigned url with signature, TaskInfo.SourceURL is redacted as it is pushed to the page
+	sourceURL string
+	canceled  bool
+	cancel    context.CancelFunc
+	done      chan struct{}
+	mutex     sync.Mutex
+}
+
+// s3TaskRecord is the S3Task in the backup file
+type s3TaskRecord struct {
+	TaskType int
+	TaskInfo
+	URL string `json:",omitempty"`
+}
+
+// MarshalJSON returns the task pushed to the page, the url with the secret is not in it
+func (t *S3Task) MarshalJSON() ([]byte, error) {
+	t.mutex.Lock()
+	record := s3TaskRecord{
+		TaskType: t.TaskType,
+		TaskInfo: t.TaskInfo,
+	}
+	t.mutex.Unlock()
+	return json.Marshal(&record)
+}
+
+// MarshalRecord returns the task in the backup file, the url is kept for resuming
+func (t *S3Task) MarshalRecord() ([]byte, error) {
+	t.mutex.Lock()
+	record := s3TaskRecord{
+		TaskType: t.TaskType,
+		TaskInfo: t.TaskInfo,
+		URL:      t.sourceURL,
+	}
+	t.mutex.Unlock()
+	return json.Marshal(&record)
+}
+
+func (t *S3Task) UnmarshalJSON(data []byte) error {
+	var record s3TaskRecord
+	if err := json.Unmarshal(data, &record); err != nil {
+		return err
+	}
+	t.TaskType, t.TaskInfo, t.sourceURL = record.TaskType, record.TaskInfo, record.URL
+	return nil
+}
+
+// NewS3Task creates the task of s3://bucket/key, s3://bucket/prefix/ or the presigned url
+func NewS3Task(sourceURL string) (*S3Task, error) {
+	u, err := url.Parse(sourceURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid url %s:%s", sourceURL, err)
+	}
+	task := &S3Task{
+		TaskType: DownloadTaskTypeHTTP,
+		TaskInfo: TaskInfo{
+			SourceURL: u.Redacted(),
+			Backend:   BackendS3,
+		},
+		sourceURL: sourceURL,
+	}
+	if u.Scheme != "s3" {
+		task.TaskInfo.SourceURL = redactPresignedURL(u)
+		task.TaskInfo.FileName = getSafeFilename(u.Host + u.Path)
+		return task, nil
+	}
+	if err := checkS3Bucket(u.Host); err != nil {
+		return nil, err
+	}
+	task.TaskInfo.FileName = getSafeFilename(u.Host + strings.TrimSuffix(u.Path, "/"))
+	return task, nil
+}
+
+// checkS3Bucket rejects the bucket which is not in -s3Buckets, the credentials of server are not used for the buckets of others
+func checkS3Bucket(bucket string) error {
+	if bucket == "" {
+		return fmt.Errorf("the s3 url expect a bucket")
+	}
+	for _, allowed := range strings.Split(*s3Buckets, ",") {
+		if strings.TrimSpace(allowed) == bucket {
+			return nil
+		}
+	}
+	return fmt.Errorf("the s3 bucket %s is not allowed by -s3Buckets", bucket)
+}
+
+func (t *S3Task) Download(downloadDir string, limitByteSize int64, limitTimeout time.Duration) (err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), limitTimeout)
+	defer cancel()
+	done := make(chan struct{})
+	defer close(done)
+	t.mutex.Lock()
+	t.cancel, t.done = cancel, done
+	canceled := t.canceled
+	t.mutex.Unlock()
+	if canceled {
+		// the task is deleted before it starts
+		return t.Errorf("task canceled")
+	}
+	fs := NewConfinedFS(downloadDir)
+	defer func() {
+		t.mutex.Lock()
+		canceled := t.canceled
+		t.mutex.Unlock()
+		// the downloaded objects are kept for resuming, unless the task is canceled
+		if err != nil && canceled {
+			fs.RemoveAll(t.TaskInfo.FileName)
+		}
+	}()
+	source, err := t.source()
+	if err != nil {
+		return t.Errorf("%s", err)
+	}
+	t.StartTime = time.Now()
+	// the objects completed by the previous transfers are not verified again
+	completed := make(map[string]bool)
+	for retry := 0; ; retry++ {
+		err = t.transfer(ctx, source, fs, limitByteSize, completed)
+		if err == nil {
+			break
+		}
+		if ctx.Err() == context.DeadlineExceeded {
+			return t.Errorf("task timeout:%s", limitTimeout)
+		}
+		if ctx.Err() != nil {
+			return t.Errorf("task canceled")
+		}
+		if _, ok := err.(*s3PermanentError); ok || retry >= s3MaxRetries {
+			return t.Errorf("%s", err)
+		}
+		log.Warnf("s3 transfer of %s error:%s, retry %d/%d", t.SourceURL, err, retry+1, s3MaxRetries)
+		select {
+		case <-time.After(s3RetryDelay):
+		case <-ctx.Done():
+		}
+	}
+	t.TaskInfo.IsCompleted = true
+	t.Size = t.TaskInfo.ContentLength
+	t.Duration = time.Now().Sub(t.StartTime)
+	t.Speed = calculateDownloadSpeed(t.Size, t.Duration)
+	log.Infof("complete S3 task: length:%s source:%s filename:%s, duration:%s", getHumanSizeString(t.TaskInfo.ContentLength), t.SourceURL, t.TaskInfo.FileName, t.Duration)
+	return nil
+}
+
+// s3PermanentError is the error which is not fixed by retrying, like the object is missing or access is denied
+type s3PermanentError struct {
+	err error
+}
+
+func (e *s3PermanentError) Error() string {
+	return e.err.Error()
+}
+
+// s3Object is the object to download and its name in the download dir
+type s3Object struct {
+	key   string
+	local string
+	size  int64
+	etag  string
+	// the md5 of x-amz-meta-md5, it is used when the ETag is not the md5
+	md5 string
+}
+
+// s3Source lists and reads the objects of the task
+type s3Source interface {
+	// list returns the object of url, or the objects under the prefix
+	list(ctx context.Context, localName string) ([]s3Object, error)
+	// getRange reads the bytes from start to end of the object, the end is included
+	getRange(ctx context.Context, object s3Object, start int64, end int64) (io.ReadCloser, error)
+}
+
+func (t *S3Task) source() (s3Source, error) {
+	u, err := url.Parse(t.sourceURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid url:%s", err)
+	}
+	if u.Scheme != "s3" {
+		return &presignedS3Source{url: t.sourceURL}, nil
+	}
+	// the restored task is checked again, -s3Buckets may be changed
+	if err := checkS3Bucket(u.Host); err != nil {
+		return nil, err
+	}
+	client, err := newS3Client()
+	if err != nil {
+		return nil, err
+	}
+	return &minioS3Source{client: client, bucket: u.Host, key: strings.TrimPrefix(u.Path, "/")}, nil
+}
+
+// transfer downloads the objects which are not completed
+func (t *S3Task) transfer(ctx context.Context, source s3Source, fs *ConfinedFS, limitByteSize int64, completed map[string]bool) error {
+	objects, err := source.list(ctx, t.TaskInfo.FileName)
+	if err != nil {
+		return err
+	}
+	var total int64
+	for _, object := range objects {
+		total += object.size
+	}
+	if total > limitByteSize {
+		return &s3PermanentError{fmt.Errorf("the content length of sourceUrl is too big:%d, limit:%d", total, limitByteSize)}
+	}
+	t.TaskInfo.ContentLength = total
+	log.Infof("create S3 task: length:%s source:%s filename:%s, objects:%d", getHumanSizeString(total), t.SourceURL, t.TaskInfo.FileName, len(objects))
+	// the progress is written by the parallel parts, it is copied to the task by the ticker
+	var written int64
+	ticker := time.NewTicker(500 * time.Millisecond)
+	defer ticker.Stop()
+	stopProgress, progressStopped := make(chan struct{}), make(chan struct{})
+	defer func() {
+		close(stopProgress)
+		<-progressStopped
+	}()
+	go func() {
+		defer close(progressStopped)
+		for {
+			select {
+			case <-ticker.C:
+				t.Size = atomic.LoadInt64(&written)
+				t.Duration = time.Now().Sub(t.StartTime)
+				t.Speed = calculateDownloadSpeed(t.Size, t.Duration)
+			case <-stopProgress:
+				return
+			}
+		}
+	}()
+	for _, object := range objects {
+		// the object downloaded by the previous transfer, or before the restart and verified, is skipped
+		if completed[object.local] || isVerifiedS3Object(fs, object) {
+			completed[object.local] = true
+			atomic.AddInt64(&written, object.size)
+			continue
+		}
+		if err := downloadS3Object(ctx, source, fs, object, &written); err != nil {
+			return err
+		}
+		if _, err := verifyS3Object(fs, object); err != nil {
+			return err
+		}
+		completed[object.local] = true
+	}
+	return nil
+}
+
+// downloadS3Object downloads the ranges of object in parallel, the written bytes are added to written
+func downloadS3Object(ctx context.Context, source s3Source, fs *ConfinedFS, object s3Object, written *int64) error {
+	if dir := path.Dir(object.local); dir != "." {
+		if err := fs.MkdirAll(dir, 0755); err != nil {
+			return &s3PermanentError{fmt.Errorf("create dir error:%s", err)}
+		}
+	}
+	fp, err := fs.OpenFile(object.local, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return &s3PermanentError{fmt.Errorf("create file error:%s", err)}
+	}
+	defer fp.Close()
+	if err := fp.Truncate(object.size); err != nil {
+		return &s3PermanentError{fmt.Errorf("allocate file error:%s", err)}
+	}
+	// the first error stops the other parts
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var once sync.Once
+	var firstErr error
+	parts := make(chan int64)
+	var wg sync.WaitGroup
+	for i := 0; i < *s3Concurrency && int64(i)*s3PartSize < object.size; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for start := range parts {
+				end := start + s3PartSize - 1
+				if end >= object.size {
+					end = object.size - 1
+				}
+				if err := downloadS3Part(ctx, source, fp, object, start, end, written); err != nil {
+					once.Do(func() {
+						firstErr = err
+						cancel()
+					})
+				}
+			}
+		}()
+	}
+	for start := int64(0); start < object.size; start += s3PartSize {
+		select {
+		case parts <- start:
+		case <-ctx.Done():
+		}
+	}
+	close(parts)
+	wg.Wait()
+	if firstErr != nil {
+		return firstErr
+	}
+	if err := fp.Sync(); err != nil {
+		return &s3PermanentError{fmt.Errorf("sync file error:%s", err)}
+	}
+	return nil
+}
+
+// downloadS3Part writes the range of object at its offset of the file
+func downloadS3Part(ctx context.Context, source s3Source, fp *os.File, object s3Object, start int64, end int64, written *int64) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	body, err := source.getRange(ctx, object, start, end)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	buf := make([]byte, 32*1024)
+	offset := start
+	for offset <= end {
+		n, readErr := body.Read(buf)
+		if int64(n) > end+1-offset {
+			n = int(end + 1 - offset)
+		}
+		if n > 0 {
+			if _, err := fp.WriteAt(buf[:n], offset); err != nil {
+				return &s3PermanentError{fmt.Errorf("body write error:%s", err)}
+			}
+			offset += int64(n)
+			atomic.AddInt64(written, int64(n))
+		}
+		if readErr == io.EOF {
+			break
+		}
+		if readErr != nil {
+			return fmt.Errorf("s3 read %s error:%s", object.key, readErr)
+		}
+	}
+	if offset != end+1 {
+		return fmt.Errorf("s3 range of %s is incomplete:%d/%d", object.key, offset-start, end+1-start)
+	}
+	return nil
+}
+
+var multipartETagRegexp = regexp.MustCompile(`^([0-9a-f]{32})-([0-9]+)$`)
+
+// isVerifiedS3Object reports whether the local file exists and matches the ETag or md5 of object
+func isVerifiedS3Object(fs *ConfinedFS, object s3Object) bool {
+	if info, err := fs.Stat(object.local); err != nil || info.Size() != object.size {
+		return false
+	}
+	verified, err := verifyS3Object(fs, object)
+	return verified && err == nil
+}
+
+// verifyS3Object checks the local file by the md5 of metadata, the ETag of single part, or the ETag of multipart
+// whose part size is guessed. the ETag of encrypted object is not the md5, and the multipart ETag of unknown part size
+// can not be reproduced, they are not verified and not an error
+func verifyS3Object(fs *ConfinedFS, object s3Object) (verified bool, err error) {
+	etag := strings.ToLower(strings.Trim(object.etag, `"`))
+	var partSizes []int64
+	expect := strings.ToLower(object.md5)
+	if expect == "" && len(etag) == 32 {
+		expect = etag
+	}
+	if expect == "" {
+		matches := multipartETagRegexp.FindStringSubmatch(etag)
+		if matches == nil {
+			log.Warnf("the ETag of s3 object %s is not md5, it is not verified:%s", object.key, object.etag)
+			return false, nil
+		}
+		parts, _ := strconv.ParseInt(matches[2], 10, 64)
+		partSizes = guessS3PartSizes(object.size, parts)
+		if len(partSizes) == 0 {
+			log.Warnf("the part size of s3 object %s is unknown, it is not verified:%s", object.key, object.etag)
+			return false, nil
+		}
+	}
+	fp, err := fs.OpenFile(object.local, os.O_RDONLY, 0)
+	if err != nil {
+		return false, &s3PermanentError{fmt.Errorf("open file error:%s", err)}
+	}
+	defer fp.Close()
+	if len(partSizes) == 0 {
+		hash := md5.New()
+		if _, err := io.Copy(hash, fp); err != nil {
+			return false, &s3PermanentError{fmt.Errorf("read file error:%s", err)}
+		}
+		if actual := hex.EncodeToString(hash.Sum(nil)); actual != expect {
+			return false, fmt.Errorf("the md5 of s3 object %s is %s, expect %s", object.key, actual, expect)
+		}
+		return true, nil
+	}
+	for _, partSize := range partSizes {
+		if _, err := fp.Seek(0, io.SeekStart); err != nil {
+			return false, &s3PermanentError{fmt.Errorf("read file error:%s", err)}
+		}
+		sums := md5.New()
+		for {
+			hash := md5.New()
+			n, err := io.CopyN(hash, fp, partSize)
+			if err != nil && err != io.EOF {
+				return false, &s3PermanentError{fmt.Errorf("read file error:%s", err)}
+			}
+			if n == 0 {
+				break
+			}
+			sums.Write(hash.Sum(nil))
+		}
+		if hex.EncodeToString(sums.Sum(nil)) == etag[:32] {
+			return true, nil
+		}
+	}
+	// the part size may not be one of the guessed, it is not a mismatch of the content
+	log.Warnf("the part size of s3 object %s is not guessed, it is not verified:%s", object.key, object.etag)
+	return false, nil
+}
+
+// guessS3PartSizes returns the common part sizes which split the size into the parts,
+// the size divided by the parts and rounded up to MB is the most common
+func guessS3PartSizes(size int64, parts int64) []int64 {
+	const mb = 1 << 20
+	candidates := []int64{(size/parts + mb - 1) / mb * mb, 5 * mb, 8 * mb, 16 * mb, 64 * mb, 100 * mb}
+	var partSizes []int64
+	seen := make(map[int64]bool)
+	for _, partSize := range candidates {
+		if partSize <= 0 || seen[partSize] || (size+partSize-1)/partSize != parts {
+			continue
+		}
+		seen[partSize] = true
+		partSizes = append(partSizes, partSize)
+	}
+	return partSizes
+}
+
+// newS3Client returns the client of -s3Endpoint, the credentials are read from the env, the credentials file
+// of aws and the config of MinIO client, the request is anonymous if none is found
+func newS3Client() (*minio.Client, error) {
+	endpoint, err := url.Parse(*s3Endpoint)
+	if err != nil || endpoint.Host == "" || (endpoint.Scheme != "http" && endpoint.Scheme != "https") {
+		return nil, fmt.Errorf("invalid s3 endpoint %s, expect http(s)://host[:port]", *s3Endpoint)
+	}
+	creds := credentials.NewChainCredentials([]credentials.Provider{
+		&credentials.EnvAWS{},
+		&credentials.FileAWSCredentials{Filename: *s3CredentialsFile, Profile: *s3Profile},
+		&credentials.EnvMinio{},
+		&credentials.FileMinioClient{},
+	})
+	client, err := minio.New(endpoint.Host, &minio.Options{
+		Creds:  creds,
+		Secure: endpoint.Scheme == "https",
+		Region: *s3Region,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("create s3 client error:%s", err)
+	}
+	return client, nil
+}
+
+// minioS3Source reads the objects of s3 url from -s3Endpoint
+type minioS3Source struct {
+	client *minio.Client
+	bucket string
+	key    string
+}
+
+// s3Error converts the error response of s3, the missing object and the denied access are permanent
+func s3Error(err error, format string, a ...interface{}) error {
+	wrapped := fmt.Errorf("%s error:%s", fmt.Sprintf(format, a...), err)
+	switch minio.ToErrorResponse(err).StatusCode {
+	case http.StatusNotFound, http.StatusForbidden, http.StatusUnauthorized, http.StatusBadRequest:
+		return &s3PermanentError{wrapped}
+	}
+	return wrapped
+}
+
+func (s *minioS3Source) list(ctx context.Context, localName string) ([]s3Object, error) {
+	if s.key != "" && !strings.HasSuffix(s.key, "/") {
+		info, err := s.client.StatObject(ctx, s.bucket, s.key, minio.StatObjectOptions{})
+		if err != nil {
+			return nil, s3Error(err, "s3 stat %s/%s", s.bucket, s.key)
+		}
+		return []s3Object{{key: s.key, local: localName, size: info.Size, etag: info.ETag, md5: info.UserMetadata["Md5"]}}, nil
+	}
+	var objects []s3Object
+	for info := range s.client.ListObjects(ctx, s.bucket, minio.ListObjectsOptions{Prefix: s.key, Recursive: true}) {
+		if info.Err != nil {
+			return nil, s3Error(info.Err, "s3 list %s/%s", s.bucket, s.key)
+		}
+		rel := path.Clean(strings.TrimPrefix(info.Key, s.key))
+		// the folder marker is skipped, the key must stay in the task folder
+		if strings.HasSuffix(info.Key, "/") || rel == "." || rel == ".." || strings.HasPrefix(rel, "../") || strings.HasPrefix(rel, "/") {
+			continue
+		}
+		if violations := urlPolicy.checkExtension(rel); len(violations) > 0 {
+			log.Warnf("skip s3 object %s:%s", info.Key, violations[0].Reason)
+			continue
+		}
+		objects = append(objects, s3Object{key: info.Key, local: path.Join(localName, rel), size: info.Size, etag: info.ETag})
+	}
+	if len(objects) == 0 {
+		return nil, &s3PermanentError{fmt.Errorf("no object under s3://%s/%s", s.bucket, s.key)}
+	}
+	return objects, nil
+}
+
+func (s *minioS3Source) getRange(ctx context.Context, object s3Object, start int64, end int64) (io.ReadCloser, error) {
+	var opts minio.GetObjectOptions
+	opts.SetRange(start, end)
+	// the object changed while downloading is not mixed
+	if object.etag != "" {
+		opts.SetMatchETag(strings.Trim(object.etag, `"`))
+	}
+	body, _, _, err := minio.Core{Client: s.client}.GetObject(ctx, s.bucket, object.key, opts)
+	if err != nil {
+		return nil, s3Error(err, "s3 get %s/%s", s.bucket, object.key)
+	}
+	return body, nil
+}
+
+// presignedS3Source reads the object of presigned url under the egress policy, the signature allows GET only
+type presignedS3Source struct {
+	url string
+}
+
+func (s *presignedS3Source) httpClient() *http.Client {
+	return &http.Client{
+		Transport: &http.Transport{
+			DialContext:         egressPolicy.DialContext,
+			TLSHandshakeTimeout: 20 * time.Second,
+		},
+		CheckRedirect: checkRedirect,
+	}
+}
+
+func (s *presignedS3Source) get(ctx context.Context, start int64, end int64, etag string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.url, nil)
+	if err != nil {
+		return nil, &s3PermanentError{fmt.Errorf("invalid url:%s", err)}
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, end))
+	if etag != "" {
+		req.Header.Set("If-Match", etag)
+	}
+	resp, err := s.httpClient().Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("http.Client error:%s", err)
+	}
+	return resp, nil
+}
+
+func (s *presignedS3Source) list(ctx context.Context, localName string) ([]s3Object, error) {
+	// HEAD is not allowed by the signature of GET, the size is in the Content-Range of the first byte
+	resp, err := s.get(ctx, 0, 0, "")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var size int64
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		contentRange := resp.Header.Get("Content-Range")
+		i := strings.LastIndex(contentRange, "/")
+		if i < 0 {
+			return nil, fmt.Errorf("invalid Content-Range:%s", contentRange)
+		}
+		size, err = strconv.ParseInt(contentRange[i+1:], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid Content-Range:%s", contentRange)
+		}
+	case http.StatusRequestedRangeNotSatisfiable:
+		// the object is empty
+	case http.StatusOK:
+		size = resp.ContentLength
+	default:
+		err := fmt.Errorf("s3 get %s error:%s", resp.Request.URL.Path, resp.Status)
+		if resp.StatusCode >= 400 && resp.StatusCode < 500 {
+			return nil, &s3PermanentError{err}
+		}
+		return nil, err
+	}
+	if size < 0 {
+		return nil, fmt.Errorf("the size of s3 object is unknown")
+	}
+	if err := urlPolicy.CheckResponse(resp, localName); err != nil {
+		return nil, &s3PermanentError{err}
+	}
+	return []s3Object{{key: resp.Request.URL.Path, local: localName, size: size, etag: resp.Header.Get("ETag"), md5: resp.Header.Get("X-Amz-Meta-Md5")}}, nil
+}
+
+func (s *presignedS3Source) getRange(ctx context.Context, object s3Object, start int64, end int64) (io.ReadCloser, error) {
+	resp, err := s.get(ctx, start, end, object.etag)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case resp.StatusCode == http.StatusPartialContent:
+		return resp.Body, nil
+	case resp.StatusCode == http.StatusOK && start == 0 && end == object.size-1:
+		return resp.Body, nil
+	}
+	resp.Body.Close()
+	err = fmt.Errorf("s3 get %s range %d-%d error:%s", object.key, start, end, resp.Status)
+	if resp.StatusCode == http.StatusPreconditionFailed {
+		// the object is changed, the next transfer downloads the new one
+		return nil, err
+	}
+	if resp.StatusCode >= 400 && resp.StatusCode < 500 {
+		return nil, &s3PermanentError{err}
+	}
+	return nil, err
+}
+
+// Cancel stops the downloading task, the downloaded objects are removed
+func (t *S3Task) Cancel() {
+	t.mutex.Lock()
+	cancel, done := t.cancel, t.done
+	t.canceled = true
+	t.mutex.Unlock()
+	if cancel == nil {
+		return
+	}
+	cancel()
+	<-done
+}
+
+func (t *S3Task) infoMutex() *sync.Mutex {
+	return &t.mutex
+}
+
+func (t *S3Task) IsCompleted() bool {
+	return t.TaskInfo.IsCompleted
+}
+
+func (t *S3Task) FileName() string {
+	return t.TaskInfo.FileName
+}
+
+func (t *S3Task) ContentLength() int64 {
+	return t.TaskInfo.ContentLength
+}
+
+func (t *S3Task) Errorf(format string, a ...interface{}) (err error) {
+	err = fmt.Errorf(format, a...)
+	_, file, line, ok := runtime.Caller(1)
+	if ok {
+		log.Errorf("[%s:%d]%s", file, line, err.Error())
+	}
+	t.TaskInfo.IsError = true
+	t.TaskInfo.IsCompleted = true
+	t.TaskInfo.Error = err.Error()
+	return err
+}
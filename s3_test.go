@@ -0,0 +1,341 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeS3Object is the object of fakeS3Server, the ETag is the md5 of content unless it is set
+type fakeS3Object struct {
+	content []byte
+	etag    string
+	md5     string
+}
+
+// fakeS3Server is the in-process s3 of path style, it serves HEAD, ranged GET and ListObjectsV2 of one bucket
+type fakeS3Server struct {
+	*httptest.Server
+	objects map[string]*fakeS3Object
+	mutex   sync.Mutex
+	// the authorization headers, the GET count of each key, and the max number of concurrent GETs
+	authorizations []string
+	gets           map[string]int
+	running        int
+	maxRunning     int
+}
+
+func newFakeS3Server(objects map[string]*fakeS3Object) *fakeS3Server {
+	s := &fakeS3Server{objects: objects, gets: make(map[string]int)}
+	for _, object := range objects {
+		if object.etag == "" {
+			sum := md5.Sum(object.content)
+			object.etag = hex.EncodeToString(sum[:])
+		}
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serve))
+	return s
+}
+
+func (s *fakeS3Server) serve(w http.ResponseWriter, r *http.Request) {
+	s.mutex.Lock()
+	s.authorizations = append(s.authorizations, r.Header.Get("Authorization"))
+	s.mutex.Unlock()
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+	if parts[0] != "bucket" {
+		s.error(w, http.StatusNotFound, "NoSuchBucket")
+		return
+	}
+	if len(parts) == 1 || parts[1] == "" {
+		s.list(w, r)
+		return
+	}
+	key := parts[1]
+	object, ok := s.objects[key]
+	if !ok {
+		s.error(w, http.StatusNotFound, "NoSuchKey")
+		return
+	}
+	header := w.Header()
+	header.Set("ETag", `"`+object.etag+`"`)
+	header.Set("Last-Modified", time.Unix(1500000000, 0).UTC().Format(http.TimeFormat))
+	header.Set("Accept-Ranges", "bytes")
+	if object.md5 != "" {
+		header.Set("X-Amz-Meta-Md5", object.md5)
+	}
+	if r.Method == http.MethodHead {
+		header.Set("Content-Length", strconv.Itoa(len(object.content)))
+		return
+	}
+	if etag := r.Header.Get("If-Match"); etag != "" && strings.Trim(etag, `"`) != object.etag {
+		s.error(w, http.StatusPreconditionFailed, "PreconditionFailed")
+		return
+	}
+	s.mutex.Lock()
+	s.gets[key]++
+	s.running++
+	if s.running > s.maxRunning {
+		s.maxRunning = s.running
+	}
+	s.mutex.Unlock()
+	defer func() {
+		s.mutex.Lock()
+		s.running--
+		s.mutex.Unlock()
+	}()
+	// the parts overlap
+	time.Sleep(20 * time.Millisecond)
+	var start, end int
+	if _, err := fmt.Sscanf(r.Header.Get("Range"), "bytes=%d-%d", &start, &end); err != nil {
+		w.Write(object.content)
+		return
+	}
+	if start >= len(object.content) {
+		s.error(w, http.StatusRequestedRangeNotSatisfiable, "InvalidRange")
+		return
+	}
+	if end >= len(object.content) {
+		end = len(object.content) - 1
+	}
+	header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, len(object.content)))
+	header.Set("Content-Length", strconv.Itoa(end+1-start))
+	w.WriteHeader(http.StatusPartialContent)
+	w.Write(object.content[start : end+1])
+}
+
+func (s *fakeS3Server) list(w http.ResponseWriter, r *http.Request) {
+	if _, ok := r.URL.Query()["location"]; ok {
+		fmt.Fprint(w, `<?xml version="1.0" encoding="UTF-8"?><LocationConstraint xmlns="http://s3.amazonaws.com/doc/2006-03-01/"></LocationConstraint>`)
+		return
+	}
+	prefix := r.URL.Query().Get("prefix")
+	var contents strings.Builder
+	for key, object := range s.objects {
+		if strings.HasPrefix(key, prefix) {
+			fmt.Fprintf(&contents, `<Contents><Key>%s</Key><LastModified>2017-07-14T02:40:00.000Z</LastModified><ETag>&quot;%s&quot;</ETag><Size>%d</Size><StorageClass>STANDARD</StorageClass></Contents>`,
+				key, object.etag, len(object.content))
+		}
+	}
+	fmt.Fprintf(w, `<?xml version="1.0" encoding="UTF-8"?><ListBucketResult xmlns="http://s3.amazonaws.com/doc/2006-03-01/"><Name>bucket</Name><Prefix>%s</Prefix><KeyCount>%d</KeyCount><MaxKeys>1000</MaxKeys><IsTruncated>false</IsTruncated>%s</ListBucketResult>`,
+		prefix, len(s.objects), contents.String())
+}
+
+func (s *fakeS3Server) error(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, `<?xml version="1.0" encoding="UTF-8"?><Error><Code>%s</Code><Message>%s</Message></Error>`, code, code)
+}
+
+func (s *fakeS3Server) Gets(key string) int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.gets[key]
+}
+
+// multipartETag returns the ETag of the object uploaded by the parts
+func multipartETag(content []byte, partSize int) string {
+	var sums []byte
+	parts := 0
+	for start := 0; start < len(content); start += partSize {
+		end := start + partSize
+		if end > len(content) {
+			end = len(content)
+		}
+		sum := md5.Sum(content[start:end])
+		sums = append(sums, sum[:]...)
+		parts++
+	}
+	sum := md5.Sum(sums)
+	return fmt.Sprintf("%s-%d", hex.EncodeToString(sum[:]), parts)
+}
+
+func TestGuessS3PartSizes(t *testing.T) {
+	const mb = 1 << 20
+	if sizes := guessS3PartSizes(100*mb+1, 13); len(sizes) != 1 || sizes[0] != 8*mb {
+		t.Fatalf("unexpected part sizes:%v", sizes)
+	}
+	if sizes := guessS3PartSizes(5*mb, 2); len(sizes) != 1 || sizes[0] != 3*mb {
+		t.Fatalf("unexpected part sizes:%v", sizes)
+	}
+	if sizes := guessS3PartSizes(mb, 3); len(sizes) != 0 {
+		t.Fatalf("unexpected part sizes:%v", sizes)
+	}
+}
+
+func TestS3Task(t *testing.T) {
+	setEgressPolicy(t, "127.0.0.0/8", "")
+	oldPartSize, oldRetries, oldDelay := s3PartSize, s3MaxRetries, s3RetryDelay
+	s3PartSize, s3MaxRetries, s3RetryDelay = 1<<20, 1, 10*time.Millisecond
+	defer func() {
+		s3PartSize, s3MaxRetries, s3RetryDelay = oldPartSize, oldRetries, oldDelay
+	}()
+	dir, err := ioutil.TempDir("", "fdp-s3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	content := make([]byte, 5<<20+123)
+	rand.Read(content)
+	multipart := content[:5<<19]
+	objects := map[string]*fakeS3Object{
+		"big.bin":           {content: content},
+		"builds/a.bin":      {content: content[:1000]},
+		"builds/sub/b.bin":  {content: multipart, etag: multipartETag(multipart, 1<<20)},
+		"builds/sub/":       {content: nil},
+		"builds/kms.bin":    {content: content[:10], etag: "not-md5-of-kms"},
+		"meta.bin":          {content: content[:100], etag: strings.Repeat("0", 32), md5: fmt.Sprintf("%x", md5.Sum(content[:100]))},
+		"corrupt.bin":       {content: content[:100], etag: strings.Repeat("0", 32)},
+		"builds/../out.bin": {content: content[:1]},
+		"odd.bin":           {content: multipart, etag: multipartETag(multipart, 1<<20+7)},
+	}
+	server := newFakeS3Server(objects)
+	defer server.Close()
+	credentials := filepath.Join(dir, "credentials")
+	ioutil.WriteFile(credentials, []byte("[default]\naws_access_key_id = AKIADEFAULT\naws_secret_access_key = x\n\n[fdp]\naws_access_key_id = AKIAFDP\naws_secret_access_key = secret\n"), 0600)
+	setFlag(t, "s3Endpoint", server.URL)
+	setFlag(t, "s3Region", "us-east-1")
+	setFlag(t, "s3Credentials", credentials)
+	setFlag(t, "s3Profile", "fdp")
+	setFlag(t, "s3Buckets", "releases,bucket")
+	download := func(sourceURL string, fileName string) (*S3Task, error) {
+		task, err := NewDownloadTask(sourceURL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		st, ok := task.(*S3Task)
+		if !ok {
+			t.Fatalf("expect s3 task, got %T", task)
+		}
+		if fileName != "" {
+			st.TaskInfo.FileName = fileName
+		}
+		return st, task.Download(dir, int64(len(content)), 10*time.Second)
+	}
+	expectFile := func(name string, data []byte) {
+		t.Helper()
+		if local, err := ioutil.ReadFile(filepath.Join(dir, name)); err != nil || !bytes.Equal(local, data) {
+			t.Fatalf("unexpected content of %s:%v", name, err)
+		}
+	}
+
+	// the object is downloaded by the parallel ranges with the credentials of profile
+	task, err := download("s3://bucket/big.bin", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectFile(task.FileName(), content)
+	if !task.IsCompleted() || task.Info().IsError || task.ContentLength() != int64(len(content)) || task.Info().Size != int64(len(content)) {
+		t.Fatalf("unexpected task:%+v", task.Info())
+	}
+	server.mutex.Lock()
+	maxRunning, authorization := server.maxRunning, server.authorizations[0]
+	server.mutex.Unlock()
+	if gets := server.Gets("big.bin"); gets != 6 || maxRunning < 2 {
+		t.Fatalf("expect the parallel ranged GETs, gets:%d concurrent:%d", gets, maxRunning)
+	}
+	if !strings.Contains(authorization, "Credential=AKIAFDP/") {
+		t.Fatalf("expect the credentials of profile, got %s", authorization)
+	}
+	data, _ := marshalTaskRecord(task)
+	restored, err := restoreTask(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rt, ok := restored.(*S3Task); !ok || rt.sourceURL != task.sourceURL || !rt.IsCompleted() {
+		t.Fatalf("unexpected restored task:%+v", restored)
+	}
+	// the verified object is not downloaded again after restart
+	if _, err := download("s3://bucket/big.bin", task.FileName()); err != nil || server.Gets("big.bin") != 6 {
+		t.Fatalf("expect the verified object skipped, gets:%d %v", server.Gets("big.bin"), err)
+	}
+
+	// the prefix is downloaded into the folder, the multipart ETag is verified, the folder marker and escaping key are skipped
+	task, err = download("s3://bucket/builds/", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectFile(filepath.Join(task.FileName(), "a.bin"), content[:1000])
+	expectFile(filepath.Join(task.FileName(), "sub", "b.bin"), multipart)
+	expectFile(filepath.Join(task.FileName(), "kms.bin"), content[:10])
+	if task.ContentLength() != int64(1000+len(multipart)+10) {
+		t.Fatalf("unexpected content length:%d", task.ContentLength())
+	}
+	if _, err := os.Stat(filepath.Join(dir, "out.bin")); err == nil {
+		t.Fatal("expect the key out of the prefix skipped")
+	}
+	// the unverifiable object is downloaded again after restart
+	before := server.Gets("builds/sub/b.bin")
+	if _, err := download("s3://bucket/builds/", task.FileName()); err != nil || server.Gets("builds/sub/b.bin") != before || server.Gets("builds/kms.bin") != 2 {
+		t.Fatalf("unexpected GETs after restart:%v %v", server.gets, err)
+	}
+
+	// the md5 of metadata is preferred to the ETag, the mismatched md5 is retried and failed
+	if _, err := download("s3://bucket/meta.bin", ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := download("s3://bucket/corrupt.bin", ""); err == nil || !strings.Contains(err.Error(), "md5") || server.Gets("corrupt.bin") != 2 {
+		t.Fatalf("expect the corrupt object retried and failed, gets:%d %v", server.Gets("corrupt.bin"), err)
+	}
+	// the multipart ETag of unknown part size is not verified, it is not an error
+	if _, err := download("s3://bucket/odd.bin", ""); err != nil || server.Gets("odd.bin") != 3 {
+		t.Fatalf("expect the object of unknown part size downloaded once, gets:%d %v", server.Gets("odd.bin"), err)
+	}
+	// the missing object is not retried, the object over the limit is rejected
+	if _, err := download("s3://bucket/missing.bin", ""); err == nil || !strings.Contains(err.Error(), "NoSuchKey") && !strings.Contains(err.Error(), "not exist") {
+		t.Fatalf("expect the missing object failed, got %v", err)
+	}
+	// the bucket out of -s3Buckets is rejected before any request
+	before = server.Gets("big.bin")
+	if _, err := NewDownloadTask("s3://other/big.bin"); err == nil || server.Gets("big.bin") != before {
+		t.Fatalf("expect the bucket rejected, got %v", err)
+	}
+	limit, _ := NewDownloadTask("s3://bucket/big.bin")
+	if err := limit.Download(dir, 1000, 10*time.Second); err == nil || !strings.Contains(err.Error(), "too big") {
+		t.Fatalf("expect the object too big, got %v", err)
+	}
+	// the task deleted before it starts sends no request
+	canceled, _ := NewDownloadTask("s3://bucket/big.bin")
+	canceled.(Canceler).Cancel()
+	before = server.Gets("big.bin")
+	if err := canceled.Download(dir, int64(len(content)), 10*time.Second); err == nil || server.Gets("big.bin") != before {
+		t.Fatalf("expect the canceled task not started, got %v", err)
+	}
+
+	// the presigned url is downloaded by ranges, the signature is hidden
+	presigned := server.URL + "/bucket/big.bin?X-Amz-Algorithm=AWS4-HMAC-SHA256&X-Amz-Credential=AKIAFDP%2F20170714%2Fus-east-1%2Fs3%2Faws4_request&X-Amz-Expires=3600&X-Amz-Signature=deadbeef"
+	before = server.Gets("big.bin")
+	task, err = download(presigned, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectFile(task.FileName(), content)
+	if strings.Contains(task.SourceURL, "deadbeef") || strings.Contains(task.SourceURL, "AKIAFDP") || task.Info().Backend != BackendS3 {
+		t.Fatalf("expect the signature hidden:%s", task.SourceURL)
+	}
+	if data, _ := json.Marshal(task); strings.Contains(string(data), "deadbeef") || strings.Contains(string(data), "AKIAFDP") {
+		t.Fatalf("expect the signature not pushed:%s", data)
+	}
+	if data, _ := marshalTaskRecord(task); !strings.Contains(string(data), "deadbeef") {
+		t.Fatalf("expect the signature kept in the backup file:%s", data)
+	}
+	// the first byte is fetched for the size
+	if gets := server.Gets("big.bin") - before; gets != 7 {
+		t.Fatalf("unexpected GETs of presigned url:%d", gets)
+	}
+	if task, err := NewDownloadTask(server.URL + "/bucket/big.bin"); err != nil || task.Info().Backend != BackendHTTP {
+		t.Fatalf("expect the unsigned url downloaded by http, got %+v %v", task, err)
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"github.com/hanjm/log"
+	"strconv"
+	"strings"
+)
+
+var seedFlag = flag.String("seed", "none", "the seeding policy of torrent after the download is completed, none, ratio:X, hours:N or forever, it can be set per task")
+
+const (
+	SeedModeNone    = "none"
+	SeedModeRatio   = "ratio"
+	SeedModeHours   = "hours"
+	SeedModeForever = "forever"
+)
+
+// SeedPolicy decides how long the completed torrent is seeded
+type SeedPolicy struct {
+	Mode  string
+	Ratio float64
+	Hours float64
+}
+
+// ParseSeedPolicy parses none, ratio:X, hours:N or forever
+func ParseSeedPolicy(s string) (SeedPolicy, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	mode, value := s, ""
+	if i := strings.Index(s, ":"); i >= 0 {
+		mode, value = s[:i], s[i+1:]
+	}
+	switch mode {
+	case SeedModeNone, SeedModeForever:
+		if value != "" {
+			return SeedPolicy{}, fmt.Errorf("seed policy %s takes no value", mode)
+		}
+		return SeedPolicy{Mode: mode}, nil
+	case SeedModeRatio, SeedModeHours:
+		number, err := strconv.ParseFloat(value, 64)
+		if err != nil || number <= 0 {
+			return SeedPolicy{}, fmt.Errorf("seed policy %s needs a positive number:%s", mode, s)
+		}
+		if mode == SeedModeRatio {
+			return SeedPolicy{Mode: mode, Ratio: number}, nil
+		}
+		return SeedPolicy{Mode: mode, Hours: number}, nil
+	}
+	return SeedPolicy{}, fmt.Errorf("unknown seed policy:%s, expect none, ratio:X, hours:N or forever", s)
+}
+
+func (p SeedPolicy) String() string {
+	switch p.Mode {
+	case SeedModeRatio:
+		return SeedModeRatio + ":" + strconv.FormatFloat(p.Ratio, 'f', -1, 64)
+	case SeedModeHours:
+		return SeedModeHours + ":" + strconv.FormatFloat(p.Hours, 'f', -1, 64)
+	case "":
+		return SeedModeNone
+	}
+	return p.Mode
+}
+
+// setAria2cOptions sets seed-ratio and seed-time, aria2c stops the download when any of them is satisfied
+func (p SeedPolicy) setAria2cOptions(options *Aria2cOptions) {
+	switch p.Mode {
+	case SeedModeRatio:
+		options.SeedRatio = strconv.FormatFloat(p.Ratio, 'f', -1, 64)
+	case SeedModeHours:
+		// seed-time is in minutes, seed-ratio 0.0 seeds regardless of the ratio
+		options.SeedRatio = "0.0"
+		options.SeedTime = strconv.FormatFloat(p.Hours*60, 'f', -1, 64)
+	case SeedModeForever:
+		options.SeedRatio = "0.0"
+	default:
+		options.SeedTime = "0"
+	}
+}
+
+// seedPolicy returns the policy of the task, the global policy is used if the task does not set it
+func (t *MagnetTask) seedPolicy() SeedPolicy {
+	t.mutex.Lock()
+	s := t.SeedPolicy
+	t.mutex.Unlock()
+	return taskSeedPolicy(t.FileName(), s)
+}
+
+// taskSeedPolicy parses the seed policy of task, the global policy is used if it is empty
+func taskSeedPolicy(filename string, s string) SeedPolicy {
+	if s == "" {
+		s = *seedFlag
+	}
+	policy, err := ParseSeedPolicy(s)
+	if err != nil {
+		log.Warnf("invalid seed policy of task %s:%s", filename, err)
+	}
+	return policy
+}
+
+// SetSeedPolicy changes the seeding policy of task, it takes effect at once if the task is downloading or seeding
+func (t *MagnetTask) SetSeedPolicy(policy SeedPolicy) error {
+	t.mutex.Lock()
+	t.SeedPolicy = policy.String()
+	var gid string
+	if len(t.gids) > 0 {
+		gid = t.gids[len(t.gids)-1]
+	}
+	t.mutex.Unlock()
+	if gid == "" {
+		return nil
+	}
+	options := &Aria2cOptions{}
+	policy.setAria2cOptions(options)
+	if options.SeedTime == "" {
+		// the seed-time of the previous policy can not be unset, it is overridden by ten years
+		options.SeedTime = "5256000"
+	}
+	if err := NewAria2cRPCClient().ChangeOption(gid, options); err != nil {
+		return fmt.Errorf("change seed options error:%s", err)
+	}
+	aria2cMonitor.Notify("seed", gid)
+	return nil
+}
+
+// startSeeding hands the completed download over to the seeding goroutine, Cancel stops seeding
+func (t *MagnetTask) startSeeding(aria2cRPCClient *Aria2cRPCClient, downloadDir string, gid string) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	t.mutex.Lock()
+	t.cancel, t.done = cancel, done
+	t.Seeding = true
+	t.mutex.Unlock()
+	log.Infof("start seeding task:%s, policy:%s", t.FileName(), t.seedPolicy())
+	go t.seed(ctx, aria2cRPCClient, downloadDir, gid, done)
+}
+
+// seed updates the upload speed and ratio until aria2c stops the download by the seeding policy or the task is canceled,
+// the completed files are kept
+func (t *MagnetTask) seed(ctx context.Context, aria2cRPCClient *Aria2cRPCClient, downloadDir string, gid string, done chan struct{}) {
+	defer close(done)
+	defer func() {
+		t.releaseAria2c(aria2cRPCClient, downloadDir, false)
+		t.mutex.Lock()
+		t.Seeding, t.UploadSpeed = false, 0
+		t.mutex.Unlock()
+		log.Infof("stop seeding task:%s, uploaded:%s, ratio:%.2f", t.FileName(), getHumanSizeString(t.Uploaded), t.Ratio)
+	}()
+	updates := make(chan *aria2cStatusUpdate, 1)
+	defer aria2cMonitor.Unsubscribe(updates)
+	aria2cMonitor.Subscribe(gid, updates)
+	for {
+		select {
+		case update := <-updates:
+			if update.Err != nil {
+				if IsAria2cNotFound(update.Err) {
+					// aria2c is restarted without the session
+					return
+				}
+				log.Warnf("[seed]TellStatus %s error:%s", gid, update.Err)
+				continue
+			}
+			t.updateSeeding(update.Result)
+			switch update.Result.Status {
+			case "complete", "removed", "error":
+				return
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (t *MagnetTask) updateSeeding(result *Aria2cTellStatusResult) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.UploadSpeed = result.UploadSpeed
+	t.Uploaded = result.UploadLength
+	if result.CompletedLength > 0 {
+		t.Ratio = float64(result.UploadLength) / float64(result.CompletedLength)
+	}
+}
+
+// ResumeSeeding re-binds the seeding task restored from the backup to its download in aria2c's session
+func (t *MagnetTask) ResumeSeeding(downloadDir string) {
+	aria2cRPCClient := NewAria2cRPCClient()
+	gid := t.findAria2cDownload(aria2cRPCClient)
+	if gid == "" {
+		t.mutex.Lock()
+		t.Seeding, t.UploadSpeed = false, 0
+		t.mutex.Unlock()
+		log.Infof("the seeding download of task %s is not found in aria2c", t.FileName())
+		return
+	}
+	t.startSeeding(aria2cRPCClient, downloadDir, gid)
+}
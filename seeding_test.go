@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParseSeedPolicy(t *testing.T) {
+	for _, test := range []struct {
+		s         string
+		expect    string
+		seedRatio string
+		seedTime  string
+	}{
+		{"none", "none", "", "0"},
+		{" Forever ", "forever", "0.0", ""},
+		{"ratio:1.5", "ratio:1.5", "1.5", ""},
+		{"hours:2", "hours:2", "0.0", "120"},
+	} {
+		policy, err := ParseSeedPolicy(test.s)
+		if err != nil {
+			t.Errorf("parse %s error:%s", test.s, err)
+			continue
+		}
+		options := &Aria2cOptions{}
+		policy.setAria2cOptions(options)
+		if policy.String() != test.expect || options.SeedRatio != test.seedRatio || options.SeedTime != test.seedTime {
+			t.Errorf("%s expect %s seed-ratio=%s seed-time=%s, got %s %+v", test.s, test.expect, test.seedRatio, test.seedTime, policy, options)
+		}
+	}
+	for _, s := range []string{"", "ratio", "ratio:0", "hours:-1", "none:1", "always"} {
+		if _, err := ParseSeedPolicy(s); err == nil {
+			t.Errorf("%q expect invalid", s)
+		}
+	}
+}
+
+func TestMagnetTask_Seeding(t *testing.T) {
+	const gid = "2089b05ecca3d829"
+	downloadDir, err := ioutil.TempDir("", "fdp-seeding")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(downloadDir)
+	if err := os.MkdirAll(filepath.Join(downloadDir, "ubuntu"), 0777); err != nil {
+		t.Fatal(err)
+	}
+	var mutex sync.Mutex
+	status := `"status":"active","seeder":"true","uploadLength":"300","uploadSpeed":"1024"`
+	var forceRemoved bool
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			ID     string            `json:"id"`
+			Method string            `json:"method"`
+			Params []json.RawMessage `json:"params"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		mutex.Lock()
+		defer mutex.Unlock()
+		result := `"OK"`
+		switch req.Method {
+		case "aria2.getVersion":
+			result = `{"version":"1.37.0"}`
+		case "aria2.addUri":
+			var options Aria2cOptions
+			json.Unmarshal(req.Params[1], &options)
+			if options.SeedRatio != "1.5" || options.SeedTime != "" {
+				t.Errorf("expect the seed options of ratio, got %+v", options)
+			}
+			result = `"` + gid + `"`
+		case "aria2.tellActive", "aria2.tellStatus", "system.multicall":
+			result = `{"gid":"` + gid + `",` + status + `,"totalLength":"200","completedLength":"200",` +
+				`"files":[{"index":"1","path":"` + downloadDir + `/ubuntu/a.iso","length":"200","completedLength":"200","selected":"true"}]}`
+			switch req.Method {
+			case "aria2.tellActive":
+				result = "[" + result + "]"
+			case "system.multicall":
+				result = "[[" + result + "]]"
+			}
+		case "aria2.forceRemove":
+			forceRemoved = true
+			status = `"status":"removed"`
+			result = `"` + gid + `"`
+		}
+		fmt.Fprintf(w, `{"id":"%s","jsonrpc":"2.0","result":%s}`, req.ID, result)
+	}))
+	defer server.Close()
+	oldRPC, oldDir, oldInterval := *aria2cRPC, *aria2cDirFlag, aria2cPollInterval
+	*aria2cRPC, *aria2cDirFlag, aria2cPollInterval = server.URL, "", time.Millisecond*50
+	defer func() {
+		*aria2cRPC, *aria2cDirFlag, aria2cPollInterval = oldRPC, oldDir, oldInterval
+	}()
+	task := NewMagnetTask("magnet:?xt=urn:btih:09c4beba230a770051207d07a8fb76cf43477523")
+	task.SeedPolicy = "ratio:1.5"
+	if err := task.Download(downloadDir, 1024, 10*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	// the task is completed while aria2c keeps seeding it
+	task.mutex.Lock()
+	seeding := task.Seeding
+	task.mutex.Unlock()
+	if !task.IsCompleted() || !seeding || task.FileName() != "ubuntu" {
+		t.Fatalf("expect completed and seeding, task:%+v", task.TaskInfo)
+	}
+	var ratio float64
+	for i := 0; i < 100 && ratio == 0; i++ {
+		time.Sleep(time.Millisecond * 10)
+		task.mutex.Lock()
+		ratio = task.Ratio
+		task.mutex.Unlock()
+	}
+	if ratio != 1.5 || task.UploadSpeed != 1024 || task.Uploaded != 300 {
+		t.Fatalf("unexpected upload, task:%+v", task.TaskInfo)
+	}
+	task.Cancel()
+	mutex.Lock()
+	defer mutex.Unlock()
+	if !forceRemoved || task.Seeding || task.UploadSpeed != 0 {
+		t.Fatalf("expect seeding stopped, task:%+v", task.TaskInfo)
+	}
+	if _, err := os.Stat(filepath.Join(downloadDir, "ubuntu")); err != nil {
+		t.Fatalf("the seeded files expect kept:%s", err)
+	}
+}
@@ -0,0 +1,533 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/hanjm/log"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"os/user"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+// the backend of sftp, the scp url is downloaded by the sftp subsystem of the server too
+const BackendSFTP = "sftp"
+
+var (
+	sshKeyFlags   stringsFlag
+	sshAgent      = flag.Bool("sshAgent", false, "authenticate the sftp hosts by the ssh agent of env SSH_AUTH_SOCK")
+	sshKnownHosts = flag.String("sshKnownHosts", "", "the known_hosts file to verify the sftp hosts, the unknown host is rejected, default is ~/.ssh/known_hosts")
+)
+
+// sshSigners are loaded from -sshKey
+var sshSigners []ssh.Signer
+
+// the transfer is resumed from the remote offset after it is interrupted, at most sftpMaxRetries times
+var (
+	sftpMaxRetries = 3
+	sftpRetryDelay = 2 * time.Second
+)
+
+func init() {
+	flag.Var(&sshKeyFlags, "sshKey", "the private key file to authenticate the sftp hosts, can be set multiple times")
+	RegisterBackend(&Backend{
+		Name:    BackendSFTP,
+		Schemes: []string{"sftp", "scp"},
+		New: func(ctx context.Context, sourceURL string) (Task, error) {
+			if err := urlPolicy.CheckURL(sourceURL); err != nil {
+				return nil, err
+			}
+			if err := egressPolicy.CheckURL(ctx, sourceURL); err != nil {
+				return nil, err
+			}
+			return NewSFTPTask(sourceURL)
+		},
+		Restore: func() Task {
+			return &SFTPTask{}
+		},
+		// the partial files are continued from their sizes
+		Resumable: true,
+	})
+}
+
+// LoadSSHSigners reads the unencrypted private keys of paths
+func LoadSSHSigners(paths []string) ([]ssh.Signer, error) {
+	var signers []ssh.Signer
+	for _, keyFile := range paths {
+		data, err := ioutil.ReadFile(keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("read ssh key %s error:%s", keyFile, err)
+		}
+		signer, err := ssh.ParsePrivateKey(data)
+		if err != nil {
+			var missing *ssh.PassphraseMissingError
+			if errors.As(err, &missing) {
+				err = fmt.Errorf("the key is encrypted, add it to the ssh agent instead")
+			}
+			return nil, fmt.Errorf("invalid ssh key %s:%s", keyFile, err)
+		}
+		signers = append(signers, signer)
+	}
+	return signers, nil
+}
+
+// SFTPTask downloads the file or the directory of sftp url, the directory is downloaded recursively into the task folder
+type SFTPTask struct {
+	TaskType int
+	TaskInfo
+	// the url with password, TaskInfo.SourceURL is redacted as it is pushed to the page
+	sourceURL string
+	canceled  bool
+	cancel    context.CancelFunc
+	done      chan struct{}
+	mutex     sync.Mutex
+}
+
+// sftpTaskRecord is the SFTPTask in the backup file
+type sftpTaskRecord struct {
+	TaskType int
+	TaskInfo
+	URL string `json:",omitempty"`
+}
+
+// MarshalJSON returns the task pushed to the page, the url with the secret is not in it
+func (t *SFTPTask) MarshalJSON() ([]byte, error) {
+	t.mutex.Lock()
+	record := sftpTaskRecord{
+		TaskType: t.TaskType,
+		TaskInfo: t.TaskInfo,
+	}
+	t.mutex.Unlock()
+	return json.Marshal(&record)
+}
+
+// MarshalRecord returns the task in the backup file, the url is kept for resuming
+func (t *SFTPTask) MarshalRecord() ([]byte, error) {
+	t.mutex.Lock()
+	record := sftpTaskRecord{
+		TaskType: t.TaskType,
+		TaskInfo: t.TaskInfo,
+		URL:      t.sourceURL,
+	}
+	t.mutex.Unlock()
+	return json.Marshal(&record)
+}
+
+func (t *SFTPTask) UnmarshalJSON(data []byte) error {
+	var record sftpTaskRecord
+	if err := json.Unmarshal(data, &record); err != nil {
+		return err
+	}
+	t.TaskType, t.TaskInfo, t.sourceURL = record.TaskType, record.TaskInfo, record.URL
+	return nil
+}
+
+func NewSFTPTask(sourceURL string) (*SFTPTask, error) {
+	u, err := url.Parse(sourceURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid url %s:%s", sourceURL, err)
+	}
+	if u.Hostname() == "" || strings.Trim(u.Path, "/~") == "" {
+		return nil, fmt.Errorf("the sftp url expect a host and path, got %s", u.Redacted())
+	}
+	return &SFTPTask{
+		TaskType: DownloadTaskTypeHTTP,
+		TaskInfo: TaskInfo{
+			SourceURL: u.Redacted(),
+			// the user and password are not in the name
+			FileName: getSafeFilename(u.Host + strings.TrimSuffix(u.Path, "/")),
+			Backend:  BackendSFTP,
+		},
+		sourceURL: sourceURL,
+	}, nil
+}
+
+func (t *SFTPTask) Download(downloadDir string, limitByteSize int64, limitTimeout time.Duration) (err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), limitTimeout)
+	defer cancel()
+	done := make(chan struct{})
+	defer close(done)
+	t.mutex.Lock()
+	t.cancel, t.done = cancel, done
+	canceled := t.canceled
+	t.mutex.Unlock()
+	if canceled {
+		// the task is deleted before it starts
+		return t.Errorf("task canceled")
+	}
+	fs := NewConfinedFS(downloadDir)
+	defer func() {
+		t.mutex.Lock()
+		canceled := t.canceled
+		t.mutex.Unlock()
+		// the partial files are kept for resuming, unless the task is canceled
+		if err != nil && canceled {
+			fs.RemoveAll(t.TaskInfo.FileName)
+		}
+	}()
+	u, err := url.Parse(t.sourceURL)
+	if err != nil {
+		return t.Errorf("invalid url:%s", err)
+	}
+	t.StartTime = time.Now()
+	for retry := 0; ; retry++ {
+		err = t.transfer(ctx, u, fs, limitByteSize)
+		if err == nil {
+			break
+		}
+		if ctx.Err() == context.DeadlineExceeded {
+			return t.Errorf("task timeout:%s", limitTimeout)
+		}
+		if ctx.Err() != nil {
+			return t.Errorf("task canceled")
+		}
+		if _, ok := err.(*sftpPermanentError); ok || retry >= sftpMaxRetries {
+			return t.Errorf("%s", err)
+		}
+		log.Warnf("sftp transfer of %s error:%s, resume from %d, retry %d/%d", t.SourceURL, err, t.Size, retry+1, sftpMaxRetries)
+		select {
+		case <-time.After(sftpRetryDelay):
+		case <-ctx.Done():
+		}
+	}
+	t.TaskInfo.IsCompleted = true
+	t.Size = t.TaskInfo.ContentLength
+	t.Duration = time.Now().Sub(t.StartTime)
+	t.Speed = calculateDownloadSpeed(t.Size, t.Duration)
+	log.Infof("complete SFTP task: length:%s source:%s filename:%s, duration:%s", getHumanSizeString(t.TaskInfo.ContentLength), t.SourceURL, t.TaskInfo.FileName, t.Duration)
+	return nil
+}
+
+// sftpPermanentError is the error which is not fixed by retrying, like the host key is unknown or the file is missing
+type sftpPermanentError struct {
+	err error
+}
+
+func (e *sftpPermanentError) Error() string {
+	return e.err.Error()
+}
+
+// sftpFile is the remote file and its local name in the download dir
+type sftpFile struct {
+	remote string
+	local  string
+	size   int64
+}
+
+// transfer downloads the files which are not completed, the offset of each file is the size of its partial file
+func (t *SFTPTask) transfer(ctx context.Context, u *url.URL, fs *ConfinedFS, limitByteSize int64) error {
+	// the connection of the transfer is closed once it returns
+	ctx, stop := context.WithCancel(ctx)
+	defer stop()
+	client, err := dialSFTP(ctx, u)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	remotePath, err := url.PathUnescape(u.EscapedPath())
+	if err != nil {
+		return &sftpPermanentError{fmt.Errorf("invalid path:%s", err)}
+	}
+	// the path of /~/ is relative to the home dir
+	if strings.HasPrefix(remotePath, "/~/") {
+		remotePath = remotePath[len("/~/"):]
+	}
+	files, err := listSFTPFiles(client, remotePath, t.TaskInfo.FileName)
+	if err != nil {
+		return err
+	}
+	var total int64
+	for _, file := range files {
+		total += file.size
+	}
+	if total > limitByteSize {
+		return &sftpPermanentError{fmt.Errorf("the content length of sourceUrl is too big:%d, limit:%d", total, limitByteSize)}
+	}
+	t.TaskInfo.ContentLength = total
+	log.Infof("create SFTP task: length:%s source:%s filename:%s, files:%d", getHumanSizeString(total), t.SourceURL, t.TaskInfo.FileName, len(files))
+	var completed int64
+	for _, file := range files {
+		if err := t.transferFile(client, fs, file, completed); err != nil {
+			return err
+		}
+		completed += file.size
+	}
+	return nil
+}
+
+// listSFTPFiles returns the file of path, or the regular files under the directory of path
+func listSFTPFiles(client *sftp.Client, remotePath string, localName string) ([]sftpFile, error) {
+	info, err := client.Stat(remotePath)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) || errors.Is(err, os.ErrPermission) {
+			return nil, &sftpPermanentError{fmt.Errorf("sftp stat %s error:%s", remotePath, err)}
+		}
+		return nil, fmt.Errorf("sftp stat %s error:%s", remotePath, err)
+	}
+	if !info.IsDir() {
+		return []sftpFile{{remote: remotePath, local: localName, size: info.Size()}}, nil
+	}
+	var files []sftpFile
+	walker := client.Walk(remotePath)
+	for walker.Step() {
+		// the unreadable sub directory is skipped rather than failing the others
+		if err := walker.Err(); err != nil {
+			if path.Clean(walker.Path()) == path.Clean(remotePath) {
+				return nil, fmt.Errorf("sftp walk %s error:%s", walker.Path(), err)
+			}
+			log.Warnf("skip sftp path %s:%s", walker.Path(), err)
+			continue
+		}
+		if !walker.Stat().Mode().IsRegular() {
+			continue
+		}
+		rel := path.Clean(strings.TrimPrefix(walker.Path(), path.Clean(remotePath)+"/"))
+		// the name given by the server must stay in the task folder
+		if rel == ".." || strings.HasPrefix(rel, "../") || path.IsAbs(rel) {
+			log.Warnf("skip sftp file out of %s:%s", remotePath, walker.Path())
+			continue
+		}
+		files = append(files, sftpFile{remote: walker.Path(), local: path.Join(localName, rel), size: walker.Stat().Size()})
+	}
+	return files, nil
+}
+
+// transferFile continues the local file from its size, completed is the size of the files downloaded before it
+func (t *SFTPTask) transferFile(client *sftp.Client, fs *ConfinedFS, file sftpFile, completed int64) error {
+	var offset int64
+	if info, err := fs.Stat(file.local); err == nil {
+		offset = info.Size()
+	}
+	if offset > file.size {
+		// the file on the server is changed
+		offset = 0
+	}
+	t.Size = completed + offset
+	if offset == file.size {
+		return nil
+	}
+	remote, err := client.Open(file.remote)
+	if err != nil {
+		return fmt.Errorf("sftp open %s error:%s", file.remote, err)
+	}
+	defer remote.Close()
+	if _, err := remote.Seek(offset, io.SeekStart); err != nil {
+		return fmt.Errorf("sftp seek %s error:%s", file.remote, err)
+	}
+	if dir := path.Dir(file.local); dir != "." {
+		if err := fs.MkdirAll(dir, 0755); err != nil {
+			return &sftpPermanentError{fmt.Errorf("create dir error:%s", err)}
+		}
+	}
+	flag := os.O_WRONLY | os.O_CREATE | os.O_APPEND
+	if offset == 0 {
+		flag |= os.O_TRUNC
+	}
+	fp, err := fs.OpenFile(file.local, flag, 0644)
+	if err != nil {
+		return &sftpPermanentError{fmt.Errorf("create file error:%s", err)}
+	}
+	defer fp.Close()
+	// the file is read by the concurrent requests of WriteTo
+	_, err = io.Copy(&sftpProgressWriter{task: t, file: fp, written: completed + offset, limit: completed + file.size}, remote)
+	if err != nil {
+		if _, ok := err.(*sftpPermanentError); ok {
+			return err
+		}
+		return fmt.Errorf("sftp read %s error:%s", file.remote, err)
+	}
+	if err := fp.Sync(); err != nil {
+		return &sftpPermanentError{fmt.Errorf("sync file error:%s", err)}
+	}
+	if t.Size != completed+file.size {
+		return fmt.Errorf("sftp transfer of %s is incomplete:%d/%d", file.remote, t.Size-completed, file.size)
+	}
+	return nil
+}
+
+// sftpProgressWriter writes the file and updates the progress of task, the file growing on the server is cut at its listed size
+type sftpProgressWriter struct {
+	task    *SFTPTask
+	file    *os.File
+	written int64
+	limit   int64
+	count   int
+}
+
+func (w *sftpProgressWriter) Write(p []byte) (int, error) {
+	if w.written+int64(len(p)) > w.limit {
+		return 0, fmt.Errorf("the file is changed on the server while downloading")
+	}
+	n, err := w.file.Write(p)
+	w.written += int64(n)
+	w.task.Size = w.written
+	if w.count++; w.count%100 == 0 {
+		w.task.Duration = time.Now().Sub(w.task.StartTime)
+		w.task.Speed = calculateDownloadSpeed(w.task.Size, w.task.Duration)
+	}
+	if err != nil {
+		return n, &sftpPermanentError{fmt.Errorf("body write error:%s", err)}
+	}
+	return n, nil
+}
+
+// dialSFTP connects the ssh server of url under the egress policy, verifies its host key by known_hosts,
+// and authenticates by the password of url, the ssh agent and the private keys
+func dialSFTP(ctx context.Context, u *url.URL) (*sftp.Client, error) {
+	port := u.Port()
+	if port == "" {
+		port = "22"
+	}
+	addr := net.JoinHostPort(u.Hostname(), port)
+	hostKeyCallback, algorithms, err := knownHostsCallback(addr)
+	if err != nil {
+		return nil, &sftpPermanentError{err}
+	}
+	username := u.User.Username()
+	if username == "" {
+		current, err := user.Current()
+		if err != nil {
+			return nil, &sftpPermanentError{fmt.Errorf("sftp url expect a user:%s", err)}
+		}
+		username = current.Username
+	}
+	var auths []ssh.AuthMethod
+	if password, ok := u.User.Password(); ok {
+		auths = append(auths, ssh.Password(password))
+	}
+	if socket := os.Getenv("SSH_AUTH_SOCK"); *sshAgent && socket != "" {
+		agentConn, err := net.Dial("unix", socket)
+		if err != nil {
+			log.Warnf("connect ssh agent %s error:%s", socket, err)
+		} else {
+			defer agentConn.Close()
+			auths = append(auths, ssh.PublicKeysCallback(agent.NewClient(agentConn).Signers))
+		}
+	}
+	if len(sshSigners) > 0 {
+		auths = append(auths, ssh.PublicKeys(sshSigners...))
+	}
+	config := &ssh.ClientConfig{
+		User:              username,
+		Auth:              auths,
+		HostKeyCallback:   hostKeyCallback,
+		HostKeyAlgorithms: algorithms,
+	}
+	conn, err := egressPolicy.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("connect ssh server error:%s", err)
+	}
+	// the connection is closed once ctx is done, the task is canceled or the transfer returns
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+	sshConn, channels, requests, err := ssh.NewClientConn(conn, addr, config)
+	if err != nil {
+		conn.Close()
+		if ctx.Err() != nil {
+			return nil, err
+		}
+		// the host key and the credentials are rejected
+		return nil, &sftpPermanentError{fmt.Errorf("ssh login as %s error:%s", username, err)}
+	}
+	client, err := sftp.NewClient(ssh.NewClient(sshConn, channels, requests))
+	if err != nil {
+		sshConn.Close()
+		return nil, fmt.Errorf("start sftp subsystem error:%s", err)
+	}
+	return client, nil
+}
+
+// knownHostsCallback returns the callback of -sshKnownHosts, and the host key algorithms of addr in it,
+// so the server offers the key which is known rather than the one it prefers
+func knownHostsCallback(addr string) (ssh.HostKeyCallback, []string, error) {
+	knownHostsFile := *sshKnownHosts
+	if knownHostsFile == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, nil, fmt.Errorf("known_hosts file is unknown:%s", err)
+		}
+		knownHostsFile = filepath.Join(home, ".ssh", "known_hosts")
+	}
+	callback, err := knownhosts.New(knownHostsFile)
+	if err != nil {
+		return nil, nil, fmt.Errorf("read known_hosts error:%s", err)
+	}
+	// the callback returns the known keys of host for the key which is not
+	probe, err := ssh.NewPublicKey(ed25519.PublicKey(make([]byte, ed25519.PublicKeySize)))
+	if err != nil {
+		return nil, nil, err
+	}
+	var keyErr *knownhosts.KeyError
+	if err := callback(addr, &net.TCPAddr{IP: net.IPv4zero}, probe); !errors.As(err, &keyErr) || len(keyErr.Want) == 0 {
+		return nil, nil, fmt.Errorf("host %s is not in %s, add its key by ssh-keyscan", addr, knownHostsFile)
+	}
+	var algorithms []string
+	for _, known := range keyErr.Want {
+		switch keyType := known.Key.Type(); keyType {
+		case ssh.KeyAlgoRSA:
+			algorithms = append(algorithms, ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256, ssh.KeyAlgoRSA)
+		default:
+			algorithms = append(algorithms, keyType)
+		}
+	}
+	return callback, algorithms, nil
+}
+
+// Cancel stops the downloading task, the partial files are removed
+func (t *SFTPTask) Cancel() {
+	t.mutex.Lock()
+	cancel, done := t.cancel, t.done
+	t.canceled = true
+	t.mutex.Unlock()
+	if cancel == nil {
+		return
+	}
+	cancel()
+	<-done
+}
+
+func (t *SFTPTask) infoMutex() *sync.Mutex {
+	return &t.mutex
+}
+
+func (t *SFTPTask) IsCompleted() bool {
+	return t.TaskInfo.IsCompleted
+}
+
+func (t *SFTPTask) FileName() string {
+	return t.TaskInfo.FileName
+}
+
+func (t *SFTPTask) ContentLength() int64 {
+	return t.TaskInfo.ContentLength
+}
+
+func (t *SFTPTask) Errorf(format string, a ...interface{}) (err error) {
+	err = fmt.Errorf(format, a...)
+	_, file, line, ok := runtime.Caller(1)
+	if ok {
+		log.Errorf("[%s:%d]%s", file, line, err.Error())
+	}
+	t.TaskInfo.IsError = true
+	t.TaskInfo.IsCompleted = true
+	t.TaskInfo.Error = err.Error()
+	return err
+}
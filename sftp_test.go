@@ -0,0 +1,376 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"encoding/pem"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeSSHServer is the in-process ssh server of the sftp subsystem, its working directory is root
+type fakeSSHServer struct {
+	listener net.Listener
+	root     string
+	hostKey  ssh.Signer
+	// the client key which is authorized, and the password if it is not empty
+	authorizedKey ssh.PublicKey
+	password      string
+	// the connection is closed after the bytes are sent once, 0 means never
+	interruptAt int
+	mutex       sync.Mutex
+	logins      int
+}
+
+func newFakeSSHServer(t *testing.T, s *fakeSSHServer) *fakeSSHServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.listener = listener
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			s.mutex.Lock()
+			defer s.mutex.Unlock()
+			if s.authorizedKey != nil && bytes.Equal(key.Marshal(), s.authorizedKey.Marshal()) {
+				return nil, nil
+			}
+			return nil, ssh.ErrNoAuth
+		},
+		PasswordCallback: func(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			if s.password != "" && string(password) == s.password {
+				return nil, nil
+			}
+			return nil, ssh.ErrNoAuth
+		},
+	}
+	config.AddHostKey(s.hostKey)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn, config)
+		}
+	}()
+	return s
+}
+
+func (s *fakeSSHServer) URL(scheme string, userinfo string, path string) string {
+	return scheme + "://" + userinfo + s.listener.Addr().String() + path
+}
+
+func (s *fakeSSHServer) Close() {
+	s.listener.Close()
+}
+
+func (s *fakeSSHServer) Authorize(key ssh.PublicKey) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.authorizedKey = key
+}
+
+func (s *fakeSSHServer) Logins() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.logins
+}
+
+func (s *fakeSSHServer) serve(conn net.Conn, config *ssh.ServerConfig) {
+	defer conn.Close()
+	s.mutex.Lock()
+	s.logins++
+	s.mutex.Unlock()
+	_, channels, requests, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		return
+	}
+	go ssh.DiscardRequests(requests)
+	for newChannel := range channels {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "session only")
+			continue
+		}
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			for req := range requests {
+				ok := req.Type == "subsystem" && string(req.Payload[4:]) == "sftp"
+				req.Reply(ok, nil)
+				if !ok {
+					continue
+				}
+				s.mutex.Lock()
+				interruptAt := s.interruptAt
+				s.interruptAt = 0
+				s.mutex.Unlock()
+				server, _ := sftp.NewServer(&interruptedChannel{Channel: channel, conn: conn, left: interruptAt}, sftp.WithServerWorkingDirectory(s.root))
+				go func() {
+					server.Serve()
+					server.Close()
+				}()
+			}
+		}()
+	}
+}
+
+// interruptedChannel closes the connection after the bytes are written
+type interruptedChannel struct {
+	ssh.Channel
+	conn net.Conn
+	left int
+}
+
+func (c *interruptedChannel) Write(p []byte) (int, error) {
+	if c.left > 0 {
+		if c.left -= len(p); c.left <= 0 {
+			c.conn.Close()
+		}
+	}
+	return c.Channel.Write(p)
+}
+
+func newSSHSigner(t *testing.T) ssh.Signer {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+func TestLoadSSHSigners(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fdp-ssh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	_, key, _ := ed25519.GenerateKey(rand.Reader)
+	block, err := ssh.MarshalPrivateKey(key, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	encrypted, err := ssh.MarshalPrivateKeyWithPassphrase(key, "", []byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ioutil.WriteFile(filepath.Join(dir, "id"), pem.EncodeToMemory(block), 0600)
+	ioutil.WriteFile(filepath.Join(dir, "id_encrypted"), pem.EncodeToMemory(encrypted), 0600)
+	signers, err := LoadSSHSigners([]string{filepath.Join(dir, "id")})
+	if err != nil || len(signers) != 1 {
+		t.Fatalf("unexpected signers:%v %v", signers, err)
+	}
+	if _, err := LoadSSHSigners([]string{filepath.Join(dir, "id_encrypted")}); err == nil || !strings.Contains(err.Error(), "ssh agent") {
+		t.Fatalf("expect the encrypted key rejected, got %v", err)
+	}
+	if _, err := LoadSSHSigners([]string{filepath.Join(dir, "missing")}); err == nil {
+		t.Fatal("expect the missing key rejected")
+	}
+}
+
+func TestSFTPTask(t *testing.T) {
+	setEgressPolicy(t, "127.0.0.0/8", "")
+	setFlag(t, "sshAgent", "false")
+	setFlag(t, "sshKnownHosts", "")
+	oldDelay, oldSigners := sftpRetryDelay, sshSigners
+	sftpRetryDelay = 10 * time.Millisecond
+	defer func() {
+		sftpRetryDelay, sshSigners = oldDelay, oldSigners
+	}()
+	root, err := ioutil.TempDir("", "fdp-sftp-root")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	dir, err := ioutil.TempDir("", "fdp-sftp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	content := make([]byte, 300000)
+	rand.Read(content)
+	files := map[string][]byte{
+		"data.bin":                content,
+		"builds/a.bin":            content[:1000],
+		"builds/sub/b.bin":        content[1000:5000],
+		"builds/sub/deeper/c.txt": []byte("c"),
+	}
+	for name, data := range files {
+		os.MkdirAll(filepath.Dir(filepath.Join(root, name)), 0755)
+		ioutil.WriteFile(filepath.Join(root, name), data, 0644)
+	}
+	os.Symlink("/etc/passwd", filepath.Join(root, "builds", "link"))
+	// the unreadable sub directory is skipped, it is readable by root but empty
+	os.Mkdir(filepath.Join(root, "builds", "locked"), 0)
+	defer os.Chmod(filepath.Join(root, "builds", "locked"), 0755)
+
+	hostKey, clientKey := newSSHSigner(t), newSSHSigner(t)
+	server := newFakeSSHServer(t, &fakeSSHServer{root: root, hostKey: hostKey, authorizedKey: clientKey.PublicKey(), password: "s3cret", interruptAt: 100000})
+	defer server.Close()
+	*sshKnownHosts = filepath.Join(dir, "known_hosts")
+	ioutil.WriteFile(*sshKnownHosts, []byte(knownhosts.Line([]string{knownhosts.Normalize(server.listener.Addr().String())}, hostKey.PublicKey())+"\n"), 0600)
+	sshSigners = []ssh.Signer{clientKey}
+	download := func(sourceURL string) (*SFTPTask, error) {
+		task, err := NewDownloadTask(sourceURL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		st, ok := task.(*SFTPTask)
+		if !ok {
+			t.Fatalf("expect sftp task, got %T", task)
+		}
+		return st, task.Download(dir, int64(len(content)), 10*time.Second)
+	}
+	expectCompleted := func(task *SFTPTask, size int) {
+		t.Helper()
+		if !task.IsCompleted() || task.Info().IsError || task.ContentLength() != int64(size) || task.Info().Size != int64(size) {
+			t.Fatalf("unexpected task:%+v", task.Info())
+		}
+	}
+
+	// the key authentication, the interrupted transfer is resumed from the remote offset
+	task, err := download(server.URL("sftp", "alice@", "/~/data.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectCompleted(task, len(content))
+	if data, _ := ioutil.ReadFile(filepath.Join(dir, task.FileName())); !bytes.Equal(data, content) {
+		t.Fatal("unexpected content of data.bin")
+	}
+	if logins := server.Logins(); logins != 2 {
+		t.Fatalf("expect the transfer resumed once, logins:%d", logins)
+	}
+	data, _ := marshalTaskRecord(task)
+	restored, err := restoreTask(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rt, ok := restored.(*SFTPTask); !ok || rt.sourceURL != task.sourceURL || !rt.IsCompleted() {
+		t.Fatalf("unexpected restored task:%+v", restored)
+	}
+
+	// the partial file of restarted task is continued, its bytes are kept
+	restarted, _ := NewDownloadTask(task.sourceURL)
+	restarted.Info().FileName = "partial.bin"
+	partial := bytes.Repeat([]byte{'x'}, 12345)
+	ioutil.WriteFile(filepath.Join(dir, "partial.bin"), partial, 0644)
+	if err := restarted.Download(dir, int64(len(content)), 10*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := ioutil.ReadFile(filepath.Join(dir, "partial.bin")); !bytes.Equal(data, append(partial, content[12345:]...)) {
+		t.Fatal("expect the partial file resumed from its size")
+	}
+
+	// the directory is downloaded recursively by the agent, the symlink and the locked directory are skipped
+	sshSigners, *sshAgent = nil, true
+	keyring := agent.NewKeyring()
+	_, clientPrivateKey, _ := ed25519.GenerateKey(rand.Reader)
+	keyring.Add(agent.AddedKey{PrivateKey: clientPrivateKey})
+	agentSigner, _ := ssh.NewSignerFromKey(clientPrivateKey)
+	server.Authorize(agentSigner.PublicKey())
+	socket := filepath.Join(dir, "agent.sock")
+	agentListener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer agentListener.Close()
+	go func() {
+		for {
+			conn, err := agentListener.Accept()
+			if err != nil {
+				return
+			}
+			go agent.ServeAgent(keyring, conn)
+		}
+	}()
+	oldSocket := os.Getenv("SSH_AUTH_SOCK")
+	os.Setenv("SSH_AUTH_SOCK", socket)
+	defer os.Setenv("SSH_AUTH_SOCK", oldSocket)
+	task, err = download(server.URL("scp", "alice@", filepath.ToSlash(root)+"/builds/"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectCompleted(task, 1000+4000+1)
+	for name, data := range files {
+		if !strings.HasPrefix(name, "builds/") {
+			continue
+		}
+		if local, _ := ioutil.ReadFile(filepath.Join(dir, task.FileName(), strings.TrimPrefix(name, "builds/"))); !bytes.Equal(local, data) {
+			t.Fatalf("unexpected content of %s", name)
+		}
+	}
+	if _, err := os.Lstat(filepath.Join(dir, task.FileName(), "link")); err == nil {
+		t.Fatal("expect the symlink skipped")
+	}
+
+	// the password in url is hidden
+	*sshAgent = false
+	task, err = download(server.URL("sftp", "alice:s3cret@", "/~/builds/a.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectCompleted(task, 1000)
+	if strings.Contains(task.SourceURL, "s3cret") || strings.Contains(task.FileName(), "s3cret") {
+		t.Fatalf("expect the password hidden:%s %s", task.SourceURL, task.FileName())
+	}
+	if data, _ := json.Marshal(task); strings.Contains(string(data), "s3cret") {
+		t.Fatalf("expect the password not pushed:%s", data)
+	}
+	if data, _ := marshalTaskRecord(task); !strings.Contains(string(data), "s3cret") {
+		t.Fatalf("expect the password kept in the backup file:%s", data)
+	}
+
+	// the rejected credentials and the missing file are not retried, the file over the limit is rejected
+	for _, sourceURL := range []string{server.URL("sftp", "alice:wrong@", "/~/data.bin"), server.URL("sftp", "alice:s3cret@", "/~/missing.bin")} {
+		before := server.Logins()
+		if _, err := download(sourceURL); err == nil {
+			t.Fatalf("expect %s failed", sourceURL)
+		}
+		if logins := server.Logins() - before; logins != 1 {
+			t.Fatalf("expect no retry of %s, logins:%d", sourceURL, logins)
+		}
+	}
+	limit, _ := NewDownloadTask(server.URL("sftp", "alice:s3cret@", "/~/data.bin"))
+	if err := limit.Download(dir, 1000, 10*time.Second); err == nil || !strings.Contains(err.Error(), "too big") {
+		t.Fatalf("expect the file too big, got %v", err)
+	}
+	// the task deleted before it starts does not connect
+	canceled, _ := NewDownloadTask(server.URL("sftp", "alice:s3cret@", "/~/data.bin"))
+	canceled.(Canceler).Cancel()
+	before := server.Logins()
+	if err := canceled.Download(dir, int64(len(content)), 10*time.Second); err == nil || server.Logins() != before {
+		t.Fatalf("expect the canceled task not started, got %v", err)
+	}
+
+	// the unknown and the changed host keys are rejected
+	ioutil.WriteFile(*sshKnownHosts, nil, 0600)
+	if _, err := download(server.URL("sftp", "alice:s3cret@", "/~/data.bin")); err == nil || !strings.Contains(err.Error(), "ssh-keyscan") {
+		t.Fatalf("expect the unknown host rejected, got %v", err)
+	}
+	ioutil.WriteFile(*sshKnownHosts, []byte(knownhosts.Line([]string{knownhosts.Normalize(server.listener.Addr().String())}, newSSHSigner(t).PublicKey())+"\n"), 0600)
+	before = server.Logins()
+	if _, err := download(server.URL("sftp", "alice:s3cret@", "/~/data.bin")); err == nil || !strings.Contains(err.Error(), "knownhosts") {
+		t.Fatalf("expect the changed host key rejected, got %v", err)
+	}
+	if logins := server.Logins() - before; logins != 1 {
+		t.Fatalf("expect no retry of the changed host key, logins:%d", logins)
+	}
+}
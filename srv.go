@@ -6,12 +6,27 @@ import (
 	"github.com/hanjm/log"
 	"net/http"
 	_ "net/http/pprof"
+	"strings"
 )
 
 func HTTPServer(tm *TasksManager, port int, basicAuth string) {
-	http.Handle("/download/", http.StripPrefix("/download", http.FileServer(http.Dir(tm.downloadDir))))
+	fileServer := http.StripPrefix("/download", http.FileServer(tm.fs))
+	http.Handle("/download/", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		filename := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/download/"), "/", 2)[0]
+		if filename == trashDirName {
+			http.NotFound(w, r)
+			return
+		}
+		tm.TouchFile(filename)
+		fileServer.ServeHTTP(w, r)
+	}))
 	http.Handle("/file_download_proxy/ws", http.HandlerFunc(tm.WebSocketHandler))
 	http.Handle("/file_download_proxy/task", http.HandlerFunc(tm.TaskHandler))
+	http.Handle("/file_download_proxy/trash", http.HandlerFunc(tm.TrashHandler))
+	http.Handle("/file_download_proxy/aria2", http.HandlerFunc(tm.Aria2cHandler))
+	http.Handle("/file_download_proxy/swarm", http.HandlerFunc(tm.SwarmHandler))
+	http.Handle("/file_download_proxy/torrent", http.HandlerFunc(tm.TorrentHandler))
+	http.Handle("/file_download_proxy/magnet", http.HandlerFunc(tm.TorrentHandler))
 	http.HandleFunc("/favicon.ico", HandleFile("favicon.ico"))
 	http.Handle("/file_download_proxy/", HandleFile("index.html"))
 	listenAddr := fmt.Sprintf(":%d", port)
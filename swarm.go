@@ -0,0 +1,385 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/hanjm/log"
+	"math/bits"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	trackerProbeTimeout = 5 * time.Second
+	trackerProbeTTL     = 10 * time.Minute
+)
+
+// Swarm is the BitTorrent swarm of a magnet task, it tells why the task does not make progress
+type Swarm struct {
+	GID             string
+	Status          string
+	InfoHash        string
+	NumSeeders      int
+	Connections     int
+	DownloadSpeed   int64
+	UploadSpeed     int64
+	NumPieces       int
+	PieceLength     int64
+	CompletedPieces int
+	// Bitfield is the hex bitfield of the downloaded pieces reported by aria2c
+	Bitfield string
+	// PieceMap is the completed percent of the pieces grouped into 100 parts at most
+	PieceMap []int
+	Peers    []SwarmPeer
+	Trackers []SwarmTracker
+}
+
+type SwarmPeer struct {
+	Address       string
+	PeerID        string
+	Client        string
+	DownloadSpeed int64
+	UploadSpeed   int64
+	// Progress is the ratio of pieces the peer has
+	Progress    float64
+	Seeder      bool
+	AmChoking   bool
+	PeerChoking bool
+}
+
+// SwarmTracker is the tracker of torrent, aria2c does not report the announce results,
+// so its status is whether fdp can reach the tracker
+type SwarmTracker struct {
+	URL string
+	// Tier is the tier of announce-list, the trackers of bt-tracker option are in the last tier
+	Tier        int
+	Source      string
+	Status      string
+	Error       string `json:",omitempty"`
+	CheckedTime time.Time
+}
+
+const (
+	TrackerStatusOK          = "ok"
+	TrackerStatusError       = "error"
+	TrackerStatusUnsupported = "unsupported"
+)
+
+// Swarm returns the swarm of the current aria2c download of the task
+func (t *MagnetTask) Swarm() (*Swarm, error) {
+	t.mutex.Lock()
+	var gid string
+	if len(t.gids) > 0 {
+		gid = t.gids[len(t.gids)-1]
+	}
+	t.mutex.Unlock()
+	if gid == "" {
+		return nil, fmt.Errorf("task is not downloading or seeding")
+	}
+	aria2cRPCClient := NewAria2cRPCClient()
+	result, err := aria2cRPCClient.TellStatus(gid)
+	if err != nil {
+		return nil, fmt.Errorf("call aria2c TellStatus error:%s", err)
+	}
+	swarm := &Swarm{
+		GID:             gid,
+		Status:          result.Status,
+		InfoHash:        result.InfoHash,
+		NumSeeders:      result.NumSeeders,
+		Connections:     result.Connections,
+		DownloadSpeed:   result.DownloadSpeed,
+		UploadSpeed:     result.UploadSpeed,
+		NumPieces:       result.NumPieces,
+		PieceLength:     result.PieceLength,
+		CompletedPieces: countPieces(result.Bitfield, result.NumPieces),
+		Bitfield:        result.Bitfield,
+		PieceMap:        pieceMap(result.Bitfield, result.NumPieces),
+	}
+	peers, err := aria2cRPCClient.GetPeers(gid)
+	if err != nil {
+		return nil, fmt.Errorf("call aria2c GetPeers error:%s", err)
+	}
+	for _, peer := range peers {
+		peerID, _ := url.PathUnescape(peer.PeerID)
+		var progress float64
+		if result.NumPieces > 0 {
+			progress = float64(countPieces(peer.Bitfield, result.NumPieces)) / float64(result.NumPieces)
+		}
+		swarm.Peers = append(swarm.Peers, SwarmPeer{
+			Address:       fmt.Sprintf("%s:%d", peer.IP, peer.Port),
+			PeerID:        peer.PeerID,
+			Client:        peerClient(peerID),
+			DownloadSpeed: peer.DownloadSpeed,
+			UploadSpeed:   peer.UploadSpeed,
+			Progress:      progress,
+			Seeder:        peer.Seeder,
+			AmChoking:     peer.AmChoking,
+			PeerChoking:   peer.PeerChoking,
+		})
+	}
+	if result.Bittorrent != nil {
+		for tier, announces := range result.Bittorrent.AnnounceList {
+			for _, announce := range announces {
+				swarm.Trackers = append(swarm.Trackers, SwarmTracker{URL: announce, Tier: tier + 1, Source: "torrent"})
+			}
+		}
+	}
+	options, err := aria2cRPCClient.GetOption(gid)
+	if err != nil {
+		return nil, fmt.Errorf("call aria2c GetOption error:%s", err)
+	}
+	tier := 1
+	if result.Bittorrent != nil {
+		tier = len(result.Bittorrent.AnnounceList) + 1
+	}
+	for _, tracker := range splitTrackers(options.BtTracker) {
+		swarm.Trackers = append(swarm.Trackers, SwarmTracker{URL: tracker, Tier: tier, Source: "bt-tracker"})
+	}
+	trackerProber.Probe(swarm.Trackers)
+	return swarm, nil
+}
+
+// countPieces counts the pieces set in the hex bitfield
+func countPieces(bitfield string, numPieces int) int {
+	data, err := hex.DecodeString(bitfield)
+	if err != nil {
+		return 0
+	}
+	count := 0
+	for _, b := range data {
+		count += bits.OnesCount8(b)
+	}
+	if count > numPieces {
+		// the spare bits at the end are not pieces
+		count = numPieces
+	}
+	return count
+}
+
+// pieceMap groups the pieces into 100 parts at most, and returns the completed percent of each part
+func pieceMap(bitfield string, numPieces int) []int {
+	data, err := hex.DecodeString(bitfield)
+	if err != nil || numPieces <= 0 || len(data)*8 < numPieces {
+		return nil
+	}
+	parts := numPieces
+	if parts > 100 {
+		parts = 100
+	}
+	completed, total := make([]int, parts), make([]int, parts)
+	for i := 0; i < numPieces; i++ {
+		part := i * parts / numPieces
+		total[part]++
+		if data[i/8]&(0x80>>uint(i%8)) != 0 {
+			completed[part]++
+		}
+	}
+	result := make([]int, parts)
+	for i := range result {
+		result[i] = completed[i] * 100 / total[i]
+	}
+	return result
+}
+
+// peerClients are the Azureus-style client codes of peer id, like -qB4250-
+var peerClients = map[string]string{
+	"AZ": "Vuze",
+	"BC": "BitComet",
+	"BI": "BiglyBT",
+	"BT": "BitTorrent",
+	"DE": "Deluge",
+	"FD": "Free Download Manager",
+	"KT": "KTorrent",
+	"LT": "libtorrent",
+	"lt": "rTorrent",
+	"qB": "qBittorrent",
+	"SD": "Thunder",
+	"TR": "Transmission",
+	"UT": "µTorrent",
+	"UW": "µTorrent Web",
+	"WW": "WebTorrent",
+	"XL": "Xunlei",
+}
+
+// peerClient returns the client name and version of the peer id
+func peerClient(peerID string) string {
+	if len(peerID) >= 8 && peerID[0] == '-' && peerID[7] == '-' {
+		code, version := peerID[1:3], peerID[3:7]
+		name, ok := peerClients[code]
+		if !ok {
+			name = code
+		}
+		var parts []string
+		for _, c := range strings.TrimRight(version, "0") {
+			parts = append(parts, string(c))
+		}
+		if len(parts) == 0 {
+			return name
+		}
+		return name + " " + strings.Join(parts, ".")
+	}
+	// aria2 uses A2-1-37-0-
+	if strings.HasPrefix(peerID, "A2-") {
+		fields := strings.Split(peerID, "-")
+		if len(fields) >= 4 {
+			return "aria2 " + strings.Join(fields[1:4], ".")
+		}
+	}
+	if strings.HasPrefix(peerID, "M") && strings.Contains(peerID, "--") {
+		return "Mainline"
+	}
+	return "unknown"
+}
+
+// TrackerProber checks whether the trackers are reachable, the results are cached for trackerProbeTTL
+type TrackerProber struct {
+	mutex   sync.Mutex
+	results map[string]SwarmTracker
+}
+
+var trackerProber = &TrackerProber{results: make(map[string]SwarmTracker)}
+
+// Probe fills the status of trackers, the trackers are probed concurrently
+func (p *TrackerProber) Probe(trackers []SwarmTracker) {
+	var wg sync.WaitGroup
+	for i := range trackers {
+		p.mutex.Lock()
+		cached, ok := p.results[trackers[i].URL]
+		p.mutex.Unlock()
+		if ok && time.Since(cached.CheckedTime) < trackerProbeTTL {
+			trackers[i].Status, trackers[i].Error, trackers[i].CheckedTime = cached.Status, cached.Error, cached.CheckedTime
+			continue
+		}
+		wg.Add(1)
+		go func(tracker *SwarmTracker) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), trackerProbeTimeout)
+			defer cancel()
+			tracker.Status, tracker.CheckedTime = TrackerStatusOK, time.Now()
+			if err := probeTracker(ctx, tracker.URL); err == errTrackerProbeUnsupported {
+				tracker.Status = TrackerStatusUnsupported
+			} else if err != nil {
+				tracker.Status, tracker.Error = TrackerStatusError, err.Error()
+			}
+			p.mutex.Lock()
+			p.results[tracker.URL] = *tracker
+			p.mutex.Unlock()
+		}(&trackers[i])
+	}
+	wg.Wait()
+}
+
+var errTrackerProbeUnsupported = fmt.Errorf("the tracker can not be probed")
+
+// probeTracker sends the connect request of udp tracker, or requests the http tracker, the egress policy is applied
+func probeTracker(ctx context.Context, tracker string) error {
+	u, err := url.Parse(tracker)
+	if err != nil {
+		return fmt.Errorf("invalid tracker:%s", err)
+	}
+	switch u.Scheme {
+	case "udp":
+		return probeUDPTracker(ctx, u.Host)
+	case "http", "https":
+		client := &http.Client{
+			Transport: &http.Transport{
+				DialContext: egressPolicy.DialContext,
+			},
+			CheckRedirect: checkRedirect,
+		}
+		req, err := http.NewRequest(http.MethodGet, tracker, nil)
+		if err != nil {
+			return err
+		}
+		resp, err := client.Do(req.WithContext(ctx))
+		if err != nil {
+			return err
+		}
+		// the tracker answers the request without info_hash with a failure reason, it is reachable
+		resp.Body.Close()
+		if resp.StatusCode >= http.StatusInternalServerError {
+			return fmt.Errorf("tracker responds %s", resp.Status)
+		}
+		return nil
+	}
+	return errTrackerProbeUnsupported
+}
+
+// probeUDPTracker sends the connect request of BEP 15 and checks the response
+func probeUDPTracker(ctx context.Context, addr string) error {
+	conn, err := egressPolicy.DialContext(ctx, "udp", addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	_, err = udpTrackerConnect(conn)
+	return err
+}
+
+// udpTrackerConnect sends the connect request of BEP 15 and returns the connection id
+func udpTrackerConnect(conn net.Conn) (uint64, error) {
+	transactionID := rand.Uint32()
+	request := make([]byte, 16)
+	binary.BigEndian.PutUint64(request[0:8], 0x41727101980)
+	binary.BigEndian.PutUint32(request[8:12], 0)
+	binary.BigEndian.PutUint32(request[12:16], transactionID)
+	if _, err := conn.Write(request); err != nil {
+		return 0, err
+	}
+	response := make([]byte, 16)
+	n, err := conn.Read(response)
+	if err != nil {
+		return 0, err
+	}
+	if n < 16 || binary.BigEndian.Uint32(response[0:4]) != 0 || binary.BigEndian.Uint32(response[4:8]) != transactionID {
+		return 0, fmt.Errorf("invalid connect response")
+	}
+	return binary.BigEndian.Uint64(response[8:16]), nil
+}
+
+// SwarmHandler returns the swarm of the magnet task
+func (m *TasksManager) SwarmHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	// filename有特殊字符如&时无法正常通过r.URL.Query()获取
+	filename, err := url.QueryUnescape(strings.TrimPrefix(r.URL.RawQuery, "filename="))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("param filename is invalid:" + r.URL.RawQuery))
+		return
+	}
+	task := m.GetTask(filename)
+	if task == nil {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("task not found"))
+		return
+	}
+	tt, ok := task.(TorrentTask)
+	if !ok {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("only the torrent has swarm"))
+		return
+	}
+	swarm, err := tt.Swarm()
+	if err != nil {
+		log.Warnf("[SwarmHandler]%s swarm error:%s", filename, err)
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(swarm)
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPeerClient(t *testing.T) {
+	for peerID, expect := range map[string]string{
+		"-qB4250-0123456789ab": "qBittorrent 4.2.5",
+		"-TR3000-0123456789ab": "Transmission 3",
+		"-XX1200-0123456789ab": "XX 1.2",
+		"A2-1-37-0-0123456789": "aria2 1.37.0",
+		"M7-2-2--0123456789ab": "Mainline",
+		"0123456789abcdefghij": "unknown",
+	} {
+		if client := peerClient(peerID); client != expect {
+			t.Errorf("%s expect %s, got %s", peerID, expect, client)
+		}
+	}
+}
+
+func TestPieceMap(t *testing.T) {
+	// 10 pieces, the first 4 and the 9th are completed
+	if count := countPieces("f080", 10); count != 5 {
+		t.Fatalf("expect 5 pieces, got %d", count)
+	}
+	if count := countPieces("ffff", 10); count != 10 {
+		t.Fatalf("expect the spare bits are not counted, got %d", count)
+	}
+	expect := []int{100, 100, 100, 100, 0, 0, 0, 0, 100, 0}
+	if parts := pieceMap("f080", 10); !reflect.DeepEqual(parts, expect) {
+		t.Fatalf("expect %v, got %v", expect, parts)
+	}
+	parts := pieceMap(strings.Repeat("ff", 50)+strings.Repeat("00", 50), 800)
+	if len(parts) != 100 || parts[0] != 100 || parts[49] != 100 || parts[50] != 0 {
+		t.Fatalf("unexpected piece map of 800 pieces:%v", parts)
+	}
+	if parts := pieceMap("zz", 10); parts != nil {
+		t.Fatalf("expect nil for the invalid bitfield, got %v", parts)
+	}
+}
+
+// newFakeUDPTracker answers the connect requests of BEP 15
+func newFakeUDPTracker(t *testing.T) net.PacketConn {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if n < 16 || binary.BigEndian.Uint64(buf[0:8]) != 0x41727101980 {
+				continue
+			}
+			response := make([]byte, 16)
+			binary.BigEndian.PutUint32(response[0:4], 0)
+			copy(response[4:8], buf[12:16])
+			binary.BigEndian.PutUint64(response[8:16], 42)
+			conn.WriteTo(response, addr)
+		}
+	}()
+	return conn
+}
+
+func TestMagnetTask_Swarm(t *testing.T) {
+	udpTracker := newFakeUDPTracker(t)
+	defer udpTracker.Close()
+	httpTracker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("d14:failure reason17:missing info_hashe"))
+	}))
+	defer httpTracker.Close()
+	udpURL := fmt.Sprintf("udp://%s/announce", udpTracker.LocalAddr())
+	httpURL := httpTracker.URL + "/announce"
+	// nobody listens on the port
+	deadURL := fmt.Sprintf("udp://%s/announce", strings.Replace(udpTracker.LocalAddr().String(), "127.0.0.1", "127.0.0.2", 1))
+	server := newFakeAria2cServer(t, map[string]string{
+		"aria2.tellStatus": `{"gid":"2089b05ecca3d829","status":"active","numSeeders":"1","connections":"2","numPieces":"10","pieceLength":"1048576",` +
+			`"bitfield":"f080","bittorrent":{"announceList":[["` + udpURL + `"],["` + httpURL + `"]]}}`,
+		"aria2.getPeers": `[{"peerId":"%2DqB4250%2D0123456789ab","ip":"1.2.3.4","port":"6881","bitfield":"ffc0","downloadSpeed":"10","uploadSpeed":"20","seeder":"true"},` +
+			`{"peerId":"A2-1-37-0-0123456789","ip":"5.6.7.8","port":"6882","bitfield":"8000","seeder":"false"}]`,
+		"aria2.getOption": `{"bt-tracker":"` + deadURL + `,wss://tracker.webtorrent.dev"}`,
+	}, nil)
+	defer server.Close()
+	oldRPC, oldTimeout := *aria2cRPC, trackerProbeTimeout
+	*aria2cRPC, trackerProbeTimeout = server.URL, time.Millisecond*500
+	defer func() {
+		*aria2cRPC, trackerProbeTimeout = oldRPC, oldTimeout
+	}()
+	policy, err := ParseEgressPolicy("127.0.0.0/8", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	task := NewMagnetTask("magnet:?xt=urn:btih:09c4beba230a770051207d07a8fb76cf43477523")
+	if _, err := task.Swarm(); err == nil {
+		t.Fatal("expect error before the task is added to aria2c")
+	}
+	task.addGID("2089b05ecca3d829")
+	var swarm *Swarm
+	withEgressPolicy(policy, func() {
+		swarm, err = task.Swarm()
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if swarm.NumSeeders != 1 || swarm.Connections != 2 || swarm.CompletedPieces != 5 || len(swarm.PieceMap) != 10 {
+		t.Fatalf("unexpected swarm:%+v", swarm)
+	}
+	if len(swarm.Peers) != 2 || swarm.Peers[0].Client != "qBittorrent 4.2.5" || swarm.Peers[0].Progress != 1 ||
+		swarm.Peers[0].Address != "1.2.3.4:6881" || swarm.Peers[1].Client != "aria2 1.37.0" || swarm.Peers[1].Progress != 0.1 {
+		t.Fatalf("unexpected peers:%+v", swarm.Peers)
+	}
+	expect := []struct {
+		url    string
+		tier   int
+		status string
+	}{
+		{udpURL, 1, TrackerStatusOK},
+		{httpURL, 2, TrackerStatusOK},
+		{deadURL, 3, TrackerStatusError},
+		{"wss://tracker.webtorrent.dev", 3, TrackerStatusUnsupported},
+	}
+	if len(swarm.Trackers) != len(expect) {
+		t.Fatalf("unexpected trackers:%+v", swarm.Trackers)
+	}
+	for i, tracker := range swarm.Trackers {
+		if tracker.URL != expect[i].url || tracker.Tier != expect[i].tier || tracker.Status != expect[i].status {
+			t.Errorf("expect tracker %+v, got %+v", expect[i], tracker)
+		}
+	}
+}
@@ -1,14 +1,19 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"github.com/gorilla/websocket"
 	"github.com/hanjm/log"
+	"io"
 	"io/ioutil"
+	"mime/multipart"
 	"net/http"
 	"os"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 	//"syscall"
 	"net/url"
@@ -16,22 +21,30 @@ import (
 )
 
 type TasksManager struct {
+	mutex               *sync.RWMutex
 	tasks               []Task
 	ConnectionsManger   *ConnectionsManger
 	downloadDir         string
+	fs                  *ConfinedFS
 	limitByteSize       int64
 	limitTimeout        time.Duration
 	PushTasksUpdateChan chan struct{}
+	Retention           RetentionPolicy
+	// the running download workers
+	workers *sync.WaitGroup
 }
 
 func NewTasksManager(downloadDir string, limitByteSize int64, limitTimeout time.Duration) *TasksManager {
 	return &TasksManager{
+		mutex:               new(sync.RWMutex),
 		tasks:               make([]Task, 0, 64),
 		ConnectionsManger:   NewConnectionsManger(),
 		PushTasksUpdateChan: make(chan struct{}, 2),
 		downloadDir:         downloadDir,
+		fs:                  NewConfinedFS(downloadDir),
 		limitByteSize:       limitByteSize,
 		limitTimeout:        limitTimeout,
+		workers:             new(sync.WaitGroup),
 	}
 }
 
@@ -64,6 +77,11 @@ func (m *TasksManager) TaskHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	filename = strings.Replace(filename, "/", "", -1)
+	if filename == "." || filename == ".." || filename == trashDirName {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("param filename is invalid:" + filename))
+		return
+	}
 	switch r.Method {
 	case http.MethodGet:
 		log.Infof("[TaskHandler]download %s", filename)
@@ -73,46 +91,15 @@ func (m *TasksManager) TaskHandler(w http.ResponseWriter, r *http.Request) {
 			w.Write([]byte("param filename is empty"))
 			return
 		}
-		http.Redirect(w, r, m.downloadDir+filename, http.StatusTemporaryRedirect)
-	case http.MethodPost:
-		// 新建任务
-		sourceURL := strings.TrimSpace(r.PostFormValue("url"))
-		log.Infof("[TaskHandler]create task:%s", sourceURL)
-		if sourceURL == "" {
-			w.WriteHeader(http.StatusBadRequest)
-			w.Write([]byte("param url is empty"))
-			return
-		}
-		// check total size
-		filesSize := m.ListFiles()
-		if filesSize > m.limitByteSize {
-			w.WriteHeader(http.StatusServiceUnavailable)
-			w.Write([]byte(fmt.Sprintf("There are too many files in server, please delete some files, FilesSize:%s", getHumanSizeString(filesSize))))
-			return
-		}
-		task, err := NewDownloadTask(sourceURL)
-		if err != nil {
-			w.WriteHeader(http.StatusBadRequest)
-			w.Write([]byte(err.Error()))
+		if _, err := m.fs.Stat(filename); err != nil {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(fmt.Sprintf("file not found:%s", err)))
 			return
 		}
-		m.AddTask(task)
-		go func(m *TasksManager) {
-			defer func() {
-				if rec := recover(); rec != nil {
-					log.Errorf("download worker panic:%s", rec)
-				}
-			}()
-			err := task.Download(m.downloadDir, m.limitByteSize, m.limitTimeout)
-			if err != nil {
-				log.Errorf("task download error:%s, task name:%s", err, task.FileName())
-			}
-			m.PushTasksUpdate()
-		}(m)
-		// 添加任务后,推送文件信息
-		w.WriteHeader(http.StatusCreated)
-		w.Write([]byte("CREATE OK"))
-		m.PushTasksUpdate()
+		http.Redirect(w, r, "/download/"+url.PathEscape(filename), http.StatusTemporaryRedirect)
+	case http.MethodPost:
+		// 新建任务, url或上传的种子文件
+		m.createTasks(w, r)
 		return
 	case http.MethodDelete:
 		log.Infof("[TaskHandler]delete %s", filename)
@@ -125,14 +112,17 @@ func (m *TasksManager) TaskHandler(w http.ResponseWriter, r *http.Request) {
 			w.Write([]byte("param filename is empty"))
 			return
 		}
-		// 正在下载不能删
+		// 正在下载不能删, 除非任务可以取消
 		if task := m.GetTask(filename); task != nil && !task.IsCompleted() {
-			w.WriteHeader(http.StatusBadRequest)
-			log.Infof("[TaskHandler]delete fail,task is downloading %s", filename)
-			w.Write([]byte("task is downloading"))
-			return
+			if _, ok := task.(Canceler); !ok {
+				w.WriteHeader(http.StatusBadRequest)
+				log.Infof("[TaskHandler]delete fail,task is downloading %s", filename)
+				w.Write([]byte("task is downloading"))
+				return
+			}
 		}
-		err := m.RemoveTask(filename)
+		// 移入回收站
+		err := m.TrashTask(filename)
 		if err != nil {
 			log.Errorf("delete '%s' error:%s", filename, err)
 			w.WriteHeader(http.StatusNotFound)
@@ -143,11 +133,319 @@ func (m *TasksManager) TaskHandler(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte("DELETE OK"))
 		log.Infof("[TaskHandler]delete ok, %s", filename)
 		m.PushTasksUpdate()
+	case http.MethodPut:
+		if selectFile := r.PostFormValue("selectFile"); selectFile != "" {
+			m.selectFiles(w, filename, selectFile)
+			return
+		}
+		if seed := r.PostFormValue("seed"); seed != "" {
+			m.setSeedPolicy(w, filename, seed)
+			return
+		}
+		// 保留文件, 不被自动清理
+		pinned, err := strconv.ParseBool(r.PostFormValue("pinned"))
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("param pinned is invalid:" + r.PostFormValue("pinned")))
+			return
+		}
+		task := m.GetTask(filename)
+		if task == nil {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte("task not found"))
+			return
+		}
+		unlock := lockTaskInfo(task)
+		task.Info().Pinned = pinned
+		unlock()
+		log.Infof("[TaskHandler]pin %s:%v", filename, pinned)
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("PIN OK"))
+		m.PushTasksUpdate()
 	default:
 		w.WriteHeader(http.StatusBadRequest)
 	}
 }
 
+// createTasks creates the task of param url, or the tasks of the torrent files uploaded by multipart/form-data as param torrent
+func (m *TasksManager) createTasks(w http.ResponseWriter, r *http.Request) {
+	var uploads []*multipart.FileHeader
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		if err := r.ParseMultipartForm(torrentMaxSize); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(fmt.Sprintf("parse multipart form error:%s", err)))
+			return
+		}
+		uploads = r.MultipartForm.File["torrent"]
+	}
+	sourceURL := strings.TrimSpace(r.PostFormValue("url"))
+	log.Infof("[TaskHandler]create task:%s, uploaded torrents:%d", sourceURL, len(uploads))
+	if sourceURL == "" && len(uploads) == 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("param url is empty"))
+		return
+	}
+	// check total size, include the trash
+	m.ListFiles()
+	filesSize := m.FilesSize()
+	if filesSize > m.limitByteSize {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte(fmt.Sprintf("There are too many files in server, please delete some files, FilesSize:%s", getHumanSizeString(filesSize))))
+		return
+	}
+	// preview fetches the metadata of torrent only, the files are selected before downloading
+	preview, _ := strconv.ParseBool(r.PostFormValue("preview"))
+	// the seeding policy of the torrent, the global policy is used if it is empty
+	var seedPolicy SeedPolicy
+	if seed := r.PostFormValue("seed"); seed != "" {
+		policy, err := ParseSeedPolicy(seed)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		seedPolicy = policy
+	}
+	var trackers []string
+	if v := r.PostFormValue("trackers"); strings.TrimSpace(v) != "" {
+		var err error
+		if trackers, err = ParseTaskTrackers(v); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		if err := checkTorrentURLs(r.Context(), trackers); err != nil {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(err.Error()))
+			return
+		}
+	}
+	// the engine of http(s)/ftp url, native or aria2c, and the options of aria2c
+	engine := r.PostFormValue("engine")
+	uriOptions, err := ParseAria2cURIOptions(r.PostForm)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	if sourceURL == "" && (engine != "" || !uriOptions.empty()) {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("only the http(s)/ftp url can choose the engine and aria2c options"))
+		return
+	}
+	var tasks []Task
+	var created []string
+	if sourceURL != "" {
+		task, err := NewDownloadTaskByEngine(sourceURL, engine, uriOptions)
+		if policyErr, ok := err.(*PolicyError); ok {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusForbidden)
+			json.NewEncoder(w).Encode(policyErr)
+			return
+		}
+		if _, ok := err.(*EgressError); ok {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		tasks = append(tasks, task)
+		created = append(created, "CREATE OK")
+	}
+	// the uploaded torrents are validated by parsing, none of them is created if any is invalid
+	for _, upload := range uploads {
+		task, info, err := newUploadedTorrentTask(r.Context(), upload)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(fmt.Sprintf("%s:%s", upload.Filename, err)))
+			return
+		}
+		tasks = append(tasks, task)
+		created = append(created, fmt.Sprintf("CREATE OK %s (%s, %d files)", info.Name, getHumanSizeString(info.Length), len(info.Files)))
+	}
+	for i, task := range tasks {
+		tt, ok := task.(TorrentTask)
+		if !ok {
+			switch {
+			case preview:
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte("only the torrent can be previewed"))
+				return
+			case len(trackers) > 0:
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte("only the torrent can add trackers"))
+				return
+			case seedPolicy.Mode != "":
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte("only the torrent can be seeded"))
+				return
+			}
+			continue
+		}
+		// the same torrent is downloaded once, it is found by the info hash
+		if infoHash := tt.InfoHash(); infoHash != "" {
+			if exist := m.getTaskByInfoHash(infoHash, tasks); exist != nil && exist != task {
+				w.WriteHeader(http.StatusConflict)
+				w.Write([]byte(fmt.Sprintf("the torrent %s exists:%s", infoHash, exist.FileName())))
+				return
+			}
+		}
+		// aria2c and the native engine write the files to the name of torrent, two torrents can not share the folder
+		if nameUsed(tt.FileName(), append(m.GetTasks(), tasks[:i]...)) {
+			w.WriteHeader(http.StatusConflict)
+			w.Write([]byte(fmt.Sprintf("the name of torrent %s is used by another task", tt.FileName())))
+			return
+		}
+		info := tt.Info()
+		info.AwaitingSelection = preview
+		info.Trackers = trackers
+		if seedPolicy.Mode != "" {
+			info.SeedPolicy = seedPolicy.String()
+		}
+	}
+	for _, task := range tasks {
+		m.AddTask(task)
+		m.startDownload(task)
+	}
+	// 添加任务后,推送文件信息
+	w.WriteHeader(http.StatusCreated)
+	w.Write([]byte(strings.Join(created, "\n")))
+	m.PushTasksUpdate()
+}
+
+// startDownload starts the download worker of the task
+func (m *TasksManager) startDownload(task Task) {
+	m.workers.Add(1)
+	go m.download(task)
+}
+
+// download runs the task in the download worker
+func (m *TasksManager) download(task Task) {
+	defer m.workers.Done()
+	defer func() {
+		if rec := recover(); rec != nil {
+			log.Errorf("download worker panic:%s", rec)
+		}
+	}()
+	err := task.Download(m.downloadDir, m.limitByteSize, m.limitTimeout)
+	if err != nil {
+		log.Errorf("task download error:%s, task name:%s", err, task.FileName())
+	}
+	m.PushTasksUpdate()
+}
+
+// nameUsed reports whether the file name is used by one of the tasks
+func nameUsed(filename string, tasks []Task) bool {
+	for _, task := range tasks {
+		if task.FileName() == filename {
+			return true
+		}
+	}
+	return false
+}
+
+// getTaskByInfoHash returns the torrent task of the info hash in the tasks and the tasks being created
+func (m *TasksManager) getTaskByInfoHash(infoHash string, creating []Task) Task {
+	for _, task := range append(m.GetTasks(), creating...) {
+		if tt, ok := task.(TorrentTask); ok && strings.EqualFold(tt.InfoHash(), infoHash) {
+			return task
+		}
+	}
+	return nil
+}
+
+// newUploadedTorrentTask reads and parses the uploaded torrent file
+func newUploadedTorrentTask(ctx context.Context, upload *multipart.FileHeader) (TorrentTask, *TorrentInfo, error) {
+	fp, err := upload.Open()
+	if err != nil {
+		return nil, nil, fmt.Errorf("open uploaded torrent error:%s", err)
+	}
+	defer fp.Close()
+	data, err := ioutil.ReadAll(io.LimitReader(fp, torrentMaxSize+1))
+	if err != nil {
+		return nil, nil, fmt.Errorf("read uploaded torrent error:%s", err)
+	}
+	task, info, err := NewTorrentTask(data)
+	if err != nil {
+		return nil, nil, err
+	}
+	magnet := info.Magnet()
+	if err := checkTorrentURLs(ctx, append(magnet.Trackers, magnet.WebSeeds...)); err != nil {
+		return nil, nil, err
+	}
+	return torrentTaskOfEngine(task), info, nil
+}
+
+// selectFiles chooses the files of torrent to download, selectFile is the comma separated file indexes
+func (m *TasksManager) selectFiles(w http.ResponseWriter, filename string, selectFile string) {
+	task := m.GetTask(filename)
+	if task == nil {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("task not found"))
+		return
+	}
+	selector, ok := task.(FileSelector)
+	if !ok {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("the files of task can not be selected"))
+		return
+	}
+	var indexes []int
+	for _, v := range strings.Split(selectFile, ",") {
+		index, err := strconv.Atoi(strings.TrimSpace(v))
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("param selectFile is invalid:" + selectFile))
+			return
+		}
+		indexes = append(indexes, index)
+	}
+	if err := selector.SelectFiles(indexes); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(fmt.Sprintf("select files error:%s", err)))
+		return
+	}
+	log.Infof("[TaskHandler]select files of %s:%s", filename, selectFile)
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("SELECT OK"))
+	m.PushTasksUpdate()
+}
+
+// setSeedPolicy changes the seeding policy of torrent, seed is none, ratio:X, hours:N or forever
+func (m *TasksManager) setSeedPolicy(w http.ResponseWriter, filename string, seed string) {
+	policy, err := ParseSeedPolicy(seed)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	task := m.GetTask(filename)
+	if task == nil {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("task not found"))
+		return
+	}
+	tt, ok := task.(TorrentTask)
+	if !ok {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("only the torrent can be seeded"))
+		return
+	}
+	if err := tt.SetSeedPolicy(policy); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(fmt.Sprintf("set seed policy error:%s", err)))
+		return
+	}
+	log.Infof("[TaskHandler]seed %s:%s", filename, policy)
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("SEED OK"))
+	m.PushTasksUpdate()
+}
+
 func (m *TasksManager) PushTasksUpdate() {
 	select {
 	case m.PushTasksUpdateChan <- struct{}{}:
@@ -170,6 +468,8 @@ func (m *TasksManager) PushTasksUpdate() {
 
 // HasDownloadingTask 检查是否有正在下载的任务
 func (m *TasksManager) HasDownloadingTask() bool {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
 	for _, v := range m.tasks {
 		if !v.IsCompleted() {
 			return true
@@ -179,10 +479,16 @@ func (m *TasksManager) HasDownloadingTask() bool {
 }
 
 func (m *TasksManager) GetTasks() []Task {
-	return m.tasks
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	tasks := make([]Task, len(m.tasks))
+	copy(tasks, m.tasks)
+	return tasks
 }
 
 func (m *TasksManager) GetTask(filename string) Task {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
 	for _, v := range m.tasks {
 		if v.FileName() == filename {
 			return v
@@ -192,32 +498,72 @@ func (m *TasksManager) GetTask(filename string) Task {
 }
 
 func (m *TasksManager) AddTask(t Task) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
 	m.tasks = append(m.tasks, t)
 }
 
+// replaceTask replaces the task record with t, the files are kept
+func (m *TasksManager) replaceTask(old Task, t Task) bool {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for i, v := range m.tasks {
+		if v == old {
+			m.tasks[i] = t
+			return true
+		}
+	}
+	return false
+}
+
+// RemoveTask removes the task and deletes its file permanently
 func (m *TasksManager) RemoveTask(filename string) error {
+	m.removeTaskRecord(filename)
+	err := m.fs.RemoveAll(filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	return nil
+}
+
+// removeTaskRecord removes the task from the task list, the downloading task is canceled
+func (m *TasksManager) removeTaskRecord(filename string) {
+	m.mutex.Lock()
+	var removed []Task
 	temp := make([]Task, 0, len(m.tasks))
 	for _, v := range m.tasks {
 		if v.FileName() != filename {
 			temp = append(temp, v)
+			continue
 		}
+		removed = append(removed, v)
 	}
 	m.tasks = temp
-	err := os.RemoveAll(m.downloadDir + "/" + filename)
-	if err != nil {
-		if os.IsNotExist(err) {
-			return nil
+	m.mutex.Unlock()
+	for _, v := range removed {
+		if c, ok := v.(Canceler); ok {
+			c.Cancel()
 		}
-		return err
 	}
-	return nil
 }
 
 // backup and restore
 const backupFilename = "tasks.json"
 
 func (m *TasksManager) BackupToJSON() error {
-	data, err := json.Marshal(m.tasks)
+	tasks := m.GetTasks()
+	records := make([]json.RawMessage, 0, len(tasks))
+	for _, task := range tasks {
+		record, err := marshalTaskRecord(task)
+		if err != nil {
+			return fmt.Errorf("json.Marshal task %s error:%s", task.FileName(), err)
+		}
+		records = append(records, record)
+	}
+	data, err := json.Marshal(records)
 	if err != nil {
 		return fmt.Errorf("json.Marshal error:%s", err)
 	}
@@ -243,56 +589,65 @@ func (m *TasksManager) RestoreFromJSON() error {
 		}
 		return fmt.Errorf("ReadFile error:%s", err)
 	}
-	var httpTasks []*HTTPTask
-	err = json.Unmarshal(fileData, &httpTasks)
+	var records []json.RawMessage
+	err = json.Unmarshal(fileData, &records)
 	if err != nil {
 		return fmt.Errorf("json.Unmarshal error:%s", err)
 	}
-	for _, ht := range httpTasks {
-		// 删除不存在的
-		if _, err := os.Stat(fmt.Sprintf("%s/%s", m.downloadDir, ht.TaskInfo.FileName)); err != nil && os.IsNotExist(err) {
+	for _, record := range records {
+		task, err := restoreTask(record)
+		if err != nil {
+			log.Warnf("restore task error:%s", err)
 			continue
 		}
-		switch ht.TaskType {
-		case DownloadTaskTypeHTTP:
-			m.AddTask(ht)
-		case DownloadTaskTypeMagnet:
-			mt := &MagnetTask{
-				TaskType: DownloadTaskTypeMagnet,
-				TaskInfo: ht.TaskInfo,
+		// 删除不存在的, the uncompleted task of resumable backend is kept, it continues the partial files
+		if _, err := m.fs.Stat(task.FileName()); err != nil {
+			if backend := backendOfTask(task); backend == nil || !backend.Resumable || task.IsCompleted() {
+				continue
 			}
-			m.AddTask(mt)
 		}
+		m.AddTask(task)
 	}
 	return nil
 }
 
-// 如果有未完成的, 继续下载
+// 如果有未完成的, 继续下载, 做种的任务继续做种
 func (m *TasksManager) ReDownloadUncompleted() {
-	for _, task := range m.tasks {
+	for _, task := range m.GetTasks() {
+		if tt, ok := task.(TorrentTask); ok && task.IsCompleted() && task.Info().Seeding {
+			log.Infof("ResumeSeeding task:%s", task.FileName())
+			go tt.ResumeSeeding(m.downloadDir)
+			continue
+		}
 		if !task.IsCompleted() {
 			log.Infof("ReDownloadUncompleted task:%s", task.FileName())
-			go func(m *TasksManager) {
+			m.workers.Add(1)
+			go func(m *TasksManager, task Task) {
+				defer m.workers.Done()
 				defer func() {
 					if rec := recover(); rec != nil {
 						log.Errorf("download worker panic:%s", rec)
 					}
 				}()
-				os.Remove(m.downloadDir + "/" + task.FileName())
+				// the task of resumable backend keeps its partial files
+				if backend := backendOfTask(task); backend == nil || !backend.Resumable {
+					m.fs.Remove(task.FileName())
+				}
 				err := task.Download(m.downloadDir, m.limitByteSize, m.limitTimeout)
 				if err != nil {
 					log.Errorf("task download error:%s, task name:%s", err, task.FileName())
 				}
 				m.PushTasksUpdate()
-			}(m)
+			}(m, task)
 		}
 	}
 }
 func (m *TasksManager) ListFiles() (fileTotalSize int64) {
-	files, _ := ioutil.ReadDir(m.downloadDir)
+	files, _ := m.fs.ReadDir(".")
 	for _, file := range files {
 		filename := file.Name()
-		if strings.HasSuffix(filename, ".torrent") ||
+		if filename == trashDirName ||
+			strings.HasSuffix(filename, ".torrent") ||
 			strings.HasSuffix(filename, ".aria2") {
 			continue
 		}
@@ -0,0 +1,564 @@
+package main
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/hanjm/log"
+)
+
+// the torrent files larger than it are rejected
+const torrentMaxSize = 10 * 1024 * 1024
+
+// TorrentInfo is the metainfo of torrent file
+type TorrentInfo struct {
+	Name        string
+	Length      int64
+	Files       []TorrentFile
+	PieceLength int64
+	// 十六进制的v1 info hash(sha1), v2 only的种子没有
+	InfoHash string
+	// 十六进制的v2 info hash(sha256), v1 only的种子没有
+	InfoHashV2 string
+	// the tiers of announce-list, announce is the only tier if announce-list is absent
+	Trackers [][]string
+	WebSeeds []string
+	// the peers of private torrent are only got from its trackers, BEP 27
+	Private bool
+	// the raw bencoded info dict
+	info []byte
+	// the concatenated sha1 of v1 pieces
+	pieces string
+}
+
+// TorrentFile is the file in torrent, its path is relative to the download dir, it starts with the name for multi-file torrent
+type TorrentFile struct {
+	Path   string
+	Length int64
+}
+
+// ParseTorrent parses the bencoded torrent file, both v1, v2 and hybrid torrents are supported
+func ParseTorrent(data []byte) (*TorrentInfo, error) {
+	if len(data) > torrentMaxSize {
+		return nil, fmt.Errorf("torrent is larger than %s", getHumanSizeString(torrentMaxSize))
+	}
+	v, err := BencodeDecode(data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid torrent:%s", err)
+	}
+	meta, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("invalid torrent:metainfo is not dict")
+	}
+	info, ok := meta["info"].(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("invalid torrent:info is not dict")
+	}
+	name, ok := info["name"].(string)
+	if !ok || !isSafeTorrentPath(name) {
+		return nil, fmt.Errorf("invalid torrent:name is invalid")
+	}
+	pieceLength, ok := info["piece length"].(int64)
+	if !ok || pieceLength <= 0 {
+		return nil, fmt.Errorf("invalid torrent:piece length is invalid")
+	}
+	t := &TorrentInfo{Name: name, PieceLength: pieceLength, Private: info["private"] == int64(1)}
+	t.info, _ = BencodeRawValue(data, "info")
+	_, isV1 := info["pieces"]
+	isV2 := info["meta version"] == int64(2)
+	switch {
+	case isV1:
+		pieces, ok := info["pieces"].(string)
+		if !ok || len(pieces)%sha1.Size != 0 {
+			return nil, fmt.Errorf("invalid torrent:pieces is invalid")
+		}
+		t.pieces = pieces
+		if err := t.parseV1Files(info); err != nil {
+			return nil, err
+		}
+		sum := sha1.Sum(t.info)
+		t.InfoHash = hex.EncodeToString(sum[:])
+	case isV2:
+		if err := t.parseV2Files(info); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("invalid torrent:neither pieces nor meta version 2")
+	}
+	if isV2 {
+		sum := sha256.Sum256(t.info)
+		t.InfoHashV2 = hex.EncodeToString(sum[:])
+	}
+	t.Trackers = parseTorrentTrackers(meta)
+	switch webSeeds := meta["url-list"].(type) {
+	case string:
+		t.WebSeeds = []string{webSeeds}
+	case []interface{}:
+		for _, webSeed := range webSeeds {
+			if s, ok := webSeed.(string); ok && s != "" {
+				t.WebSeeds = append(t.WebSeeds, s)
+			}
+		}
+	}
+	return t, nil
+}
+
+// parseV1Files parses the length of single file or the files of multi-file torrent
+func (t *TorrentInfo) parseV1Files(info map[string]interface{}) error {
+	if length, ok := info["length"].(int64); ok {
+		// single file
+		if length < 0 {
+			return fmt.Errorf("invalid torrent:length is negative")
+		}
+		t.Length = length
+		t.Files = []TorrentFile{{Path: t.Name, Length: length}}
+		return nil
+	}
+	files, ok := info["files"].([]interface{})
+	if !ok || len(files) == 0 {
+		return fmt.Errorf("invalid torrent:neither length nor files")
+	}
+	for i, f := range files {
+		file, ok := f.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("invalid torrent:file %d is not dict", i)
+		}
+		length, ok := file["length"].(int64)
+		if !ok || length < 0 {
+			return fmt.Errorf("invalid torrent:length of file %d is invalid", i)
+		}
+		elements, ok := file["path"].([]interface{})
+		if !ok || len(elements) == 0 {
+			return fmt.Errorf("invalid torrent:path of file %d is empty", i)
+		}
+		parts := []string{t.Name}
+		for _, element := range elements {
+			part, ok := element.(string)
+			if !ok || !isSafeTorrentPath(part) {
+				return fmt.Errorf("invalid torrent:path of file %d is invalid", i)
+			}
+			parts = append(parts, part)
+		}
+		t.Files = append(t.Files, TorrentFile{Path: path.Join(parts...), Length: length})
+		t.Length += length
+	}
+	return nil
+}
+
+// parseV2Files parses the file tree of v2 torrent, the file is the dict whose key is empty string
+func (t *TorrentInfo) parseV2Files(info map[string]interface{}) error {
+	tree, ok := info["file tree"].(map[string]interface{})
+	if !ok || len(tree) == 0 {
+		return fmt.Errorf("invalid torrent:file tree is invalid")
+	}
+	var walk func(dir []string, node map[string]interface{}, depth int) error
+	walk = func(dir []string, node map[string]interface{}, depth int) error {
+		if depth > bencodeMaxDepth {
+			return fmt.Errorf("invalid torrent:file tree is too deep")
+		}
+		names := make([]string, 0, len(node))
+		for name := range node {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			child, ok := node[name].(map[string]interface{})
+			if !ok || !isSafeTorrentPath(name) {
+				return fmt.Errorf("invalid torrent:file tree is invalid")
+			}
+			parts := append(append([]string(nil), dir...), name)
+			if file, ok := child[""].(map[string]interface{}); ok {
+				length, ok := file["length"].(int64)
+				if !ok || length < 0 {
+					return fmt.Errorf("invalid torrent:length of %s is invalid", path.Join(parts...))
+				}
+				t.Files = append(t.Files, TorrentFile{Path: path.Join(parts...), Length: length})
+				t.Length += length
+				continue
+			}
+			if err := walk(parts, child, depth+1); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := walk([]string{t.Name}, tree, 0); err != nil {
+		return err
+	}
+	if len(t.Files) == 0 {
+		return fmt.Errorf("invalid torrent:file tree has no file")
+	}
+	// the single file is named by the name like v1
+	if len(t.Files) == 1 && len(tree) == 1 && strings.Count(t.Files[0].Path, "/") == 1 {
+		t.Files[0].Path = t.Name
+	}
+	return nil
+}
+
+// parseTorrentTrackers returns the tiers of announce-list, or announce as the only tier
+func parseTorrentTrackers(meta map[string]interface{}) [][]string {
+	var tiers [][]string
+	seen := map[string]bool{}
+	if list, ok := meta["announce-list"].([]interface{}); ok {
+		for _, t := range list {
+			tier, ok := t.([]interface{})
+			if !ok {
+				continue
+			}
+			var trackers []string
+			for _, tracker := range tier {
+				if s, ok := tracker.(string); ok && s != "" && !seen[s] {
+					seen[s] = true
+					trackers = append(trackers, s)
+				}
+			}
+			if len(trackers) > 0 {
+				tiers = append(tiers, trackers)
+			}
+		}
+	}
+	if announce, ok := meta["announce"].(string); ok && announce != "" && len(tiers) == 0 {
+		tiers = [][]string{{announce}}
+	}
+	return tiers
+}
+
+// hash returns the v1 info hash, or the v2 one for v2 only torrent, it names the torrent file like aria2c's bt-save-metadata
+func (t *TorrentInfo) hash() string {
+	if t.InfoHash != "" {
+		return t.InfoHash
+	}
+	return t.InfoHashV2
+}
+
+// Magnet returns the magnet link of torrent
+func (t *TorrentInfo) Magnet() *Magnet {
+	m := &Magnet{InfoHash: t.InfoHash, InfoHashV2: t.InfoHashV2, Name: t.Name, Length: t.Length, WebSeeds: t.WebSeeds}
+	for _, tier := range t.Trackers {
+		m.Trackers = append(m.Trackers, tier...)
+	}
+	return m
+}
+
+// isSafeTorrentPath checks the name and path elements of torrent can not escape the download dir
+func isSafeTorrentPath(s string) bool {
+	return s != "" && s != "." && s != ".." && !strings.ContainsAny(s, "/\\\x00")
+}
+
+// IsBase64Torrent reports whether str is the base64 encoded torrent file
+func IsBase64Torrent(str string) bool {
+	data, err := base64.StdEncoding.DecodeString(str)
+	if err != nil {
+		return false
+	}
+	_, err = ParseTorrent(data)
+	return err == nil
+}
+
+// NewTorrentTask creates the task of torrent file, the name and files are known before downloading
+func NewTorrentTask(data []byte) (*MagnetTask, *TorrentInfo, error) {
+	info, err := ParseTorrent(data)
+	if err != nil {
+		return nil, nil, err
+	}
+	t := NewMagnetTask(base64.StdEncoding.EncodeToString(data))
+	// aria2c writes the files to the name of torrent
+	t.TaskInfo.FileName = info.Name
+	t.TaskInfo.ContentLength = info.Length
+	t.infoHash = info.hash()
+	for i, file := range info.Files {
+		t.Files = append(t.Files, TaskFile{Index: i + 1, Path: file.Path, Length: file.Length, Selected: true})
+	}
+	return t, info, nil
+}
+
+// Magnet is the magnet link of BitTorrent
+type Magnet struct {
+	// 十六进制的v1 info hash
+	InfoHash string
+	// 十六进制的v2 info hash
+	InfoHashV2 string
+	// dn, the display name
+	Name string
+	// xl, the total length
+	Length   int64
+	Trackers []string
+	// ws, the web seeds
+	WebSeeds []string
+}
+
+// ParseMagnet parses the magnet link, the info hash in base32 is converted to hex
+func ParseMagnet(link string) (*Magnet, error) {
+	if !strings.HasPrefix(link, "magnet:?") {
+		return nil, fmt.Errorf("invalid magnet:%s", link)
+	}
+	values, err := url.ParseQuery(strings.TrimPrefix(link, "magnet:?"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid magnet:%s", err)
+	}
+	m := &Magnet{Name: values.Get("dn"), Trackers: values["tr"], WebSeeds: values["ws"]}
+	for _, xt := range values["xt"] {
+		switch {
+		case strings.HasPrefix(xt, "urn:btih:"):
+			hash := strings.TrimPrefix(xt, "urn:btih:")
+			if len(hash) == 32 {
+				// base32
+				data, err := base32.StdEncoding.DecodeString(strings.ToUpper(hash))
+				if err != nil {
+					return nil, fmt.Errorf("invalid magnet:info hash %s is invalid", hash)
+				}
+				hash = hex.EncodeToString(data)
+			}
+			if data, err := hex.DecodeString(hash); err != nil || len(data) != sha1.Size {
+				return nil, fmt.Errorf("invalid magnet:info hash %s is invalid", hash)
+			}
+			m.InfoHash = strings.ToLower(hash)
+		case strings.HasPrefix(xt, "urn:btmh:1220"):
+			// the multihash of sha256
+			hash := strings.TrimPrefix(xt, "urn:btmh:1220")
+			if data, err := hex.DecodeString(hash); err != nil || len(data) != sha256.Size {
+				return nil, fmt.Errorf("invalid magnet:info hash %s is invalid", hash)
+			}
+			m.InfoHashV2 = strings.ToLower(hash)
+		}
+	}
+	if m.InfoHash == "" && m.InfoHashV2 == "" {
+		return nil, fmt.Errorf("invalid magnet:info hash is not found")
+	}
+	if xl := values.Get("xl"); xl != "" {
+		m.Length, _ = strconv.ParseInt(xl, 10, 64)
+	}
+	return m, nil
+}
+
+// hash returns the v1 info hash, or the v2 one if the magnet has no v1
+func (m *Magnet) hash() string {
+	if m.InfoHash != "" {
+		return m.InfoHash
+	}
+	return m.InfoHashV2
+}
+
+// String returns the magnet link
+func (m *Magnet) String() string {
+	var params []string
+	if m.InfoHash != "" {
+		params = append(params, "xt=urn:btih:"+m.InfoHash)
+	}
+	if m.InfoHashV2 != "" {
+		params = append(params, "xt=urn:btmh:1220"+m.InfoHashV2)
+	}
+	if m.Name != "" {
+		params = append(params, "dn="+url.QueryEscape(m.Name))
+	}
+	if m.Length > 0 {
+		params = append(params, "xl="+strconv.FormatInt(m.Length, 10))
+	}
+	for _, tracker := range m.Trackers {
+		params = append(params, "tr="+url.QueryEscape(tracker))
+	}
+	for _, webSeed := range m.WebSeeds {
+		params = append(params, "ws="+url.QueryEscape(webSeed))
+	}
+	return "magnet:?" + strings.Join(params, "&")
+}
+
+// Torrent converts the magnet to torrent file with the info dict fetched from peers,
+// the info dict must match the info hash of magnet
+func (m *Magnet) Torrent(info []byte) ([]byte, error) {
+	if m.InfoHash != "" {
+		if sum := sha1.Sum(info); hex.EncodeToString(sum[:]) != m.InfoHash {
+			return nil, fmt.Errorf("info dict does not match info hash %s", m.InfoHash)
+		}
+	} else if sum := sha256.Sum256(info); hex.EncodeToString(sum[:]) != m.InfoHashV2 {
+		return nil, fmt.Errorf("info dict does not match info hash %s", m.InfoHashV2)
+	}
+	meta := map[string]interface{}{"info": BencodeRaw(info)}
+	if len(m.Trackers) > 0 {
+		// every tracker of magnet is a tier
+		tiers := make([]interface{}, 0, len(m.Trackers))
+		for _, tracker := range m.Trackers {
+			tiers = append(tiers, []string{tracker})
+		}
+		meta["announce"] = m.Trackers[0]
+		meta["announce-list"] = tiers
+	}
+	if len(m.WebSeeds) > 0 {
+		meta["url-list"] = m.WebSeeds
+	}
+	data, err := BencodeEncode(meta)
+	if err != nil {
+		return nil, err
+	}
+	// the info dict is validated by parsing
+	if _, err := ParseTorrent(data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// Torrent returns the torrent file of task, the magnet is converted to torrent with the metadata saved by aria2c
+func (t *MagnetTask) Torrent(downloadDir string) ([]byte, error) {
+	t.mutex.Lock()
+	sourceURL, infoHash := t.SourceURL, t.infoHash
+	t.mutex.Unlock()
+	return sourceTorrent(downloadDir, sourceURL, infoHash)
+}
+
+// Magnet returns the magnet link of task, the torrent is converted to magnet with its trackers and web seeds
+func (t *MagnetTask) Magnet(downloadDir string) (*Magnet, error) {
+	t.mutex.Lock()
+	sourceURL, infoHash, trackers := t.SourceURL, t.infoHash, t.Trackers
+	t.mutex.Unlock()
+	return sourceMagnet(downloadDir, sourceURL, infoHash, trackers)
+}
+
+// sourceTorrent returns the torrent file of the source of torrent task, the torrent is saved as <info hash>.torrent
+// in downloadDir, and the metadata of magnet is saved so too
+func sourceTorrent(downloadDir string, sourceURL string, infoHash string) ([]byte, error) {
+	if data, err := base64.StdEncoding.DecodeString(sourceURL); err == nil {
+		return data, nil
+	}
+	if infoHash == "" {
+		return nil, fmt.Errorf("the info hash is not known yet")
+	}
+	data, err := NewConfinedFS(downloadDir).ReadFile(infoHash + ".torrent")
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("the metadata is not fetched yet")
+		}
+		return nil, fmt.Errorf("read torrent file error:%s", err)
+	}
+	if !strings.HasPrefix(sourceURL, "magnet:") {
+		return data, nil
+	}
+	magnet, err := ParseMagnet(sourceURL)
+	if err != nil {
+		return nil, err
+	}
+	info, err := BencodeRawValue(data, "info")
+	if err != nil {
+		return nil, fmt.Errorf("invalid metadata:%s", err)
+	}
+	return magnet.Torrent(info)
+}
+
+// sourceMagnet returns the magnet link of the source of torrent task, the trackers added to the task are included
+func sourceMagnet(downloadDir string, sourceURL string, infoHash string, trackers []string) (*Magnet, error) {
+	var magnet *Magnet
+	if strings.HasPrefix(sourceURL, "magnet:") {
+		m, err := ParseMagnet(sourceURL)
+		if err != nil {
+			return nil, err
+		}
+		magnet = m
+	} else {
+		data, err := sourceTorrent(downloadDir, sourceURL, infoHash)
+		if err != nil {
+			return nil, err
+		}
+		info, err := ParseTorrent(data)
+		if err != nil {
+			return nil, err
+		}
+		magnet = info.Magnet()
+	}
+	magnet.Trackers = dedupeTrackers(append(magnet.Trackers, trackers...))
+	return magnet, nil
+}
+
+// TorrentHandler converts the torrent task between magnet and torrent, or creates the torrent of the completed task,
+// GET /file_download_proxy/torrent?filename= returns the torrent file, GET /file_download_proxy/magnet?filename= returns the magnet link,
+// POST /file_download_proxy/torrent?filename= creates the torrent
+func (m *TasksManager) TorrentHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	// filename有特殊字符如&时无法正常通过r.URL.Query()获取
+	filename, err := url.QueryUnescape(strings.TrimPrefix(r.URL.RawQuery, "filename="))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("param filename is invalid:" + r.URL.RawQuery))
+		return
+	}
+	task := m.GetTask(filename)
+	if task == nil {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("task not found"))
+		return
+	}
+	if r.Method == http.MethodPost {
+		m.createTorrent(w, r, task)
+		return
+	}
+	if strings.HasSuffix(r.URL.Path, "/magnet") {
+		magnet, err := m.taskMagnet(task)
+		if err != nil {
+			log.Warnf("[TorrentHandler]%s magnet error:%s", filename, err)
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Write([]byte(magnet.String()))
+		return
+	}
+	data, err := m.taskTorrent(task)
+	if err != nil {
+		log.Warnf("[TorrentHandler]%s torrent error:%s", filename, err)
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-bittorrent")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s", strconv.Quote(filename+".torrent")))
+	w.Write(data)
+}
+
+// taskTorrent returns the torrent file of the torrent task, or the torrent created from the task
+func (m *TasksManager) taskTorrent(task Task) ([]byte, error) {
+	if tt, ok := task.(TorrentTask); ok {
+		return tt.Torrent(m.downloadDir)
+	}
+	info := task.Info()
+	unlock := lockTaskInfo(task)
+	infoHash, creating, createError := info.CreatedTorrent, info.CreatingTorrent, info.CreateTorrentError
+	unlock()
+	switch {
+	case creating:
+		return nil, fmt.Errorf("the torrent is being created")
+	case infoHash != "":
+		return m.fs.ReadFile(infoHash + ".torrent")
+	case createError != "":
+		return nil, fmt.Errorf("%s", createError)
+	}
+	return nil, fmt.Errorf("the task has no torrent")
+}
+
+// taskMagnet returns the magnet link of the torrent task, or the torrent created from the task
+func (m *TasksManager) taskMagnet(task Task) (*Magnet, error) {
+	if tt, ok := task.(TorrentTask); ok {
+		return tt.Magnet(m.downloadDir)
+	}
+	data, err := m.taskTorrent(task)
+	if err != nil {
+		return nil, err
+	}
+	info, err := ParseTorrent(data)
+	if err != nil {
+		return nil, err
+	}
+	return info.Magnet(), nil
+}
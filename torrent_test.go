@@ -0,0 +1,304 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	testSingleFileTorrent = "d8:announce25:udp://8.8.8.8:80/announce4:infod6:lengthi1024e4:name9:a.iso.txt12:piece lengthi16384e6:pieces20:aaaaaaaaaaaaaaaaaaaaee"
+	testMultiFileTorrent  = "d4:infod5:filesld6:lengthi100e4:pathl3:dir5:a.txteed6:lengthi200e4:pathl5:b.txteee4:name6:ubuntu12:piece lengthi16384e6:pieces20:aaaaaaaaaaaaaaaaaaaaee"
+)
+
+func TestBencodeDecode(t *testing.T) {
+	v, err := BencodeDecode([]byte("d1:ai-3e1:bl4:spami0eee"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := map[string]interface{}{"a": int64(-3), "b": []interface{}{"spam", int64(0)}}
+	if !reflect.DeepEqual(v, expect) {
+		t.Fatalf("expect %#v, got %#v", expect, v)
+	}
+	for _, data := range []string{"", "i03e", "i-0e", "ie", "5:abc", "l", "d1:a", "di1ei2ee", "i1ei2e", "x", strings.Repeat("l", 100) + strings.Repeat("e", 100)} {
+		if _, err := BencodeDecode([]byte(data)); err == nil {
+			t.Errorf("%q expect invalid", data)
+		}
+	}
+}
+
+func TestBencodeEncode(t *testing.T) {
+	v := map[string]interface{}{"b": []interface{}{"spam", int64(-3)}, "a": 1, "c": []string{"x"}, "d": BencodeRaw("i42e")}
+	data, err := BencodeEncode(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "d1:ai1e1:bl4:spami-3ee1:cl1:xe1:di42ee" {
+		t.Fatalf("unexpected bencode:%s", data)
+	}
+	if _, err := BencodeEncode(map[string]interface{}{"a": 1.5}); err == nil {
+		t.Fatal("expect float unsupported")
+	}
+	// the raw value is kept as it is, even if its keys are not sorted
+	raw, err := BencodeRawValue([]byte("d4:infod1:bi1e1:ai2ee1:zi0ee"), "info")
+	if err != nil || string(raw) != "d1:bi1e1:ai2ee" {
+		t.Fatalf("unexpected raw value:%s %v", raw, err)
+	}
+	if _, err := BencodeRawValue([]byte("d1:ai1ee"), "info"); err == nil {
+		t.Fatal("expect the missing key error")
+	}
+}
+
+func TestParseTorrent(t *testing.T) {
+	info, err := ParseTorrent([]byte(testSingleFileTorrent))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Name != "a.iso.txt" || info.Length != 1024 || !reflect.DeepEqual(info.Files, []TorrentFile{{"a.iso.txt", 1024}}) {
+		t.Fatalf("unexpected single file torrent:%+v", info)
+	}
+	info, err = ParseTorrent([]byte(testMultiFileTorrent))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Name != "ubuntu" || info.Length != 300 || !reflect.DeepEqual(info.Files, []TorrentFile{{"ubuntu/dir/a.txt", 100}, {"ubuntu/b.txt", 200}}) {
+		t.Fatalf("unexpected multi file torrent:%+v", info)
+	}
+	sum := sha1.Sum([]byte(testMultiFileTorrent[7 : len(testMultiFileTorrent)-1]))
+	if info.InfoHash != hex.EncodeToString(sum[:]) || info.InfoHashV2 != "" || info.PieceLength != 16384 {
+		t.Fatalf("unexpected info hash:%+v", info)
+	}
+	// the announce-list replaces the announce, and the web seed of single url
+	info, err = ParseTorrent([]byte("d8:announce5:udp:a13:announce-listll5:udp:b5:udp:cel5:udp:bee4:info" + testSingleFileTorrent[strings.Index(testSingleFileTorrent, "4:info")+6:len(testSingleFileTorrent)-1] + "8:url-list12:http://a/a.xe"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(info.Trackers, [][]string{{"udp:b", "udp:c"}}) || !reflect.DeepEqual(info.WebSeeds, []string{"http://a/a.x"}) {
+		t.Fatalf("unexpected trackers and web seeds:%+v", info)
+	}
+	// v2 only
+	v2Info := "d9:file treed1:ad5:a.txtd0:d6:lengthi10e11:pieces root32:" + strings.Repeat("r", 32) + "eee1:bd0:d6:lengthi5eeee" +
+		"12:meta versioni2e4:name2:v212:piece lengthi16384ee"
+	info, err = ParseTorrent([]byte("d4:info" + v2Info + "e"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum256 := sha256.Sum256([]byte(v2Info))
+	if info.InfoHash != "" || info.InfoHashV2 != hex.EncodeToString(sum256[:]) || info.Length != 15 ||
+		!reflect.DeepEqual(info.Files, []TorrentFile{{"v2/a/a.txt", 10}, {"v2/b", 5}}) {
+		t.Fatalf("unexpected v2 torrent:%+v", info)
+	}
+	for _, data := range []string{
+		"hello",
+		"d4:infoi1ee",
+		"d4:infod6:lengthi1ee",
+		"d4:infod6:lengthi1e4:name2:..ee",
+		"d4:infod5:filesld6:lengthi1e4:pathl2:..eee4:name1:aee",
+		"d4:infod6:lengthi1e4:name1:a12:piece lengthi0e6:pieces0:ee",
+		"d4:infod6:lengthi1e4:name1:a12:piece lengthi1e6:pieces3:abcee",
+		"d4:infod6:lengthi1e4:name1:a12:piece lengthi1eee",
+	} {
+		if _, err := ParseTorrent([]byte(data)); err == nil {
+			t.Errorf("%q expect invalid torrent", data)
+		}
+	}
+	// the plain strings are valid base64, but they are not torrent
+	for _, s := range []string{"abcd", "test", "magnet", base64.StdEncoding.EncodeToString([]byte("hello"))} {
+		if IsBase64Torrent(s) {
+			t.Errorf("%s expect not torrent", s)
+		}
+	}
+	if !IsBase64Torrent(base64.StdEncoding.EncodeToString([]byte(testMultiFileTorrent))) {
+		t.Fatal("expect base64 torrent")
+	}
+}
+
+func TestParseMagnet(t *testing.T) {
+	m, err := ParseMagnet("magnet:?xt=urn:btih:BHCL5ORCB53QAUJAPUDKR63WZ5BUO5JD&dn=ubuntu&tr=udp%3A%2F%2Fa%3A80&tr=udp%3A%2F%2Fb%3A80&ws=http%3A%2F%2Fw%2F&xl=300")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := &Magnet{InfoHash: "09c4beba220f770051207d06a8fb76cf43477523", Name: "ubuntu", Length: 300,
+		Trackers: []string{"udp://a:80", "udp://b:80"}, WebSeeds: []string{"http://w/"}}
+	if !reflect.DeepEqual(m, expect) {
+		t.Fatalf("expect %+v, got %+v", expect, m)
+	}
+	if s := m.String(); s != "magnet:?xt=urn:btih:09c4beba220f770051207d06a8fb76cf43477523&dn=ubuntu&xl=300&tr=udp%3A%2F%2Fa%3A80&tr=udp%3A%2F%2Fb%3A80&ws=http%3A%2F%2Fw%2F" {
+		t.Fatalf("unexpected magnet:%s", s)
+	}
+	for _, link := range []string{"http://a", "magnet:?dn=a", "magnet:?xt=urn:btih:123", "magnet:?xt=urn:btmh:1220abcd"} {
+		if _, err := ParseMagnet(link); err == nil {
+			t.Errorf("%s expect invalid magnet", link)
+		}
+	}
+	// torrent -> magnet -> torrent
+	info, err := ParseTorrent([]byte(testSingleFileTorrent))
+	if err != nil {
+		t.Fatal(err)
+	}
+	magnet := info.Magnet()
+	if magnet.InfoHash != info.InfoHash || !reflect.DeepEqual(magnet.Trackers, []string{"udp://8.8.8.8:80/announce"}) {
+		t.Fatalf("unexpected magnet of torrent:%+v", magnet)
+	}
+	data, err := magnet.Torrent(info.info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	converted, err := ParseTorrent(data)
+	if err != nil || converted.InfoHash != info.InfoHash || !reflect.DeepEqual(converted.Trackers, info.Trackers) {
+		t.Fatalf("unexpected converted torrent:%+v %v", converted, err)
+	}
+	magnet.InfoHash = strings.Repeat("0", 40)
+	if _, err := magnet.Torrent(info.info); err == nil {
+		t.Fatal("expect the info dict of other torrent rejected")
+	}
+}
+
+func TestMagnetTask_Torrent(t *testing.T) {
+	downloadDir, err := ioutil.TempDir("", "fdp-torrent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(downloadDir)
+	info, err := ParseTorrent([]byte(testMultiFileTorrent))
+	if err != nil {
+		t.Fatal(err)
+	}
+	task, err := NewDownloadTask("magnet:?xt=urn:btih:" + info.InfoHash + "&dn=ubuntu&tr=udp%3A%2F%2F1.2.3.4%3A80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mt := task.(*MagnetTask)
+	if mt.FileName() != "ubuntu" || mt.InfoHash() != info.InfoHash {
+		t.Fatalf("expect the task named by magnet, got %s %s", mt.FileName(), mt.InfoHash())
+	}
+	if _, err := mt.Torrent(downloadDir); err == nil {
+		t.Fatal("expect error before the metadata is fetched")
+	}
+	// the metadata saved by aria2c
+	if err := ioutil.WriteFile(downloadDir+"/"+info.InfoHash+".torrent", []byte("d4:info"+string(info.info)+"e"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	data, err := mt.Torrent(downloadDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	converted, err := ParseTorrent(data)
+	if err != nil || converted.InfoHash != info.InfoHash || !reflect.DeepEqual(converted.Trackers, [][]string{{"udp://1.2.3.4:80"}}) {
+		t.Fatalf("unexpected torrent of magnet:%+v %v", converted, err)
+	}
+	torrentTask, _, err := NewTorrentTask([]byte(testMultiFileTorrent))
+	if err != nil {
+		t.Fatal(err)
+	}
+	torrentTask.Trackers = []string{"udp://b:80"}
+	magnet, err := torrentTask.Magnet(downloadDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if magnet.InfoHash != info.InfoHash || magnet.Name != "ubuntu" || !reflect.DeepEqual(magnet.Trackers, []string{"udp://b:80"}) {
+		t.Fatalf("unexpected magnet of torrent:%+v", magnet)
+	}
+}
+
+func TestNewBitTorrentTask_Policy(t *testing.T) {
+	info := "4:infod6:lengthi1024e4:name9:a.iso.txt12:piece lengthi16384e6:pieces20:aaaaaaaaaaaaaaaaaaaae"
+	torrent := func(extra string) string {
+		return base64.StdEncoding.EncodeToString([]byte("d" + extra + info + "e"))
+	}
+	if _, err := NewDownloadTask(torrent("8:announce25:udp://8.8.8.8:80/announce")); err != nil {
+		t.Fatal(err)
+	}
+	// the trackers and web seeds of torrent are checked like the ones of magnet
+	if _, err := NewDownloadTask(torrent("8:announce29:udp://127.0.0.1:6969/announce")); err == nil {
+		t.Error("expect the loopback tracker denied")
+	}
+	if _, err := NewDownloadTask(torrent("8:url-listl20:http://10.0.0.1/a.isoe")); err == nil {
+		t.Error("expect the private web seed denied")
+	}
+	oldURLPolicy := urlPolicy
+	urlPolicy = &URLPolicy{MaxRedirects: 10, DenyHosts: []string{"8.8.8.8"}}
+	defer func() {
+		urlPolicy = oldURLPolicy
+	}()
+	if _, err := NewDownloadTask(torrent("8:announce25:udp://8.8.8.8:80/announce")); err == nil {
+		t.Error("expect the tracker denied by the url policy")
+	}
+	if _, err := NewDownloadTask("magnet:?xt=urn:btih:09c4beba230a770051207d07a8fb76cf43477523&ws=http://8.8.8.8/a.iso"); err == nil {
+		t.Error("expect the web seed of magnet denied by the url policy")
+	}
+}
+
+func TestTasksManager_UploadTorrents(t *testing.T) {
+	downloadDir, err := ioutil.TempDir("", "fdp-upload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(downloadDir)
+	m := NewTasksManager(downloadDir, 1024*1024, time.Minute)
+	defer func() {
+		// the tasks are canceled so that they do not call the aria2c of the later tests
+		for _, task := range m.GetTasks() {
+			m.removeTaskRecord(task.FileName())
+		}
+		m.workers.Wait()
+	}()
+	upload := func(torrents ...string) *httptest.ResponseRecorder {
+		body := &bytes.Buffer{}
+		writer := multipart.NewWriter(body)
+		for _, torrent := range torrents {
+			part, _ := writer.CreateFormFile("torrent", "test.torrent")
+			part.Write([]byte(torrent))
+		}
+		writer.WriteField("seed", "ratio:2")
+		writer.Close()
+		req := httptest.NewRequest(http.MethodPost, "/file_download_proxy/task", body)
+		req.Header.Set("Content-Type", writer.FormDataContentType())
+		w := httptest.NewRecorder()
+		m.TaskHandler(w, req)
+		return w
+	}
+	if w := upload(testSingleFileTorrent, "not a torrent"); w.Code != http.StatusBadRequest || len(m.GetTasks()) != 0 {
+		t.Fatalf("expect the invalid torrent rejected, got %d %s", w.Code, w.Body)
+	}
+	w := upload(testSingleFileTorrent, testMultiFileTorrent)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expect created, got %d %s", w.Code, w.Body)
+	}
+	if !strings.Contains(w.Body.String(), "CREATE OK ubuntu (300.00 B, 2 files)") {
+		t.Fatalf("expect the parsed torrent in response, got %s", w.Body)
+	}
+	tasks := m.GetTasks()
+	if len(tasks) != 2 {
+		t.Fatalf("expect 2 tasks, got %d", len(tasks))
+	}
+	// the same torrent is not added twice
+	if w := upload(testMultiFileTorrent); w.Code != http.StatusConflict || len(m.GetTasks()) != 2 {
+		t.Fatalf("expect the duplicate torrent rejected, got %d %s", w.Code, w.Body)
+	}
+	// the other torrent of the same name would share the folder
+	sameName := strings.Replace(testMultiFileTorrent, "6:pieces20:aaaaaaaaaaaaaaaaaaaa", "6:pieces20:bbbbbbbbbbbbbbbbbbbb", 1)
+	if w := upload(sameName); w.Code != http.StatusConflict || !strings.Contains(w.Body.String(), "ubuntu") || len(m.GetTasks()) != 2 {
+		t.Fatalf("expect the torrent of the same name rejected, got %d %s", w.Code, w.Body)
+	}
+	// aria2c is not running, the downloads fail at once
+	m.workers.Wait()
+	for _, task := range tasks {
+		mt := task.(*MagnetTask)
+		files, seedPolicy := mt.Files, mt.SeedPolicy
+		if seedPolicy != "ratio:2" || len(files) == 0 || !files[0].Selected {
+			t.Errorf("unexpected task:%+v", mt.TaskInfo)
+		}
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"github.com/hanjm/log"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	trackerFile         = flag.String("trackerFile", "", "the file of BitTorrent trackers, one announce url per line")
+	trackerURL          = flag.String("trackerURL", "", "the url of BitTorrent trackers list, e.g. https://raw.githubusercontent.com/ngosang/trackerslist/master/trackers_best.txt, empty to disable")
+	trackerRefreshHours = flag.Int64("trackerRefreshHours", 24, "refresh the trackers from -trackerFile and -trackerURL every hours, 0 means never")
+)
+
+// defaultTrackers are used until the trackers are loaded from -trackerFile or -trackerURL
+var defaultTrackers = []string{
+	"udp://tracker.opentrackr.org:1337/announce",
+	"http://tracker.opentrackr.org:1337/announce",
+	"udp://open.stealth.si:80/announce",
+	"udp://tracker.torrent.eu.org:451/announce",
+	"udp://exodus.desync.com:6969/announce",
+	"udp://open.demonii.com:1337/announce",
+}
+
+var trackerList = NewTrackerList(defaultTrackers)
+
+// TrackerList is the trackers added to all the torrents of aria2c by the global option bt-tracker
+type TrackerList struct {
+	mutex    sync.RWMutex
+	trackers []string
+}
+
+func NewTrackerList(trackers []string) *TrackerList {
+	return &TrackerList{trackers: trackers}
+}
+
+func (l *TrackerList) Trackers() []string {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+	return append([]string(nil), l.trackers...)
+}
+
+// String returns the bt-tracker option of aria2c
+func (l *TrackerList) String() string {
+	return strings.Join(l.Trackers(), ",")
+}
+
+// Refresh loads the trackers from file and url, and applies them to the running aria2c.
+// the trackers are kept if nothing is loaded
+func (l *TrackerList) Refresh(file string, listURL string) error {
+	var trackers []string
+	var errs []string
+	if file != "" {
+		fp, err := os.Open(file)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("open tracker file error:%s", err))
+		} else {
+			trackers = append(trackers, ParseTrackers(fp)...)
+			fp.Close()
+		}
+	}
+	if listURL != "" {
+		fetched, err := fetchTrackers(listURL)
+		if err != nil {
+			errs = append(errs, err.Error())
+		}
+		trackers = append(trackers, fetched...)
+	}
+	if len(trackers) == 0 {
+		if len(errs) > 0 {
+			return fmt.Errorf("%s", strings.Join(errs, ", "))
+		}
+		return nil
+	}
+	trackers = dedupeTrackers(trackers)
+	l.mutex.Lock()
+	l.trackers = trackers
+	l.mutex.Unlock()
+	log.Infof("[TrackerList]loaded %d trackers", len(trackers))
+	if IsAria2cRunning() {
+		// the running aria2c uses the new trackers without restart
+		err := NewAria2cRPCClient().ChangeGlobalOption(&Aria2cOptions{BtTracker: strings.Join(trackers, ",")})
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("change aria2c bt-tracker error:%s", err))
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%s", strings.Join(errs, ", "))
+	}
+	return nil
+}
+
+// RefreshWorker refreshes the trackers at once and every interval
+func (l *TrackerList) RefreshWorker(file string, listURL string, interval time.Duration) {
+	if file == "" && listURL == "" {
+		// the default trackers are used
+		return
+	}
+	for {
+		if err := l.Refresh(file, listURL); err != nil {
+			log.Warnf("[TrackerList]refresh trackers error:%s", err)
+		}
+		if interval <= 0 {
+			return
+		}
+		time.Sleep(interval)
+	}
+}
+
+func fetchTrackers(listURL string) ([]string, error) {
+	client := &http.Client{
+		Timeout: 30 * time.Second,
+	}
+	resp, err := client.Get(listURL)
+	if err != nil {
+		return nil, fmt.Errorf("fetch trackers error:%s", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetch trackers error:status %s", resp.Status)
+	}
+	return ParseTrackers(io.LimitReader(resp.Body, 1<<20)), nil
+}
+
+// ParseTrackers reads the announce urls separated by lines, commas or spaces, the lines start with # are comments
+func ParseTrackers(r io.Reader) []string {
+	var trackers []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		for _, field := range splitTrackers(line) {
+			if err := checkTracker(field); err != nil {
+				log.Warnf("[TrackerList]%s", err)
+				continue
+			}
+			trackers = append(trackers, field)
+		}
+	}
+	return dedupeTrackers(trackers)
+}
+
+// ParseTaskTrackers parses the extra trackers of task, separated by lines, commas or spaces, any invalid one is an error
+func ParseTaskTrackers(s string) ([]string, error) {
+	trackers := splitTrackers(s)
+	for _, tracker := range trackers {
+		if err := checkTracker(tracker); err != nil {
+			return nil, err
+		}
+	}
+	return dedupeTrackers(trackers), nil
+}
+
+func splitTrackers(s string) []string {
+	return strings.FieldsFunc(s, func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\t' || r == '\r' || r == '\n'
+	})
+}
+
+// checkTracker checks the announce url is udp, http(s) or ws(s)
+func checkTracker(tracker string) error {
+	u, err := url.Parse(tracker)
+	if err != nil {
+		return fmt.Errorf("invalid tracker %s:%s", tracker, err)
+	}
+	switch u.Scheme {
+	case "udp", "http", "https", "ws", "wss":
+	default:
+		return fmt.Errorf("invalid tracker %s:unsupported scheme", tracker)
+	}
+	if u.Host == "" {
+		return fmt.Errorf("invalid tracker %s:empty host", tracker)
+	}
+	return nil
+}
+
+func dedupeTrackers(trackers []string) []string {
+	seen := make(map[string]bool, len(trackers))
+	result := trackers[:0:0]
+	for _, tracker := range trackers {
+		if !seen[tracker] {
+			seen[tracker] = true
+			result = append(result, tracker)
+		}
+	}
+	return result
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseTrackers(t *testing.T) {
+	trackers := ParseTrackers(strings.NewReader(`# best trackers
+udp://tracker.opentrackr.org:1337/announce
+
+http://tracker.opentrackr.org:1337/announce,udp://tracker.opentrackr.org:1337/announce
+ftp://invalid/announce udp:///announce wss://tracker.webtorrent.dev`))
+	expect := []string{"udp://tracker.opentrackr.org:1337/announce", "http://tracker.opentrackr.org:1337/announce", "wss://tracker.webtorrent.dev"}
+	if !reflect.DeepEqual(trackers, expect) {
+		t.Fatalf("expect %v, got %v", expect, trackers)
+	}
+	if _, err := ParseTaskTrackers("udp://a:1/announce, ftp://b/announce"); err == nil {
+		t.Fatal("expect the invalid tracker of task is an error")
+	}
+}
+
+func TestTrackerList_Refresh(t *testing.T) {
+	listServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "udp://b.example.com:6969/announce\n\nudp://a.example.com:1337/announce\n")
+	}))
+	defer listServer.Close()
+	fp, err := ioutil.TempFile("", "fdp-trackers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(fp.Name())
+	fp.WriteString("udp://a.example.com:1337/announce\n")
+	fp.Close()
+	requests := make(chan []interface{}, 2)
+	server := newFakeAria2cServer(t, map[string]string{
+		"aria2.getVersion":         `{"version":"1.37.0"}`,
+		"aria2.changeGlobalOption": `"OK"`,
+	}, requests)
+	defer server.Close()
+	oldRPC := *aria2cRPC
+	*aria2cRPC = server.URL
+	defer func() {
+		*aria2cRPC = oldRPC
+	}()
+	l := NewTrackerList(defaultTrackers)
+	if err := l.Refresh(fp.Name(), listServer.URL); err != nil {
+		t.Fatal(err)
+	}
+	expect := "udp://a.example.com:1337/announce,udp://b.example.com:6969/announce"
+	if l.String() != expect {
+		t.Fatalf("expect trackers %s, got %s", expect, l)
+	}
+	<-requests
+	request := <-requests
+	if request[0] != "aria2.changeGlobalOption" || !reflect.DeepEqual(request[len(request)-1], map[string]interface{}{"bt-tracker": expect}) {
+		t.Fatalf("expect bt-tracker applied to aria2c, got %v", request)
+	}
+	// the trackers are kept if nothing is loaded
+	if err := l.Refresh(fp.Name()+".missing", ""); err == nil || l.String() != expect {
+		t.Fatalf("expect error and trackers kept, got %v, %s", err, l)
+	}
+	task := NewMagnetTask("magnet:?xt=urn:btih:09c4beba230a770051207d07a8fb76cf43477523")
+	task.Trackers = []string{"udp://c.example.com:80/announce"}
+	trackerList, l = l, trackerList
+	defer func() {
+		trackerList = l
+	}()
+	if options := task.aria2cOptions("/data", true); options.BtTracker != expect+",udp://c.example.com:80/announce" {
+		t.Fatalf("expect the extra trackers of task, got %s", options.BtTracker)
+	}
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/hanjm/log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// the deleted files are moved into the trash dir of download dir, so they still count toward the quota
+const trashDirName = ".trash"
+
+// TrashItem is a deleted file and its task record, the file is saved as trash/<ID>/<FileName>, the item is saved as trash/<ID>.json
+type TrashItem struct {
+	ID          string
+	FileName    string
+	Size        int64
+	DeletedTime time.Time
+	Task        json.RawMessage `json:",omitempty"`
+}
+
+// trashItemPath returns the path of the trash item dir relative to download dir
+func trashItemPath(id string) string {
+	return trashDirName + "/" + id
+}
+
+// TrashTask moves the file and task record into the trash, the file without task is moved too.
+// the downloading or seeding task is canceled before its files are moved, the partial files removed by canceling are not kept
+func (m *TasksManager) TrashTask(filename string) error {
+	var record []byte
+	var err error
+	if task := m.GetTask(filename); task != nil {
+		if canceler, ok := task.(Canceler); ok {
+			canceler.Cancel()
+		}
+		if record, err = marshalTaskRecord(task); err != nil {
+			return fmt.Errorf("json.Marshal task error:%s", err)
+		}
+	} else if _, err = m.fs.Stat(filename); err != nil {
+		return err
+	}
+	item := TrashItem{
+		ID:          strconv.FormatInt(time.Now().UnixNano(), 10),
+		FileName:    filename,
+		DeletedTime: time.Now(),
+		Task:        record,
+	}
+	itemDir := trashItemPath(item.ID)
+	err = m.fs.MkdirAll(itemDir, 0777)
+	if err != nil {
+		return fmt.Errorf("create trash dir error:%s", err)
+	}
+	err = m.fs.Rename(filename, itemDir+"/"+filename)
+	if err != nil && !os.IsNotExist(err) {
+		m.fs.RemoveAll(itemDir)
+		return fmt.Errorf("move file to trash error:%s", err)
+	}
+	item.Size = m.fileSize(itemDir)
+	data, err := json.Marshal(item)
+	if err != nil {
+		return fmt.Errorf("json.Marshal trash item error:%s", err)
+	}
+	err = m.fs.WriteFile(itemDir+".json", data, 0644)
+	if err != nil {
+		return fmt.Errorf("write trash item error:%s", err)
+	}
+	m.removeTaskRecord(filename)
+	log.Infof("[trash]move %s to trash, id:%s", filename, item.ID)
+	return nil
+}
+
+// ListTrash returns the trash items, the latest deleted first.
+// the task of item is the one pushed to the page, the secrets in the record are kept for restoring only
+func (m *TasksManager) ListTrash() ([]TrashItem, error) {
+	files, err := m.fs.ReadDir(trashDirName)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	items := make([]TrashItem, 0, len(files))
+	for _, file := range files {
+		if !strings.HasSuffix(file.Name(), ".json") {
+			continue
+		}
+		item, err := m.getTrashItem(strings.TrimSuffix(file.Name(), ".json"))
+		if err != nil {
+			log.Warnf("[trash]%s", err)
+			continue
+		}
+		if len(item.Task) > 0 {
+			task, err := restoreTask(item.Task)
+			item.Task = nil
+			if err == nil {
+				item.Task, _ = json.Marshal(task)
+			}
+		}
+		items = append(items, item)
+	}
+	sort.Slice(items, func(i, j int) bool {
+		return items[i].DeletedTime.After(items[j].DeletedTime)
+	})
+	return items, nil
+}
+
+func (m *TasksManager) getTrashItem(id string) (item TrashItem, err error) {
+	if _, err := strconv.ParseInt(id, 10, 64); err != nil {
+		return item, fmt.Errorf("trash item id is invalid:%s", id)
+	}
+	data, err := m.fs.ReadFile(trashItemPath(id) + ".json")
+	if err != nil {
+		return item, fmt.Errorf("read trash item %s error:%s", id, err)
+	}
+	err = json.Unmarshal(data, &item)
+	if err != nil {
+		return item, fmt.Errorf("json.Unmarshal trash item %s error:%s", id, err)
+	}
+	return item, nil
+}
+
+// RestoreTrash moves the file back to download dir and restores its task
+func (m *TasksManager) RestoreTrash(id string) error {
+	item, err := m.getTrashItem(id)
+	if err != nil {
+		return err
+	}
+	// the file without task is restored without task record
+	var task Task
+	if len(item.Task) > 0 {
+		if task, err = restoreTask(item.Task); err != nil {
+			return err
+		}
+	}
+	if _, err := m.fs.Stat(item.FileName); err == nil || m.GetTask(item.FileName) != nil {
+		return fmt.Errorf("file %s already exists", item.FileName)
+	}
+	err = m.fs.Rename(trashItemPath(id)+"/"+item.FileName, item.FileName)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("move file from trash error:%s", err)
+	}
+	if task != nil {
+		m.AddTask(task)
+	}
+	log.Infof("[trash]restore %s from trash, id:%s", item.FileName, id)
+	return m.PurgeTrash(id)
+}
+
+// PurgeTrash deletes the trash item permanently
+func (m *TasksManager) PurgeTrash(id string) error {
+	if _, err := strconv.ParseInt(id, 10, 64); err != nil {
+		return fmt.Errorf("trash item id is invalid:%s", id)
+	}
+	itemDir := trashItemPath(id)
+	if err := m.fs.RemoveAll(itemDir); err != nil {
+		return err
+	}
+	if err := m.fs.Remove(itemDir + ".json"); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// PurgeExpiredTrash deletes the trash items older than maxAge
+func (m *TasksManager) PurgeExpiredTrash(maxAge time.Duration) {
+	items, err := m.ListTrash()
+	if err != nil {
+		log.Errorf("[trash]ListTrash error:%s", err)
+		return
+	}
+	for _, item := range items {
+		if time.Since(item.DeletedTime) <= maxAge {
+			continue
+		}
+		if err := m.PurgeTrash(item.ID); err != nil {
+			log.Errorf("[trash]purge %s error:%s", item.ID, err)
+			continue
+		}
+		log.Infof("[trash]purge expired %s, deleted at %s", item.FileName, item.DeletedTime.Format(time.RFC3339))
+	}
+}
+
+func (m *TasksManager) TrashHandler(w http.ResponseWriter, r *http.Request) {
+	id := r.URL.Query().Get("id")
+	switch r.Method {
+	case http.MethodGet:
+		// 回收站列表
+		items, err := m.ListTrash()
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(fmt.Sprintf("list trash error:%s", err)))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(items)
+	case http.MethodPost:
+		// 还原
+		log.Infof("[TrashHandler]restore %s", id)
+		err := m.RestoreTrash(id)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(fmt.Sprintf("restore error:%s", err)))
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("RESTORE OK"))
+		m.PushTasksUpdate()
+	case http.MethodDelete:
+		// 彻底删除, 不指定id时清空回收站
+		log.Infof("[TrashHandler]purge %s", id)
+		ids := []string{id}
+		if id == "" {
+			items, err := m.ListTrash()
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				w.Write([]byte(fmt.Sprintf("list trash error:%s", err)))
+				return
+			}
+			ids = ids[:0]
+			for _, item := range items {
+				ids = append(ids, item.ID)
+			}
+		}
+		for _, id := range ids {
+			if err := m.PurgeTrash(id); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte(fmt.Sprintf("purge error:%s", err)))
+				return
+			}
+		}
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("PURGE OK"))
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+	}
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// urlPolicy is evaluated before the task is created, and again once the response headers arrive
+var urlPolicy = &URLPolicy{MaxRedirects: 10}
+
+// URLPolicy restricts what can be downloaded, the empty allow list allows everything
+type URLPolicy struct {
+	// hostname, or domain suffix starts with "." which matches all its subdomains
+	AllowHosts []string
+	DenyHosts  []string
+	AllowURLs  []*regexp.Regexp
+	DenyURLs   []*regexp.Regexp
+	// MIME type like "application/x-msdownload", or "video/*"
+	DenyMIMETypes []string
+	// file extension like ".exe"
+	DenyExtensions []string
+	MaxRedirects   int
+}
+
+// PolicyViolation is the structured reason why the URL or response is rejected
+type PolicyViolation struct {
+	Rule   string `json:"rule"`
+	Value  string `json:"value"`
+	Reason string `json:"reason"`
+}
+
+const (
+	PolicyRuleAllowHosts     = "allowHosts"
+	PolicyRuleDenyHosts      = "denyHosts"
+	PolicyRuleAllowURLs      = "allowURLs"
+	PolicyRuleDenyURLs       = "denyURLs"
+	PolicyRuleDenyMIMETypes  = "denyMIMETypes"
+	PolicyRuleDenyExtensions = "denyExtensions"
+	PolicyRuleMaxRedirects   = "maxRedirects"
+)
+
+// PolicyError is returned when the URL or response violates the URL policy
+type PolicyError struct {
+	URL        string            `json:"url"`
+	Violations []PolicyViolation `json:"violations"`
+}
+
+func (e *PolicyError) Error() string {
+	reasons := make([]string, 0, len(e.Violations))
+	for _, v := range e.Violations {
+		reasons = append(reasons, v.Reason)
+	}
+	return fmt.Sprintf("%s is rejected by policy: %s", e.URL, strings.Join(reasons, "; "))
+}
+
+func (e *PolicyError) MarshalJSON() ([]byte, error) {
+	type policyError PolicyError
+	return json.Marshal(struct {
+		Error string `json:"error"`
+		*policyError
+	}{e.Error(), (*policyError)(e)})
+}
+
+// ParseURLPolicy parses the comma separated lists, the URL rules are regexps
+func ParseURLPolicy(allowHosts, denyHosts string, allowURLs, denyURLs []string, denyMIMETypes, denyExtensions string, maxRedirects int) (*URLPolicy, error) {
+	p := &URLPolicy{
+		AllowHosts:     splitLowerList(allowHosts),
+		DenyHosts:      splitLowerList(denyHosts),
+		DenyMIMETypes:  splitLowerList(denyMIMETypes),
+		DenyExtensions: splitLowerList(denyExtensions),
+		MaxRedirects:   maxRedirects,
+	}
+	for i, ext := range p.DenyExtensions {
+		if !strings.HasPrefix(ext, ".") {
+			p.DenyExtensions[i] = "." + ext
+		}
+	}
+	for _, rules := range []struct {
+		exprs  []string
+		target *[]*regexp.Regexp
+	}{{allowURLs, &p.AllowURLs}, {denyURLs, &p.DenyURLs}} {
+		for _, expr := range rules.exprs {
+			re, err := regexp.Compile(expr)
+			if err != nil {
+				return nil, fmt.Errorf("invalid url rule %s:%s", expr, err)
+			}
+			*rules.target = append(*rules.target, re)
+		}
+	}
+	return p, nil
+}
+
+func splitLowerList(list string) (items []string) {
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.ToLower(strings.TrimSpace(item)); item != "" {
+			items = append(items, strings.TrimPrefix(item, "*"))
+		}
+	}
+	return items
+}
+
+// CheckURL evaluates the host, URL and extension rules, the magnet link is checked by its "dn" name
+func (p *URLPolicy) CheckURL(rawURL string) error {
+	var violations []PolicyViolation
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return fmt.Errorf("invalid url %s:%s", rawURL, err)
+	}
+	if host := u.Hostname(); host != "" {
+		violations = append(violations, p.checkHost(host)...)
+	}
+	for _, re := range p.DenyURLs {
+		if re.MatchString(rawURL) {
+			violations = append(violations, PolicyViolation{PolicyRuleDenyURLs, re.String(), "url matches denied rule " + re.String()})
+		}
+	}
+	if len(p.AllowURLs) > 0 {
+		matched := false
+		for _, re := range p.AllowURLs {
+			matched = matched || re.MatchString(rawURL)
+		}
+		if !matched {
+			violations = append(violations, PolicyViolation{PolicyRuleAllowURLs, rawURL, "url matches no allowed rule"})
+		}
+	}
+	name := path.Base(u.Path)
+	if u.Scheme == "magnet" {
+		name = u.Query().Get("dn")
+	}
+	violations = append(violations, p.checkExtension(name)...)
+	if len(violations) > 0 {
+		return &PolicyError{URL: rawURL, Violations: violations}
+	}
+	return nil
+}
+
+// CheckHost evaluates the host rules only, it is used when the url is not known like the CONNECT of aria2c proxy
+func (p *URLPolicy) CheckHost(host string) error {
+	if violations := p.checkHost(host); len(violations) > 0 {
+		return &PolicyError{URL: host, Violations: violations}
+	}
+	return nil
+}
+
+func (p *URLPolicy) checkHost(host string) []PolicyViolation {
+	if matchHost(p.DenyHosts, host) {
+		return []PolicyViolation{{PolicyRuleDenyHosts, host, "host " + host + " is denied"}}
+	} else if len(p.AllowHosts) > 0 && !matchHost(p.AllowHosts, host) {
+		return []PolicyViolation{{PolicyRuleAllowHosts, host, "host " + host + " is not allowed"}}
+	}
+	return nil
+}
+
+func (p *URLPolicy) checkExtension(filename string) []PolicyViolation {
+	ext := strings.ToLower(path.Ext(filename))
+	for _, denied := range p.DenyExtensions {
+		if ext == denied {
+			return []PolicyViolation{{PolicyRuleDenyExtensions, ext, "file extension " + ext + " is denied"}}
+		}
+	}
+	return nil
+}
+
+// CheckResponse evaluates the rules again with the final URL, the Content-Type and the filename of response
+func (p *URLPolicy) CheckResponse(resp *http.Response, filename string) error {
+	finalURL := resp.Request.URL.String()
+	var violations []PolicyViolation
+	if err := p.CheckURL(finalURL); err != nil {
+		policyErr, ok := err.(*PolicyError)
+		if !ok {
+			return err
+		}
+		violations = policyErr.Violations
+	}
+	if mediaType, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type")); err == nil {
+		for _, denied := range p.DenyMIMETypes {
+			if mediaType == denied || (strings.HasSuffix(denied, "/*") && strings.HasPrefix(mediaType, strings.TrimSuffix(denied, "*"))) {
+				violations = append(violations, PolicyViolation{PolicyRuleDenyMIMETypes, mediaType, "content type " + mediaType + " is denied"})
+				break
+			}
+		}
+	}
+	if ext := strings.ToLower(path.Ext(filename)); ext != strings.ToLower(path.Ext(resp.Request.URL.Path)) {
+		violations = append(violations, p.checkExtension(filename)...)
+	}
+	if len(violations) > 0 {
+		return &PolicyError{URL: finalURL, Violations: violations}
+	}
+	return nil
+}
+
+// CheckRedirect is used as http.Client.CheckRedirect with the egress policy
+func (p *URLPolicy) CheckRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) > p.MaxRedirects {
+		return &PolicyError{URL: req.URL.String(), Violations: []PolicyViolation{{
+			PolicyRuleMaxRedirects, fmt.Sprint(len(via)), fmt.Sprintf("stopped after %d redirects", p.MaxRedirects),
+		}}}
+	}
+	return p.CheckURL(req.URL.String())
+}
+
+// checkRedirect applies both the egress policy and URL policy to the redirect
+func checkRedirect(req *http.Request, via []*http.Request) error {
+	if err := egressPolicy.CheckRedirect(req, via); err != nil {
+		return err
+	}
+	return urlPolicy.CheckRedirect(req, via)
+}
+
+// stringsFlag is the flag which can be set multiple times
+type stringsFlag []string
+
+func (f *stringsFlag) String() string {
+	return strings.Join(*f, " ")
+}
+
+func (f *stringsFlag) Set(value string) error {
+	*f = append(*f, value)
+	return nil
+}
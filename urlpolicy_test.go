@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestURLPolicy_CheckURL(t *testing.T) {
+	policy, err := ParseURLPolicy(".example.com,example.org", "bad.example.com", nil, []string{`/private/`}, "", "exe,.APK", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for rawURL, rule := range map[string]string{
+		"https://example.org/a.zip":                                                 "",
+		"https://cdn.example.com/a.zip":                                             "",
+		"https://bad.example.com/a.zip":                                             PolicyRuleDenyHosts,
+		"https://example.net/a.zip":                                                 PolicyRuleAllowHosts,
+		"https://example.org/private/a.zip":                                         PolicyRuleDenyURLs,
+		"https://example.org/setup.EXE":                                             PolicyRuleDenyExtensions,
+		"https://example.org/app.apk?from=home":                                     PolicyRuleDenyExtensions,
+		"magnet:?xt=urn:btih:09c4beba230a770051207d07a8fb76cf43477523&dn=setup.exe": PolicyRuleDenyExtensions,
+	} {
+		err := policy.CheckURL(rawURL)
+		if rule == "" {
+			if err != nil {
+				t.Errorf("%s expect allowed, error:%s", rawURL, err)
+			}
+			continue
+		}
+		policyErr, ok := err.(*PolicyError)
+		if !ok || policyErr.Violations[0].Rule != rule {
+			t.Errorf("%s expect violate %s, error:%v", rawURL, rule, err)
+		}
+	}
+	policy, err = ParseURLPolicy("", "", []string{`^https://mirror\.`}, nil, "", "", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := policy.CheckURL("https://mirror.example.com/a.zip"); err != nil {
+		t.Error(err)
+	}
+	if err := policy.CheckURL("https://example.com/a.zip"); err == nil {
+		t.Error("url matches no allowed rule expect rejected")
+	}
+}
+
+func TestHTTPTask_DownloadURLPolicy(t *testing.T) {
+	downloadDir, err := ioutil.TempDir("", "fdp-urlpolicy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(downloadDir)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/video":
+			w.Header().Set("Content-Type", "video/mp4")
+		case r.URL.Path == "/attachment":
+			w.Header().Set("Content-Disposition", "attachment; filename=setup.exe")
+		case strings.HasPrefix(r.URL.Path, "/redirect/"):
+			var n int
+			fmt.Sscanf(r.URL.Path, "/redirect/%d", &n)
+			if n > 0 {
+				http.Redirect(w, r, fmt.Sprintf("/redirect/%d", n-1), http.StatusFound)
+				return
+			}
+		}
+		w.Write([]byte("content"))
+	}))
+	defer server.Close()
+	egress, _ := ParseEgressPolicy("127.0.0.1", "")
+	policy, err := ParseURLPolicy("", "", nil, nil, "video/*", ".exe", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldPolicy := urlPolicy
+	urlPolicy = policy
+	defer func() {
+		urlPolicy = oldPolicy
+	}()
+	withEgressPolicy(egress, func() {
+		for path, rule := range map[string]string{
+			"/file":       "",
+			"/redirect/2": "",
+			"/redirect/3": PolicyRuleMaxRedirects,
+			"/video":      PolicyRuleDenyMIMETypes,
+			"/attachment": PolicyRuleDenyExtensions,
+		} {
+			task := NewHTTPTask(server.URL + path)
+			err := task.Download(downloadDir, 1024, time.Minute)
+			if rule == "" {
+				if err != nil {
+					t.Errorf("%s expect downloaded, error:%s", path, err)
+				}
+				continue
+			}
+			if err == nil || len(task.Violations) == 0 || task.Violations[0].Rule != rule {
+				t.Errorf("%s expect violate %s, error:%v, violations:%+v", path, rule, err, task.Violations)
+			}
+		}
+	})
+}
+
+func TestTasksManager_TaskHandlerPolicyRejection(t *testing.T) {
+	policy, _ := ParseURLPolicy("", "", nil, nil, "", ".exe", 10)
+	oldPolicy := urlPolicy
+	urlPolicy = policy
+	defer func() {
+		urlPolicy = oldPolicy
+	}()
+	downloadDir, err := ioutil.TempDir("", "fdp-urlpolicy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(downloadDir)
+	m := NewTasksManager(downloadDir, 1<<40, time.Minute)
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPost, "/file_download_proxy/task", strings.NewReader(url.Values{"url": {"https://example.com/setup.exe"}}.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	m.TaskHandler(w, r)
+	if w.Code != http.StatusForbidden || !strings.Contains(w.Body.String(), `"rule":"denyExtensions"`) {
+		t.Fatalf("expect structured rejection, code:%d, body:%s", w.Code, w.Body)
+	}
+}